@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"distributed_file_system/common"
+	pb "distributed_file_system/proto"
+)
+
+// cdcParams returns the content-defined chunk bounds for the chosen average
+// chunk size
+func (o storeOptions) cdcParams() common.CDCParams {
+	return common.NewCDCParams(int(o.chunkSize))
+}
+
+// placementChunkSize returns the largest chunk the file can have, which the
+// controller places chunks by
+func (o storeOptions) placementChunkSize() int64 {
+	if o.cdc {
+		return int64(o.cdcParams().MaxSize)
+	}
+	return o.chunkSize
+}
+
+// splitFile splits a file into fixed-size or content-defined chunks
+func splitFile(file *os.File, opts storeOptions) ([][]byte, error) {
+	if opts.cdc {
+		return common.SplitFileContentDefined(file, opts.cdcParams())
+	}
+	return common.SplitFile(file, opts.chunkSize)
+}
+
+// chunkOffsets returns the start of each chunk within the file
+func chunkOffsets(chunks [][]byte) []uint64 {
+	offsets := make([]uint64, len(chunks))
+	var offset uint64
+	for i, chunk := range chunks {
+		offsets[i] = offset
+		offset += uint64(len(chunk))
+	}
+	return offsets
+}
+
+// checkChunkLength checks that a chunk of a content-defined file has the
+// length its offsets give it. Fixed-size chunks are not checked.
+func checkChunkLength(layout *pb.RetrievalResponse, chunkNum int, data []byte) error {
+	offsets := layout.ChunkOffsets
+	if chunkNum >= len(offsets) {
+		return nil
+	}
+	end := layout.FileSize
+	if chunkNum+1 < len(offsets) {
+		end = offsets[chunkNum+1]
+	}
+	if want := end - offsets[chunkNum]; uint64(len(data)) != want {
+		return fmt.Errorf("chunk has %d bytes, expected %d", len(data), want)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"distributed_file_system/common"
+	pb "distributed_file_system/proto"
+)
+
+// contentHashes returns the content hash of each chunk of a deduplicated file
+func contentHashes(chunks [][]byte) []string {
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hashes[i] = common.ContentHash(chunk)
+	}
+	return hashes
+}
+
+// storeDeduplicated uploads the chunks of a deduplicated file the cluster does
+// not already hold, each under its content block name
+func (c *Client) storeDeduplicated(chunks [][]byte, opts storeOptions, placements []*pb.ChunkPlacement) error {
+	var wg sync.WaitGroup
+	errors := make(chan error, len(placements))
+
+	// A file repeating a chunk only needs to upload it once
+	uploading := make(map[string]bool)
+	skipped := 0
+	for _, placement := range placements {
+		if placement.Exists || uploading[placement.BlockName] {
+			skipped++
+			continue
+		}
+		uploading[placement.BlockName] = true
+
+		wg.Add(1)
+		go func(placement *pb.ChunkPlacement, data []byte) {
+			defer wg.Done()
+			if err := c.storeChunk(placement.BlockName, 0, data, placement.StorageNodes, opts.compression); err != nil {
+				errors <- fmt.Errorf("chunk %d: %v", placement.ChunkNumber, err)
+			}
+		}(placement, chunks[placement.ChunkNumber])
+	}
+
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		if err != nil {
+			return fmt.Errorf("failed to store file: %v", err)
+		}
+	}
+
+	if skipped > 0 {
+		log.Printf("Skipped uploading %d of %d chunks already stored", skipped, len(placements))
+	}
+	return nil
+}
+
+// contentBlocks returns the content block name of each chunk of a deduplicated
+// file, by chunk number; other files have none
+func contentBlocks(layout *pb.RetrievalResponse) map[int]string {
+	blocks := make(map[int]string)
+	for _, chunk := range layout.Chunks {
+		if chunk.BlockName != "" {
+			blocks[int(chunk.ChunkNumber)] = chunk.BlockName
+		}
+	}
+	return blocks
+}
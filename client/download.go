@@ -0,0 +1,54 @@
+package main
+
+// defaultDownloadWindow is how many chunks a download fetches ahead of the next
+// chunk to write, unless set with -download-window
+const defaultDownloadWindow = 4
+
+// chunkResult is a chunk fetched by a download, or the error fetching it
+type chunkResult struct {
+	num  int
+	data []byte
+	err  error
+}
+
+// downloadChunks fetches chunks [0, numChunks) in parallel and writes them in
+// order as soon as they are contiguous. A chunk is only fetched once it is within
+// c.downloadWindow of the next chunk to write, so at most that many chunks are
+// held in memory, however large the file.
+func (c *Client) downloadChunks(numChunks int, fetch func(num int) ([]byte, error), write func(num int, data []byte) error) error {
+	window := c.downloadWindow
+	if window <= 0 {
+		window = defaultDownloadWindow
+	}
+
+	// Room for every fetch in flight, so none blocks after an early return
+	results := make(chan chunkResult, window)
+	pending := make(map[int][]byte)
+	next, launched := 0, 0
+
+	for next < numChunks {
+		for ; launched < numChunks && launched < next+window; launched++ {
+			go func(num int) {
+				data, err := fetch(num)
+				results <- chunkResult{num: num, data: data, err: err}
+			}(launched)
+		}
+
+		result := <-results
+		if result.err != nil {
+			return result.err
+		}
+		pending[result.num] = result.data
+
+		// Write out every chunk that is now contiguous with what was written
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			delete(pending, next)
+			if err := write(next, data); err != nil {
+				return err
+			}
+			next++
+		}
+	}
+
+	return nil
+}
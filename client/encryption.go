@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"distributed_file_system/common"
+	pb "distributed_file_system/proto"
+)
+
+// encryptionAlgorithm is the cipher chunks and file keys are sealed with
+const encryptionAlgorithm = "AES-256-GCM"
+
+// minKeyFileSize is the least secret material a user key file must hold
+const minKeyFileSize = 32
+
+// loadUserKey derives the key that wraps file keys from the contents of a
+// user's key file. The key file never leaves the machine.
+func loadUserKey(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+	if len(secret) < minKeyFileSize {
+		return nil, &common.ValidationError{Field: "key_file", Message: fmt.Sprintf("must hold at least %d bytes", minKeyFileSize)}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("dfs client-side encryption"))
+	return mac.Sum(nil), nil
+}
+
+// newFileKey generates a random key for a new file and wraps it with the user's
+// key. Every stored version of a file gets its own key.
+func newFileKey(userKey []byte) ([]byte, *pb.Encryption, error) {
+	fileKey := make([]byte, 32)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate file key: %v", err)
+	}
+	wrapped, err := common.Seal(userKey, fileKey, []byte(encryptionAlgorithm))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap file key: %v", err)
+	}
+	return fileKey, &pb.Encryption{Algorithm: encryptionAlgorithm, WrappedKey: wrapped}, nil
+}
+
+// fileKey unwraps the key of a file encrypted by a client, or returns nil if
+// the file is stored in plaintext
+func (c *Client) fileKey(layout *pb.RetrievalResponse) ([]byte, error) {
+	if layout.Encryption == nil {
+		return nil, nil
+	}
+	if layout.Encryption.Algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption algorithm %q", layout.Encryption.Algorithm)
+	}
+	if c.userKey == nil {
+		return nil, fmt.Errorf("file is encrypted, a key file is required")
+	}
+	fileKey, err := common.Open(c.userKey, layout.Encryption.WrappedKey, []byte(encryptionAlgorithm))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap file key, wrong key file? %v", err)
+	}
+	return fileKey, nil
+}
+
+// chunkAAD binds a sealed chunk to its position in the file so chunks cannot be
+// swapped or reordered without detection
+func chunkAAD(chunkNum int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(chunkNum))
+}
+
+// sealChunk encrypts a chunk with the file key. Each chunk is sealed on its own
+// so any chunk can be read without the rest of the file.
+func sealChunk(fileKey []byte, chunkNum int, data []byte) ([]byte, error) {
+	if fileKey == nil {
+		return data, nil
+	}
+	return common.Seal(fileKey, data, chunkAAD(chunkNum))
+}
+
+// openChunk decrypts a chunk sealed by sealChunk, passing plaintext through if
+// the file is not encrypted
+func openChunk(fileKey []byte, chunkNum int, data []byte) ([]byte, error) {
+	if fileKey == nil {
+		return data, nil
+	}
+	plaintext, err := common.Open(fileKey, data, chunkAAD(chunkNum))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d failed to decrypt: %v", chunkNum, err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+)
+
+// storeErasureCoded encodes the file one stripe at a time and stores every
+// fragment on the node chosen by the controller
+func (c *Client) storeErasureCoded(file *os.File, filename string, fileSize int64, opts storeOptions, locations map[int][]string) error {
+	rs, err := common.NewReedSolomon(opts.dataShards, opts.parityShards)
+	if err != nil {
+		return err
+	}
+	width := opts.dataShards + opts.parityShards
+	stripeSize := opts.chunkSize * int64(opts.dataShards)
+
+	buffer := make([]byte, stripeSize)
+	for stripe := 0; int64(stripe)*stripeSize < fileSize; stripe++ {
+		n, err := file.ReadAt(buffer, int64(stripe)*stripeSize)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read stripe %d: %v", stripe, err)
+		}
+
+		shards := append(common.SplitStripe(buffer[:n], opts.dataShards), make([][]byte, opts.parityShards)...)
+		if err := rs.Encode(shards); err != nil {
+			return fmt.Errorf("failed to encode stripe %d: %v", stripe, err)
+		}
+
+		// Store the fragments of the stripe in parallel
+		var wg sync.WaitGroup
+		errors := make(chan error, width)
+
+		for shard, data := range shards {
+			chunkNum := stripe*width + shard
+			nodes := locations[chunkNum]
+			if len(nodes) == 0 {
+				return fmt.Errorf("no storage node assigned to fragment %d", chunkNum)
+			}
+			wg.Add(1)
+			go func(num int, data []byte, storageNodes []string) {
+				defer wg.Done()
+				if err := c.storeChunk(filename, num, data, storageNodes, opts.compression); err != nil {
+					errors <- fmt.Errorf("fragment %d: %v", num, err)
+				}
+			}(chunkNum, data, nodes)
+		}
+
+		wg.Wait()
+		close(errors)
+
+		if err := <-errors; err != nil {
+			return fmt.Errorf("failed to store file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// retrieveErasureCoded reads an erasure-coded file one stripe at a time, decoding
+// from parity fragments when data fragments are missing or corrupt
+func (c *Client) retrieveErasureCoded(reads *readSession, filename string, layout *dfs.RetrievalResponse, outFile *os.File) error {
+	dataShards := int(layout.ErasureCoding.DataShards)
+	parityShards := int(layout.ErasureCoding.ParityShards)
+	rs, err := common.NewReedSolomon(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	width := dataShards + parityShards
+	locations := chunkLocations(layout)
+	stripeSize := int64(layout.ChunkSize) * int64(dataShards)
+	fileSize := int64(layout.FileSize)
+
+	for stripe := 0; int64(stripe)*stripeSize < fileSize; stripe++ {
+		first := stripe * width
+		shards := make([][]byte, width)
+
+		// Parity fragments are only read when data fragments are unavailable
+		if missing := c.fetchFragments(reads, filename, locations, shards, first, 0, dataShards); missing > 0 {
+			c.fetchFragments(reads, filename, locations, shards, first, dataShards, width)
+			if err := rs.Reconstruct(shards); err != nil {
+				return fmt.Errorf("failed to decode stripe %d: %v", stripe, err)
+			}
+		}
+
+		size := stripeSize
+		if remaining := fileSize - int64(stripe)*stripeSize; remaining < size {
+			size = remaining
+		}
+		if _, err := outFile.Write(common.JoinStripe(shards, dataShards, int(size))); err != nil {
+			return fmt.Errorf("failed to write stripe %d: %v", stripe, err)
+		}
+	}
+
+	return nil
+}
+
+// fetchFragments retrieves fragments [from, to) of the stripe starting at chunk
+// number first into shards, and returns how many could not be read
+func (c *Client) fetchFragments(reads *readSession, filename string, locations map[int][]string, shards [][]byte, first, from, to int) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	missing := 0
+
+	for shard := from; shard < to; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			data, err := reads.retrieveChunk(filename, first+shard, locations[first+shard])
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				missing++
+				return
+			}
+			shards[shard] = data
+		}(shard)
+	}
+
+	wg.Wait()
+	return missing
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	pb "distributed_file_system/proto"
+)
+
+const (
+	// latencySamples is how many recent read latencies are kept per node
+	latencySamples = 32
+	// hedgePercentile of recent read latencies a read may take before it is
+	// raced against another replica
+	hedgePercentile = 0.95
+	// hedgeMinSamples is how many latencies must be known before the
+	// percentile is trusted over defaultHedgeDelay
+	hedgeMinSamples = 8
+	// defaultHedgeDelay and minHedgeDelay bound the delay before hedging
+	defaultHedgeDelay = 500 * time.Millisecond
+	minHedgeDelay     = 10 * time.Millisecond
+	// blacklistFailures is how many failed reads take a node out of rotation
+	// for the rest of an operation
+	blacklistFailures = 2
+)
+
+// latencyTracker keeps the latencies of recent chunk reads from each node
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{samples: make(map[string][]time.Duration)}
+}
+
+// observe records how long a successful read from a node took
+func (t *latencyTracker) observe(node string, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := append(t.samples[node], latency)
+	if len(samples) > latencySamples {
+		samples = samples[len(samples)-latencySamples:]
+	}
+	t.samples[node] = samples
+}
+
+// mean returns the mean recent read latency of a node, if any read completed
+func (t *latencyTracker) mean(node string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := t.samples[node]
+	if len(samples) == 0 {
+		return 0, false
+	}
+	var total time.Duration
+	for _, latency := range samples {
+		total += latency
+	}
+	return total / time.Duration(len(samples)), true
+}
+
+// hedgeDelay returns how long to wait for a read before racing another replica:
+// the hedgePercentile of recent latencies across all nodes
+func (t *latencyTracker) hedgeDelay() time.Duration {
+	t.mu.Lock()
+	var all []time.Duration
+	for _, samples := range t.samples {
+		all = append(all, samples...)
+	}
+	t.mu.Unlock()
+
+	if len(all) < hedgeMinSamples {
+		return defaultHedgeDelay
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	delay := all[int(float64(len(all)-1)*hedgePercentile)]
+	if delay < minHedgeDelay {
+		delay = minHedgeDelay
+	}
+	return delay
+}
+
+// readSession picks replicas for the chunk reads of one operation. It ranks
+// replicas by observed latency and the load the controller reported, and stops
+// using nodes that keep failing.
+type readSession struct {
+	c    *Client
+	load map[string]float64 // Requests per second per node, as reported by the controller
+
+	mu       sync.Mutex
+	failures map[string]int // Failed reads per node during this operation
+}
+
+// newReadSession starts a read operation on a file with the given layout, which
+// may be nil
+func (c *Client) newReadSession(layout *pb.RetrievalResponse) *readSession {
+	s := &readSession{c: c, failures: make(map[string]int)}
+	if layout != nil {
+		s.load = layout.NodeLoad
+	}
+	return s
+}
+
+// fail records a failed read from a node
+func (s *readSession) fail(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[node]++
+}
+
+// blacklisted reports whether a node failed too often to be tried again
+func (s *readSession) blacklisted(node string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures[node] >= blacklistFailures
+}
+
+// rank orders replicas by expected latency, scaled up for nodes busier than the
+// others. Nodes without samples are expected to take the mean latency, so they
+// are neither favored nor avoided. Blacklisted nodes are dropped unless no other
+// replica is left.
+func (s *readSession) rank(nodes []string) []string {
+	var ranked, blacklisted []string
+	for _, node := range nodes {
+		if s.blacklisted(node) {
+			blacklisted = append(blacklisted, node)
+		} else {
+			ranked = append(ranked, node)
+		}
+	}
+	if len(ranked) == 0 {
+		ranked = blacklisted
+	}
+
+	latency := make(map[string]float64, len(ranked))
+	var sampled, totalLatency, totalLoad float64
+	for _, node := range ranked {
+		if mean, ok := s.c.latencies.mean(node); ok {
+			latency[node] = float64(mean)
+			totalLatency += float64(mean)
+			sampled++
+		}
+		totalLoad += s.load[node]
+	}
+	expected := func(node string) float64 {
+		score, ok := latency[node]
+		if !ok {
+			score = 1
+			if sampled > 0 {
+				score = totalLatency / sampled
+			}
+		}
+		if totalLoad > 0 {
+			score *= 1 + s.load[node]/(totalLoad/float64(len(ranked)))
+		}
+		return score
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool { return expected(ranked[i]) < expected(ranked[j]) })
+	return ranked
+}
+
+// retrieveChunk retrieves a whole chunk from the best of its replicas
+func (s *readSession) retrieveChunk(filename string, chunkNum int, nodes []string) ([]byte, error) {
+	return s.retrieveRange(filename, chunkNum, 0, 0, nodes)
+}
+
+// retrieveRange retrieves length bytes of a chunk starting at offset, or the
+// whole chunk if length is 0. The best replica is read first; if it has not
+// answered within the hedge delay, the next one is raced against it and the
+// slower read is cancelled. A failed read moves on to the next replica, and the
+// replicas that failed are repaired once one succeeds.
+func (s *readSession) retrieveRange(filename string, chunkNum int, offset, length uint64, nodes []string) ([]byte, error) {
+	candidates := s.rank(nodes)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("failed to retrieve chunk from all nodes: no replicas")
+	}
+
+	// Returning cancels whichever reads are still running
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type attempt struct {
+		node    string
+		data    []byte
+		err     error
+		latency time.Duration
+	}
+	results := make(chan attempt, len(candidates))
+	next, running := 0, 0
+	launch := func() {
+		node := candidates[next]
+		next++
+		running++
+		go func() {
+			start := time.Now()
+			data, err := s.c.retrieveRangeFromNode(ctx, filename, chunkNum, offset, length, node)
+			results <- attempt{node: node, data: data, err: err, latency: time.Since(start)}
+		}()
+	}
+
+	launch()
+	hedge := time.NewTimer(s.c.latencies.hedgeDelay())
+	defer hedge.Stop()
+
+	var lastErr error
+	var bad []string
+	for running > 0 {
+		select {
+		case <-hedge.C:
+			// The replica is slow; race the next one against it
+			if next < len(candidates) {
+				launch()
+			}
+		case result := <-results:
+			running--
+			if result.err == nil {
+				s.c.latencies.observe(result.node, result.latency)
+				cancel()
+				s.repair(filename, chunkNum, bad, result.node)
+				return result.data, nil
+			}
+			s.fail(result.node)
+			lastErr = result.err
+			if !unreachable(result.err) {
+				bad = append(bad, result.node)
+			}
+			if next < len(candidates) {
+				launch()
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("failed to retrieve chunk from all nodes: %v", lastErr)
+}
@@ -0,0 +1,11 @@
+package main
+
+import "distributed_file_system/common"
+
+// inlinable reports whether a file is small and plain enough for the controller
+// to store in its metadata. Whether it does depends on its inline threshold;
+// otherwise the file is stored on storage nodes as usual.
+func (o storeOptions) inlinable(size int64) bool {
+	plain := !o.encrypt && !o.dedup && !o.cdc && (o.compression == "" || o.compression == common.CodecNone)
+	return plain && o.parityShards == 0 && size > 0 && size <= common.MaxInlineSize
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"distributed_file_system/common"
 	pb "distributed_file_system/proto"
@@ -21,47 +24,203 @@ import (
 type Client struct {
 	controllerAddr  string
 	defaultChunkSize int64
+	clientID         string // Identifies this client when it holds a write lease
+	user             string   // User requests are made as, and whose trash deleted files are moved to
+	groups           []string // Groups of the user, primary group first
+	transport        *common.Transport // Mutual TLS for every connection, nil for plain TCP
+	userKey          []byte            // Wraps the keys of client-side encrypted files, nil without a key file
+	downloadWindow   int               // Chunks a download fetches ahead of the next one to write
+	latencies        *latencyTracker   // Recent read latencies of each storage node
+	readRepair       bool              // Report replicas that failed a read so the controller repairs them
+
+	tokensMu    sync.Mutex
+	blockTokens map[string]*pb.BlockToken // Latest block tokens from the controller, by operation, block name and packed extent
 }
 
 func NewClient(controllerAddr string) *Client {
+	hostname, _ := os.Hostname()
+	username := os.Getenv("USER")
+	var groups []string
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+		groups = userGroups(current)
+	}
 	return &Client{
 		controllerAddr:   controllerAddr,
 		defaultChunkSize: common.DefaultChunkSize,
+		clientID:         fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		user:             username,
+		groups:           groups,
+		downloadWindow:   defaultDownloadWindow,
+		latencies:        newLatencyTracker(),
+		readRepair:       true,
+		blockTokens:      make(map[string]*pb.BlockToken),
 	}
 }
 
-func (c *Client) storeFile(filepath string, chunkSize int64) error {
-	file, err := os.Open(filepath)
+// userGroups returns the names of a user's groups, primary group first
+func userGroups(u *user.User) []string {
+	ids, err := u.GroupIds()
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		ids = nil
+	}
+	ids = append([]string{u.Gid}, ids...)
+	seen := make(map[string]bool)
+	var groups []string
+	for _, id := range ids {
+		group, err := user.LookupGroupId(id)
+		if err != nil || seen[group.Name] {
+			continue
+		}
+		seen[group.Name] = true
+		groups = append(groups, group.Name)
+	}
+	return groups
+}
+
+// storeOptions holds the per-file settings chosen at store time
+type storeOptions struct {
+	chunkSize    int64
+	replication  int // 0 uses the controller's default
+	dataShards   int // Reed-Solomon data shards per stripe, if erasure coded
+	parityShards int // Reed-Solomon parity shards per stripe, 0 to replicate
+	overwrite    bool
+	// Only store if the file is at expectedGeneration, 0 if it must not exist
+	checkGeneration    bool
+	expectedGeneration uint64
+	encrypt            bool
+	encryption         *pb.Encryption // Wrapped file key of an encrypted file, set once generated
+	compression        string         // Codec storage nodes compress each chunk with, empty for none
+	dedup              bool
+	chunkHashes        []string // Content hash of each chunk of a deduplicated file, set once hashed
+	cdc                bool     // Cut chunks at content-defined boundaries averaging chunkSize
+	chunkOffsets       []uint64 // Start of each content-defined chunk, set once split
+	inlineData         []byte   // Contents of a tiny file, sent along in case the controller stores it inline
+	stream             bool     // Upload chunks as they are read, without knowing the size up front
+	name               string   // Name to store the file under, if not its local name
+}
+
+func (c *Client) storeFile(filepath string, chunkSize int64) error {
+	return c.storeFileWithOptions(filepath, storeOptions{chunkSize: chunkSize})
+}
+
+func (c *Client) storeFileWithOptions(filepath string, opts storeOptions) error {
+	// "-" reads the file from standard input
+	file := os.Stdin
+	if filepath != "-" {
+		var err error
+		if file, err = os.Open(filepath); err != nil {
+			return fmt.Errorf("failed to open file: %v", err)
+		}
+		defer file.Close()
 	}
-	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %v", err)
 	}
 
+	// Chunks of an encrypted file are sealed with a fresh file key before they leave the machine
+	var fileKey []byte
+	if opts.encrypt {
+		if c.userKey == nil {
+			return fmt.Errorf("encryption requires a key file")
+		}
+		if fileKey, opts.encryption, err = newFileKey(c.userKey); err != nil {
+			return err
+		}
+	}
+
+	// Pipes and files too large to hold in memory are uploaded as they are read
+	if opts.stream {
+		name := opts.name
+		if name == "" {
+			name = fileInfo.Name()
+		}
+		return c.storeStream(file, name, opts, fileKey)
+	}
+
+	// Replicated files are split up front, so content-defined boundaries and
+	// content hashes are known before asking for placements
+	var chunks [][]byte
+	if opts.parityShards == 0 {
+		if chunks, err = splitFile(file, opts); err != nil {
+			return fmt.Errorf("failed to split file: %v", err)
+		}
+		if opts.cdc {
+			opts.chunkOffsets = chunkOffsets(chunks)
+		}
+		if opts.dedup {
+			opts.chunkHashes = contentHashes(chunks)
+		}
+		if opts.inlinable(fileInfo.Size()) {
+			opts.inlineData = bytes.Join(chunks, nil)
+		}
+	}
+
 	// Get storage locations from controller
-	locations, err := c.getStorageLocations(fileInfo.Name(), fileInfo.Size(), chunkSize)
+	response, err := c.getStorageLocations(fileInfo.Name(), fileInfo.Size(), opts)
 	if err != nil {
 		return fmt.Errorf("failed to get storage locations: %v", err)
 	}
+	// A file stored inline is complete once the controller has it
+	if response.Inline {
+		return nil
+	}
 
-	// Store chunks in parallel
-	var wg sync.WaitGroup
-	errors := make(chan error, len(locations))
+	locations := placementLocations(response)
+	storedName := response.BlockName
+	if storedName == "" {
+		storedName = fileInfo.Name()
+	}
+
+	// Hold the write lease until every chunk is stored
+	stop := c.keepLeaseAlive(fileInfo.Name())
+	switch {
+	case response.Packed != nil:
+		err = c.storePacked(bytes.Join(chunks, nil), response.Packed)
+	case opts.parityShards > 0:
+		// Erasure-coded files are encoded and stored stripe by stripe
+		err = c.storeErasureCoded(file, storedName, fileInfo.Size(), opts, locations)
+	case len(opts.chunkHashes) > 0:
+		err = c.storeDeduplicated(chunks, opts, response.ChunkPlacements)
+	default:
+		err = c.storeReplicated(chunks, storedName, opts, locations, fileKey)
+	}
+	stop()
 
-	chunks, err := common.SplitFile(file, chunkSize)
+	// An incomplete file is removed rather than left behind; an overwrite in
+	// progress is only made visible once released
 	if err != nil {
-		return fmt.Errorf("failed to split file: %v", err)
+		if _, abortErr := c.leaseRequest("abort", fileInfo.Name()); abortErr != nil {
+			log.Printf("Failed to abort store: %v", abortErr)
+		}
+		return err
+	}
+
+	if _, err := c.leaseRequest("release", fileInfo.Name()); err != nil {
+		return fmt.Errorf("failed to complete file: %v", err)
 	}
 
+	return nil
+}
+
+// storeReplicated stores each chunk of a file on its replica nodes, sealing
+// each chunk first if a file key is given
+func (c *Client) storeReplicated(chunks [][]byte, filename string, opts storeOptions, locations map[int][]string, fileKey []byte) error {
+	// Store chunks in parallel
+	var wg sync.WaitGroup
+	errors := make(chan error, len(locations))
+
 	for chunkNum, nodes := range locations {
 		wg.Add(1)
 		go func(num int, data []byte, storageNodes []string) {
 			defer wg.Done()
-			if err := c.storeChunk(fileInfo.Name(), num, data, storageNodes); err != nil {
+			data, err := sealChunk(fileKey, num, data)
+			if err == nil {
+				err = c.storeChunk(filename, num, data, storageNodes, opts.compression)
+			}
+			if err != nil {
 				errors <- fmt.Errorf("chunk %d: %v", num, err)
 			}
 		}(chunkNum, chunks[chunkNum], nodes)
@@ -82,71 +241,195 @@ func (c *Client) storeFile(filepath string, chunkSize int64) error {
 }
 
 func (c *Client) retrieveFile(filename string, outputPath string) error {
+	return c.retrieve(&pb.RetrievalRequest{Filename: filename}, outputPath)
+}
+
+// retrieve retrieves the file, previous version or snapshot copy named by a
+// retrieval request
+func (c *Client) retrieve(request *pb.RetrievalRequest, outputPath string) error {
 	// Get chunk locations from controller
-	locations, err := c.getChunkLocations(filename)
+	layout, err := c.requestLayout(request)
 	if err != nil {
 		return fmt.Errorf("failed to get chunk locations: %v", err)
 	}
-
-	// Create output file
-	outFile, err := os.Create(outputPath)
+	locations := chunkLocations(layout)
+	fileKey, err := c.fileKey(layout)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+		return err
+	}
+
+	// Create output file, or write to standard output for "-"
+	outFile := os.Stdout
+	if outputPath != "-" {
+		if outFile, err = os.Create(outputPath); err != nil {
+			return fmt.Errorf("failed to create output file: %v", err)
+		}
+		defer outFile.Close()
+	}
+
+	// Chunks may be stored under a different name, e.g. after transcoding, and
+	// chunks of deduplicated files under their content hash
+	storedName := blockName(request.Filename, layout)
+	shared := contentBlocks(layout)
+	reads := c.newReadSession(layout)
+
+	// Erasure-coded files are decoded stripe by stripe
+	if layout.ErasureCoding != nil {
+		return c.retrieveErasureCoded(reads, storedName, layout, outFile)
+	}
+
+	// Inline files come with the layout
+	if layout.InlineData != nil {
+		if _, err := outFile.Write(layout.InlineData); err != nil {
+			return fmt.Errorf("failed to write file: %v", err)
+		}
+		return nil
+	}
+
+	// Packed files are read as a range of their container
+	if layout.Packed != nil {
+		return c.retrievePacked(reads, layout, outFile)
 	}
-	defer outFile.Close()
 
 	// Retrieve chunks in parallel
+	fetch := func(num int) ([]byte, error) {
+		var data []byte
+		var err error
+		if block, isShared := shared[num]; isShared {
+			data, err = reads.retrieveChunk(block, 0, locations[num])
+		} else {
+			data, err = reads.retrieveChunk(storedName, num, locations[num])
+		}
+		if err == nil {
+			// Encrypted chunks decrypt independently of each other
+			data, err = openChunk(fileKey, num, data)
+		}
+		if err == nil {
+			err = checkChunkLength(layout, num, data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve file: chunk %d: %v", num, err)
+		}
+		return data, nil
+	}
+
+	// Write chunks in order, stopping at the committed file size so data from
+	// an append in progress is never returned
+	remaining := int64(layout.FileSize)
+	write := func(num int, data []byte) error {
+		if int64(len(data)) > remaining {
+			data = data[:remaining]
+		}
+		if _, err := outFile.Write(data); err != nil {
+			return fmt.Errorf("failed to write chunk %d: %v", num, err)
+		}
+		remaining -= int64(len(data))
+		return nil
+	}
+
+	return c.downloadChunks(len(locations), fetch, write)
+}
+
+// appendFile appends the contents of a local file to a file in the DFS
+func (c *Client) appendFile(localPath string, filename string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("nothing to append")
+	}
+
+	// Get the append lease and chunk placements from controller
+	grant, err := c.requestAppend(filename, int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("failed to start append: %v", err)
+	}
+	storedName := grant.BlockName
+	if storedName == "" {
+		storedName = filename
+	}
+	stop := c.keepLeaseAlive(filename)
+
+	// Write the parts in parallel
 	var wg sync.WaitGroup
-	errors := make(chan error, len(locations))
-	chunks := make(map[int][]byte)
-	var mu sync.Mutex
+	errors := make(chan error, len(grant.Placements))
 
-	for chunkNum, nodes := range locations {
+	offset := uint64(0)
+	for _, placement := range grant.Placements {
 		wg.Add(1)
-		go func(num int, storageNodes []string) {
+		go func(placement *pb.AppendPlacement, part []byte) {
 			defer wg.Done()
-			data, err := c.retrieveChunk(filename, num, storageNodes)
-			if err != nil {
-				errors <- fmt.Errorf("chunk %d: %v", num, err)
-				return
+			if err := c.appendChunk(storedName, grant, placement, part); err != nil {
+				errors <- fmt.Errorf("chunk %d: %v", placement.ChunkNumber, err)
 			}
-			mu.Lock()
-			chunks[num] = data
-			mu.Unlock()
-		}(chunkNum, nodes)
+		}(placement, data[offset:offset+placement.Length])
+		offset += placement.Length
 	}
 
-	// Wait for all chunks to be retrieved
 	wg.Wait()
 	close(errors)
+	stop()
 
-	// Check for any errors
-	for err := range errors {
-		if err != nil {
-			return fmt.Errorf("failed to retrieve file: %v", err)
+	// Discard the append if any part failed so the lease is released
+	if err := <-errors; err != nil {
+		if _, abortErr := c.commitAppend(filename, grant.AppendId, true); abortErr != nil {
+			log.Printf("Failed to abort append: %v", abortErr)
 		}
+		return fmt.Errorf("failed to append: %v", err)
 	}
 
-	// Write chunks in order
-	for i := 0; i < len(locations); i++ {
-		if _, err := outFile.Write(chunks[i]); err != nil {
-			return fmt.Errorf("failed to write chunk %d: %v", i, err)
-		}
+	if _, err := c.commitAppend(filename, grant.AppendId, false); err != nil {
+		return fmt.Errorf("failed to commit append: %v", err)
 	}
 
 	return nil
 }
 
+// keepLeaseAlive renews the write lease on a file in the background until the
+// returned function is called
+func (c *Client) keepLeaseAlive(filename string) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(common.LeaseTimeout * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := c.leaseRequest("renew", filename); err != nil {
+					log.Printf("Failed to renew lease on %s: %v", filename, err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
 func (c *Client) runInteractive() {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("\nDFS Client Commands:\n")
-		fmt.Println("1. store <filepath> [chunk_size]")
-		fmt.Println("2. retrieve <filename> <output_path>")
+		fmt.Println("1. store [-r replication | -ec data+parity] [-overwrite] [-if-generation gen] [-encrypt] [-compress codec] [-stream] [-name name] <filepath|-> [chunk_size]")
+		fmt.Println("2. retrieve <filename> <output_path|-> [generation]")
 		fmt.Println("3. list")
-		fmt.Println("4. delete <filename>")
+		fmt.Println("4. delete [-skip-trash] <filename>")
 		fmt.Println("5. status")
-		fmt.Println("6. exit")
+		fmt.Println("6. setrep <filename> <replication>")
+		fmt.Println("7. safemode [enter|leave|get]")
+		fmt.Println("8. transcode")
+		fmt.Println("9. append <local_path> <filename>")
+		fmt.Println("10. leases")
+		fmt.Println("11. revoke <filename>")
+		fmt.Println("12. versions <filename>")
+		fmt.Println("13. revert <filename> <generation>")
+		fmt.Println("14. trash [list|restore <filename>|empty]")
+		fmt.Println("15. snapshot create <name> [path] | list [name] | get <name> <filename> <output_path> | diff <name> | delete <name>")
+		fmt.Println("16. quota set|clear|report [-dir path | -user name] [-space bytes] [-files count]")
+		fmt.Println("17. chmod <mode> <path>")
+		fmt.Println("18. chown <owner>[:group] <path>")
+		fmt.Println("19. exit")
 		fmt.Print("\nEnter command: ")
 
 		command, _ := reader.ReadString('\n')
@@ -159,31 +442,33 @@ func (c *Client) runInteractive() {
 
 		switch parts[0] {
 		case "store":
-			if len(parts) < 2 {
-				fmt.Println("Usage: store <filepath> [chunk_size]")
+			path, opts, err := c.parseStoreArgs(parts[1:])
+			if err != nil {
+				fmt.Printf("Invalid store arguments: %v\n", err)
+				fmt.Println("Usage: store [-r replication | -ec data+parity] [-overwrite] [-if-generation gen] [-encrypt] [-compress codec] [-stream] [-name name] <filepath|-> [chunk_size]")
 				continue
 			}
-			chunkSize := c.defaultChunkSize
-			if len(parts) > 2 {
-				size, err := strconv.ParseInt(parts[2], 10, 64)
-				if err != nil {
-					fmt.Printf("Invalid chunk size: %v\n", err)
-					continue
-				}
-				chunkSize = size
-			}
-			if err := c.storeFile(parts[1], chunkSize); err != nil {
+			if err := c.storeFileWithOptions(path, opts); err != nil {
 				fmt.Printf("Error storing file: %v\n", err)
 			} else {
 				fmt.Println("File stored successfully")
 			}
 
 		case "retrieve":
-			if len(parts) != 3 {
-				fmt.Println("Usage: retrieve <filename> <output_path>")
+			if len(parts) != 3 && len(parts) != 4 {
+				fmt.Println("Usage: retrieve <filename> <output_path|-> [generation]")
 				continue
 			}
-			if err := c.retrieveFile(parts[1], parts[2]); err != nil {
+			var generation uint64
+			if len(parts) == 4 {
+				gen, err := strconv.ParseUint(parts[3], 10, 64)
+				if err != nil || gen == 0 {
+					fmt.Printf("Invalid generation: %s\n", parts[3])
+					continue
+				}
+				generation = gen
+			}
+			if err := c.retrieve(&pb.RetrievalRequest{Filename: parts[1], Generation: generation}, parts[2]); err != nil {
 				fmt.Printf("Error retrieving file: %v\n", err)
 			} else {
 				fmt.Println("File retrieved successfully")
@@ -196,19 +481,43 @@ func (c *Client) runInteractive() {
 				continue
 			}
 			fmt.Println("\nFiles in DFS:")
-			fmt.Println("Name\tSize\tChunks")
-			fmt.Println("----\t----\t------")
+			fmt.Println("Name\tSize\tStored\tChunks\tLayout\tGeneration\tMode\tOwner")
+			fmt.Println("----\t----\t------\t------\t------\t----------\t----\t-----")
 			for _, file := range files {
-				fmt.Printf("%s\t%d\t%d\n", file.Filename, file.Size, file.NumChunks)
+				layout := fmt.Sprintf("%dx", file.ReplicationFactor)
+				if file.ErasureCoding != nil {
+					layout = fmt.Sprintf("RS(%d,%d)", file.ErasureCoding.DataShards, file.ErasureCoding.ParityShards)
+				}
+				if file.Encryption != "" {
+					layout += " " + file.Encryption
+				}
+				if file.ContentDefined {
+					layout += " cdc"
+				}
+				if file.Packed {
+					layout += " packed"
+				}
+				if file.Inline {
+					layout += " inline"
+				}
+				if file.Compression != "" {
+					layout += " " + file.Compression
+				}
+				fmt.Printf("%s\t%d\t%d\t%d\t%s\t%d\t%04o\t%s:%s\n", file.Filename, file.Size, file.StoredSize, file.NumChunks, layout,
+					file.Generation, file.Mode, file.Owner, file.Group)
 			}
 
 		case "delete":
-			if len(parts) != 2 {
-				fmt.Println("Usage: delete <filename>")
+			skipTrash := len(parts) == 3 && parts[1] == "-skip-trash"
+			if len(parts) != 2 && !skipTrash {
+				fmt.Println("Usage: delete [-skip-trash] <filename>")
 				continue
 			}
-			if err := c.deleteFile(parts[1]); err != nil {
+			trashPath, err := c.deleteFile(parts[len(parts)-1], skipTrash)
+			if err != nil {
 				fmt.Printf("Error deleting file: %v\n", err)
+			} else if trashPath != "" {
+				fmt.Printf("File moved to %s\n", trashPath)
 			} else {
 				fmt.Println("File deleted successfully")
 			}
@@ -220,15 +529,269 @@ func (c *Client) runInteractive() {
 				continue
 			}
 			fmt.Println("\nStorage Node Status:")
-			fmt.Println("Node ID\tFree Space\tRequests Handled")
-			fmt.Println("-------\t----------\t---------------")
+			fmt.Println("Node ID\tFree Space\tRequests Handled\tData\tOn Disk")
+			fmt.Println("-------\t----------\t---------------\t----\t-------")
 			for _, node := range status.Nodes {
-				fmt.Printf("%s\t%d GB\t%d\n", 
+				fmt.Printf("%s\t%d GB\t%d\t%d MB\t%d MB\n", 
 					node.NodeId, 
 					node.FreeSpace/(1024*1024*1024), 
-					node.RequestsProcessed)
+					node.RequestsProcessed,
+					node.LogicalBytes/(1024*1024),
+					node.StoredBytes/(1024*1024))
 			}
 			fmt.Printf("\nTotal Available Space: %d GB\n", status.TotalSpace/(1024*1024*1024))
+			if status.SafeMode {
+				fmt.Printf("Safe mode: ON (%d/%d chunks reported)\n", status.ReportedChunks, status.TotalChunks)
+			} else {
+				fmt.Println("Safe mode: OFF")
+			}
+			if status.Containers > 0 {
+				fmt.Printf("Packed files: %d KB in %d containers, %d KB deleted awaiting compaction\n",
+					status.PackedBytes/1024, status.Containers, status.GarbageBytes/1024)
+			}
+
+		case "setrep":
+			if len(parts) != 3 {
+				fmt.Println("Usage: setrep <filename> <replication>")
+				continue
+			}
+			replication, err := strconv.Atoi(parts[2])
+			if err != nil || replication < 1 {
+				fmt.Printf("Invalid replication factor: %s\n", parts[2])
+				continue
+			}
+			if err := c.setReplication(parts[1], replication); err != nil {
+				fmt.Printf("Error setting replication: %v\n", err)
+			} else {
+				fmt.Println("Replication updated; replicas are adjusted in the background")
+			}
+
+		case "safemode":
+			action := "get"
+			if len(parts) > 1 {
+				action = parts[1]
+			}
+			if len(parts) > 2 || (action != "enter" && action != "leave" && action != "get") {
+				fmt.Println("Usage: safemode [enter|leave|get]")
+				continue
+			}
+			status, err := c.setSafeMode(action)
+			if err != nil {
+				fmt.Printf("Error updating safe mode: %v\n", err)
+				continue
+			}
+			if status.SafeMode {
+				fmt.Printf("Safe mode is ON (%d/%d chunks reported)\n", status.ReportedChunks, status.TotalChunks)
+			} else {
+				fmt.Println("Safe mode is OFF")
+			}
+
+		case "transcode":
+			status, err := c.getTranscodeStatus()
+			if err != nil {
+				fmt.Printf("Error getting transcoding status: %v\n", err)
+				continue
+			}
+			fmt.Printf("\nTranscoding policy: %s\n", status.Policy)
+			if len(status.Tasks) == 0 {
+				fmt.Println("No files transcoded yet")
+				continue
+			}
+			fmt.Println("Name\tLayout\tState\tProgress")
+			fmt.Println("----\t------\t-----\t--------")
+			for _, task := range status.Tasks {
+				fmt.Printf("%s\tRS(%d,%d)\t%s\t%d/%d stripes",
+					task.Filename,
+					task.ErasureCoding.GetDataShards(),
+					task.ErasureCoding.GetParityShards(),
+					task.State,
+					task.StripesDone,
+					task.TotalStripes)
+				if task.Error != "" {
+					fmt.Printf("\t%s", task.Error)
+				}
+				fmt.Println()
+			}
+
+		case "append":
+			if len(parts) != 3 {
+				fmt.Println("Usage: append <local_path> <filename>")
+				continue
+			}
+			if err := c.appendFile(parts[1], parts[2]); err != nil {
+				fmt.Printf("Error appending to file: %v\n", err)
+			} else {
+				fmt.Println("File appended successfully")
+			}
+
+		case "leases":
+			status, err := c.leaseRequest("list", "")
+			if err != nil {
+				fmt.Printf("Error listing leases: %v\n", err)
+				continue
+			}
+			if len(status.Leases) == 0 {
+				fmt.Println("No write leases held")
+				continue
+			}
+			fmt.Println("\nWrite Leases:")
+			fmt.Println("Name\tHolder\tOperation\tExpires In")
+			fmt.Println("----\t------\t---------\t----------")
+			for _, lease := range status.Leases {
+				fmt.Printf("%s\t%s\t%s\t%ds\n", lease.Filename, lease.Holder, lease.Operation, lease.ExpiresInSeconds)
+			}
+
+		case "revoke":
+			if len(parts) != 2 {
+				fmt.Println("Usage: revoke <filename>")
+				continue
+			}
+			if _, err := c.leaseRequest("revoke", parts[1]); err != nil {
+				fmt.Printf("Error revoking lease: %v\n", err)
+			} else {
+				fmt.Println("Lease revoked; uncommitted writes were discarded")
+			}
+
+		case "versions":
+			if len(parts) != 2 {
+				fmt.Println("Usage: versions <filename>")
+				continue
+			}
+			status, err := c.versionsRequest("list", parts[1], 0)
+			if err != nil {
+				fmt.Printf("Error listing versions: %v\n", err)
+				continue
+			}
+			fmt.Printf("\nVersions of %s:\n", parts[1])
+			fmt.Println("Generation\tSize\tCreated\tReplaced")
+			fmt.Println("----------\t----\t-------\t--------")
+			for _, version := range status.Versions {
+				replaced := "current"
+				if !version.Current {
+					replaced = time.Unix(version.ArchivedAt, 0).Format(time.RFC3339)
+				}
+				fmt.Printf("%d\t%d\t%s\t%s\n", version.Generation, version.Size,
+					time.Unix(version.CreatedAt, 0).Format(time.RFC3339), replaced)
+			}
+
+		case "revert":
+			if len(parts) != 3 {
+				fmt.Println("Usage: revert <filename> <generation>")
+				continue
+			}
+			generation, err := strconv.ParseUint(parts[2], 10, 64)
+			if err != nil || generation == 0 {
+				fmt.Printf("Invalid generation: %s\n", parts[2])
+				continue
+			}
+			if _, err := c.versionsRequest("revert", parts[1], generation); err != nil {
+				fmt.Printf("Error reverting file: %v\n", err)
+			} else {
+				fmt.Println("File reverted successfully")
+			}
+
+		case "trash":
+			action := "list"
+			if len(parts) > 1 {
+				action = parts[1]
+			}
+			valid := (action == "list" || action == "empty") && len(parts) <= 2
+			if action == "restore" {
+				valid = len(parts) == 3
+			}
+			if !valid {
+				fmt.Println("Usage: trash [list|restore <filename>|empty]")
+				continue
+			}
+			filename := ""
+			if action == "restore" {
+				filename = parts[2]
+			}
+			status, err := c.trashRequest(action, filename)
+			if err != nil {
+				fmt.Printf("Error updating trash: %v\n", err)
+				continue
+			}
+			switch action {
+			case "restore":
+				fmt.Println("File restored successfully")
+			case "empty":
+				fmt.Println("Trash emptied")
+			default:
+				if len(status.Entries) == 0 {
+					fmt.Println("Trash is empty")
+					continue
+				}
+				fmt.Printf("\nTrash of %s:\n", c.user)
+				fmt.Println("Path\tOriginal Name\tSize\tExpires In")
+				fmt.Println("----\t-------------\t----\t----------")
+				for _, entry := range status.Entries {
+					fmt.Printf("%s\t%s\t%d\t%ds\n", entry.Path, entry.OriginalName, entry.Size, entry.ExpiresInSeconds)
+				}
+			}
+
+		case "snapshot":
+			c.runSnapshotCommand(parts[1:])
+
+		case "quota":
+			request, err := parseQuotaArgs(parts[1:])
+			if err != nil {
+				fmt.Printf("Invalid quota arguments: %v\n", err)
+				fmt.Println("Usage: quota set|clear|report [-dir path | -user name] [-space bytes] [-files count]")
+				continue
+			}
+			status, err := c.quotaRequest(request)
+			if err != nil {
+				fmt.Printf("Error updating quota: %v\n", err)
+				continue
+			}
+			if request.Action != "report" {
+				fmt.Println("Quota updated")
+				continue
+			}
+			fmt.Println("\nQuotas:")
+			fmt.Println("Target\tSpace Used\tSpace Limit\tFiles\tFile Limit")
+			fmt.Println("------\t----------\t-----------\t-----\t----------")
+			for _, quota := range status.Quotas {
+				target := "dir " + quota.Directory
+				if quota.User != "" {
+					target = "user " + quota.User
+				}
+				fmt.Printf("%s\t%d\t%s\t%d\t%s\n", target, quota.SpaceUsed, formatLimit(quota.SpaceLimit),
+					quota.FilesUsed, formatLimit(quota.FileLimit))
+			}
+
+		case "chmod":
+			if len(parts) != 3 {
+				fmt.Println("Usage: chmod <mode> <path>")
+				continue
+			}
+			mode, err := strconv.ParseUint(parts[1], 8, 32)
+			if err != nil || mode > 07777 {
+				fmt.Printf("Invalid mode %q, expected octal such as 640\n", parts[1])
+				continue
+			}
+			if err := c.changePermissions(&pb.PermissionRequest{Action: "chmod", Path: parts[2], Mode: uint32(mode)}); err != nil {
+				fmt.Printf("Error changing mode: %v\n", err)
+			} else {
+				fmt.Println("Mode changed")
+			}
+
+		case "chown":
+			if len(parts) != 3 {
+				fmt.Println("Usage: chown <owner>[:group] <path>")
+				continue
+			}
+			owner, group, _ := strings.Cut(parts[1], ":")
+			if owner == "" && group == "" {
+				fmt.Println("chown needs an owner, a group or both")
+				continue
+			}
+			if err := c.changePermissions(&pb.PermissionRequest{Action: "chown", Path: parts[2], Owner: owner, Group: group}); err != nil {
+				fmt.Printf("Error changing owner: %v\n", err)
+			} else {
+				fmt.Println("Owner changed")
+			}
 
 		case "exit":
 			fmt.Println("Goodbye!")
@@ -240,10 +803,290 @@ func (c *Client) runInteractive() {
 	}
 }
 
+// runSnapshotCommand handles the snapshot subcommands of the interactive client
+func (c *Client) runSnapshotCommand(args []string) {
+	usage := "Usage: snapshot create <name> [path] | list [name] | get <name> <filename> <output_path> | diff <name> | delete <name>"
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return
+	}
+
+	switch {
+	case args[0] == "create" && (len(args) == 2 || len(args) == 3):
+		path := ""
+		if len(args) == 3 {
+			path = args[2]
+		}
+		if _, err := c.snapshotRequest("create", args[1], path); err != nil {
+			fmt.Printf("Error creating snapshot: %v\n", err)
+		} else {
+			fmt.Printf("Snapshot %s created\n", args[1])
+		}
+
+	case args[0] == "list" && len(args) == 1:
+		status, err := c.snapshotRequest("list", "", "")
+		if err != nil {
+			fmt.Printf("Error listing snapshots: %v\n", err)
+			return
+		}
+		if len(status.Snapshots) == 0 {
+			fmt.Println("No snapshots")
+			return
+		}
+		fmt.Println("\nSnapshots:")
+		fmt.Println("Name\tPath\tCreated\tFiles\tSize")
+		fmt.Println("----\t----\t-------\t-----\t----")
+		for _, snap := range status.Snapshots {
+			path := snap.Path
+			if path == "" {
+				path = "/"
+			}
+			fmt.Printf("%s\t%s\t%s\t%d\t%d\n", snap.Name, path,
+				time.Unix(snap.CreatedAt, 0).Format(time.RFC3339), snap.NumFiles, snap.TotalSize)
+		}
+
+	case args[0] == "list" && len(args) == 2:
+		status, err := c.snapshotRequest("list", args[1], "")
+		if err != nil {
+			fmt.Printf("Error listing snapshot: %v\n", err)
+			return
+		}
+		fmt.Printf("\nFiles in snapshot %s:\n", args[1])
+		fmt.Println("Name\tSize\tChunks\tGeneration")
+		fmt.Println("----\t----\t------\t----------")
+		for _, file := range status.Files {
+			fmt.Printf("%s\t%d\t%d\t%d\n", file.Filename, file.Size, file.NumChunks, file.Generation)
+		}
+
+	case args[0] == "get" && len(args) == 4:
+		if err := c.retrieve(&pb.RetrievalRequest{Filename: args[2], Snapshot: args[1]}, args[3]); err != nil {
+			fmt.Printf("Error retrieving file: %v\n", err)
+		} else {
+			fmt.Println("File retrieved successfully")
+		}
+
+	case args[0] == "diff" && len(args) == 2:
+		status, err := c.snapshotRequest("diff", args[1], "")
+		if err != nil {
+			fmt.Printf("Error diffing snapshot: %v\n", err)
+			return
+		}
+		if len(status.Changes) == 0 {
+			fmt.Println("No changes since the snapshot")
+			return
+		}
+		for _, change := range status.Changes {
+			fmt.Printf("%s\t%s\n", change.Change, change.Filename)
+		}
+
+	case args[0] == "delete" && len(args) == 2:
+		if _, err := c.snapshotRequest("delete", args[1], ""); err != nil {
+			fmt.Printf("Error deleting snapshot: %v\n", err)
+		} else {
+			fmt.Printf("Snapshot %s deleted\n", args[1])
+		}
+
+	default:
+		fmt.Println(usage)
+	}
+}
+
+// parseQuotaArgs parses "set|clear|report [-dir path | -user name] [-space bytes] [-files count]"
+func parseQuotaArgs(args []string) (*pb.QuotaRequest, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("missing action")
+	}
+	request := &pb.QuotaRequest{Action: args[0]}
+	if request.Action != "set" && request.Action != "clear" && request.Action != "report" {
+		return nil, fmt.Errorf("unknown action %q", request.Action)
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("missing value for %s", args[i])
+		}
+		value := args[i+1]
+		var err error
+		switch args[i] {
+		case "-dir":
+			request.Directory = "/" + strings.Trim(value, "/")
+		case "-user":
+			request.User = value
+		case "-space":
+			request.SpaceLimit, err = strconv.ParseUint(value, 10, 64)
+		case "-files":
+			request.FileLimit, err = strconv.ParseUint(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown option %s", args[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value %q", args[i], value)
+		}
+	}
+
+	if request.Directory != "" && request.User != "" {
+		return nil, fmt.Errorf("-dir and -user cannot be combined")
+	}
+	if request.Action != "report" && request.Directory == "" && request.User == "" {
+		return nil, fmt.Errorf("-dir or -user is required")
+	}
+	if request.Action == "set" && request.SpaceLimit == 0 && request.FileLimit == 0 {
+		return nil, fmt.Errorf("-space or -files is required")
+	}
+	return request, nil
+}
+
+// formatLimit formats a quota limit, where 0 means no limit
+func formatLimit(limit uint64) string {
+	if limit == 0 {
+		return "none"
+	}
+	return strconv.FormatUint(limit, 10)
+}
+
+// parseStoreArgs parses "[-r replication | -ec data+parity] [-overwrite] [-if-generation gen] [-encrypt] [-compress codec] [-stream] [-name name] <filepath|-> [chunk_size]"
+func (c *Client) parseStoreArgs(args []string) (string, storeOptions, error) {
+	opts := storeOptions{chunkSize: c.defaultChunkSize}
+
+	var erasureCoding string
+	flags := flag.NewFlagSet("store", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.IntVar(&opts.replication, "r", 0, "replication factor")
+	flags.StringVar(&erasureCoding, "ec", "", "erasure coding scheme, e.g. 6+3")
+	flags.BoolVar(&opts.overwrite, "overwrite", false, "replace the file if it exists")
+	flags.Uint64Var(&opts.expectedGeneration, "if-generation", 0, "only store if the file is at this generation, 0 if it must not exist")
+	flags.BoolVar(&opts.encrypt, "encrypt", false, "encrypt the file with the key file before storing it")
+	flags.StringVar(&opts.compression, "compress", "", "codec to compress each chunk with: "+strings.Join(common.CodecNames(), ", ")+
+		"; gzip and flate are DEFLATE at its best ratio and fastest level, zstd is about as small as gzip and nearly as fast as flate")
+	flags.BoolVar(&opts.dedup, "dedup", false, "store each chunk once by content hash, sharing chunks other files already stored")
+	flags.BoolVar(&opts.cdc, "cdc", false, "cut chunks at content-defined boundaries averaging chunk_size")
+	flags.BoolVar(&opts.stream, "stream", false, "upload chunks as they are read, for pipes and files larger than memory")
+	flags.StringVar(&opts.name, "name", "", "name to store a streamed file under, required when reading standard input")
+	if err := flags.Parse(args); err != nil {
+		return "", opts, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "if-generation" {
+			opts.checkGeneration = true
+		}
+	})
+
+	if erasureCoding != "" {
+		if opts.replication != 0 {
+			return "", opts, fmt.Errorf("-r and -ec cannot be combined")
+		}
+		if opts.encrypt {
+			return "", opts, fmt.Errorf("-encrypt and -ec cannot be combined")
+		}
+		if opts.dedup {
+			return "", opts, fmt.Errorf("-dedup and -ec cannot be combined")
+		}
+		if opts.cdc {
+			return "", opts, fmt.Errorf("-cdc and -ec cannot be combined")
+		}
+		if _, err := fmt.Sscanf(erasureCoding, "%d+%d", &opts.dataShards, &opts.parityShards); err != nil ||
+			opts.dataShards <= 0 || opts.parityShards <= 0 {
+			return "", opts, fmt.Errorf("invalid erasure coding scheme %q, expected data+parity", erasureCoding)
+		}
+	}
+
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return "", opts, fmt.Errorf("expected <filepath> [chunk_size]")
+	}
+	if flags.NArg() == 2 {
+		size, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+		if err != nil || size <= 0 {
+			return "", opts, fmt.Errorf("invalid chunk size %q", flags.Arg(1))
+		}
+		opts.chunkSize = size
+	}
+	if opts.replication < 0 {
+		return "", opts, fmt.Errorf("invalid replication factor %d", opts.replication)
+	}
+	if opts.dedup && opts.encrypt {
+		return "", opts, fmt.Errorf("-dedup and -encrypt cannot be combined")
+	}
+	if opts.cdc {
+		if err := opts.cdcParams().Validate(); err != nil {
+			return "", opts, err
+		}
+	}
+	if flags.Arg(0) == "-" {
+		if opts.name == "" {
+			return "", opts, fmt.Errorf("-name is required to store standard input")
+		}
+		opts.stream = true
+	}
+	if opts.name != "" && !opts.stream {
+		return "", opts, fmt.Errorf("-name requires -stream")
+	}
+	if opts.stream {
+		switch {
+		case erasureCoding != "":
+			return "", opts, fmt.Errorf("-stream and -ec cannot be combined")
+		case opts.dedup:
+			return "", opts, fmt.Errorf("-stream and -dedup cannot be combined")
+		case opts.cdc:
+			return "", opts, fmt.Errorf("-stream and -cdc cannot be combined")
+		}
+	}
+	if _, err := common.LookupCodec(opts.compression); err != nil {
+		return "", opts, err
+	}
+
+	return flags.Arg(0), opts, nil
+}
+
 func main() {
 	controllerAddr := flag.String("controller", "localhost:8000", "Controller address")
+	certFile := flag.String("cert", "", "TLS certificate; with -key and -ca enables mutual TLS")
+	keyFile := flag.String("key", "", "TLS private key")
+	caFile := flag.String("ca", "", "CA certificate that signs the controller and storage node certificates")
+	userKeyFile := flag.String("encryption-key", "", "File holding the secret that encrypts files stored with -encrypt (optional)")
+	readRepair := flag.Bool("read-repair", true, "Report replicas that fail a read so the controller repairs them from a good replica")
+	downloadWindow := flag.Int("download-window", defaultDownloadWindow, "Chunks a download fetches in parallel; memory use is this many chunks")
 	flag.Parse()
 
 	client := NewClient(*controllerAddr)
+	transport, err := common.NewTransport(*certFile, *keyFile, *caFile)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	client.transport = transport
+	if *downloadWindow <= 0 {
+		log.Fatalf("Invalid download window %d", *downloadWindow)
+	}
+	client.downloadWindow = *downloadWindow
+	client.readRepair = *readRepair
+	if *userKeyFile != "" {
+		if client.userKey, err = loadUserKey(*userKeyFile); err != nil {
+			log.Fatalf("Invalid encryption key: %v", err)
+		}
+	}
+
+	// A store or retrieve given on the command line runs once, so data can be
+	// piped in or out
+	switch flag.Arg(0) {
+	case "":
+	case "store":
+		path, opts, err := client.parseStoreArgs(flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Invalid store arguments: %v", err)
+		}
+		if err := client.storeFileWithOptions(path, opts); err != nil {
+			log.Fatalf("Error storing file: %v", err)
+		}
+		return
+	case "retrieve":
+		if flag.NArg() != 3 {
+			log.Fatalf("Usage: retrieve <filename> <output_path|->")
+		}
+		if err := client.retrieveFile(flag.Arg(1), flag.Arg(2)); err != nil {
+			log.Fatalf("Error retrieving file: %v", err)
+		}
+		return
+	default:
+		log.Fatalf("Unknown command %q, only store and retrieve can be run from the command line", flag.Arg(0))
+	}
 	client.runInteractive()
 }
\ No newline at end of file
@@ -2,12 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +24,9 @@ type mockController struct {
 	listener net.Listener
 	files    map[string]*pb.FileInfo
 	nodes    []*pb.NodeInfo
+
+	mu      sync.Mutex
+	reports []*pb.ReplicaReportRequest // Bad replicas reported by clients
 }
 
 func newMockController(t *testing.T) *mockController {
@@ -139,6 +145,25 @@ func (mc *mockController) handleConnection(t *testing.T, conn net.Conn) {
 		resp := &pb.DeleteResponse{Success: true}
 		respData, _ := proto.Marshal(resp)
 		common.WriteMessage(conn, common.MsgTypeDeleteResponse, respData)
+
+	case common.MsgTypeLeaseRequest:
+		resp := &pb.LeaseResponse{Success: true}
+		respData, _ := proto.Marshal(resp)
+		common.WriteMessage(conn, common.MsgTypeLeaseResponse, respData)
+
+	case common.MsgTypeReplicaReportRequest:
+		req := &pb.ReplicaReportRequest{}
+		if err := proto.Unmarshal(data, req); err != nil {
+			t.Errorf("Failed to unmarshal replica report: %v", err)
+			return
+		}
+		mc.mu.Lock()
+		mc.reports = append(mc.reports, req)
+		mc.mu.Unlock()
+
+		resp := &pb.ReplicaReportResponse{Scheduled: uint32(len(req.BadNodes))}
+		respData, _ := proto.Marshal(resp)
+		common.WriteMessage(conn, common.MsgTypeReplicaReportResponse, respData)
 	}
 }
 
@@ -305,4 +330,372 @@ func TestCommandLineInterface(t *testing.T) {
 			t.Errorf("Command %q output %q does not contain %q", cmd.input, output, cmd.expected)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestParseStoreArgs(t *testing.T) {
+	client := NewClient("localhost:0")
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    storeOptions
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			args: []string{"file.txt"},
+			want: storeOptions{chunkSize: common.DefaultChunkSize},
+		},
+		{
+			name: "replication and chunk size",
+			args: []string{"-r", "2", "file.txt", "1024"},
+			want: storeOptions{chunkSize: 1024, replication: 2},
+		},
+		{
+			name: "erasure coding",
+			args: []string{"-ec", "6+3", "file.txt"},
+			want: storeOptions{chunkSize: common.DefaultChunkSize, dataShards: 6, parityShards: 3},
+		},
+		{
+			name: "conditional overwrite",
+			args: []string{"-overwrite", "-if-generation", "0", "file.txt"},
+			want: storeOptions{chunkSize: common.DefaultChunkSize, overwrite: true, checkGeneration: true},
+		},
+		{
+			name: "encryption",
+			args: []string{"-encrypt", "file.txt"},
+			want: storeOptions{chunkSize: common.DefaultChunkSize, encrypt: true},
+		},
+		{
+			name: "compression",
+			args: []string{"-compress", "gzip", "file.txt"},
+			want: storeOptions{chunkSize: common.DefaultChunkSize, compression: common.CodecGzip},
+		},
+		{
+			name: "deduplication",
+			args: []string{"-dedup", "-compress", "flate", "file.txt"},
+			want: storeOptions{chunkSize: common.DefaultChunkSize, dedup: true, compression: common.CodecFlate},
+		},
+		{
+			name: "content-defined chunking",
+			args: []string{"-cdc", "-dedup", "file.txt", "65536"},
+			want: storeOptions{chunkSize: 65536, dedup: true, cdc: true},
+		},
+		{
+			name:    "content-defined chunking with erasure coding",
+			args:    []string{"-cdc", "-ec", "6+3", "file.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "content-defined chunks too small",
+			args:    []string{"-cdc", "file.txt", "128"},
+			wantErr: true,
+		},
+		{
+			name:    "deduplication with encryption",
+			args:    []string{"-dedup", "-encrypt", "file.txt"},
+			wantErr: true,
+		},
+		{
+			name: "streaming",
+			args: []string{"-stream", "-name", "dump.sql", "file.txt"},
+			want: storeOptions{chunkSize: common.DefaultChunkSize, stream: true, name: "dump.sql"},
+		},
+		{
+			name:    "standard input without a name",
+			args:    []string{"-"},
+			wantErr: true,
+		},
+		{
+			name:    "streaming with erasure coding",
+			args:    []string{"-stream", "-ec", "6+3", "file.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown codec",
+			args:    []string{"-compress", "lz77", "file.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "encryption with erasure coding",
+			args:    []string{"-encrypt", "-ec", "6+3", "file.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "replication with erasure coding",
+			args:    []string{"-r", "2", "-ec", "6+3", "file.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid erasure coding",
+			args:    []string{"-ec", "6", "file.txt"},
+			wantErr: true,
+		},
+		{
+			name:    "missing filepath",
+			args:    []string{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, opts, err := client.parseStoreArgs(tt.args)
+			if err != nil {
+				if !tt.wantErr {
+					t.Errorf("parseStoreArgs() error = %v", err)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("parseStoreArgs() succeeded with invalid arguments")
+			}
+			if path != "file.txt" {
+				t.Errorf("parseStoreArgs() path = %q, want %q", path, "file.txt")
+			}
+			if !reflect.DeepEqual(opts, tt.want) {
+				t.Errorf("parseStoreArgs() options = %+v, want %+v", opts, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientSideEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "user.key")
+	if err := os.WriteFile(keyPath, []byte("correct horse battery staple, long enough"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	client := NewClient("localhost:0")
+	userKey, err := loadUserKey(keyPath)
+	if err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+	client.userKey = userKey
+
+	// Short key files are rejected
+	shortPath := filepath.Join(dir, "short.key")
+	os.WriteFile(shortPath, []byte("secret"), 0600)
+	if _, err := loadUserKey(shortPath); err == nil {
+		t.Error("Expected a short key file to be rejected")
+	}
+
+	// Only the wrapped file key is sent to the controller
+	fileKey, encryption, err := newFileKey(client.userKey)
+	if err != nil {
+		t.Fatalf("Failed to generate file key: %v", err)
+	}
+	if encryption.Algorithm != encryptionAlgorithm || bytes.Contains(encryption.WrappedKey, fileKey) {
+		t.Fatalf("Unexpected encryption metadata %+v", encryption)
+	}
+
+	// Chunks are sealed one by one and each decrypts on its own
+	chunks := [][]byte{[]byte("first chunk"), []byte("second chunk")}
+	sealed := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		if sealed[i], err = sealChunk(fileKey, i, chunk); err != nil {
+			t.Fatalf("Failed to seal chunk %d: %v", i, err)
+		}
+		if bytes.Contains(sealed[i], chunk) || len(sealed[i]) != len(chunk)+common.SealedOverhead {
+			t.Errorf("Chunk %d not encrypted", i)
+		}
+	}
+	layoutKey, err := client.fileKey(&pb.RetrievalResponse{Encryption: encryption})
+	if err != nil {
+		t.Fatalf("Failed to unwrap file key: %v", err)
+	}
+	data, err := openChunk(layoutKey, 1, sealed[1])
+	if err != nil || !bytes.Equal(data, chunks[1]) {
+		t.Errorf("Chunk 1 decrypted to %q, %v", data, err)
+	}
+
+	// Chunks cannot be reordered
+	if _, err := openChunk(layoutKey, 0, sealed[1]); err == nil {
+		t.Error("Expected a chunk read at the wrong position to fail")
+	}
+
+	// Plaintext files pass through
+	if key, err := client.fileKey(&pb.RetrievalResponse{}); err != nil || key != nil {
+		t.Errorf("Expected no file key for a plaintext file, got %v, %v", key, err)
+	}
+
+	// Another user's key cannot unwrap the file key
+	other := NewClient("localhost:0")
+	other.userKey = bytes.Repeat([]byte{1}, 32)
+	if _, err := other.fileKey(&pb.RetrievalResponse{Encryption: encryption}); err == nil {
+		t.Error("Expected unwrapping with the wrong key to fail")
+	}
+	other.userKey = nil
+	if _, err := other.fileKey(&pb.RetrievalResponse{Encryption: encryption}); err == nil {
+		t.Error("Expected an encrypted file to need a key file")
+	}
+}
+
+func TestOrderedDownload(t *testing.T) {
+	client := NewClient("localhost:0")
+	client.downloadWindow = 3
+
+	// Later chunks arrive first, yet are written in order with at most a window in flight
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	fetch := func(num int) ([]byte, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(time.Duration(10-num) * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return []byte{byte(num)}, nil
+	}
+	var written []byte
+	write := func(num int, data []byte) error {
+		if num != len(written) {
+			t.Errorf("Chunk %d written after %d chunks", num, len(written))
+		}
+		written = append(written, data...)
+		return nil
+	}
+	if err := client.downloadChunks(10, fetch, write); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(written, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("Chunks written as %v", written)
+	}
+	if maxInFlight > client.downloadWindow {
+		t.Errorf("%d chunks fetched at once, window is %d", maxInFlight, client.downloadWindow)
+	}
+
+	// A failed chunk fails the download before anything past it is written
+	written = nil
+	err := client.downloadChunks(10, func(num int) ([]byte, error) {
+		if num == 4 {
+			return nil, fmt.Errorf("chunk %d unavailable", num)
+		}
+		return []byte{byte(num)}, nil
+	}, write)
+	if err == nil || len(written) > 4 {
+		t.Errorf("Download with a failed chunk returned %v after writing %v", err, written)
+	}
+}
+
+// startChunkServer serves chunk reads with data after a delay, or fails them
+func startChunkServer(t *testing.T, data []byte, delay time.Duration, fail bool) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to create mock storage node: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				if _, _, err := common.ReadMessage(conn); err != nil {
+					return
+				}
+				time.Sleep(delay)
+				resp := &pb.ChunkRetrieveResponse{Data: data}
+				if fail {
+					resp = &pb.ChunkRetrieveResponse{Error: "chunk corrupted"}
+				}
+				respData, _ := proto.Marshal(resp)
+				common.WriteMessage(conn, common.MsgTypeChunkRetrieve, respData)
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHedgedReads(t *testing.T) {
+	client := NewClient("localhost:0")
+	slow := startChunkServer(t, []byte("slow"), 2*time.Second, false)
+	fast := startChunkServer(t, []byte("fast"), 0, false)
+	broken := startChunkServer(t, nil, 0, true)
+
+	// Without latencies, the least loaded replica is read first
+	reads := client.newReadSession(&pb.RetrievalResponse{NodeLoad: map[string]float64{slow: 50, fast: 5}})
+	if ranked := reads.rank([]string{slow, fast}); ranked[0] != fast {
+		t.Errorf("Replicas ranked %v, want the idle node first", ranked)
+	}
+
+	// A replica that looked fast but stalls is raced against the next one
+	for i := 0; i < hedgeMinSamples; i++ {
+		client.latencies.observe(slow, time.Millisecond)
+		client.latencies.observe(fast, 5*time.Millisecond)
+	}
+	reads = client.newReadSession(nil)
+	start := time.Now()
+	data, err := reads.retrieveChunk("file.txt", 0, []string{slow, fast})
+	if err != nil || string(data) != "fast" {
+		t.Fatalf("Hedged read returned %q, %v", data, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Hedged read took %v, waiting for the slow replica", elapsed)
+	}
+
+	// Cancelling a read abandons it
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := client.retrieveRangeFromNode(ctx, "file.txt", 0, 0, 0, slow); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Cancelled read returned %v after %v", err, time.Since(start))
+	}
+
+	// A replica that keeps failing is skipped for the rest of the operation
+	reads = client.newReadSession(nil)
+	for i := 0; i < blacklistFailures; i++ {
+		if data, err := reads.retrieveChunk("file.txt", 0, []string{broken, fast}); err != nil || string(data) != "fast" {
+			t.Fatalf("Read did not fall back to a good replica: %q, %v", data, err)
+		}
+	}
+	if ranked := reads.rank([]string{broken, fast}); len(ranked) != 1 || ranked[0] != fast {
+		t.Errorf("Failing replica still ranked: %v", ranked)
+	}
+	if ranked := reads.rank([]string{broken}); len(ranked) != 1 {
+		t.Error("Blacklisted replica dropped when it is the only one left")
+	}
+}
+
+func TestReadRepairReport(t *testing.T) {
+	mc := newMockController(t)
+	defer mc.listener.Close()
+	client := NewClient(mc.listener.Addr().String())
+
+	good := startChunkServer(t, []byte("good"), 0, false)
+	broken := startChunkServer(t, nil, 0, true)
+	unreachable := "localhost:1"
+
+	// Only the replica that answered with an error is reported; one that could
+	// not be reached is left to the controller's failure detection
+	reads := client.newReadSession(nil)
+	data, err := reads.retrieveChunk("data.bin", 3, []string{unreachable, broken, good})
+	if err != nil || string(data) != "good" {
+		t.Fatalf("Read returned %q, %v", data, err)
+	}
+	mc.mu.Lock()
+	reports := mc.reports
+	mc.reports = nil
+	mc.mu.Unlock()
+	if len(reports) != 1 || reports[0].BlockName != "data.bin" || reports[0].ChunkNumber != 3 ||
+		!reflect.DeepEqual(reports[0].BadNodes, []string{broken}) || reports[0].GoodNode != good {
+		t.Errorf("Unexpected replica reports: %v", reports)
+	}
+
+	// Reads that needed no fallback, or with read repair off, report nothing
+	client.newReadSession(nil).retrieveChunk("data.bin", 3, []string{good})
+	client.readRepair = false
+	client.newReadSession(nil).retrieveChunk("data.bin", 3, []string{broken, good})
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if len(mc.reports) != 0 {
+		t.Errorf("Unexpected replica reports: %v", mc.reports)
+	}
+}
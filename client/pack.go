@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	pb "distributed_file_system/proto"
+)
+
+// storePacked appends a small file to the container chunk the controller
+// packed it into, on every replica of the container
+func (c *Client) storePacked(data []byte, extent *pb.PackedExtent) error {
+	grant := &pb.AppendResponse{Generation: extent.Generation, BlockToken: extent.BlockToken}
+	placement := &pb.AppendPlacement{
+		ChunkNumber:  0,
+		ChunkOffset:  extent.Offset,
+		Length:       uint64(len(data)),
+		StorageNodes: extent.StorageNodes,
+	}
+	if err := c.appendChunk(extent.BlockName, grant, placement, data); err != nil {
+		return fmt.Errorf("failed to pack file into %s: %v", extent.BlockName, err)
+	}
+	return nil
+}
+
+// retrievePacked reads a packed file's range of its container
+func (c *Client) retrievePacked(reads *readSession, layout *pb.RetrievalResponse, outFile *os.File) error {
+	extent := layout.Packed
+	data, err := reads.retrieveRange(extent.BlockName, 0, extent.Offset, layout.FileSize, extent.StorageNodes)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve file: %v", err)
+	}
+	if _, err := outFile.Write(data); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	return nil
+}
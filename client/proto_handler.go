@@ -1,18 +1,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"net"
-	"os"
 	"sync"
 
 	"google.golang.org/protobuf/proto"
 )
 
-// getStorageLocations requests chunk storage locations from the controller
-func (c *Client) getStorageLocations(filename string, fileSize int64, chunkSize int64) (map[int][]string, error) {
+// getStorageLocations requests chunk placements from the controller along with
+// the block name to store them under, if not the filename
+func (c *Client) getStorageLocations(filename string, fileSize int64, opts storeOptions) (*dfs.StorageResponse, error) {
 	// Connect to controller
-	conn, err := net.Dial("tcp", c.controllerAddr)
+	conn, err := c.transport.Dial(c.controllerAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to controller: %v", err)
 	}
@@ -20,9 +20,29 @@ func (c *Client) getStorageLocations(filename string, fileSize int64, chunkSize
 
 	// Create request
 	request := &dfs.StorageRequest{
-		Filename:  filename,
-		FileSize:  uint64(fileSize),
-		ChunkSize: uint32(chunkSize),
+		Filename:          filename,
+		FileSize:          uint64(fileSize),
+		ChunkSize:         uint32(opts.placementChunkSize()),
+		ReplicationFactor: uint32(opts.replication),
+		ClientId:          c.clientID,
+		Overwrite:         opts.overwrite,
+		User:              c.user,
+		Groups:            c.groups,
+		Encryption:        opts.encryption,
+		Compression:       opts.compression,
+		ChunkHashes:       opts.chunkHashes,
+		ChunkOffsets:      opts.chunkOffsets,
+		InlineData:        opts.inlineData,
+		Streaming:         opts.stream,
+	}
+	if opts.checkGeneration {
+		request.ExpectedGeneration = &opts.expectedGeneration
+	}
+	if opts.parityShards > 0 {
+		request.ErasureCoding = &dfs.ErasureCoding{
+			DataShards:   uint32(opts.dataShards),
+			ParityShards: uint32(opts.parityShards),
+		}
 	}
 
 	// Serialize request
@@ -55,27 +75,78 @@ func (c *Client) getStorageLocations(filename string, fileSize int64, chunkSize
 		return nil, fmt.Errorf("controller error: %s", response.Error)
 	}
 
-	// Convert response to map
+	c.rememberBlockToken(response.BlockToken)
+	for _, placement := range response.ChunkPlacements {
+		c.rememberBlockToken(placement.BlockToken)
+	}
+
+	return response, nil
+}
+
+// placementLocations converts a storage response to a map of chunk number to storage nodes
+func placementLocations(response *dfs.StorageResponse) map[int][]string {
 	locations := make(map[int][]string)
 	for _, placement := range response.ChunkPlacements {
 		locations[int(placement.ChunkNumber)] = placement.StorageNodes
 	}
-
-	return locations, nil
+	return locations
 }
 
-// storeChunk stores a chunk on a storage node
-func (c *Client) storeChunk(file *os.File, chunkNum int, chunkSize int64, nodes []string) error {
-	// Read chunk data
-	data := make([]byte, chunkSize)
-	n, err := file.ReadAt(data, int64(chunkNum)*chunkSize)
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("failed to read chunk: %v", err)
+// allocateChunk asks the controller to place the next chunk of a file being
+// streamed and returns the nodes to store it on
+func (c *Client) allocateChunk(filename string, chunkNum int) ([]string, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.ChunkAllocationRequest{
+		Filename:    filename,
+		ChunkNumber: uint32(chunkNum),
+		ClientId:    c.clientID,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeChunkAllocationRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeChunkAllocationResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.ChunkAllocationResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
 	}
-	data = data[:n] // Trim to actual size
 
+	return response.Placement.StorageNodes, nil
+}
+
+// storeChunk stores a chunk on a storage node, which compresses it with the
+// given codec
+func (c *Client) storeChunk(filename string, chunkNum int, data []byte, nodes []string, compression string) error {
 	// Connect to primary storage node
-	conn, err := net.Dial("tcp", nodes[0])
+	conn, err := c.transport.Dial(nodes[0])
 	if err != nil {
 		return fmt.Errorf("failed to connect to storage node: %v", err)
 	}
@@ -83,10 +154,12 @@ func (c *Client) storeChunk(file *os.File, chunkNum int, chunkSize int64, nodes
 
 	// Create request
 	request := &dfs.ChunkStoreRequest{
-		Filename:    filepath.Base(file.Name()),
+		Filename:    filename,
 		ChunkNumber: uint32(chunkNum),
 		Data:       data,
 		ReplicaNodes: nodes[1:], // Remaining nodes for replication
+		BlockToken:   c.blockToken(filename, common.BlockTokenWrite, 0),
+		Compression:  compression,
 	}
 
 	// Serialize request
@@ -124,17 +197,46 @@ func (c *Client) storeChunk(file *os.File, chunkNum int, chunkSize int64, nodes
 
 // getChunkLocations requests chunk locations from the controller
 func (c *Client) getChunkLocations(filename string) (map[int][]string, error) {
+	layout, err := c.getFileLayout(filename)
+	if err != nil {
+		return nil, err
+	}
+	return chunkLocations(layout), nil
+}
+
+// chunkLocations converts a retrieval response to a map of chunk number to storage nodes
+func chunkLocations(layout *dfs.RetrievalResponse) map[int][]string {
+	locations := make(map[int][]string)
+	for _, chunk := range layout.Chunks {
+		locations[int(chunk.ChunkNumber)] = chunk.StorageNodes
+	}
+	return locations
+}
+
+// blockName returns the name the file's chunks are stored under on storage nodes
+func blockName(filename string, layout *dfs.RetrievalResponse) string {
+	if layout.BlockName != "" {
+		return layout.BlockName
+	}
+	return filename
+}
+
+// getFileLayout requests chunk locations and the file's layout from the controller
+func (c *Client) getFileLayout(filename string) (*dfs.RetrievalResponse, error) {
+	return c.requestLayout(&dfs.RetrievalRequest{Filename: filename})
+}
+
+// requestLayout requests the layout of the file, previous version or snapshot
+// copy named by a retrieval request
+func (c *Client) requestLayout(request *dfs.RetrievalRequest) (*dfs.RetrievalResponse, error) {
 	// Connect to controller
-	conn, err := net.Dial("tcp", c.controllerAddr)
+	conn, err := c.transport.Dial(c.controllerAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to controller: %v", err)
 	}
 	defer conn.Close()
 
-	// Create request
-	request := &dfs.RetrievalRequest{
-		Filename: filename,
-	}
+	request.User, request.Groups = c.user, c.groups
 
 	// Serialize request
 	requestData, err := proto.Marshal(request)
@@ -166,41 +268,67 @@ func (c *Client) getChunkLocations(filename string) (map[int][]string, error) {
 		return nil, fmt.Errorf("controller error: %s", response.Error)
 	}
 
-	// Convert response to map
-	locations := make(map[int][]string)
+	c.rememberBlockToken(response.BlockToken)
 	for _, chunk := range response.Chunks {
-		locations[int(chunk.ChunkNumber)] = chunk.StorageNodes
+		c.rememberBlockToken(chunk.BlockToken)
+	}
+	if response.Packed != nil {
+		c.rememberBlockToken(response.Packed.BlockToken)
+	}
+	return response, nil
+}
+
+// rememberBlockToken keeps a block token from the controller to present to
+// storage nodes
+func (c *Client) rememberBlockToken(token *dfs.BlockToken) {
+	if token == nil {
+		return
 	}
+	c.tokensMu.Lock()
+	defer c.tokensMu.Unlock()
+	c.blockTokens[blockTokenKey(token.BlockName, token.Operation, token.Offset, token.Length > 0)] = token
+}
 
-	return locations, nil
+// blockTokenKey names a block token by its operation and block, and by its
+// extent if it only covers one packed file of a container
+func blockTokenKey(blockName, operation string, offset uint64, extent bool) string {
+	if !extent {
+		return operation + " " + blockName
+	}
+	return fmt.Sprintf("%s %s@%d", operation, blockName, offset)
 }
 
-// retrieveChunk retrieves a chunk from a storage node
-func (c *Client) retrieveChunk(filename string, chunkNum int, nodes []string) ([]byte, error) {
-	// Try each node until successful
-	var lastErr error
-	for _, node := range nodes {
-		data, err := c.retrieveChunkFromNode(filename, chunkNum, node)
-		if err == nil {
-			return data, nil
-		}
-		lastErr = err
+// blockToken returns the latest token granting an operation on a block name,
+// preferring one for the packed file at offset, or nil if the controller issued
+// none
+func (c *Client) blockToken(blockName, operation string, offset uint64) *dfs.BlockToken {
+	c.tokensMu.Lock()
+	defer c.tokensMu.Unlock()
+	if token, exists := c.blockTokens[blockTokenKey(blockName, operation, offset, true)]; exists {
+		return token
 	}
-	return nil, fmt.Errorf("failed to retrieve chunk from all nodes: %v", lastErr)
+	return c.blockTokens[blockTokenKey(blockName, operation, 0, false)]
 }
 
-func (c *Client) retrieveChunkFromNode(filename string, chunkNum int, node string) ([]byte, error) {
+// retrieveRangeFromNode retrieves a range of a chunk from a storage node, or the
+// whole chunk if length is 0. Cancelling ctx abandons the read.
+func (c *Client) retrieveRangeFromNode(ctx context.Context, filename string, chunkNum int, offset, length uint64, node string) ([]byte, error) {
 	// Connect to storage node
-	conn, err := net.Dial("tcp", node)
+	conn, err := c.transport.Dial(node)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to storage node: %v", err)
+		return nil, &common.ConnectionError{Address: node, Err: err}
 	}
 	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
 
 	// Create request
 	request := &dfs.ChunkRetrieveRequest{
 		Filename:    filename,
 		ChunkNumber: uint32(chunkNum),
+		BlockToken:  c.blockToken(filename, common.BlockTokenRead, offset),
+		Offset:      offset,
+		Length:      length,
 	}
 
 	// Serialize request
@@ -236,17 +364,71 @@ func (c *Client) retrieveChunkFromNode(filename string, chunkNum int, node strin
 	return response.Data, nil
 }
 
+// reportBadReplicas tells the controller which replicas of a chunk failed a read
+// that the good node then served, and returns how many it will repair
+func (c *Client) reportBadReplicas(blockName string, chunkNum int, bad []string, good string) (uint32, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.ReplicaReportRequest{
+		BlockName:   blockName,
+		ChunkNumber: uint32(chunkNum),
+		BadNodes:    bad,
+		GoodNode:    good,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeReplicaReportRequest, requestData); err != nil {
+		return 0, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeReplicaReportResponse {
+		return 0, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.ReplicaReportResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return 0, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response.Scheduled, nil
+}
+
 // listFiles requests the list of files from the controller
 func (c *Client) listFiles() ([]*dfs.FileInfo, error) {
 	// Connect to controller
-	conn, err := net.Dial("tcp", c.controllerAddr)
+	conn, err := c.transport.Dial(c.controllerAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to controller: %v", err)
 	}
 	defer conn.Close()
 
-	// Create empty request
-	request := &dfs.ListFilesRequest{}
+	// Create request; only files this user may see are listed
+	request := &dfs.ListFilesRequest{
+		User:   c.user,
+		Groups: c.groups,
+	}
 
 	// Serialize request
 	requestData, err := proto.Marshal(request)
@@ -274,13 +456,17 @@ func (c *Client) listFiles() ([]*dfs.FileInfo, error) {
 		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
 	}
 
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
 	return response.Files, nil
 }
 
 // getNodeStatus requests the status of all nodes from the controller
 func (c *Client) getNodeStatus() (*dfs.NodeStatusResponse, error) {
 	// Connect to controller
-	conn, err := net.Dial("tcp", c.controllerAddr)
+	conn, err := c.transport.Dial(c.controllerAddr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to controller: %v", err)
 	}
@@ -316,4 +502,663 @@ func (c *Client) getNodeStatus() (*dfs.NodeStatusResponse, error) {
 	}
 
 	return response, nil
+}
+
+// setSafeMode asks the controller to enter, leave or report safe mode
+func (c *Client) setSafeMode(action string) (*dfs.SafeModeResponse, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.SafeModeRequest{
+		Action: action,
+		User:   c.user,
+		Groups: c.groups,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeSafeModeRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeSafeModeResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.SafeModeResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response, nil
+}
+
+// setReplication asks the controller to change a file's replication factor
+func (c *Client) setReplication(filename string, replication int) error {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.SetReplicationRequest{
+		Filename:          filename,
+		ReplicationFactor: uint32(replication),
+		User:              c.user,
+		Groups:            c.groups,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeSetReplicationRequest, requestData); err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeSetReplicationResponse {
+		return fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.SetReplicationResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return nil
+}
+
+// getTranscodeStatus requests the transcoding policy and progress from the controller
+func (c *Client) getTranscodeStatus() (*dfs.TranscodeStatusResponse, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create empty request
+	request := &dfs.TranscodeStatusRequest{}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeTranscodeStatusRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeTranscodeStatusResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.TranscodeStatusResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return response, nil
+}
+
+// requestAppend asks the controller for the append lease on a file and where to
+// write the appended data
+func (c *Client) requestAppend(filename string, length int64) (*dfs.AppendResponse, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.AppendRequest{
+		Filename: filename,
+		Length:   uint64(length),
+		ClientId: c.clientID,
+		User:     c.user,
+		Groups:   c.groups,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeAppendRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeAppendResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.AppendResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response, nil
+}
+
+// appendChunk writes part of an append granted by the controller to the first
+// storage node of a placement, which forwards it to the other replicas
+func (c *Client) appendChunk(filename string, grant *dfs.AppendResponse, placement *dfs.AppendPlacement, data []byte) error {
+	if len(placement.StorageNodes) == 0 {
+		return fmt.Errorf("no storage nodes assigned")
+	}
+
+	// Connect to primary storage node
+	conn, err := c.transport.Dial(placement.StorageNodes[0])
+	if err != nil {
+		return fmt.Errorf("failed to connect to storage node: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.ChunkAppendRequest{
+		Filename:     filename,
+		ChunkNumber:  placement.ChunkNumber,
+		Offset:       placement.ChunkOffset,
+		Data:         data,
+		Generation:   grant.Generation,
+		ReplicaNodes: placement.StorageNodes[1:], // Remaining nodes for replication
+		Compression:  grant.Compression,
+		BlockToken:   grant.BlockToken,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeChunkAppend, requestData); err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeChunkAppend {
+		return fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.ChunkAppendResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("storage node error: %s", response.Error)
+	}
+
+	return nil
+}
+
+// commitAppend asks the controller to commit or abort an append and returns the
+// resulting file size
+func (c *Client) commitAppend(filename string, appendID uint64, abort bool) (uint64, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.AppendCommitRequest{
+		Filename: filename,
+		AppendId: appendID,
+		Abort:    abort,
+		ClientId: c.clientID,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeAppendCommitRequest, requestData); err != nil {
+		return 0, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeAppendCommitResponse {
+		return 0, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.AppendCommitResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return 0, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response.FileSize, nil
+}
+
+// leaseRequest renews, releases or aborts this client's write lease on a file, or
+// lists or revokes leases
+func (c *Client) leaseRequest(action string, filename string) (*dfs.LeaseResponse, error) {
+	return c.sendLeaseRequest(&dfs.LeaseRequest{
+		Action:   action,
+		Filename: filename,
+		ClientId: c.clientID,
+	})
+}
+
+// releaseStream completes a streamed file by releasing its lease with the number
+// of bytes written
+func (c *Client) releaseStream(filename string, size int64) (*dfs.LeaseResponse, error) {
+	return c.sendLeaseRequest(&dfs.LeaseRequest{
+		Action:   "release",
+		Filename: filename,
+		ClientId: c.clientID,
+		FileSize: uint64(size),
+	})
+}
+
+// sendLeaseRequest sends a lease request to the controller on behalf of the user
+func (c *Client) sendLeaseRequest(request *dfs.LeaseRequest) (*dfs.LeaseResponse, error) {
+	request.User, request.Groups = c.user, c.groups
+
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeLeaseRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeLeaseResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.LeaseResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response, nil
+}
+
+// versionsRequest lists the versions of a file or reverts it to a previous version
+func (c *Client) versionsRequest(action string, filename string, generation uint64) (*dfs.VersionsResponse, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.VersionsRequest{
+		Action:     action,
+		Filename:   filename,
+		Generation: generation,
+		User:       c.user,
+		Groups:     c.groups,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeVersionsRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeVersionsResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.VersionsResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response, nil
+}
+
+// deleteFile asks the controller to delete a file, moving it to this user's trash
+// unless skipTrash is set. Returns the file's path in the trash, if it was moved.
+func (c *Client) deleteFile(filename string, skipTrash bool) (string, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.DeleteRequest{
+		Filename:  filename,
+		User:      c.user,
+		SkipTrash: skipTrash,
+		Groups:    c.groups,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeDeleteRequest, requestData); err != nil {
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeDeleteResponse {
+		return "", fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.DeleteResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return "", fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return "", fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response.TrashPath, nil
+}
+
+// trashRequest lists, restores from or empties this user's trash
+func (c *Client) trashRequest(action string, filename string) (*dfs.TrashResponse, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.TrashRequest{
+		Action:   action,
+		User:     c.user,
+		Filename: filename,
+		Groups:   c.groups,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeTrashRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeTrashResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.TrashResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response, nil
+}
+
+// snapshotRequest creates, lists, diffs or deletes namespace snapshots
+func (c *Client) snapshotRequest(action string, name string, path string) (*dfs.SnapshotResponse, error) {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.SnapshotRequest{
+		Action: action,
+		Name:   name,
+		Path:   path,
+		User:   c.user,
+		Groups: c.groups,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeSnapshotRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeSnapshotResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.SnapshotResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response, nil
+}
+
+// quotaRequest sets, clears or reports the quota of a directory or user on
+// behalf of the client's user
+func (c *Client) quotaRequest(request *dfs.QuotaRequest) (*dfs.QuotaResponse, error) {
+	request.Caller, request.CallerGroups = c.user, c.groups
+
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeQuotaRequest, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeQuotaResponse {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.QuotaResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return response, nil
+}
+
+// changePermissions asks the controller to chmod or chown a file or directory as this user
+func (c *Client) changePermissions(request *dfs.PermissionRequest) error {
+	// Connect to controller
+	conn, err := c.transport.Dial(c.controllerAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	request.User, request.Groups = c.user, c.groups
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypePermissionRequest, requestData); err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypePermissionResponse {
+		return fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.PermissionResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return fmt.Errorf("controller error: %s", response.Error)
+	}
+
+	return nil
 }
\ No newline at end of file
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"distributed_file_system/common"
+)
+
+// unreachable reports whether a read failed because the node could not be
+// reached. Such nodes are left to the controller's failure detection rather
+// than repaired.
+func unreachable(err error) bool {
+	var connErr *common.ConnectionError
+	return errors.As(err, &connErr)
+}
+
+// repair reports replicas that failed a read of a chunk the good node then
+// served, so the controller has the good node overwrite them. Storage nodes
+// verify a chunk's checksum before serving it, so the good node's copy is
+// intact. The read succeeds whether or not the report does.
+func (s *readSession) repair(blockName string, chunkNum int, bad []string, good string) {
+	if !s.c.readRepair || len(bad) == 0 {
+		return
+	}
+	if _, err := s.c.reportBadReplicas(blockName, chunkNum, bad, good); err != nil {
+		log.Printf("Failed to report bad replicas of chunk %d of %s: %v", chunkNum, blockName, err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// streamWindow is the number of chunks a streaming upload holds in memory while
+// they are read and stored
+const streamWindow = 4
+
+// storeStream stores a file of unknown size as it is read, asking the controller
+// to place each chunk once its data has arrived. The size is set when the lease
+// is released, so the input never has to fit in memory or be seekable.
+func (c *Client) storeStream(r io.Reader, filename string, opts storeOptions, fileKey []byte) error {
+	opts.stream = true
+	response, err := c.getStorageLocations(filename, 0, opts)
+	if err != nil {
+		return fmt.Errorf("failed to start stream: %v", err)
+	}
+	storedName := response.BlockName
+	if storedName == "" {
+		storedName = filename
+	}
+
+	// Hold the write lease until every chunk is stored
+	stop := c.keepLeaseAlive(filename)
+	size, err := c.streamChunks(r, filename, storedName, opts, fileKey)
+	stop()
+
+	// A partly streamed file is removed rather than left behind
+	if err != nil {
+		if _, abortErr := c.leaseRequest("abort", filename); abortErr != nil {
+			log.Printf("Failed to abort store: %v", abortErr)
+		}
+		return err
+	}
+
+	if _, err := c.releaseStream(filename, size); err != nil {
+		return fmt.Errorf("failed to complete file: %v", err)
+	}
+
+	return nil
+}
+
+// streamChunks reads the input a chunk at a time and stores each chunk in the
+// background. A chunk is only read once one of the window's slots is free, which
+// bounds memory to streamWindow chunks. Returns the number of bytes read.
+func (c *Client) streamChunks(r io.Reader, filename, storedName string, opts storeOptions, fileKey []byte) (int64, error) {
+	slots := make(chan struct{}, streamWindow)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	var size int64
+	for chunkNum, done := 0, false; !done && !failed(); chunkNum++ {
+		slots <- struct{}{}
+		data := make([]byte, opts.chunkSize)
+		n, err := io.ReadFull(r, data)
+		switch {
+		case err == io.EOF:
+			<-slots
+			done = true
+			continue
+		case err == io.ErrUnexpectedEOF:
+			// A short chunk is the last one
+			done = true
+		case err != nil:
+			<-slots
+			fail(fmt.Errorf("failed to read input: %v", err))
+			continue
+		}
+		data = data[:n]
+		size += int64(n)
+
+		nodes, err := c.allocateChunk(filename, chunkNum)
+		if err != nil {
+			<-slots
+			fail(fmt.Errorf("failed to allocate chunk %d: %v", chunkNum, err))
+			continue
+		}
+
+		wg.Add(1)
+		go func(num int, data []byte, storageNodes []string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			data, err := sealChunk(fileKey, num, data)
+			if err == nil {
+				err = c.storeChunk(storedName, num, data, storageNodes, opts.compression)
+			}
+			if err != nil {
+				fail(fmt.Errorf("failed to store file: chunk %d: %v", num, err))
+			}
+		}(chunkNum, data, nodes)
+	}
+
+	// Wait for the chunks still being stored
+	wg.Wait()
+	return size, firstErr
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// CDCParams bounds the chunks cut by content-defined chunking. Cut points
+// are found with a gear rolling hash as in FastCDC: a stricter mask before
+// the average size and a looser one after it keep chunk sizes close to it.
+type CDCParams struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// NewCDCParams returns the parameters for an average chunk size, with chunks
+// between a quarter and four times the average
+func NewCDCParams(avgSize int) CDCParams {
+	return CDCParams{MinSize: avgSize / 4, AvgSize: avgSize, MaxSize: avgSize * 4}
+}
+
+// Validate checks that the sizes are ordered and large enough for the hash
+func (p CDCParams) Validate() error {
+	if p.MinSize < 64 {
+		return &ValidationError{Field: "chunk_size", Message: "content-defined chunks must be at least 64 bytes"}
+	}
+	if p.AvgSize < p.MinSize || p.MaxSize < p.AvgSize {
+		return &ValidationError{Field: "chunk_size", Message: fmt.Sprintf("need min %d <= avg %d <= max %d", p.MinSize, p.AvgSize, p.MaxSize)}
+	}
+	return nil
+}
+
+// gearTable maps each byte to a random 64-bit value. It is generated from a
+// fixed seed: changing it would move every cut point and defeat deduplication
+// against chunks already stored.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6466732d63646321) // "dfs-cdc!"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// cdcMask returns a mask of the given number of the hash's top bits, which
+// depend on the last 64 bytes
+func cdcMask(ones int) uint64 {
+	return ^uint64(0) << (64 - ones)
+}
+
+// NextCutPoint returns the length of the content-defined chunk starting at
+// the beginning of data
+func NextCutPoint(data []byte, p CDCParams) int {
+	if len(data) <= p.MinSize {
+		return len(data)
+	}
+	end := min(len(data), p.MaxSize)
+	normal := min(end, p.AvgSize)
+
+	// One bit more than the average needs before it, one bit less after it
+	avgBits := bits.Len(uint(p.AvgSize)) - 1
+	strict, loose := cdcMask(avgBits+1), cdcMask(avgBits-1)
+
+	var hash uint64
+	i := p.MinSize
+	for ; i < normal; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&strict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < end; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&loose == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// SplitContentDefined splits data into chunks whose boundaries depend on the
+// content, so an insertion or deletion only changes the chunks around it
+func SplitContentDefined(data []byte, p CDCParams) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := NextCutPoint(data, p)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// SplitFileContentDefined splits a file into content-defined chunks
+func SplitFileContentDefined(file *os.File, p CDCParams) ([][]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek file: %v", err)
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	return SplitContentDefined(data, p), nil
+}
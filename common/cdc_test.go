@@ -0,0 +1,46 @@
+package common
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestContentDefinedChunking(t *testing.T) {
+	params := NewCDCParams(4096)
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := SplitContentDefined(data, params)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("Chunks do not join back into the data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > params.MaxSize || (len(chunk) < params.MinSize && i < len(chunks)-1) {
+			t.Errorf("Chunk %d has %d bytes, outside [%d, %d]", i, len(chunk), params.MinSize, params.MaxSize)
+		}
+	}
+	if avg := len(data) / len(chunks); avg < params.AvgSize/2 || avg > params.AvgSize*2 {
+		t.Errorf("Average chunk size %d is far from %d", avg, params.AvgSize)
+	}
+
+	// Inserting a byte at the start only changes the chunks around it
+	shifted := SplitContentDefined(append([]byte{0}, data...), params)
+	original := make(map[string]bool)
+	for _, chunk := range chunks {
+		original[ContentHash(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range shifted {
+		if !original[ContentHash(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("%d of %d chunks changed after inserting one byte", changed, len(shifted))
+	}
+
+	if err := (CDCParams{MinSize: 4096, AvgSize: 1024, MaxSize: 8192}).Validate(); err == nil {
+		t.Error("Validate() accepted a minimum above the average")
+	}
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of the built-in compression codecs
+const (
+	CodecNone  = "none"
+	CodecGzip  = "gzip"
+	CodecFlate = "flate"
+	CodecZstd  = "zstd"
+)
+
+// Codec compresses chunks independently of each other, so every chunk can be
+// decompressed on its own
+type Codec interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress fails rather than return more than limit bytes
+	Decompress(data []byte, limit int64) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(flateCodec{})
+	RegisterCodec(zstdCodec{})
+}
+
+// RegisterCodec makes a codec available by name, replacing any codec of the same name
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// LookupCodec returns the codec registered under a name. An empty name is the
+// none codec.
+func LookupCodec(name string) (Codec, error) {
+	if name == "" {
+		name = CodecNone
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, exists := codecs[name]
+	if !exists {
+		return nil, &ValidationError{Field: "compression", Message: fmt.Sprintf("unknown codec %q", name)}
+	}
+	return codec, nil
+}
+
+// CodecNames returns the names of every registered codec, sorted
+func CodecNames() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// noneCodec stores chunks as they are
+type noneCodec struct{}
+
+func (noneCodec) Name() string { return CodecNone }
+
+func (noneCodec) Compress(data []byte) ([]byte, error) { return data, nil }
+
+func (noneCodec) Decompress(data []byte, limit int64) ([]byte, error) {
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("chunk exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+// gzipCodec trades speed for the best ratio of the built-in codecs
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return CodecGzip }
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte, limit int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readLimited(reader, limit)
+}
+
+// flateCodec is raw DEFLATE at its fastest level, for write-heavy data
+type flateCodec struct{}
+
+func (flateCodec) Name() string { return CodecFlate }
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte, limit int64) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return readLimited(reader, limit)
+}
+
+// zstdCodec compresses about as well as gzip at close to the speed of flate
+type zstdCodec struct{}
+
+// zstdEncoder is shared by every chunk; EncodeAll is safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+
+func (zstdCodec) Name() string { return CodecZstd }
+
+func (zstdCodec) Compress(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func (zstdCodec) Decompress(data []byte, limit int64) ([]byte, error) {
+	reader, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return readLimited(reader, limit)
+}
+
+// readLimited reads everything from a decompressor, failing past limit bytes so
+// a corrupt or malicious chunk cannot exhaust memory
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("chunk decompresses to more than %d bytes", limit)
+	}
+	return data, nil
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("chunk data compresses well when it repeats "), 1000)
+	for _, name := range CodecNames() {
+		codec, err := LookupCodec(name)
+		if err != nil {
+			t.Fatalf("Failed to look up codec %s: %v", name, err)
+		}
+		compressed, err := codec.Compress(data)
+		if err != nil {
+			t.Fatalf("Failed to compress with %s: %v", name, err)
+		}
+		if name != CodecNone && len(compressed) >= len(data) {
+			t.Errorf("%s did not shrink repetitive data: %d bytes", name, len(compressed))
+		}
+		decompressed, err := codec.Decompress(compressed, int64(len(data)))
+		if err != nil || !bytes.Equal(decompressed, data) {
+			t.Errorf("%s round trip failed: %v", name, err)
+		}
+
+		// A chunk decompressing past the limit is rejected
+		if _, err := codec.Decompress(compressed, int64(len(data)-1)); err == nil {
+			t.Errorf("%s decompressed past the limit", name)
+		}
+	}
+	if _, err := LookupCodec(CodecZstd); err != nil {
+		t.Errorf("zstd codec not registered: %v", err)
+	}
+}
@@ -15,12 +15,59 @@ const (
 	MsgTypeNodeStatusResponse byte = 11
 	MsgTypeChunkStore       byte = 12
 	MsgTypeChunkRetrieve    byte = 13
+	MsgTypeSafeModeRequest  byte = 14
+	MsgTypeSafeModeResponse byte = 15
+	MsgTypeSetReplicationRequest  byte = 16
+	MsgTypeSetReplicationResponse byte = 17
+	MsgTypeChunkReplicate   byte = 18
+	MsgTypeChunkDelete      byte = 19
+	MsgTypeChunkReconstruct byte = 20
+	MsgTypeTranscodeStatusRequest  byte = 21
+	MsgTypeTranscodeStatusResponse byte = 22
+	MsgTypeChunkTranscode   byte = 23
+	MsgTypeAppendRequest    byte = 24
+	MsgTypeAppendResponse   byte = 25
+	MsgTypeAppendCommitRequest  byte = 26
+	MsgTypeAppendCommitResponse byte = 27
+	MsgTypeChunkAppend      byte = 28
+	MsgTypeLeaseRequest     byte = 29
+	MsgTypeLeaseResponse    byte = 30
+	MsgTypeVersionsRequest  byte = 31
+	MsgTypeVersionsResponse byte = 32
+	MsgTypeTrashRequest     byte = 33
+	MsgTypeTrashResponse    byte = 34
+	MsgTypeSnapshotRequest  byte = 35
+	MsgTypeSnapshotResponse byte = 36
+	MsgTypeQuotaRequest     byte = 37
+	MsgTypeQuotaResponse    byte = 38
+	MsgTypePermissionRequest  byte = 39
+	MsgTypePermissionResponse byte = 40
+	MsgTypeHeartbeatResponse  byte = 41
+	MsgTypeChunkAllocationRequest  byte = 42
+	MsgTypeChunkAllocationResponse byte = 43
+	MsgTypeReplicaReportRequest    byte = 44
+	MsgTypeReplicaReportResponse   byte = 45
+	MsgTypeChunkCompact            byte = 46
 )
 
 // Default values
 const (
 	DefaultChunkSize    = 64 * 1024 * 1024 // 64MB
 	DefaultReplication  = 3
+	MaxReplication      = 10
 	HeartbeatInterval  = 5  // seconds
 	HeartbeatTimeout   = 15 // seconds
+	BlockReportInterval = 300 // seconds between full chunk reports from a storage node
+	LeaseTimeout       = 60 // seconds
+	BlockTokenLifetime = 600 // seconds
+
+	// Largest file whose contents the controller may store in its metadata
+	MaxInlineSize = 64 * 1024
+
+	// Permission bits of files and directories that were never chmod'ed
+	DefaultFileMode = 0644
+	DefaultDirMode  = 0755
+
+	// Fraction of known chunks that must be reported before leaving safe mode
+	DefaultSafeModeThreshold = 0.999
 )
\ No newline at end of file
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// ContentBlockPrefix starts the names deduplicated chunks are stored under on
+// storage nodes. Filenames may not start with it.
+const ContentBlockPrefix = "sha256:"
+
+// ContentHash returns the hex SHA-256 of a chunk, which identifies it when
+// deduplicating
+func ContentHash(data []byte) string {
+	return hex.EncodeToString(CalculateChecksum(data))
+}
+
+// IsContentHash reports whether s is a hex SHA-256 as returned by ContentHash
+func IsContentHash(s string) bool {
+	if len(s) != 64 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// ContentBlockName returns the name the deduplicated chunk with a content hash
+// is stored under
+func ContentBlockName(hash string) string {
+	return ContentBlockPrefix + hash
+}
+
+// ParseContentBlockName returns the content hash a deduplicated chunk's block
+// name was derived from, or false if the name is not content-addressed
+func ParseContentBlockName(blockName string) (string, bool) {
+	if !strings.HasPrefix(blockName, ContentBlockPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(blockName, ContentBlockPrefix), true
+}
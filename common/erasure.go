@@ -0,0 +1,288 @@
+package common
+
+import "fmt"
+
+// MaxErasureShards is the largest stripe width supported by GF(2^8) Reed-Solomon
+const MaxErasureShards = 256
+
+// Galois field GF(2^8) tables using the polynomial x^8 + x^4 + x^3 + x^2 + 1
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInverse(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])*n)%255]
+}
+
+// ReedSolomon encodes stripes of data shards into parity shards and rebuilds
+// missing shards from any dataShards of the dataShards+parityShards shards
+type ReedSolomon struct {
+	dataShards   int
+	parityShards int
+	matrix       [][]byte // Systematic encoding matrix, (data+parity) x data
+}
+
+// NewReedSolomon creates an RS(dataShards, parityShards) codec
+func NewReedSolomon(dataShards, parityShards int) (*ReedSolomon, error) {
+	if dataShards <= 0 {
+		return nil, &ValidationError{Field: "data_shards", Message: "must be positive"}
+	}
+	if parityShards <= 0 {
+		return nil, &ValidationError{Field: "parity_shards", Message: "must be positive"}
+	}
+	if dataShards+parityShards > MaxErasureShards {
+		return nil, &ValidationError{Field: "parity_shards", Message: fmt.Sprintf("at most %d shards per stripe", MaxErasureShards)}
+	}
+
+	// Any dataShards rows of a Vandermonde matrix are invertible. Multiplying by the
+	// inverse of its top square turns it into a systematic matrix (identity on top)
+	// with the same property, so data shards are stored unmodified.
+	total := dataShards + parityShards
+	vandermonde := make([][]byte, total)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := invertMatrix(vandermonde[:dataShards])
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReedSolomon{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       multiplyMatrix(vandermonde, top),
+	}, nil
+}
+
+// DataShards returns the number of data shards per stripe
+func (rs *ReedSolomon) DataShards() int {
+	return rs.dataShards
+}
+
+// ParityShards returns the number of parity shards per stripe
+func (rs *ReedSolomon) ParityShards() int {
+	return rs.parityShards
+}
+
+// Encode computes the parity shards of a stripe. shards holds the data shards
+// followed by the parity shards; all data shards must have the same length and
+// parity shards are allocated if needed.
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if len(shards) != rs.dataShards+rs.parityShards {
+		return fmt.Errorf("expected %d shards, got %d", rs.dataShards+rs.parityShards, len(shards))
+	}
+
+	shardSize := len(shards[0])
+	for i := 0; i < rs.dataShards; i++ {
+		if len(shards[i]) != shardSize {
+			return fmt.Errorf("data shard %d has size %d, want %d", i, len(shards[i]), shardSize)
+		}
+	}
+
+	for i := rs.dataShards; i < len(shards); i++ {
+		shards[i] = rs.codeShard(rs.matrix[i], shards[:rs.dataShards], shardSize)
+	}
+	return nil
+}
+
+// Reconstruct rebuilds missing shards in place. Missing shards are nil; at least
+// DataShards shards must be present and all present shards must have the same length.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if len(shards) != rs.dataShards+rs.parityShards {
+		return fmt.Errorf("expected %d shards, got %d", rs.dataShards+rs.parityShards, len(shards))
+	}
+
+	// Pick the first dataShards present shards to decode from
+	shardSize := -1
+	present := make([]int, 0, rs.dataShards)
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if shardSize == -1 {
+			shardSize = len(shard)
+		} else if len(shard) != shardSize {
+			return fmt.Errorf("shard %d has size %d, want %d", i, len(shard), shardSize)
+		}
+		if len(present) < rs.dataShards {
+			present = append(present, i)
+		}
+	}
+	if len(present) < rs.dataShards {
+		return fmt.Errorf("too few shards to reconstruct (required: %d, available: %d)", rs.dataShards, len(present))
+	}
+
+	// Rebuild missing data shards from the inverse of the rows that produced the present shards
+	missingData := false
+	for i := 0; i < rs.dataShards; i++ {
+		if shards[i] == nil {
+			missingData = true
+			break
+		}
+	}
+	if missingData {
+		subMatrix := make([][]byte, rs.dataShards)
+		inputs := make([][]byte, rs.dataShards)
+		for i, index := range present {
+			subMatrix[i] = rs.matrix[index]
+			inputs[i] = shards[index]
+		}
+		decode, err := invertMatrix(subMatrix)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < rs.dataShards; i++ {
+			if shards[i] == nil {
+				shards[i] = rs.codeShard(decode[i], inputs, shardSize)
+			}
+		}
+	}
+
+	// Recompute missing parity shards from the complete data shards
+	for i := rs.dataShards; i < len(shards); i++ {
+		if shards[i] == nil {
+			shards[i] = rs.codeShard(rs.matrix[i], shards[:rs.dataShards], shardSize)
+		}
+	}
+	return nil
+}
+
+// codeShard computes the linear combination of inputs given by coefficients
+func (rs *ReedSolomon) codeShard(coefficients []byte, inputs [][]byte, shardSize int) []byte {
+	out := make([]byte, shardSize)
+	for j, input := range inputs {
+		table := &gfMul[coefficients[j]]
+		for i, b := range input {
+			out[i] ^= table[b]
+		}
+	}
+	return out
+}
+
+// multiplyMatrix returns a x b
+func multiplyMatrix(a, b [][]byte) [][]byte {
+	result := make([][]byte, len(a))
+	for r := range a {
+		result[r] = make([]byte, len(b[0]))
+		for c := range result[r] {
+			var value byte
+			for i := range b {
+				value ^= gfMul[a[r][i]][b[i][c]]
+			}
+			result[r][c] = value
+		}
+	}
+	return result
+}
+
+// invertMatrix returns the inverse of a square matrix using Gauss-Jordan elimination
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+	size := len(matrix)
+
+	// Build [matrix | identity]
+	work := make([][]byte, size)
+	for r := range work {
+		work[r] = make([]byte, 2*size)
+		copy(work[r], matrix[r])
+		work[r][size+r] = 1
+	}
+
+	for col := 0; col < size; col++ {
+		// Find a row with a non-zero pivot
+		pivot := col
+		for pivot < size && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == size {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		// Scale the pivot row to 1
+		scale := gfInverse(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul[scale][work[col][c]]
+		}
+
+		// Eliminate the column from every other row
+		for r := 0; r < size; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			factor := work[r][col]
+			for c := range work[r] {
+				work[r][c] ^= gfMul[factor][work[col][c]]
+			}
+		}
+	}
+
+	inverse := make([][]byte, size)
+	for r := range inverse {
+		inverse[r] = work[r][size:]
+	}
+	return inverse, nil
+}
+
+// SplitStripe splits the data of one stripe into dataShards equally sized
+// shards, zero-padding the last ones
+func SplitStripe(data []byte, dataShards int) [][]byte {
+	shardSize := (len(data) + dataShards - 1) / dataShards
+	shards := make([][]byte, dataShards)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		start := i * shardSize
+		if start < len(data) {
+			copy(shards[i], data[start:])
+		}
+	}
+	return shards
+}
+
+// JoinStripe concatenates the data shards of a stripe and drops the padding
+// added by SplitStripe
+func JoinStripe(shards [][]byte, dataShards int, stripeSize int) []byte {
+	data := make([]byte, 0, stripeSize)
+	for i := 0; i < dataShards && len(data) < stripeSize; i++ {
+		data = append(data, shards[i]...)
+	}
+	if len(data) > stripeSize {
+		data = data[:stripeSize]
+	}
+	return data
+}
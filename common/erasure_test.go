@@ -0,0 +1,91 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing []int
+		wantErr bool
+	}{
+		{
+			name:    "no missing shards",
+			missing: nil,
+		},
+		{
+			name:    "missing data shards",
+			missing: []int{0, 4, 5},
+		},
+		{
+			name:    "missing parity shards",
+			missing: []int{6, 8},
+		},
+		{
+			name:    "missing data and parity shards",
+			missing: []int{1, 3, 7},
+		},
+		{
+			name:    "too many missing shards",
+			missing: []int{0, 1, 2, 3},
+			wantErr: true,
+		},
+	}
+
+	// Create test data that does not divide evenly into shards
+	testData := bytes.Repeat([]byte("erasure coded stripe "), 100)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := NewReedSolomon(6, 3)
+			if err != nil {
+				t.Fatalf("NewReedSolomon() error = %v", err)
+			}
+
+			shards := append(SplitStripe(testData, 6), nil, nil, nil)
+			if err := rs.Encode(shards); err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			original := make([][]byte, len(shards))
+			copy(original, shards)
+
+			// Drop shards and rebuild them
+			for _, i := range tt.missing {
+				shards[i] = nil
+			}
+			err = rs.Reconstruct(shards)
+			if err != nil {
+				if !tt.wantErr {
+					t.Errorf("Reconstruct() error = %v", err)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("Reconstruct() succeeded with too few shards")
+			}
+
+			for i := range shards {
+				if !bytes.Equal(shards[i], original[i]) {
+					t.Errorf("Shard %d does not match original", i)
+				}
+			}
+			if !bytes.Equal(JoinStripe(shards, 6, len(testData)), testData) {
+				t.Error("Joined data does not match input data")
+			}
+		})
+	}
+}
+
+func TestNewReedSolomonValidation(t *testing.T) {
+	if _, err := NewReedSolomon(0, 3); err == nil {
+		t.Error("NewReedSolomon() succeeded with no data shards")
+	}
+	if _, err := NewReedSolomon(6, 0); err == nil {
+		t.Error("NewReedSolomon() succeeded with no parity shards")
+	}
+	if _, err := NewReedSolomon(200, 100); err == nil {
+		t.Error("NewReedSolomon() succeeded with too many shards")
+	}
+}
@@ -1,6 +1,9 @@
 package common
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // ChunkCorruptionError indicates that a chunk's data is corrupted
 type ChunkCorruptionError struct {
@@ -111,4 +114,86 @@ type ValidationError struct {
 
 func (e ValidationError) Error() string {
 	return fmt.Sprintf("validation error: %s: %s", e.Field, e.Message)
+}
+
+// SafeModeError indicates that a write was rejected because the controller is in safe mode
+type SafeModeError struct {
+	Operation string
+}
+
+func (e SafeModeError) Error() string {
+	return fmt.Sprintf("cannot %s: controller is in safe mode", e.Operation)
+}
+
+// PreconditionFailedError indicates that a conditional write found the file at a
+// different generation than expected
+type PreconditionFailedError struct {
+	Filename string
+	Expected uint64
+	Actual   uint64
+}
+
+func (e PreconditionFailedError) Error() string {
+	return fmt.Sprintf("file %s is at generation %d, expected %d", e.Filename, e.Actual, e.Expected)
+}
+
+// LeaseConflictError indicates that another writer holds the lease on a file
+type LeaseConflictError struct {
+	Filename string
+	Holder   string
+}
+
+func (e LeaseConflictError) Error() string {
+	return fmt.Sprintf("file %s is being written by %s", e.Filename, e.Holder)
+}
+
+// QuotaExceededError indicates that a write would take a directory or user over
+// its space or namespace quota
+type QuotaExceededError struct {
+	Target    string // e.g. "directory data" or "user alice"
+	Resource  string // "space" or "files"
+	Limit     uint64
+	Used      uint64
+	Requested uint64
+}
+
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota of %s exceeded: %d used, %d requested, limit %d", e.Resource, e.Target, e.Used, e.Requested, e.Limit)
+}
+
+// PermissionDeniedError indicates that a user lacks the access a request needs
+type PermissionDeniedError struct {
+	User   string
+	Path   string
+	Access string // e.g. "read", "write" or "execute"
+}
+
+func (e PermissionDeniedError) Error() string {
+	return fmt.Sprintf("permission denied: %s has no %s access to %s", e.User, e.Access, e.Path)
+}
+
+// UnauthenticatedNodeError indicates a storage node reported under an ID its
+// certificate does not vouch for
+type UnauthenticatedNodeError struct {
+	NodeID     string
+	Identities []string // Names in the certificate, empty if it presented none
+}
+
+func (e UnauthenticatedNodeError) Error() string {
+	if len(e.Identities) == 0 {
+		return fmt.Sprintf("node %s did not present a certificate", e.NodeID)
+	}
+	return fmt.Sprintf("node %s does not match certificate identity %s", e.NodeID, strings.Join(e.Identities, ", "))
+}
+
+// InvalidBlockTokenError indicates a storage node request carried a block token
+// that is missing, expired or not valid for the chunk and operation
+type InvalidBlockTokenError struct {
+	BlockName string
+	Operation string
+	Reason    string // e.g. "expired" or "signature mismatch"
+}
+
+func (e InvalidBlockTokenError) Error() string {
+	return fmt.Sprintf("invalid block token to %s %s: %s", e.Operation, e.BlockName, e.Reason)
 }
\ No newline at end of file
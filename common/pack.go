@@ -0,0 +1,13 @@
+package common
+
+import "strings"
+
+// ContainerBlockPrefix starts the names of the container chunks small files are
+// packed into. Storage nodes keep containers in their own append-only format,
+// and filenames may not start with it.
+const ContainerBlockPrefix = ".containers/"
+
+// IsContainerBlockName reports whether a block name is that of a container chunk
+func IsContainerBlockName(blockName string) bool {
+	return strings.HasPrefix(blockName, ContainerBlockPrefix)
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Transport opens the connections between clients, the controller and storage
+// nodes. When configured with certificates every connection uses mutual TLS; a
+// nil Transport uses plain TCP.
+type Transport struct {
+	config *tls.Config
+}
+
+// NewTransport loads this component's certificate and key and the CA that signs
+// the certificates of every component. Returns a nil Transport if no files are
+// given.
+func NewTransport(certFile, keyFile, caFile string) (*Transport, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, &ValidationError{Field: "tls", Message: "a certificate, key and CA are all required"}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+
+	return &Transport{
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
+
+// Listen accepts connections on a TCP address
+func (t *Transport) Listen(address string) (net.Listener, error) {
+	if t == nil {
+		return net.Listen("tcp", address)
+	}
+	return tls.Listen("tcp", address, t.config)
+}
+
+// Dial connects to a TCP address
+func (t *Transport) Dial(address string) (net.Conn, error) {
+	return t.DialTimeout(address, 0)
+}
+
+// DialTimeout connects to a TCP address, failing after timeout. A zero timeout
+// waits as long as the operating system allows.
+func (t *Transport) DialTimeout(address string, timeout time.Duration) (net.Conn, error) {
+	if t == nil {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, t.config)
+}
+
+// peerCertificate returns the certificate the other end of a TLS connection
+// authenticated with, or nil for plain TCP connections
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
+
+// PeerIdentities returns the names in the certificate the other end of a TLS
+// connection authenticated with: its common name and DNS names. Returns nil for
+// plain TCP connections.
+func PeerIdentities(conn net.Conn) []string {
+	cert := peerCertificate(conn)
+	if cert == nil {
+		return nil
+	}
+	return append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+}
+
+// PeerUser returns the user a client's certificate names, its common name, and
+// the user's groups, its organizational units. ok is false for plain TCP
+// connections.
+func PeerUser(conn net.Conn) (user string, groups []string, ok bool) {
+	cert := peerCertificate(conn)
+	if cert == nil {
+		return "", nil, false
+	}
+	return cert.Subject.CommonName, cert.Subject.OrganizationalUnit, true
+}
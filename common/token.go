@@ -0,0 +1,23 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Operations a block token grants
+const (
+	BlockTokenRead   = "read"
+	BlockTokenWrite  = "write"
+	BlockTokenDelete = "delete"
+)
+
+// SignBlockToken returns the HMAC-SHA256 signature of a block token's fields
+// under the secret shared by the controller and storage nodes. A token with a
+// length is limited to that extent of a container.
+func SignBlockToken(secret []byte, blockName, operation string, expiresAt int64, offset, length uint64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\x00%s\x00%d\x00%d\x00%d", blockName, operation, expiresAt, offset, length)
+	return mac.Sum(nil)
+}
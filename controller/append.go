@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// appendSession is an append that has been granted to a writer but not yet committed
+type appendSession struct {
+	ID         uint64
+	Generation uint64 // Fencing stamp storage nodes check the append's writes against
+	Length     int64
+	Chunks     map[int][]string // Chunks written by the append and the nodes holding them
+}
+
+// handleAppendRequest grants a writer the lease to append to a file and tells it
+// where to write: the rest of the last partial chunk, then newly allocated chunks
+func (c *Controller) handleAppendRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.AppendRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal append request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkWritable("append to file"); err != nil {
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+
+	metadata, exists := c.files[request.Filename]
+	if !exists {
+		err := &common.FileNotFoundError{Filename: request.Filename}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if err := c.checkFile(identify(peer, request.User, request.Groups), request.Filename, metadata, accessWrite); err != nil {
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if metadata.isErasureCoded() {
+		err := &common.ValidationError{Field: "filename", Message: "file is erasure coded"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if metadata.isEncrypted() {
+		err := &common.ValidationError{Field: "filename", Message: "file is encrypted by the client"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if metadata.isDeduplicated() {
+		err := &common.ValidationError{Field: "filename", Message: "file shares deduplicated chunks"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if metadata.isPacked() {
+		err := &common.ValidationError{Field: "filename", Message: "file is packed into a container"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if metadata.isInline() {
+		err := &common.ValidationError{Field: "filename", Message: "file is stored inline in the controller's metadata"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if metadata.isContentDefined() {
+		err := &common.ValidationError{Field: "filename", Message: "file has content-defined chunks"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if request.Length == 0 {
+		err := &common.ValidationError{Field: "length", Message: "must be positive"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+
+	// Only one writer may write to a file at a time
+	if err := c.checkLease(request.Filename, request.ClientId); err != nil {
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if lease, exists := c.leases[request.Filename]; exists && lease.Pending != nil {
+		err := &common.ValidationError{Field: "filename", Message: "file is being overwritten"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	if lease, exists := c.leases[request.Filename]; exists && lease.Streaming {
+		err := &common.ValidationError{Field: "filename", Message: "file is being streamed"}
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+
+	replication := c.replicationFor(metadata)
+	if err := c.checkQuota(request.Filename, metadata.Owner, request.Length*uint64(replication), 0, nil); err != nil {
+		return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+	}
+	chunkSize := int64(metadata.ChunkSize)
+	session := &appendSession{
+		Length: int64(request.Length),
+		Chunks: make(map[int][]string),
+	}
+	response := &dfs.AppendResponse{
+		BlockName:   metadata.BlockName,
+		Offset:      uint64(metadata.Size),
+		Compression: metadata.Compression,
+		BlockToken:  c.issueBlockToken(metadata.blockName(request.Filename), common.BlockTokenWrite),
+	}
+
+	// Fill the last partial chunk first, then allocate new chunks
+	for offset, end := metadata.Size, metadata.Size+session.Length; offset < end; {
+		chunkNum := int(offset / chunkSize)
+		chunkOffset := offset % chunkSize
+		length := chunkSize - chunkOffset
+		if end-offset < length {
+			length = end - offset
+		}
+
+		var nodes []string
+		if chunkOffset > 0 {
+			// The partial chunk is extended on its live replicas
+			nodes = c.liveReplicas(metadata.Chunks[chunkNum])
+			if len(nodes) == 0 {
+				err := &common.ChunkNotFoundError{Filename: request.Filename, ChunkNum: chunkNum}
+				return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+			}
+		} else {
+			nodes = c.selectStorageNodes(metadata.ChunkSize, replication, nil)
+			if len(nodes) < replication {
+				err := &common.NotEnoughNodesError{Required: replication, Available: len(nodes)}
+				return marshalErrorResponse(&dfs.AppendResponse{Error: err.Error()}, err)
+			}
+		}
+
+		session.Chunks[chunkNum] = nodes
+		response.Placements = append(response.Placements, &dfs.AppendPlacement{
+			ChunkNumber:  uint32(chunkNum),
+			StorageNodes: nodes,
+			ChunkOffset:  uint64(chunkOffset),
+			Length:       uint64(length),
+		})
+		offset += length
+	}
+
+	// A writer starting a new append gives up its previous uncommitted one
+	lease := c.grantLease(request.Filename, request.ClientId, "append")
+	if lease.Append != nil {
+		c.discardAppend(request.Filename, metadata, lease.Append)
+	}
+
+	// A new stamp fences out any writer whose lease was taken over. The file's
+	// generation only changes once the append is committed.
+	metadata.AppendStamp++
+	c.nextAppendID++
+	session.ID = c.nextAppendID
+	session.Generation = metadata.AppendStamp
+	lease.Append = session
+	response.AppendId = session.ID
+	response.Generation = session.Generation
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// handleAppendCommitRequest makes a written append visible by extending the file's
+// size and chunk list in one step, or discards it
+func (c *Controller) handleAppendCommitRequest(data []byte) ([]byte, error) {
+	request := &dfs.AppendCommitRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal append commit request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lease, exists := c.leases[request.Filename]
+	if !exists || lease.Append == nil || lease.Append.ID != request.AppendId {
+		err := &common.ValidationError{Field: "append_id", Message: "no such append in progress"}
+		return marshalErrorResponse(&dfs.AppendCommitResponse{Error: err.Error()}, err)
+	}
+	if lease.Holder != request.ClientId {
+		err := &common.LeaseConflictError{Filename: request.Filename, Holder: lease.Holder}
+		return marshalErrorResponse(&dfs.AppendCommitResponse{Error: err.Error()}, err)
+	}
+	if !request.Abort {
+		if err := c.checkWritable("append to file"); err != nil {
+			return marshalErrorResponse(&dfs.AppendCommitResponse{Error: err.Error()}, err)
+		}
+	}
+	session := lease.Append
+
+	// The append's lease ends here, unless the file itself is still being created
+	lease.Append = nil
+	if lease.Operation == "append" {
+		delete(c.leases, request.Filename)
+	}
+
+	metadata, exists := c.files[request.Filename]
+	if !exists {
+		err := &common.FileNotFoundError{Filename: request.Filename}
+		return marshalErrorResponse(&dfs.AppendCommitResponse{Error: err.Error()}, err)
+	}
+
+	if request.Abort {
+		c.discardAppend(request.Filename, metadata, session)
+	} else {
+		for chunkNum, nodes := range session.Chunks {
+			metadata.Chunks[chunkNum] = nodes
+		}
+		metadata.Size += session.Length
+		metadata.Generation++
+	}
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	response := &dfs.AppendCommitResponse{
+		Success:  true,
+		FileSize: uint64(metadata.Size),
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// discardAppend deletes the chunks allocated for an uncommitted append. Data written
+// past the end of the last partial chunk is left in place; it is never read and is
+// replaced by the next append. The caller must hold c.mu.
+func (c *Controller) discardAppend(filename string, metadata *FileMetadata, session *appendSession) {
+	unused := make(map[int][]string)
+	for chunkNum, nodes := range session.Chunks {
+		if _, exists := metadata.Chunks[chunkNum]; !exists {
+			unused[chunkNum] = nodes
+		}
+	}
+	go c.deleteChunks(metadata.blockName(filename), unused)
+}
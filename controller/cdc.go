@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+)
+
+// isContentDefined reports whether the file's chunk boundaries were cut by
+// content, so chunks vary in length up to ChunkSize
+func (m *FileMetadata) isContentDefined() bool {
+	return m.ChunkOffsets != nil
+}
+
+// validateChunkOffsets checks the chunk offsets of a storage request for a
+// content-defined file: starting at 0, increasing, and no chunk longer than
+// the chunk size
+func validateChunkOffsets(request *dfs.StorageRequest) error {
+	offsets := request.ChunkOffsets
+	if len(offsets) == 0 {
+		return nil
+	}
+	if request.ErasureCoding != nil {
+		return &common.ValidationError{Field: "chunk_offsets", Message: "erasure-coded files use fixed-size chunks"}
+	}
+	if offsets[0] != 0 {
+		return &common.ValidationError{Field: "chunk_offsets", Message: "first chunk must start at 0"}
+	}
+	for chunkNum := range offsets {
+		end := request.FileSize
+		if chunkNum+1 < len(offsets) {
+			end = offsets[chunkNum+1]
+		}
+		if end <= offsets[chunkNum] || end-offsets[chunkNum] > uint64(request.ChunkSize) {
+			return &common.ValidationError{Field: "chunk_offsets", Message: fmt.Sprintf("chunk %d must hold between 1 and %d bytes", chunkNum, request.ChunkSize)}
+		}
+	}
+	return nil
+}
+
+// requestChunks returns the number of chunks a storage request places
+func requestChunks(request *dfs.StorageRequest) uint64 {
+	if len(request.ChunkOffsets) > 0 {
+		return uint64(len(request.ChunkOffsets))
+	}
+	return (request.FileSize + uint64(request.ChunkSize) - 1) / uint64(request.ChunkSize)
+}
+
+// requestChunkLength returns the length of a chunk placed by a storage request
+func requestChunkLength(request *dfs.StorageRequest, chunkNum int) int64 {
+	start := uint64(chunkNum) * uint64(request.ChunkSize)
+	end := start + uint64(request.ChunkSize)
+	if len(request.ChunkOffsets) > 0 {
+		start, end = request.ChunkOffsets[chunkNum], request.FileSize
+		if chunkNum+1 < len(request.ChunkOffsets) {
+			end = request.ChunkOffsets[chunkNum+1]
+		}
+	}
+	return int64(min(end, request.FileSize) - start)
+}
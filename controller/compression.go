@@ -0,0 +1,60 @@
+package main
+
+import "distributed_file_system/common"
+
+// storedSize returns the bytes the file's chunks take on disk across all copies,
+// as last reported by the nodes holding them. Shared chunks of deduplicated
+// files count in full for every file, while packed files only count their own
+// bytes of the container, and inline files the bytes in the controller's
+// metadata. The caller must hold c.mu.
+func (c *Controller) storedSize(filename string, metadata *FileMetadata) uint64 {
+	if metadata.isDeduplicated() {
+		return c.contentStoredSize(metadata)
+	}
+	if metadata.isPacked() {
+		return c.packedStoredSize(metadata)
+	}
+	if metadata.isInline() {
+		return uint64(len(metadata.Inline))
+	}
+	blockName := metadata.blockName(filename)
+	var total uint64
+	for chunkNum, nodes := range metadata.Chunks {
+		key := chunkKey(blockName, chunkNum)
+		for _, nodeID := range nodes {
+			if node, exists := c.nodes[nodeID]; exists {
+				total += uint64(node.StoredSizes[key])
+			}
+		}
+	}
+	return total
+}
+
+// contentStoredSize returns the bytes the content chunks of a deduplicated file
+// take on disk across all copies. The caller must hold c.mu.
+func (c *Controller) contentStoredSize(metadata *FileMetadata) uint64 {
+	var total uint64
+	for _, hash := range metadata.ChunkHashes {
+		entry, exists := c.contentChunks[hash]
+		if !exists {
+			continue
+		}
+		key := chunkKey(common.ContentBlockName(hash), 0)
+		for _, nodeID := range entry.Nodes {
+			if node, exists := c.nodes[nodeID]; exists {
+				total += uint64(node.StoredSizes[key])
+			}
+		}
+	}
+	return total
+}
+
+// packedStoredSize returns the bytes a packed file takes in every live copy of
+// its container. The caller must hold c.mu.
+func (c *Controller) packedStoredSize(metadata *FileMetadata) uint64 {
+	packed, exists := c.containers[metadata.Container]
+	if !exists {
+		return 0
+	}
+	return uint64(metadata.Size) * uint64(len(c.liveReplicas(packed.Nodes)))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// contentChunk is a chunk stored once under its content hash and shared by
+// every deduplicated file containing it
+type contentChunk struct {
+	Nodes       []string
+	Size        int64
+	Replication int  // Highest replication factor of the files that placed it
+	Refs        int  // Files, versions, snapshot copies and pending writes referencing it
+	Committed   bool // A write that uploaded it completed, so later writers may skip uploading it
+}
+
+// isDeduplicated reports whether the file's chunks are shared content chunks
+func (m *FileMetadata) isDeduplicated() bool {
+	return m.ChunkHashes != nil
+}
+
+// numChunks returns the number of chunks or fragments making up the file
+func (m *FileMetadata) numChunks() int {
+	if m.isDeduplicated() {
+		return len(m.ChunkHashes)
+	}
+	return len(m.Chunks)
+}
+
+// validateDedup checks the chunk hashes of a storage request for a
+// deduplicated file. Block names of content chunks are reserved for them.
+func validateDedup(request *dfs.StorageRequest) error {
+	if _, isContent := common.ParseContentBlockName(request.Filename); isContent {
+		return &common.ValidationError{Field: "filename", Message: fmt.Sprintf("names starting with %s are reserved", common.ContentBlockPrefix)}
+	}
+	if len(request.ChunkHashes) == 0 {
+		return nil
+	}
+	if request.ErasureCoding != nil {
+		return &common.ValidationError{Field: "chunk_hashes", Message: "erasure-coded files cannot be deduplicated"}
+	}
+	if request.Encryption != nil {
+		return &common.ValidationError{Field: "chunk_hashes", Message: "encrypted files cannot be deduplicated"}
+	}
+	numChunks := requestChunks(request)
+	if uint64(len(request.ChunkHashes)) != numChunks {
+		return &common.ValidationError{Field: "chunk_hashes", Message: fmt.Sprintf("expected %d hashes, got %d", numChunks, len(request.ChunkHashes))}
+	}
+	for _, hash := range request.ChunkHashes {
+		if !common.IsContentHash(hash) {
+			return &common.ValidationError{Field: "chunk_hashes", Message: fmt.Sprintf("invalid SHA-256 %q", hash)}
+		}
+	}
+	return nil
+}
+
+// placeDeduplicatedFile places the chunks of a new deduplicated file. Chunks
+// already in the index are shared and only need uploading if no completed
+// write has stored them yet; new chunks are placed like replicated chunks.
+// The caller must hold c.mu.
+func (c *Controller) placeDeduplicatedFile(request *dfs.StorageRequest, replication int) ([]byte, error) {
+	response := &dfs.StorageResponse{
+		ChunkPlacements: make([]*dfs.ChunkPlacement, 0, len(request.ChunkHashes)),
+	}
+
+	for chunkNum, hash := range request.ChunkHashes {
+		entry, exists := c.contentChunks[hash]
+		if !exists || len(c.liveReplicas(entry.Nodes)) == 0 {
+			nodes := c.selectStorageNodes(int(request.ChunkSize), replication, nil)
+			if len(nodes) < replication {
+				c.releaseContent(request.ChunkHashes[:chunkNum])
+				return nil, fmt.Errorf("not enough storage nodes available")
+			}
+			if !exists {
+				entry = &contentChunk{Size: requestChunkLength(request, chunkNum)}
+				c.contentChunks[hash] = entry
+			}
+			entry.Nodes, entry.Committed = nodes, false
+		}
+		entry.Refs++
+		entry.Replication = max(entry.Replication, replication)
+
+		blockName := common.ContentBlockName(hash)
+		response.ChunkPlacements = append(response.ChunkPlacements, &dfs.ChunkPlacement{
+			ChunkNumber:  uint32(chunkNum),
+			StorageNodes: c.liveReplicas(entry.Nodes),
+			BlockName:    blockName,
+			Exists:       entry.Committed,
+			BlockToken:   c.issueBlockToken(blockName, common.BlockTokenWrite),
+		})
+	}
+
+	metadata := &FileMetadata{
+		Size:              int64(request.FileSize),
+		ChunkSize:         int(request.ChunkSize),
+		ReplicationFactor: replication,
+		CreatedAt:         time.Now(),
+		Chunks:            make(map[int][]string),
+		ChunkHashes:       request.ChunkHashes,
+	}
+	response.BlockName = c.beginWrite(request, metadata)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// contentLocations returns where each chunk of a deduplicated file is stored,
+// with a token to read it. The caller must hold c.mu.
+func (c *Controller) contentLocations(metadata *FileMetadata) []*dfs.ChunkLocation {
+	locations := make([]*dfs.ChunkLocation, 0, len(metadata.ChunkHashes))
+	for chunkNum, hash := range metadata.ChunkHashes {
+		var nodes []string
+		if entry, exists := c.contentChunks[hash]; exists {
+			nodes = c.liveReplicas(entry.Nodes)
+		}
+		blockName := common.ContentBlockName(hash)
+		locations = append(locations, &dfs.ChunkLocation{
+			ChunkNumber:  uint32(chunkNum),
+			StorageNodes: nodes,
+			BlockName:    blockName,
+			BlockToken:   c.issueBlockToken(blockName, common.BlockTokenRead),
+		})
+	}
+	return locations
+}
+
+// retainContent adds a reference to each content chunk, e.g. for a snapshot
+// copy of a deduplicated file. The caller must hold c.mu.
+func (c *Controller) retainContent(hashes []string) {
+	for _, hash := range hashes {
+		if entry, exists := c.contentChunks[hash]; exists {
+			entry.Refs++
+		}
+	}
+}
+
+// commitContent marks the content chunks of a completed write as stored, so
+// later writers skip uploading them. The caller must hold c.mu.
+func (c *Controller) commitContent(metadata *FileMetadata) {
+	for _, hash := range metadata.ChunkHashes {
+		if entry, exists := c.contentChunks[hash]; exists {
+			entry.Committed = true
+		}
+	}
+}
+
+// releaseContent drops a reference to each content chunk and garbage collects
+// the chunks no longer referenced. The caller must hold c.mu.
+func (c *Controller) releaseContent(hashes []string) {
+	for _, hash := range hashes {
+		entry, exists := c.contentChunks[hash]
+		if !exists {
+			continue
+		}
+		entry.Refs--
+		if entry.Refs > 0 {
+			continue
+		}
+		delete(c.contentChunks, hash)
+		go c.deleteChunks(common.ContentBlockName(hash), map[int][]string{0: entry.Nodes})
+	}
+}
+
+// releaseChunks garbage collects the chunks of a file version nothing refers to
+// any more: its own chunks, or its references to chunks shared with other
+// files. The caller must hold c.mu.
+func (c *Controller) releaseChunks(filename string, metadata *FileMetadata) {
+	if !c.releaseShared(metadata) {
+		go c.deleteChunks(metadata.blockName(filename), metadata.Chunks)
+	}
+}
+
+// releaseShared drops a file version's references to deduplicated content
+// chunks, to its container or to its inline contents. Returns false if the file
+// has chunks of its own. The caller must hold c.mu.
+func (c *Controller) releaseShared(metadata *FileMetadata) bool {
+	switch {
+	case metadata.isDeduplicated():
+		c.releaseContent(metadata.ChunkHashes)
+	case metadata.isPacked():
+		c.releasePacked(metadata)
+	case metadata.isInline():
+		c.inlineChanged = true
+	default:
+		return false
+	}
+	return true
+}
+
+// retainShared adds a reference to the chunks a file version shares with
+// other files, e.g. for a snapshot copy. The caller must hold c.mu.
+func (c *Controller) retainShared(metadata *FileMetadata) {
+	switch {
+	case metadata.isDeduplicated():
+		c.retainContent(metadata.ChunkHashes)
+	case metadata.isPacked():
+		c.retainPacked(metadata)
+	}
+}
+
+// commitShared marks the shared chunks of a completed write as stored. The
+// caller must hold c.mu.
+func (c *Controller) commitShared(metadata *FileMetadata) {
+	switch {
+	case metadata.isDeduplicated():
+		c.commitContent(metadata)
+	case metadata.isPacked():
+		c.commitPacked(metadata)
+	}
+}
+
+// replicateContent copies a content chunk from a live replica to new nodes
+// until it reaches the highest replication factor of the files sharing it
+func (c *Controller) replicateContent(hash string) {
+	blockName := common.ContentBlockName(hash)
+	key := chunkKey(blockName, 0)
+
+	c.mu.Lock()
+	entry, exists := c.contentChunks[hash]
+	if !exists || c.safeMode || c.replicating[key] {
+		c.mu.Unlock()
+		return
+	}
+
+	live := c.liveReplicas(entry.Nodes)
+	missing := entry.Replication - len(live)
+	if missing <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	if len(live) == 0 {
+		c.mu.Unlock()
+		log.Printf("Content chunk %s has no live replicas left", hash)
+		return
+	}
+
+	targets := c.selectStorageNodes(int(entry.Size), missing, entry.Nodes)
+	if len(targets) == 0 {
+		c.mu.Unlock()
+		log.Printf("No storage nodes available to re-replicate content chunk %s", hash)
+		return
+	}
+	c.replicating[key] = true
+	c.mu.Unlock()
+
+	// Have an existing replica push the chunk to the new nodes
+	err := c.sendChunkReplicate(live[0], blockName, 0, targets)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.replicating, key)
+
+	if err != nil {
+		log.Printf("Failed to replicate content chunk %s from %s: %v", hash, live[0], err)
+		return
+	}
+
+	// The chunk may have been garbage collected while the copy was in flight
+	if c.contentChunks[hash] != entry {
+		return
+	}
+	entry.Nodes = append(c.liveReplicas(entry.Nodes), targets...)
+	log.Printf("Replicated content chunk %s to %v", hash, targets)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+}
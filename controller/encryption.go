@@ -0,0 +1,39 @@
+package main
+
+import (
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+)
+
+// isEncrypted reports whether the client encrypted the file's chunks before storing them
+func (m *FileMetadata) isEncrypted() bool {
+	return m.Cipher != ""
+}
+
+// encryption describes how the client encrypted the file, or returns nil if it
+// is stored in plaintext
+func (m *FileMetadata) encryption() *dfs.Encryption {
+	if !m.isEncrypted() {
+		return nil
+	}
+	return &dfs.Encryption{
+		Algorithm:  m.Cipher,
+		WrappedKey: m.WrappedKey,
+	}
+}
+
+// validateEncryption checks the client-side encryption requested for a new file.
+// The controller never sees the file key, so it only checks the layout can hold
+// chunks sealed one by one: erasure-coded stripes would split them across fragments.
+func validateEncryption(request *dfs.StorageRequest) error {
+	if request.Encryption == nil {
+		return nil
+	}
+	if request.Encryption.Algorithm == "" || len(request.Encryption.WrappedKey) == 0 {
+		return &common.ValidationError{Field: "encryption", Message: "algorithm and wrapped key are required"}
+	}
+	if request.ErasureCoding != nil {
+		return &common.ValidationError{Field: "encryption", Message: "encrypted files cannot be erasure coded"}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// isErasureCoded reports whether the file is stored as Reed-Solomon stripes
+func (m *FileMetadata) isErasureCoded() bool {
+	return m.ParityShards > 0
+}
+
+// stripeWidth returns the number of fragments per stripe of an erasure-coded file
+func (m *FileMetadata) stripeWidth() int {
+	return m.DataShards + m.ParityShards
+}
+
+// erasureCoding describes the file's stripe layout, or returns nil if it is replicated
+func (m *FileMetadata) erasureCoding() *dfs.ErasureCoding {
+	if !m.isErasureCoded() {
+		return nil
+	}
+	return &dfs.ErasureCoding{
+		DataShards:   uint32(m.DataShards),
+		ParityShards: uint32(m.ParityShards),
+	}
+}
+
+// placeErasureCodedFile assigns every fragment of every stripe of a new file to a
+// storage node, with the fragments of a stripe on distinct nodes.
+// The caller must hold c.mu.
+func (c *Controller) placeErasureCodedFile(request *dfs.StorageRequest) ([]byte, error) {
+	dataShards := int(request.ErasureCoding.DataShards)
+	parityShards := int(request.ErasureCoding.ParityShards)
+	if _, err := common.NewReedSolomon(dataShards, parityShards); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+	width := dataShards + parityShards
+
+	nodes := c.selectStorageNodes(int(request.ChunkSize), width, nil)
+	if len(nodes) < width {
+		err := &common.NotEnoughNodesError{Required: width, Available: len(nodes)}
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+
+	stripeSize := uint64(request.ChunkSize) * uint64(dataShards)
+	numStripes := int((request.FileSize + stripeSize - 1) / stripeSize)
+
+	metadata := &FileMetadata{
+		Size:         int64(request.FileSize),
+		ChunkSize:    int(request.ChunkSize),
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		CreatedAt:    time.Now(),
+		Chunks:       make(map[int][]string, numStripes*width),
+	}
+	response := &dfs.StorageResponse{
+		ChunkPlacements: make([]*dfs.ChunkPlacement, 0, numStripes*width),
+	}
+
+	for stripe := 0; stripe < numStripes; stripe++ {
+		for shard := 0; shard < width; shard++ {
+			// Rotate assignments so parity fragments are spread over all nodes
+			node := nodes[(stripe+shard)%width]
+			chunkNum := stripe*width + shard
+			metadata.Chunks[chunkNum] = []string{node}
+			response.ChunkPlacements = append(response.ChunkPlacements, &dfs.ChunkPlacement{
+				ChunkNumber:  uint32(chunkNum),
+				StorageNodes: []string{node},
+			})
+		}
+	}
+	response.BlockName = c.beginWrite(request, metadata)
+	response.BlockToken = c.issueBlockToken(metadata.blockName(request.Filename), common.BlockTokenWrite)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// repairFragment rebuilds a lost fragment of an erasure-coded file on a new node
+// from the surviving fragments of its stripe
+func (c *Controller) repairFragment(filename string, fragment int) {
+	key := chunkKey(filename, fragment)
+
+	c.mu.Lock()
+	metadata, exists := c.files[filename]
+	if !exists || !metadata.isErasureCoded() || c.safeMode || c.replicating[key] {
+		c.mu.Unlock()
+		return
+	}
+	if len(c.liveReplicas(metadata.Chunks[fragment])) > 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	// Collect the surviving fragments of the stripe
+	width := metadata.stripeWidth()
+	first := fragment - fragment%width
+	var sources []*dfs.ChunkLocation
+	var stripeNodes []string
+	for chunkNum := first; chunkNum < first+width; chunkNum++ {
+		live := c.liveReplicas(metadata.Chunks[chunkNum])
+		if chunkNum == fragment || len(live) == 0 {
+			continue
+		}
+		sources = append(sources, &dfs.ChunkLocation{
+			ChunkNumber:  uint32(chunkNum),
+			StorageNodes: live,
+		})
+		stripeNodes = append(stripeNodes, live...)
+	}
+	if len(sources) < metadata.DataShards {
+		c.mu.Unlock()
+		log.Printf("Fragment %s is unrecoverable: only %d of %d required fragments left", key, len(sources), metadata.DataShards)
+		return
+	}
+
+	// Keep the fragments of a stripe on distinct nodes
+	targets := c.selectStorageNodes(metadata.ChunkSize, 1, stripeNodes)
+	if len(targets) == 0 {
+		c.mu.Unlock()
+		log.Printf("No storage nodes available to repair fragment %s", key)
+		return
+	}
+	erasureCoding := metadata.erasureCoding()
+	blockName := metadata.blockName(filename)
+	compression := metadata.Compression
+	c.replicating[key] = true
+	c.mu.Unlock()
+
+	err := c.sendChunkReconstruct(targets[0], blockName, fragment, erasureCoding, sources, compression)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.replicating, key)
+
+	if err != nil {
+		log.Printf("Failed to repair fragment %s on %s: %v", key, targets[0], err)
+		return
+	}
+
+	// The file may have been deleted while the repair was in flight
+	metadata, exists = c.files[filename]
+	if !exists || metadata.blockName(filename) != blockName {
+		return
+	}
+	metadata.Chunks[fragment] = targets
+	log.Printf("Repaired fragment %s on %s", key, targets[0])
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// isInline reports whether the file's contents are stored in its metadata
+// rather than on storage nodes
+func (m *FileMetadata) isInline() bool {
+	return m.Inline != nil
+}
+
+// plainData reports whether a storage request leaves the layout of its data to
+// the cluster: not erasure coded, encrypted, deduplicated, content-defined or
+// compressed
+func plainData(request *dfs.StorageRequest) bool {
+	uncompressed := request.Compression == "" || request.Compression == common.CodecNone
+	return uncompressed && request.ErasureCoding == nil && request.Encryption == nil &&
+		len(request.ChunkHashes) == 0 && len(request.ChunkOffsets) == 0
+}
+
+// inlinable reports whether a storage request carries the whole contents of a
+// plain file no larger than the inline threshold
+func (c *Controller) inlinable(request *dfs.StorageRequest) bool {
+	if c.inlineThreshold <= 0 || request.FileSize == 0 || request.FileSize > uint64(c.inlineThreshold) {
+		return false
+	}
+	return uint64(len(request.InlineData)) == request.FileSize && plainData(request)
+}
+
+// storeInlineFile keeps a tiny file's contents in its metadata. The write is
+// complete once the metadata is saved, so no lease outlives the request. The
+// caller must hold c.mu.
+func (c *Controller) storeInlineFile(request *dfs.StorageRequest, replication int) ([]byte, error) {
+	metadata := &FileMetadata{
+		Size:              int64(request.FileSize),
+		ChunkSize:         int(request.ChunkSize),
+		ReplicationFactor: replication,
+		CreatedAt:         time.Now(),
+		Chunks:            make(map[int][]string),
+		Inline:            request.InlineData,
+		InlineHash:        common.ContentHash(request.InlineData),
+	}
+	c.beginWrite(request, metadata)
+	c.inlineChanged = true
+	if lease, exists := c.leases[request.Filename]; exists {
+		c.releaseLease(request.Filename, lease)
+	}
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(&dfs.StorageResponse{Inline: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// inlineStorePath returns the file the contents of inline files are saved to,
+// next to the metadata file
+func (c *Controller) inlineStorePath() string {
+	return c.metadataPath + ".inline"
+}
+
+// eachInline calls fn with every inline file version the controller holds:
+// current files, previous versions and snapshot copies. The caller must hold
+// c.mu.
+func (c *Controller) eachInline(fn func(metadata *FileMetadata)) {
+	visit := func(metadata *FileMetadata) {
+		if metadata.InlineHash != "" {
+			fn(metadata)
+		}
+	}
+	for _, metadata := range c.files {
+		visit(metadata)
+	}
+	for _, versions := range c.versions {
+		for _, metadata := range versions {
+			visit(metadata)
+		}
+	}
+	for _, snap := range c.snapshots {
+		for _, metadata := range snap.Files {
+			visit(metadata)
+		}
+	}
+}
+
+// saveInlineStore writes the contents of inline files to the inline store, by
+// content hash. The metadata file only records the hashes, so the store is only
+// rewritten when inline files were stored or released. The caller must hold
+// c.mu.
+func (c *Controller) saveInlineStore() error {
+	if !c.inlineChanged {
+		return nil
+	}
+	contents := make(map[string][]byte)
+	c.eachInline(func(metadata *FileMetadata) {
+		contents[metadata.InlineHash] = metadata.Inline
+	})
+
+	path := c.inlineStorePath()
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create inline store: %v", err)
+	}
+	if err := json.NewEncoder(file).Encode(contents); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to encode inline store: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close inline store: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace inline store: %v", err)
+	}
+
+	c.inlineChanged = false
+	return nil
+}
+
+// loadInlineStore restores the contents of the inline files in the loaded
+// metadata. The caller must hold c.mu.
+func (c *Controller) loadInlineStore() error {
+	raw, err := os.ReadFile(c.inlineStorePath())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open inline store: %v", err)
+	}
+	contents := make(map[string][]byte)
+	if err == nil {
+		if err := json.Unmarshal(raw, &contents); err != nil {
+			return fmt.Errorf("failed to decode inline store: %v", err)
+		}
+	}
+
+	c.eachInline(func(metadata *FileMetadata) {
+		data, exists := contents[metadata.InlineHash]
+		if !exists {
+			log.Printf("Warning: contents of an inline file with hash %s are missing from the inline store", metadata.InlineHash)
+			return
+		}
+		metadata.Inline = data
+	})
+	return nil
+}
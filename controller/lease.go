@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeLease gives one client exclusive write access to a file until it expires
+type writeLease struct {
+	Holder    string
+	Operation string // "create", "overwrite" or "append"
+	Expires   time.Time
+	Append    *appendSession // Uncommitted append, if any
+	Pending   *FileMetadata  // New version written by an overwrite, swapped in on release
+	Streaming bool           // Chunks are allocated as data arrives and the size is set on release
+}
+
+// checkLease returns an error if another writer holds an unexpired lease on the
+// file. An expired lease is recovered first. The caller must hold c.mu.
+func (c *Controller) checkLease(filename, clientID string) error {
+	lease, exists := c.leases[filename]
+	if !exists {
+		return nil
+	}
+	if time.Now().After(lease.Expires) {
+		c.recoverLease(filename)
+		return nil
+	}
+	if lease.Holder != clientID {
+		return &common.LeaseConflictError{Filename: filename, Holder: lease.Holder}
+	}
+	return nil
+}
+
+// grantLease gives a client the write lease on a file, or renews the lease it
+// already holds. The caller must hold c.mu and have called checkLease.
+func (c *Controller) grantLease(filename, clientID, operation string) *writeLease {
+	lease, exists := c.leases[filename]
+	if !exists {
+		lease = &writeLease{Holder: clientID, Operation: operation}
+		c.leases[filename] = lease
+	}
+	lease.Expires = time.Now().Add(common.LeaseTimeout * time.Second)
+	return lease
+}
+
+// validateWriter checks that a write which only completes when its writer
+// releases the lease names the writer. New plain files stored without a client
+// ID are complete once placed and get no lease.
+func validateWriter(request *dfs.StorageRequest, replacing bool) error {
+	if request.ClientId != "" {
+		return nil
+	}
+	switch {
+	case replacing:
+		return &common.ValidationError{Field: "client_id", Message: "required to overwrite a file"}
+	case request.Streaming:
+		return &common.ValidationError{Field: "client_id", Message: "required to stream a file"}
+	case len(request.ChunkHashes) > 0:
+		return &common.ValidationError{Field: "client_id", Message: "required to store a deduplicated file"}
+	}
+	return nil
+}
+
+// recoverLease closes out a file whose writer gave up, died or was revoked: an
+// uncommitted append is discarded, leaving the file at its last committed size,
+// and a file that was never completed is closed at its last consistent length.
+// The caller must hold c.mu.
+func (c *Controller) recoverLease(filename string) {
+	lease, exists := c.leases[filename]
+	if !exists {
+		return
+	}
+	delete(c.leases, filename)
+
+	// The new version of an overwrite never became visible
+	if lease.Pending != nil {
+		c.releaseChunks(filename, lease.Pending)
+	}
+
+	metadata, exists := c.files[filename]
+	if !exists {
+		return
+	}
+	if lease.Append != nil {
+		c.discardAppend(filename, metadata, lease.Append)
+	}
+	if lease.Operation == "create" {
+		c.finalizeFile(filename, metadata, lease.Streaming)
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+	}
+
+	log.Printf("Recovered %s lease of %s on %s", lease.Operation, lease.Holder, filename)
+}
+
+// confirmedReplicas returns the live nodes that reported holding a chunk. The
+// caller must hold c.mu.
+func (c *Controller) confirmedReplicas(blockName string, chunkNum int, nodes []string) []string {
+	var confirmed []string
+	for _, nodeID := range nodes {
+		if node, exists := c.nodes[nodeID]; exists && slices.Contains(node.ReplicatedChunks[blockName], chunkNum) {
+			confirmed = append(confirmed, nodeID)
+		}
+	}
+	return confirmed
+}
+
+// finalizeFile closes a new file whose writer is gone at its last consistent
+// length: the chunks from the start of the file that storage nodes confirmed
+// holding. The last chunk of a stream may be partial, so it is only kept once
+// the size is known. Chunks past that are deleted, and a file with none left,
+// or whose chunks are striped or shared with other files, is removed. The
+// caller must hold c.mu.
+func (c *Controller) finalizeFile(filename string, metadata *FileMetadata, streaming bool) {
+	blockName := metadata.blockName(filename)
+	kept := 0
+	if !metadata.isErasureCoded() && !metadata.isDeduplicated() && !metadata.isPacked() && !metadata.isInline() {
+		complete := len(metadata.Chunks)
+		if streaming && complete > 0 {
+			complete--
+		}
+		for ; kept < complete; kept++ {
+			if len(c.confirmedReplicas(blockName, kept, metadata.Chunks[kept])) == 0 {
+				break
+			}
+		}
+	}
+	if kept == 0 {
+		delete(c.files, filename)
+		c.releaseChunks(filename, metadata)
+		log.Printf("Removed %s, none of it was stored", filename)
+		return
+	}
+
+	unconfirmed := make(map[int][]string)
+	for chunkNum, nodes := range metadata.Chunks {
+		if chunkNum >= kept {
+			unconfirmed[chunkNum] = nodes
+			delete(metadata.Chunks, chunkNum)
+		} else {
+			metadata.Chunks[chunkNum] = c.confirmedReplicas(blockName, chunkNum, nodes)
+		}
+	}
+	go c.deleteChunks(blockName, unconfirmed)
+
+	switch fullChunks := int64(kept) * int64(metadata.ChunkSize); {
+	case metadata.isContentDefined():
+		if kept < len(metadata.ChunkOffsets) {
+			metadata.Size = metadata.ChunkOffsets[kept]
+		}
+		metadata.ChunkOffsets = metadata.ChunkOffsets[:kept]
+	case streaming || fullChunks < metadata.Size:
+		metadata.Size = fullChunks
+	}
+	log.Printf("Closed %s at %d bytes in %d chunks", filename, metadata.Size, kept)
+}
+
+// releaseLease completes the write of a writer that is done: a pending overwrite
+// becomes visible, and anything it did not commit is dropped. The caller must
+// hold c.mu.
+func (c *Controller) releaseLease(filename string, lease *writeLease) {
+	if metadata, exists := c.files[filename]; exists && lease.Append != nil {
+		c.discardAppend(filename, metadata, lease.Append)
+	}
+	if lease.Pending != nil {
+		c.commitShared(lease.Pending)
+		c.commitOverwrite(filename, lease.Pending)
+	} else if metadata, exists := c.files[filename]; exists {
+		c.commitShared(metadata)
+	}
+	delete(c.leases, filename)
+}
+
+// expireLeases periodically recovers leases whose writers stopped renewing them
+func (c *Controller) expireLeases() {
+	ticker := time.NewTicker(5 * time.Second)
+	for range ticker.C {
+		c.mu.Lock()
+		// Recovery changes metadata, which waits until safe mode is left
+		if !c.safeMode {
+			now := time.Now()
+			for filename, lease := range c.leases {
+				if now.After(lease.Expires) {
+					log.Printf("Lease of %s on %s expired", lease.Holder, filename)
+					c.recoverLease(filename)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// handleLeaseRequest renews, releases or aborts a writer's lease, or lists and
+// revokes leases on behalf of an admin
+func (c *Controller) handleLeaseRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.LeaseRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lease request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response := &dfs.LeaseResponse{
+		Success: true,
+	}
+
+	lease, exists := c.leases[request.Filename]
+	switch request.Action {
+	case "renew", "release", "abort":
+		if !exists {
+			err := &common.ValidationError{Field: "filename", Message: fmt.Sprintf("no lease held on %s", request.Filename)}
+			return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+		}
+		if lease.Holder != request.ClientId {
+			err := &common.LeaseConflictError{Filename: request.Filename, Holder: lease.Holder}
+			return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+		}
+		switch request.Action {
+		case "renew":
+			lease.Expires = time.Now().Add(common.LeaseTimeout * time.Second)
+		case "release":
+			if err := c.checkWritable("release lease"); err != nil {
+				return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+			}
+			if lease.Streaming {
+				if err := c.finishStream(request.Filename, lease, request.FileSize); err != nil {
+					return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+				}
+			}
+			c.releaseLease(request.Filename, lease)
+		case "abort":
+			if err := c.checkWritable("abort write"); err != nil {
+				return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+			}
+			c.recoverLease(request.Filename)
+		}
+
+	case "revoke":
+		if err := c.checkWritable("revoke lease"); err != nil {
+			return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+		}
+		if err := c.checkSuperuser(identify(peer, request.User, request.Groups), request.Filename); err != nil {
+			return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+		}
+		if !exists {
+			err := &common.ValidationError{Field: "filename", Message: fmt.Sprintf("no lease held on %s", request.Filename)}
+			return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+		}
+		c.recoverLease(request.Filename)
+
+	case "list":
+		if err := c.checkSuperuser(identify(peer, request.User, request.Groups), "/"); err != nil {
+			return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+		}
+		now := time.Now()
+		for filename, lease := range c.leases {
+			response.Leases = append(response.Leases, &dfs.LeaseInfo{
+				Filename:         filename,
+				Holder:           lease.Holder,
+				Operation:        lease.Operation,
+				ExpiresInSeconds: int64(lease.Expires.Sub(now) / time.Second),
+			})
+		}
+		sort.Slice(response.Leases, func(i, j int) bool {
+			return response.Leases[i].Filename < response.Leases[j].Filename
+		})
+
+	default:
+		err := &common.ValidationError{Field: "action", Message: fmt.Sprintf("unknown lease action %q", request.Action)}
+		return marshalErrorResponse(&dfs.LeaseResponse{Error: err.Error()}, err)
+	}
+
+	// Leases are saved with the metadata, so a finished write is not recovered after a restart
+	if request.Action != "renew" && request.Action != "list" {
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
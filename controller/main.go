@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,9 +16,32 @@ import (
 
 // FileMetadata stores information about a file in the system
 type FileMetadata struct {
-	Size      int64
-	ChunkSize int
-	Chunks    map[int][]string // Map of chunk number to list of storage nodes
+	Size              int64
+	ChunkSize         int
+	ReplicationFactor int              // Desired replicas per chunk, 0 uses the cluster default
+	DataShards        int              // Reed-Solomon data shards per stripe, if erasure coded
+	ParityShards      int              // Reed-Solomon parity shards per stripe, 0 if replicated
+	BlockName         string           // Name the chunks are stored under, empty uses the filename
+	CreatedAt         time.Time
+	LastAccessed      time.Time
+	Generation        uint64 // Starts at 1, bumped by every committed append or overwrite
+	AppendStamp       uint64 // Bumped by every granted append, fences out writers whose lease was taken over
+	ArchivedAt        time.Time // When a previous version was replaced or deleted
+	TrashedFrom       string    // Original name of a file in the trash
+	TrashedAt         time.Time // When the file was moved to the trash
+	Owner             string    // User who created the file, charged against user quotas
+	Group             string    // Group granted the group permission bits
+	Mode              uint32    // Permission bits, as in chmod
+	Cipher            string    // Algorithm of client-side encryption, empty if stored in plaintext
+	WrappedKey        []byte    // File key wrapped with the owner's key, never readable by the cluster
+	Compression       string    // Codec storage nodes compress the chunks with, empty stores them raw
+	ChunkHashes       []string  // Content hash of each chunk of a deduplicated file, nil otherwise
+	ChunkOffsets      []int64   // Start of each content-defined chunk, nil for fixed-size chunks
+	Container         string    // Block name of the container chunk a packed file is stored in, empty otherwise
+	ContainerOffset   int64     // Start of a packed file within its container
+	Inline            []byte    `json:"-"` // Contents of a tiny file stored in the metadata, nil otherwise
+	InlineHash        string    // Content hash of an inline file, its key in the inline store
+	Chunks            map[int][]string // Map of chunk number to list of storage nodes
 }
 
 // NodeInfo stores information about a storage node
@@ -24,8 +50,12 @@ type NodeInfo struct {
 	Address          string
 	FreeSpace        uint64
 	RequestsHandled  uint64
+	RequestRate      float64 // Requests per second over the last heartbeat interval
 	LastHeartbeat    time.Time
 	ReplicatedChunks map[string][]int // Map of filename to chunk numbers
+	StoredSizes      map[string]int64 // On-disk bytes of each reported chunk, by chunk key
+	LogicalBytes     uint64           // Bytes of chunk data held, before compression
+	StoredBytes      uint64           // Bytes of chunk data on disk, after compression
 }
 
 // Controller manages the distributed file system metadata and coordinates storage nodes
@@ -42,9 +72,70 @@ type Controller struct {
 	// Configuration
 	replicationFactor int
 	heartbeatTimeout  time.Duration
+	metadataPath      string // Empty disables metadata persistence
+
+	// Safe mode: the controller is read-only until enough known chunks are reported
+	safeMode          bool
+	safeModeManual    bool            // Entered by an admin, only left by an admin
+	safeModeThreshold float64         // Fraction of known chunks required to leave
+	reportedChunks    map[string]bool // Chunks reported by registered nodes while in safe mode
+	blockReports      map[string]bool // Nodes that sent a full chunk report while in safe mode
+
+	// Chunks with a re-replication in flight
+	replicating map[string]bool
+
+	// Background transcoding of cold replicated files to erasure coding
+	transcodeAfter        time.Duration // Age at which a file is cold, 0 disables transcoding
+	transcodeByAccess     bool          // Measure age from the last access instead of creation
+	transcodeDataShards   int
+	transcodeParityShards int
+	transcodeTasks        map[string]*transcodeTask
+
+	// Write leases, at most one writer per file
+	leases       map[string]*writeLease
+	nextAppendID uint64
+
+	// Previous versions of overwritten and deleted files, oldest first
+	versions      map[string][]*FileMetadata
+	maxVersions   int           // Previous versions kept per file, 0 disables versioning
+	versionMaxAge time.Duration // Age at which previous versions expire, 0 never expires them
+
+	// Deleted files stay in their owner's trash this long before they are removed, 0 disables the trash
+	trashInterval time.Duration
+
+	// Point-in-time copies of the namespace, by name
+	snapshots map[string]*snapshot
+
+	// Space and namespace quotas, by directory and by owner
+	dirQuotas  map[string]*quota
+	userQuotas map[string]*quota
+
+	// Ownership and permission checks
+	permissions bool                // Enforce permission bits, false lets everyone do everything
+	superusers  map[string]bool     // Users that bypass permission checks
+	dirs        map[string]*dirInfo // Directories that were chmod'ed or chown'ed, by path
+
+	// Mutual TLS for every connection, nil for plain TCP
+	transport *common.Transport
+
+	// Block tokens let storage nodes check that the controller granted a chunk access
+	blockTokenSecret   []byte // Shared with storage nodes at registration, nil disables block tokens
+	blockTokenLifetime time.Duration
+
+	// Chunks of deduplicated files, stored once and shared, by content hash
+	contentChunks map[string]*contentChunk
+
+	// Container chunks small files are packed into, by block name
+	containers    map[string]*container
+	packThreshold int64 // Files up to this size are packed into containers, 0 disables packing
+
+	// Files up to this size are stored in their metadata, 0 disables inline storage
+	inlineThreshold int64
+	inlineChanged   bool // Inline files were stored or released since the inline store was saved
 
 	// Listener for incoming connections
 	listener net.Listener
+	ready    chan struct{} // Closed once the listener is up
 
 	// Port number
 	port int
@@ -54,23 +145,55 @@ func NewController(listenPort int) *Controller {
 	return &Controller{
 		nodes:             make(map[string]*NodeInfo),
 		files:             make(map[string]*FileMetadata),
+		replicating:       make(map[string]bool),
+		transcodeTasks:    make(map[string]*transcodeTask),
+		leases:            make(map[string]*writeLease),
+		versions:          make(map[string][]*FileMetadata),
+		snapshots:         make(map[string]*snapshot),
+		dirQuotas:         make(map[string]*quota),
+		userQuotas:        make(map[string]*quota),
+		superusers:        make(map[string]bool),
+		dirs:              make(map[string]*dirInfo),
+		contentChunks:     make(map[string]*contentChunk),
+		containers:        make(map[string]*container),
+		ready:             make(chan struct{}),
 		replicationFactor: common.DefaultReplication,
 		heartbeatTimeout:  common.HeartbeatTimeout * time.Second,
+		blockTokenLifetime: common.BlockTokenLifetime * time.Second,
+		safeModeThreshold: common.DefaultSafeModeThreshold,
 		port:             listenPort,
 	}
 }
 
 func (c *Controller) Start() error {
+	// Load metadata saved by a previous run
+	if err := c.loadMetadata(); err != nil {
+		return fmt.Errorf("failed to load metadata: %v", err)
+	}
+
+	// Stay read-only until storage nodes have reported the known chunks
+	c.mu.Lock()
+	c.safeMode = true
+	c.reportedChunks = make(map[string]bool)
+	c.blockReports = make(map[string]bool)
+	c.checkSafeMode()
+	c.mu.Unlock()
+
 	// Start listening for connections
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", c.port))
+	listener, err := c.transport.Listen(fmt.Sprintf(":%d", c.port))
 	if err != nil {
 		return fmt.Errorf("failed to start listener: %v", err)
 	}
 	c.listener = listener
+	close(c.ready)
 
 	// Start background tasks
 	go c.checkNodeHealth()
 	go c.maintainReplication()
+	go c.transcodeColdFiles()
+	go c.expireLeases()
+	go c.expireVersions()
+	go c.purgeTrash()
 
 	log.Printf("Controller started on port %d", c.port)
 
@@ -88,6 +211,12 @@ func (c *Controller) Start() error {
 func (c *Controller) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	// A client that authenticated with a certificate acts as the user it names
+	var peer *caller
+	if user, groups, ok := common.PeerUser(conn); ok {
+		peer = &caller{user: user, groups: groups}
+	}
+
 	for {
 		// Read message type and data
 		msgType, data, err := common.ReadMessage(conn)
@@ -98,21 +227,67 @@ func (c *Controller) handleConnection(conn net.Conn) {
 
 		var response []byte
 		var respErr error
+		respType := msgType
 
 		// Handle different message types
 		switch msgType {
 		case common.MsgTypeHeartbeat:
-			respErr = c.handleHeartbeat(data)
+			response, respErr = c.handleHeartbeat(data, common.PeerIdentities(conn))
+			respType = common.MsgTypeHeartbeatResponse
 		case common.MsgTypeStorageRequest:
-			response, respErr = c.handleStorageRequest(data)
+			response, respErr = c.handleStorageRequest(data, peer)
+			respType = common.MsgTypeStorageResponse
 		case common.MsgTypeRetrievalRequest:
-			response, respErr = c.handleRetrievalRequest(data)
+			response, respErr = c.handleRetrievalRequest(data, peer)
+			respType = common.MsgTypeRetrievalResponse
 		case common.MsgTypeDeleteRequest:
-			response, respErr = c.handleDeleteRequest(data)
+			response, respErr = c.handleDeleteRequest(data, peer)
+			respType = common.MsgTypeDeleteResponse
 		case common.MsgTypeListRequest:
-			response, respErr = c.handleListRequest(data)
+			response, respErr = c.handleListRequest(data, peer)
+			respType = common.MsgTypeListResponse
 		case common.MsgTypeNodeStatusRequest:
 			response, respErr = c.handleNodeStatusRequest(data)
+			respType = common.MsgTypeNodeStatusResponse
+		case common.MsgTypeSafeModeRequest:
+			response, respErr = c.handleSafeModeRequest(data, peer)
+			respType = common.MsgTypeSafeModeResponse
+		case common.MsgTypeSetReplicationRequest:
+			response, respErr = c.handleSetReplicationRequest(data, peer)
+			respType = common.MsgTypeSetReplicationResponse
+		case common.MsgTypeTranscodeStatusRequest:
+			response, respErr = c.handleTranscodeStatusRequest(data)
+			respType = common.MsgTypeTranscodeStatusResponse
+		case common.MsgTypeAppendRequest:
+			response, respErr = c.handleAppendRequest(data, peer)
+			respType = common.MsgTypeAppendResponse
+		case common.MsgTypeAppendCommitRequest:
+			response, respErr = c.handleAppendCommitRequest(data)
+			respType = common.MsgTypeAppendCommitResponse
+		case common.MsgTypeLeaseRequest:
+			response, respErr = c.handleLeaseRequest(data, peer)
+			respType = common.MsgTypeLeaseResponse
+		case common.MsgTypeVersionsRequest:
+			response, respErr = c.handleVersionsRequest(data, peer)
+			respType = common.MsgTypeVersionsResponse
+		case common.MsgTypeTrashRequest:
+			response, respErr = c.handleTrashRequest(data, peer)
+			respType = common.MsgTypeTrashResponse
+		case common.MsgTypeSnapshotRequest:
+			response, respErr = c.handleSnapshotRequest(data, peer)
+			respType = common.MsgTypeSnapshotResponse
+		case common.MsgTypeQuotaRequest:
+			response, respErr = c.handleQuotaRequest(data, peer)
+			respType = common.MsgTypeQuotaResponse
+		case common.MsgTypePermissionRequest:
+			response, respErr = c.handlePermissionRequest(data, peer)
+			respType = common.MsgTypePermissionResponse
+		case common.MsgTypeChunkAllocationRequest:
+			response, respErr = c.handleChunkAllocationRequest(data)
+			respType = common.MsgTypeChunkAllocationResponse
+		case common.MsgTypeReplicaReportRequest:
+			response, respErr = c.handleReplicaReport(data)
+			respType = common.MsgTypeReplicaReportResponse
 		default:
 			respErr = fmt.Errorf("unknown message type: %d", msgType)
 		}
@@ -121,7 +296,7 @@ func (c *Controller) handleConnection(conn net.Conn) {
 			log.Printf("Error handling message type %d: %v", msgType, respErr)
 			// Send error response if applicable
 			if response != nil {
-				if err := common.WriteMessage(conn, msgType, response); err != nil {
+				if err := common.WriteMessage(conn, respType, response); err != nil {
 					log.Printf("Error sending error response: %v", err)
 				}
 			}
@@ -130,7 +305,7 @@ func (c *Controller) handleConnection(conn net.Conn) {
 
 		// Send response if one was generated
 		if response != nil {
-			if err := common.WriteMessage(conn, msgType, response); err != nil {
+			if err := common.WriteMessage(conn, respType, response); err != nil {
 				log.Printf("Error sending response: %v", err)
 				return
 			}
@@ -158,6 +333,11 @@ func (c *Controller) handleNodeFailure(nodeID string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	// Missing replicas are expected while nodes are still reporting in
+	if c.safeMode {
+		return
+	}
+
 	// Find all chunks that were stored on the failed node
 	affectedChunks := make(map[string][]int) // filename -> chunk numbers
 	for filename, metadata := range c.files {
@@ -171,10 +351,31 @@ func (c *Controller) handleNodeFailure(nodeID string) {
 		}
 	}
 
-	// Trigger re-replication for affected chunks
+	// Trigger re-replication or fragment repair for affected chunks
 	for filename, chunks := range affectedChunks {
+		erasureCoded := c.files[filename].isErasureCoded()
 		for _, chunkNum := range chunks {
-			go c.replicateChunk(filename, chunkNum)
+			if erasureCoded {
+				go c.repairFragment(filename, chunkNum)
+			} else {
+				go c.replicateChunk(filename, chunkNum)
+			}
+		}
+	}
+	for hash, entry := range c.contentChunks {
+		for _, node := range entry.Nodes {
+			if node == nodeID {
+				go c.replicateContent(hash)
+				break
+			}
+		}
+	}
+	for blockName, packed := range c.containers {
+		for _, node := range packed.Nodes {
+			if node == nodeID {
+				go c.replicateContainer(blockName)
+				break
+			}
 		}
 	}
 }
@@ -183,28 +384,267 @@ func (c *Controller) maintainReplication() {
 	ticker := time.NewTicker(1 * time.Minute)
 	for range ticker.C {
 		c.mu.RLock()
+		if c.safeMode {
+			c.mu.RUnlock()
+			continue
+		}
 		// Check replication level of all chunks
 		for filename, metadata := range c.files {
+			// Erasure-coded fragments are stored once and rebuilt rather than copied
+			if metadata.isErasureCoded() {
+				for fragment, nodes := range metadata.Chunks {
+					if len(c.liveReplicas(nodes)) == 0 {
+						go c.repairFragment(filename, fragment)
+					}
+				}
+				continue
+			}
+
+			desired := c.replicationFor(metadata)
 			for chunkNum, nodes := range metadata.Chunks {
-				if len(nodes) < c.replicationFactor {
+				live := len(c.liveReplicas(nodes))
+				if live < desired {
 					go c.replicateChunk(filename, chunkNum)
+				} else if live > desired {
+					go c.trimChunk(filename, chunkNum)
 				}
 			}
 		}
+		for hash, entry := range c.contentChunks {
+			if len(c.liveReplicas(entry.Nodes)) < entry.Replication {
+				go c.replicateContent(hash)
+			}
+		}
+		for blockName, packed := range c.containers {
+			if len(c.liveReplicas(packed.Nodes)) < packed.Replication {
+				go c.replicateContainer(blockName)
+			} else if packed.needsCompaction() {
+				go c.compactContainer(blockName)
+			}
+		}
 		c.mu.RUnlock()
 	}
 }
 
+// replicationFor returns the desired number of replicas for a file
+func (c *Controller) replicationFor(metadata *FileMetadata) int {
+	if metadata.isErasureCoded() {
+		return 1
+	}
+	if metadata.ReplicationFactor > 0 {
+		return metadata.ReplicationFactor
+	}
+	return c.replicationFactor
+}
+
+// liveReplicas returns the nodes in the list that are still active.
+// The caller must hold c.mu.
+func (c *Controller) liveReplicas(nodes []string) []string {
+	live := make([]string, 0, len(nodes))
+	for _, nodeID := range nodes {
+		if _, exists := c.nodes[nodeID]; exists {
+			live = append(live, nodeID)
+		}
+	}
+	return live
+}
+
+// replicateChunk copies a chunk from a live replica to new nodes until it
+// reaches the file's replication factor
 func (c *Controller) replicateChunk(filename string, chunkNum int) {
-	// Implementation will be added for chunk replication
-	// This will coordinate with storage nodes to create new replicas
+	key := chunkKey(filename, chunkNum)
+
+	c.mu.Lock()
+	metadata, exists := c.files[filename]
+	if !exists || c.safeMode || c.replicating[key] {
+		c.mu.Unlock()
+		return
+	}
+
+	live := c.liveReplicas(metadata.Chunks[chunkNum])
+	missing := c.replicationFor(metadata) - len(live)
+	if missing <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	if len(live) == 0 {
+		c.mu.Unlock()
+		log.Printf("Chunk %s has no live replicas left", key)
+		return
+	}
+
+	targets := c.selectStorageNodes(metadata.ChunkSize, missing, metadata.Chunks[chunkNum])
+	if len(targets) == 0 {
+		c.mu.Unlock()
+		log.Printf("No storage nodes available to re-replicate chunk %s", key)
+		return
+	}
+	blockName := metadata.blockName(filename)
+	c.replicating[key] = true
+	c.mu.Unlock()
+
+	// Have an existing replica push the chunk to the new nodes
+	err := c.sendChunkReplicate(live[0], blockName, chunkNum, targets)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.replicating, key)
+
+	if err != nil {
+		log.Printf("Failed to replicate chunk %s from %s: %v", key, live[0], err)
+		return
+	}
+
+	// The file may have been deleted or transcoded while the copy was in flight
+	metadata, exists = c.files[filename]
+	if !exists || metadata.blockName(filename) != blockName {
+		return
+	}
+	metadata.Chunks[chunkNum] = append(c.liveReplicas(metadata.Chunks[chunkNum]), targets...)
+	log.Printf("Replicated chunk %s to %v", key, targets)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+}
+
+// trimChunk removes surplus replicas of a chunk, e.g. after its file's
+// replication factor was lowered
+func (c *Controller) trimChunk(filename string, chunkNum int) {
+	key := chunkKey(filename, chunkNum)
+
+	c.mu.Lock()
+	metadata, exists := c.files[filename]
+	if !exists || c.safeMode || c.replicating[key] {
+		c.mu.Unlock()
+		return
+	}
+
+	live := c.liveReplicas(metadata.Chunks[chunkNum])
+	surplus := len(live) - c.replicationFor(metadata)
+	if surplus <= 0 {
+		c.mu.Unlock()
+		return
+	}
+
+	// Free space on the fullest nodes first
+	sort.Slice(live, func(i, j int) bool {
+		return c.nodes[live[i]].FreeSpace < c.nodes[live[j]].FreeSpace
+	})
+	removed := live[:surplus]
+	blockName := metadata.blockName(filename)
+
+	// Stop handing out the removed replicas before deleting them
+	metadata.Chunks[chunkNum] = live[surplus:]
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+	c.mu.Unlock()
+
+	for _, nodeID := range removed {
+		if err := c.sendChunkDelete(nodeID, blockName, chunkNum); err != nil {
+			log.Printf("Failed to delete surplus replica of chunk %s on %s: %v", key, nodeID, err)
+		}
+	}
+}
+
+// adjustReplication brings every chunk of a file to its replication factor
+func (c *Controller) adjustReplication(filename string) {
+	c.mu.RLock()
+	metadata, exists := c.files[filename]
+	if !exists {
+		c.mu.RUnlock()
+		return
+	}
+	chunkNums := make([]int, 0, len(metadata.Chunks))
+	for chunkNum := range metadata.Chunks {
+		chunkNums = append(chunkNums, chunkNum)
+	}
+	c.mu.RUnlock()
+
+	for _, chunkNum := range chunkNums {
+		c.replicateChunk(filename, chunkNum)
+		c.trimChunk(filename, chunkNum)
+	}
 }
 
 func main() {
 	listenPort := flag.Int("port", 8000, "Port to listen on")
+	metadataPath := flag.String("metadata", "", "Path to persist file metadata (optional)")
+	safeModeThreshold := flag.Float64("safemode-threshold", common.DefaultSafeModeThreshold,
+		"Fraction of known chunks that must be reported before leaving safe mode")
+	transcodeAfter := flag.Duration("transcode-after", 0,
+		"Transcode replicated files to erasure coding once they are this old, e.g. 720h (0 disables)")
+	transcodePolicy := flag.String("transcode-policy", "age", "Measure file age from creation (age) or last access (access)")
+	transcodeEC := flag.String("transcode-ec", "6+3", "Erasure coding scheme for transcoded files, as data+parity")
+	maxVersions := flag.Int("versions", 0, "Previous versions kept per overwritten or deleted file (0 disables versioning)")
+	versionMaxAge := flag.Duration("version-max-age", 0, "Expire previous versions once they are this old, e.g. 168h (0 keeps them)")
+	trashInterval := flag.Duration("trash-interval", 0, "Keep deleted files in the trash this long before removing them, e.g. 24h (0 disables the trash)")
+	packThreshold := flag.Int64("pack-threshold", 0, "Pack files up to this many bytes into shared container chunks (0 disables packing)")
+	inlineThreshold := flag.Int64("inline-threshold", 0, fmt.Sprintf("Store files up to this many bytes, at most %d, in the controller's metadata; needs -metadata (0 disables inline storage)", common.MaxInlineSize))
+	permissions := flag.Bool("permissions", false, "Enforce file and directory permissions; without -cert, -key and -ca callers assert their own identity, so checks are advisory")
+	superusers := flag.String("superusers", "", "Comma-separated users that bypass permission checks and may run admin actions")
+	certFile := flag.String("cert", "", "TLS certificate; with -key and -ca enables mutual TLS")
+	keyFile := flag.String("key", "", "TLS private key")
+	caFile := flag.String("ca", "", "CA certificate that signs every client and storage node certificate")
+	blockTokens := flag.Bool("block-tokens", false, "Require signed block tokens for chunk reads, writes and deletes on storage nodes; needs -cert, -key and -ca")
+	blockTokenLifetime := flag.Duration("block-token-lifetime", common.BlockTokenLifetime*time.Second, "How long issued block tokens stay valid")
 	flag.Parse()
 
 	controller := NewController(*listenPort)
+	controller.metadataPath = *metadataPath
+	controller.safeModeThreshold = *safeModeThreshold
+	controller.transcodeAfter = *transcodeAfter
+	controller.maxVersions = *maxVersions
+	controller.versionMaxAge = *versionMaxAge
+	controller.trashInterval = *trashInterval
+	controller.packThreshold = *packThreshold
+	if *inlineThreshold > common.MaxInlineSize {
+		log.Fatalf("Invalid inline threshold %d, must be at most %d", *inlineThreshold, common.MaxInlineSize)
+	}
+	// Inline files exist nowhere but in the metadata
+	if *inlineThreshold > 0 && *metadataPath == "" {
+		log.Fatalf("Inline storage needs -metadata, or inline files are lost on restart")
+	}
+	controller.inlineThreshold = *inlineThreshold
+	controller.permissions = *permissions
+	for _, user := range strings.Split(*superusers, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			controller.superusers[user] = true
+		}
+	}
+	switch *transcodePolicy {
+	case "age":
+	case "access":
+		controller.transcodeByAccess = true
+	default:
+		log.Fatalf("Invalid transcode policy %q, expected age or access", *transcodePolicy)
+	}
+	if _, err := fmt.Sscanf(*transcodeEC, "%d+%d", &controller.transcodeDataShards, &controller.transcodeParityShards); err != nil {
+		log.Fatalf("Invalid transcode erasure coding scheme %q, expected data+parity", *transcodeEC)
+	}
+	if _, err := common.NewReedSolomon(controller.transcodeDataShards, controller.transcodeParityShards); err != nil {
+		log.Fatalf("Invalid transcode erasure coding scheme %q: %v", *transcodeEC, err)
+	}
+	transport, err := common.NewTransport(*certFile, *keyFile, *caFile)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	controller.transport = transport
+	if *permissions && *certFile == "" {
+		log.Printf("Warning: permissions are advisory without TLS; clients assert their own identity")
+	}
+	controller.blockTokenLifetime = *blockTokenLifetime
+	if *blockTokens {
+		// The secret goes out with heartbeat responses, so only authenticated nodes may get it
+		if *certFile == "" {
+			log.Fatalf("Block tokens need mutual TLS: set -cert, -key and -ca")
+		}
+		controller.blockTokenSecret = make([]byte, 32)
+		if _, err := rand.Read(controller.blockTokenSecret); err != nil {
+			log.Fatalf("Failed to generate block token secret: %v", err)
+		}
+	}
 	if err := controller.Start(); err != nil {
 		log.Fatalf("Controller failed to start: %v", err)
 	}
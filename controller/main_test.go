@@ -1,7 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -16,6 +30,7 @@ type mockStorageNode struct {
 	id        string
 	freeSpace uint64
 	requests  uint64
+	chunks    []*pb.StoredChunk
 }
 
 func (m *mockStorageNode) sendHeartbeat(conn net.Conn) error {
@@ -23,6 +38,8 @@ func (m *mockStorageNode) sendHeartbeat(conn net.Conn) error {
 		NodeId:           m.id,
 		FreeSpace:       m.freeSpace,
 		RequestsProcessed: m.requests,
+		Chunks:           m.chunks,
+		FullReport:       m.chunks != nil,
 	}
 	data, err := proto.Marshal(heartbeat)
 	if err != nil {
@@ -31,6 +48,41 @@ func (m *mockStorageNode) sendHeartbeat(conn net.Conn) error {
 	return common.WriteMessage(conn, common.MsgTypeHeartbeat, data)
 }
 
+// startController starts the controller and returns its address once it is
+// listening
+func startController(t *testing.T, controller *Controller) string {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- controller.Start()
+	}()
+	select {
+	case <-controller.ready:
+	case err := <-errCh:
+		t.Fatalf("Controller failed to start: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Controller did not start listening")
+	}
+	return controller.listener.Addr().String()
+}
+
+// waitFor polls until condition holds, failing the test after a few seconds
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// nodeCount returns the number of registered storage nodes
+func nodeCount(controller *Controller) int {
+	controller.mu.RLock()
+	defer controller.mu.RUnlock()
+	return len(controller.nodes)
+}
+
 func TestControllerStartup(t *testing.T) {
 	controller := NewController(0) // Use port 0 for random available port
 	
@@ -306,4 +358,2378 @@ func TestReplicationMaintenance(t *testing.T) {
 
 	// Clean up
 	controller.listener.Close()
-}
\ No newline at end of file
+}
+
+func TestSafeModeStartup(t *testing.T) {
+	// Create temporary directory for metadata
+	tmpDir, err := os.MkdirTemp("", "controller_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Persist metadata as a previous controller run would have
+	previous := NewController(0)
+	previous.metadataPath = filepath.Join(tmpDir, "metadata.json")
+	previous.files["test.txt"] = &FileMetadata{
+		Size:      128,
+		ChunkSize: 64,
+		Chunks: map[int][]string{
+			0: {"node-1"},
+			1: {"node-1"},
+		},
+	}
+	if err := previous.saveMetadata(); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+
+	// Restart the controller from the saved metadata
+	controller := NewController(0)
+	controller.metadataPath = previous.metadataPath
+	go controller.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	addr := controller.listener.Addr().String()
+
+	// Storage requests are rejected while in safe mode
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	data, err := proto.Marshal(&pb.StorageRequest{Filename: "new.txt", FileSize: 64, ChunkSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if err := common.WriteMessage(conn, common.MsgTypeStorageRequest, data); err != nil {
+		t.Fatalf("Failed to send storage request: %v", err)
+	}
+	_, respData, err := common.ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	storageResp := &pb.StorageResponse{}
+	if err := proto.Unmarshal(respData, storageResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if !strings.Contains(storageResp.Error, "safe mode") {
+		t.Errorf("Expected safe mode error, got %q", storageResp.Error)
+	}
+
+	// Report the known chunks from a storage node
+	node := &mockStorageNode{
+		id:        "node-1",
+		freeSpace: 1024 * 1024 * 1024,
+		chunks: []*pb.StoredChunk{
+			{Filename: "test.txt", ChunkNumber: 0},
+			{Filename: "test.txt", ChunkNumber: 1},
+		},
+	}
+	nodeConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect node: %v", err)
+	}
+	defer nodeConn.Close()
+	if err := node.sendHeartbeat(nodeConn); err != nil {
+		t.Fatalf("Failed to send heartbeat: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	controller.mu.RLock()
+	safeMode := controller.safeMode
+	controller.mu.RUnlock()
+	if safeMode {
+		t.Error("Controller did not leave safe mode after chunks were reported")
+	}
+
+	// Enter safe mode manually
+	adminConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to controller: %v", err)
+	}
+	defer adminConn.Close()
+
+	data, err = proto.Marshal(&pb.SafeModeRequest{Action: "enter"})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if err := common.WriteMessage(adminConn, common.MsgTypeSafeModeRequest, data); err != nil {
+		t.Fatalf("Failed to send safe mode request: %v", err)
+	}
+	msgType, respData, err := common.ReadMessage(adminConn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if msgType != common.MsgTypeSafeModeResponse {
+		t.Errorf("Unexpected response type: got %d, want %d", msgType, common.MsgTypeSafeModeResponse)
+	}
+	safeModeResp := &pb.SafeModeResponse{}
+	if err := proto.Unmarshal(respData, safeModeResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if !safeModeResp.SafeMode {
+		t.Error("Controller did not enter safe mode")
+	}
+
+	// Clean up
+	controller.listener.Close()
+}
+
+func TestBlockReports(t *testing.T) {
+	controller := NewController(0)
+	controller.safeMode = true
+	controller.reportedChunks = make(map[string]bool)
+	controller.blockReports = make(map[string]bool)
+	controller.files["test.txt"] = &FileMetadata{
+		Size:              200,
+		ChunkSize:         100,
+		ReplicationFactor: 1,
+		CreatedAt:         time.Now(),
+		Chunks:            map[int][]string{0: {"node-1"}, 1: {"node-1"}},
+	}
+	heartbeat := func(full bool, chunks ...*pb.StoredChunk) *pb.HeartbeatResponse {
+		data, _ := proto.Marshal(&pb.Heartbeat{NodeId: "node-1", FreeSpace: 1024 * 1024 * 1024, Chunks: chunks, FullReport: full})
+		respData, err := controller.handleHeartbeat(data, nil)
+		if err != nil {
+			t.Fatalf("Heartbeat failed: %v", err)
+		}
+		response := &pb.HeartbeatResponse{}
+		proto.Unmarshal(respData, response)
+		return response
+	}
+
+	// In safe mode, a node is asked for a full report until it sends one
+	if response := heartbeat(false); !response.BlockReportRequested {
+		t.Error("Full report not requested in safe mode")
+	}
+	if response := heartbeat(true, &pb.StoredChunk{Filename: "test.txt", ChunkNumber: 0}); response.BlockReportRequested {
+		t.Error("Full report requested again after the node sent one")
+	}
+
+	// Heartbeats between full reports leave the chunk list alone
+	heartbeat(false)
+	if chunks := controller.nodes["node-1"].ReplicatedChunks["test.txt"]; len(chunks) != 1 {
+		t.Errorf("Chunk list is %v after a heartbeat without a report, want [0]", chunks)
+	}
+
+	// An empty full report clears the node's chunks
+	heartbeat(true)
+	if chunks := controller.nodes["node-1"].ReplicatedChunks; len(chunks) != 0 {
+		t.Errorf("Chunk list is %v after an empty full report, want none", chunks)
+	}
+}
+
+func TestPerFileReplication(t *testing.T) {
+	controller := NewController(0)
+
+	// Start controller
+	addr := startController(t, controller)
+
+	// Register nodes
+	nodes := []*mockStorageNode{
+		{id: "node-1", freeSpace: 1024 * 1024 * 1024},
+		{id: "node-2", freeSpace: 2 * 1024 * 1024 * 1024},
+		{id: "node-3", freeSpace: 3 * 1024 * 1024 * 1024},
+	}
+	for _, node := range nodes {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect node %s: %v", node.id, err)
+		}
+		defer conn.Close()
+		if err := node.sendHeartbeat(conn); err != nil {
+			t.Fatalf("Failed to send heartbeat for node %s: %v", node.id, err)
+		}
+	}
+	waitFor(t, "nodes to register", func() bool { return nodeCount(controller) == 3 })
+
+	// Store a file with a replication factor of 2
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	data, err := proto.Marshal(&pb.StorageRequest{
+		Filename:          "scratch.txt",
+		FileSize:          128,
+		ChunkSize:         64,
+		ReplicationFactor: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if err := common.WriteMessage(conn, common.MsgTypeStorageRequest, data); err != nil {
+		t.Fatalf("Failed to send storage request: %v", err)
+	}
+	_, respData, err := common.ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	storageResp := &pb.StorageResponse{}
+	if err := proto.Unmarshal(respData, storageResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	for _, placement := range storageResp.ChunkPlacements {
+		if len(placement.StorageNodes) != 2 {
+			t.Errorf("Wrong number of replicas: got %d, want 2", len(placement.StorageNodes))
+		}
+	}
+
+	// Lower the replication factor of a fully replicated file
+	controller.mu.Lock()
+	controller.files["test.txt"] = &FileMetadata{
+		Size:      64,
+		ChunkSize: 64,
+		Chunks: map[int][]string{
+			0: {"node-1", "node-2", "node-3"},
+		},
+	}
+	controller.mu.Unlock()
+
+	setrepConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to controller: %v", err)
+	}
+	defer setrepConn.Close()
+
+	data, err = proto.Marshal(&pb.SetReplicationRequest{Filename: "test.txt", ReplicationFactor: 1})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if err := common.WriteMessage(setrepConn, common.MsgTypeSetReplicationRequest, data); err != nil {
+		t.Fatalf("Failed to send set replication request: %v", err)
+	}
+	msgType, respData, err := common.ReadMessage(setrepConn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if msgType != common.MsgTypeSetReplicationResponse {
+		t.Errorf("Unexpected response type: got %d, want %d", msgType, common.MsgTypeSetReplicationResponse)
+	}
+	setrepResp := &pb.SetReplicationResponse{}
+	if err := proto.Unmarshal(respData, setrepResp); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if !setrepResp.Success {
+		t.Fatalf("Set replication failed: %s", setrepResp.Error)
+	}
+
+	// Wait for surplus replicas to be trimmed
+	var replicas []string
+	waitFor(t, "surplus replicas to be trimmed", func() bool {
+		controller.mu.RLock()
+		defer controller.mu.RUnlock()
+		replicas = controller.files["test.txt"].Chunks[0]
+		return len(replicas) == 1
+	})
+	if len(replicas) == 1 && replicas[0] != "node-3" {
+		t.Errorf("Kept replica on %s, want the node with the most free space", replicas[0])
+	}
+
+	// Clean up
+	controller.listener.Close()
+}
+
+func TestErasureCodedPlacement(t *testing.T) {
+	controller := NewController(0)
+
+	// Start controller
+	addr := startController(t, controller)
+
+	// Register one node per fragment of an RS(6,3) stripe
+	for i := 1; i <= 9; i++ {
+		node := &mockStorageNode{id: fmt.Sprintf("node-%d", i), freeSpace: 1024 * 1024 * 1024}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect node %s: %v", node.id, err)
+		}
+		defer conn.Close()
+		if err := node.sendHeartbeat(conn); err != nil {
+			t.Fatalf("Failed to send heartbeat for node %s: %v", node.id, err)
+		}
+	}
+	waitFor(t, "nodes to register", func() bool { return nodeCount(controller) == 9 })
+
+	// Store a file spanning two stripes
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to controller: %v", err)
+	}
+	defer conn.Close()
+
+	data, err := proto.Marshal(&pb.StorageRequest{
+		Filename:      "archive.tar",
+		FileSize:      500,
+		ChunkSize:     64,
+		ErasureCoding: &pb.ErasureCoding{DataShards: 6, ParityShards: 3},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if err := common.WriteMessage(conn, common.MsgTypeStorageRequest, data); err != nil {
+		t.Fatalf("Failed to send storage request: %v", err)
+	}
+	_, respData, err := common.ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	response := &pb.StorageResponse{}
+	if err := proto.Unmarshal(respData, response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if response.Error != "" {
+		t.Fatalf("Storage request failed: %s", response.Error)
+	}
+
+	if len(response.ChunkPlacements) != 18 {
+		t.Fatalf("Wrong number of fragment placements: got %d, want 18", len(response.ChunkPlacements))
+	}
+
+	// Every fragment has one node and the fragments of a stripe are on distinct nodes
+	stripeNodes := make(map[int]map[string]bool)
+	for _, placement := range response.ChunkPlacements {
+		if len(placement.StorageNodes) != 1 {
+			t.Errorf("Fragment %d placed on %d nodes, want 1", placement.ChunkNumber, len(placement.StorageNodes))
+			continue
+		}
+		stripe := int(placement.ChunkNumber) / 9
+		if stripeNodes[stripe] == nil {
+			stripeNodes[stripe] = make(map[string]bool)
+		}
+		if stripeNodes[stripe][placement.StorageNodes[0]] {
+			t.Errorf("Stripe %d has two fragments on %s", stripe, placement.StorageNodes[0])
+		}
+		stripeNodes[stripe][placement.StorageNodes[0]] = true
+	}
+
+	// Retrieval describes the stripe layout
+	retrieveConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to controller: %v", err)
+	}
+	defer retrieveConn.Close()
+
+	data, err = proto.Marshal(&pb.RetrievalRequest{Filename: "archive.tar"})
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+	if err := common.WriteMessage(retrieveConn, common.MsgTypeRetrievalRequest, data); err != nil {
+		t.Fatalf("Failed to send retrieval request: %v", err)
+	}
+	_, respData, err = common.ReadMessage(retrieveConn)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	retrieval := &pb.RetrievalResponse{}
+	if err := proto.Unmarshal(respData, retrieval); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if retrieval.ErasureCoding == nil || retrieval.ErasureCoding.DataShards != 6 || retrieval.ErasureCoding.ParityShards != 3 {
+		t.Errorf("Wrong erasure coding layout: %v", retrieval.ErasureCoding)
+	}
+	if retrieval.FileSize != 500 || retrieval.ChunkSize != 64 {
+		t.Errorf("Wrong file layout: size %d, chunk size %d", retrieval.FileSize, retrieval.ChunkSize)
+	}
+
+	// Clean up
+	controller.listener.Close()
+}
+
+// mockCommandNode accepts storage node commands from the controller, records their
+// message types and reports success
+type mockCommandNode struct {
+	listener net.Listener
+	mu       sync.Mutex
+	received map[byte]int
+}
+
+func newMockCommandNode(t *testing.T) *mockCommandNode {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to create mock storage node: %v", err)
+	}
+	node := &mockCommandNode{listener: listener, received: make(map[byte]int)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // listener closed
+			}
+			go node.handleConnection(conn)
+		}
+	}()
+	return node
+}
+
+func (m *mockCommandNode) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	msgType, _, err := common.ReadMessage(conn)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	m.received[msgType]++
+	m.mu.Unlock()
+
+	var response proto.Message
+	switch msgType {
+	case common.MsgTypeChunkTranscode:
+		response = &pb.ChunkTranscodeResponse{Success: true}
+	case common.MsgTypeChunkDelete:
+		response = &pb.ChunkDeleteResponse{Success: true}
+	case common.MsgTypeChunkReplicate:
+		response = &pb.ChunkReplicateResponse{Success: true}
+	case common.MsgTypeChunkCompact:
+		response = &pb.ChunkCompactResponse{Success: true}
+	default:
+		return
+	}
+	data, _ := proto.Marshal(response)
+	common.WriteMessage(conn, msgType, data)
+}
+
+func (m *mockCommandNode) count(msgType byte) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.received[msgType]
+}
+
+func TestTranscodeColdFile(t *testing.T) {
+	controller := NewController(0)
+	controller.transcodeAfter = time.Hour
+	controller.transcodeDataShards = 2
+	controller.transcodeParityShards = 1
+
+	// Register storage nodes that accept commands
+	var nodes []*mockCommandNode
+	var nodeIDs []string
+	for i := 0; i < 3; i++ {
+		node := newMockCommandNode(t)
+		defer node.listener.Close()
+		nodes = append(nodes, node)
+		nodeID := node.listener.Addr().String()
+		nodeIDs = append(nodeIDs, nodeID)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	// A cold file of three fully replicated chunks, i.e. two RS(2,1) stripes
+	controller.files["cold.log"] = &FileMetadata{
+		Size:              300,
+		ChunkSize:         100,
+		ReplicationFactor: 3,
+		CreatedAt:         time.Now().Add(-2 * time.Hour),
+		Chunks: map[int][]string{
+			0: nodeIDs,
+			1: nodeIDs,
+			2: nodeIDs,
+		},
+	}
+	controller.files["hot.log"] = &FileMetadata{
+		Size:              100,
+		ChunkSize:         100,
+		ReplicationFactor: 3,
+		CreatedAt:         time.Now(),
+		Chunks:            map[int][]string{0: nodeIDs},
+	}
+
+	if !controller.isCold(controller.files["cold.log"], time.Now()) {
+		t.Error("Old file not considered cold")
+	}
+	if controller.isCold(controller.files["hot.log"], time.Now()) {
+		t.Error("New file considered cold")
+	}
+
+	if err := controller.transcodeFile("cold.log"); err != nil {
+		t.Fatalf("Failed to transcode file: %v", err)
+	}
+
+	// The file now uses the erasure-coded layout under a new block name
+	metadata := controller.files["cold.log"]
+	if !metadata.isErasureCoded() || metadata.DataShards != 2 || metadata.ParityShards != 1 {
+		t.Errorf("Wrong layout after transcoding: RS(%d,%d)", metadata.DataShards, metadata.ParityShards)
+	}
+	if metadata.BlockName == "" || metadata.BlockName == "cold.log" {
+		t.Errorf("Transcoded fragments stored under old block name %q", metadata.BlockName)
+	}
+	if len(metadata.Chunks) != 6 {
+		t.Errorf("Wrong number of fragments: got %d, want 6", len(metadata.Chunks))
+	}
+	for fragment, fragmentNodes := range metadata.Chunks {
+		if len(fragmentNodes) != 1 {
+			t.Errorf("Fragment %d placed on %d nodes, want 1", fragment, len(fragmentNodes))
+		}
+	}
+
+	// Each stripe was encoded once and all nine old replicas were deleted
+	var transcodes, deletes int
+	for _, node := range nodes {
+		transcodes += node.count(common.MsgTypeChunkTranscode)
+		deletes += node.count(common.MsgTypeChunkDelete)
+	}
+	if transcodes != 2 {
+		t.Errorf("Wrong number of stripes transcoded: got %d, want 2", transcodes)
+	}
+	if deletes != 9 {
+		t.Errorf("Wrong number of replicas deleted: got %d, want 9", deletes)
+	}
+
+	// Progress is visible in the status report
+	respData, err := controller.handleTranscodeStatusRequest(nil)
+	if err != nil {
+		t.Fatalf("Failed to get transcoding status: %v", err)
+	}
+	status := &pb.TranscodeStatusResponse{}
+	if err := proto.Unmarshal(respData, status); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if !status.Enabled || len(status.Tasks) != 1 {
+		t.Fatalf("Wrong transcoding status: %v", status)
+	}
+	task := status.Tasks[0]
+	if task.Filename != "cold.log" || task.State != "done" || task.StripesDone != 2 || task.TotalStripes != 2 {
+		t.Errorf("Wrong transcoding task: %v", task)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	controller := NewController(0)
+	nodeIDs := []string{"node-1", "node-2", "node-3"}
+	for _, nodeID := range nodeIDs {
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	// A file ending in a partial chunk
+	controller.files["app.log"] = &FileMetadata{
+		Size:              150,
+		ChunkSize:         100,
+		ReplicationFactor: 3,
+		CreatedAt:         time.Now(),
+		Chunks:            map[int][]string{0: nodeIDs, 1: nodeIDs},
+	}
+
+	appendRequest := func(clientID string, length uint64) (*pb.AppendResponse, error) {
+		data, _ := proto.Marshal(&pb.AppendRequest{Filename: "app.log", Length: length, ClientId: clientID})
+		respData, err := controller.handleAppendRequest(data, nil)
+		response := &pb.AppendResponse{}
+		if respData != nil {
+			if err := proto.Unmarshal(respData, response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+		}
+		return response, err
+	}
+
+	grant, err := appendRequest("writer-1", 120)
+	if err != nil {
+		t.Fatalf("Append request failed: %v", err)
+	}
+	if grant.Offset != 150 || len(grant.Placements) != 2 {
+		t.Fatalf("Wrong append grant: offset %d, %d placements", grant.Offset, len(grant.Placements))
+	}
+
+	// The partial chunk is extended, then a new chunk is allocated
+	partial, next := grant.Placements[0], grant.Placements[1]
+	if partial.ChunkNumber != 1 || partial.ChunkOffset != 50 || partial.Length != 50 {
+		t.Errorf("Wrong partial chunk placement: %v", partial)
+	}
+	if next.ChunkNumber != 2 || next.ChunkOffset != 0 || next.Length != 70 || len(next.StorageNodes) != 3 {
+		t.Errorf("Wrong new chunk placement: %v", next)
+	}
+
+	// A second writer is locked out while the lease is held
+	_, err = appendRequest("writer-2", 10)
+	if _, ok := err.(*common.LeaseConflictError); !ok {
+		t.Errorf("Expected lease conflict, got %v", err)
+	}
+
+	// Nothing is visible before the commit
+	if metadata := controller.files["app.log"]; metadata.Size != 150 || metadata.Generation != 0 {
+		t.Errorf("File changed before commit: size %d, generation %d", metadata.Size, metadata.Generation)
+	}
+
+	// Only the writer holding the lease may commit
+	data, _ := proto.Marshal(&pb.AppendCommitRequest{Filename: "app.log", AppendId: grant.AppendId, ClientId: "writer-2"})
+	if _, err := controller.handleAppendCommitRequest(data); err == nil {
+		t.Error("Commit by another writer succeeded")
+	}
+
+	commit := func(appendID uint64) (*pb.AppendCommitResponse, error) {
+		data, _ := proto.Marshal(&pb.AppendCommitRequest{Filename: "app.log", AppendId: appendID, ClientId: "writer-1"})
+		respData, err := controller.handleAppendCommitRequest(data)
+		response := &pb.AppendCommitResponse{}
+		if respData != nil {
+			if err := proto.Unmarshal(respData, response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+		}
+		return response, err
+	}
+
+	if _, err := commit(grant.AppendId + 1); err == nil {
+		t.Error("Commit with unknown append ID succeeded")
+	}
+	resp, err := commit(grant.AppendId)
+	if err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if resp.FileSize != 270 {
+		t.Errorf("Wrong file size after commit: got %d, want 270", resp.FileSize)
+	}
+	metadata := controller.files["app.log"]
+	if len(metadata.Chunks) != 3 || metadata.Generation != 1 {
+		t.Errorf("Wrong metadata after commit: %d chunks, generation %d", len(metadata.Chunks), metadata.Generation)
+	}
+
+	// The lease is released by the commit
+	if _, err := appendRequest("writer-2", 10); err != nil {
+		t.Errorf("Append after commit failed: %v", err)
+	}
+}
+
+func TestWriteLeases(t *testing.T) {
+	controller := NewController(0)
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node-%d", i)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	store := func(filename, clientID string) error {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: 100, ChunkSize: 100, ClientId: clientID})
+		_, err := controller.handleStorageRequest(data, nil)
+		return err
+	}
+	leaseRequest := func(action, filename, clientID string) (*pb.LeaseResponse, error) {
+		data, _ := proto.Marshal(&pb.LeaseRequest{Action: action, Filename: filename, ClientId: clientID})
+		respData, err := controller.handleLeaseRequest(data, nil)
+		response := &pb.LeaseResponse{}
+		if respData != nil {
+			if err := proto.Unmarshal(respData, response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+		}
+		return response, err
+	}
+
+	// A second writer cannot create the file while the first holds the lease
+	if err := store("data.bin", "writer-1"); err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	if _, ok := store("data.bin", "writer-2").(*common.LeaseConflictError); !ok {
+		t.Error("Concurrent create not rejected with a lease conflict")
+	}
+	if _, err := leaseRequest("renew", "data.bin", "writer-2"); err == nil {
+		t.Error("Lease renewed by a writer that does not hold it")
+	}
+
+	// Leases are listed with their holder
+	status, err := leaseRequest("list", "", "")
+	if err != nil {
+		t.Fatalf("Failed to list leases: %v", err)
+	}
+	if len(status.Leases) != 1 || status.Leases[0].Holder != "writer-1" || status.Leases[0].Operation != "create" {
+		t.Errorf("Wrong leases listed: %v", status.Leases)
+	}
+
+	// Releasing the lease completes the file
+	if _, err := leaseRequest("release", "data.bin", "writer-1"); err != nil {
+		t.Fatalf("Failed to release lease: %v", err)
+	}
+	if _, exists := controller.files["data.bin"]; !exists {
+		t.Error("Completed file removed")
+	}
+
+	// An expired create lease with nothing stored removes the file
+	if err := store("partial.bin", "writer-1"); err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	controller.leases["partial.bin"].Expires = time.Now().Add(-time.Second)
+	if err := store("partial.bin", "writer-2"); err != nil {
+		t.Errorf("Storage request after lease expiry failed: %v", err)
+	}
+	if lease := controller.leases["partial.bin"]; lease == nil || lease.Holder != "writer-2" {
+		t.Errorf("Lease not taken over after expiry: %v", lease)
+	}
+
+	// Otherwise the file is closed after the chunks storage nodes confirmed
+	data, _ := proto.Marshal(&pb.StorageRequest{Filename: "crashed.bin", FileSize: 250, ChunkSize: 100, ClientId: "writer-1"})
+	if _, err := controller.handleStorageRequest(data, nil); err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	crashed := controller.files["crashed.bin"]
+	for _, nodeID := range crashed.Chunks[0] {
+		controller.nodes[nodeID].ReplicatedChunks["crashed.bin"] = []int{0}
+	}
+	node := controller.nodes[crashed.Chunks[2][0]]
+	node.ReplicatedChunks["crashed.bin"] = append(node.ReplicatedChunks["crashed.bin"], 2)
+	controller.leases["crashed.bin"].Expires = time.Now().Add(-time.Second)
+	controller.checkLease("crashed.bin", "writer-2")
+	if crashed, exists := controller.files["crashed.bin"]; !exists || crashed.Size != 100 || len(crashed.Chunks) != 1 {
+		t.Errorf("File not closed at its confirmed length: %+v", crashed)
+	}
+
+	// Writers that do not name themselves get no lease, and cannot overwrite
+	if err := store("anonymous.bin", ""); err != nil {
+		t.Fatalf("Storage request without a client ID failed: %v", err)
+	}
+	if _, held := controller.leases["anonymous.bin"]; held {
+		t.Error("Lease granted to a writer without a client ID")
+	}
+	data, _ = proto.Marshal(&pb.StorageRequest{Filename: "anonymous.bin", FileSize: 100, ChunkSize: 100, Overwrite: true})
+	if _, err := controller.handleStorageRequest(data, nil); err == nil {
+		t.Error("Overwrite without a client ID succeeded")
+	}
+
+	// Releasing a lease changes metadata, so it waits for safe mode to end
+	if err := store("safe.bin", "writer-1"); err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	controller.enterSafeMode()
+	if _, err := leaseRequest("release", "safe.bin", "writer-1"); err == nil {
+		t.Error("Lease released in safe mode")
+	}
+	controller.leaveSafeMode()
+
+	// A revoked append lease leaves the file at its last committed size
+	data, _ = proto.Marshal(&pb.AppendRequest{Filename: "data.bin", Length: 50, ClientId: "writer-1"})
+	if _, err := controller.handleAppendRequest(data, nil); err != nil {
+		t.Fatalf("Append request failed: %v", err)
+	}
+	if _, err := leaseRequest("revoke", "data.bin", ""); err != nil {
+		t.Fatalf("Failed to revoke lease: %v", err)
+	}
+	metadata, exists := controller.files["data.bin"]
+	if !exists || metadata.Size != 100 {
+		t.Errorf("File not closed out at its committed size after revoke")
+	}
+	if _, held := controller.leases["data.bin"]; held {
+		t.Error("Lease still held after revoke")
+	}
+}
+
+func TestLeasesSurviveRestart(t *testing.T) {
+	addNodes := func(controller *Controller) {
+		for i := 1; i <= 3; i++ {
+			nodeID := fmt.Sprintf("node-%d", i)
+			controller.nodes[nodeID] = &NodeInfo{
+				ID:               nodeID,
+				FreeSpace:        1024 * 1024 * 1024,
+				LastHeartbeat:    time.Now(),
+				ReplicatedChunks: make(map[string][]int),
+			}
+		}
+	}
+	previous := NewController(0)
+	previous.metadataPath = filepath.Join(t.TempDir(), "metadata.json")
+	addNodes(previous)
+
+	// A write is open when the controller stops
+	data, _ := proto.Marshal(&pb.StorageRequest{Filename: "open.bin", FileSize: 250, ChunkSize: 100, ClientId: "writer-1"})
+	if _, err := previous.handleStorageRequest(data, nil); err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	placed := previous.files["open.bin"].Chunks[0]
+
+	controller := NewController(0)
+	controller.metadataPath = previous.metadataPath
+	if err := controller.loadMetadata(); err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	addNodes(controller)
+	lease, exists := controller.leases["open.bin"]
+	if !exists || lease.Holder != "writer-1" || lease.Operation != "create" || !lease.Expires.After(time.Now()) {
+		t.Fatalf("Open write's lease not restored: %+v", lease)
+	}
+
+	// A writer that never comes back has the file closed at its confirmed chunks
+	for _, nodeID := range placed {
+		controller.nodes[nodeID].ReplicatedChunks["open.bin"] = []int{0}
+	}
+	lease.Expires = time.Now().Add(-time.Second)
+	controller.checkLease("open.bin", "writer-2")
+	if recovered, exists := controller.files["open.bin"]; !exists || recovered.Size != 100 || len(recovered.Chunks) != 1 {
+		t.Errorf("File not closed at its confirmed length after a restart: %+v", recovered)
+	}
+
+	// A released lease is not restored
+	restarted := NewController(0)
+	restarted.metadataPath = previous.metadataPath
+	if err := restarted.loadMetadata(); err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	if _, exists := restarted.leases["open.bin"]; exists {
+		t.Error("Recovered lease restored after another restart")
+	}
+}
+
+func TestContainerWritesAfterRestart(t *testing.T) {
+	previous := NewController(0)
+	previous.metadataPath = filepath.Join(t.TempDir(), "metadata.json")
+	previous.replicationFactor = 1
+	previous.packThreshold = 4096
+	previous.nodes["node-1"] = &NodeInfo{
+		ID:               "node-1",
+		FreeSpace:        1024 * 1024 * 1024,
+		LastHeartbeat:    time.Now(),
+		ReplicatedChunks: make(map[string][]int),
+	}
+	store := func(filename string) *pb.PackedExtent {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: 100, ChunkSize: 1024 * 1024, ClientId: "writer"})
+		respData, err := previous.handleStorageRequest(data, nil)
+		if err != nil {
+			t.Fatalf("Storage request for %s failed: %v", filename, err)
+		}
+		response := &pb.StorageResponse{}
+		proto.Unmarshal(respData, response)
+		if response.Packed == nil {
+			t.Fatalf("%s was not packed", filename)
+		}
+		return response.Packed
+	}
+	load := func() *Controller {
+		controller := NewController(0)
+		controller.metadataPath = previous.metadataPath
+		if err := controller.loadMetadata(); err != nil {
+			t.Fatalf("Failed to load metadata: %v", err)
+		}
+		return controller
+	}
+
+	// A write still under a lease keeps its container until the lease is recovered
+	packed := store("open.txt")
+	if restored := load().containers[packed.BlockName]; restored == nil || !restored.Writing {
+		t.Errorf("Container of a leased write not kept writing after a restart: %+v", restored)
+	}
+
+	// A write nobody owns is dropped and opens its container to the next writer
+	previous.mu.Lock()
+	delete(previous.leases, "open.txt")
+	previous.saveMetadata()
+	previous.mu.Unlock()
+	controller := load()
+	if _, exists := controller.files["open.txt"]; exists {
+		t.Error("File of an unowned write kept after a restart")
+	}
+	if restored := controller.containers[packed.BlockName]; restored != nil {
+		t.Errorf("Container left with no files kept after a restart: %+v", restored)
+	}
+
+	// Files packed before it are kept
+	previous.mu.Lock()
+	previous.leases["open.txt"] = &writeLease{Holder: "writer", Operation: "create"}
+	previous.mu.Unlock()
+	data, _ := proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: "open.txt", ClientId: "writer"})
+	if _, err := previous.handleLeaseRequest(data, nil); err != nil {
+		t.Fatalf("Failed to release lease: %v", err)
+	}
+	store("unowned.txt")
+	previous.mu.Lock()
+	delete(previous.leases, "unowned.txt")
+	previous.saveMetadata()
+	previous.mu.Unlock()
+	controller = load()
+	restored := controller.containers[packed.BlockName]
+	if restored == nil || restored.Writing || len(restored.Extents) != 1 || restored.Garbage != 100 {
+		t.Errorf("Unexpected container after a restart: %+v", restored)
+	}
+	if _, exists := controller.files["open.txt"]; !exists {
+		t.Error("Completed packed file lost after a restart")
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	controller := NewController(0)
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node-%d", i)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	store := func(request *pb.StorageRequest) (*pb.StorageResponse, error) {
+		request.Filename = "config.json"
+		request.FileSize = 100
+		request.ChunkSize = 100
+		request.ClientId = "writer-1"
+		data, _ := proto.Marshal(request)
+		respData, err := controller.handleStorageRequest(data, nil)
+		response := &pb.StorageResponse{}
+		if respData != nil {
+			if err := proto.Unmarshal(respData, response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+		}
+		return response, err
+	}
+	release := func() {
+		data, _ := proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: "config.json", ClientId: "writer-1"})
+		if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+			t.Fatalf("Failed to release lease: %v", err)
+		}
+	}
+	generation := func(n uint64) *uint64 { return &n }
+
+	// Create the file only if it does not exist yet
+	if _, err := store(&pb.StorageRequest{ExpectedGeneration: generation(0)}); err != nil {
+		t.Fatalf("Conditional create failed: %v", err)
+	}
+	release()
+	original := controller.files["config.json"]
+	if original.Generation != 1 {
+		t.Errorf("Wrong generation for new file: got %d, want 1", original.Generation)
+	}
+
+	// Storing again without overwrite fails with a typed error
+	if _, err := store(&pb.StorageRequest{}); err == nil {
+		t.Error("Storing an existing file without overwrite succeeded")
+	} else if _, ok := err.(*common.FileExistsError); !ok {
+		t.Errorf("Expected FileExistsError, got %v", err)
+	}
+
+	// The new version is written under fresh chunk IDs and stays invisible until released
+	resp, err := store(&pb.StorageRequest{Overwrite: true})
+	if err != nil {
+		t.Fatalf("Overwrite failed: %v", err)
+	}
+	if resp.BlockName == "" || resp.BlockName == "config.json" {
+		t.Errorf("Overwrite not written under a fresh block name: %q", resp.BlockName)
+	}
+	if controller.files["config.json"] != original {
+		t.Error("New version visible before the lease was released")
+	}
+	release()
+	replaced := controller.files["config.json"]
+	if replaced.Generation != 2 || replaced.BlockName != resp.BlockName {
+		t.Errorf("Wrong metadata after overwrite: generation %d, block name %q", replaced.Generation, replaced.BlockName)
+	}
+
+	// Compare-and-swap on the previous version
+	if _, err := store(&pb.StorageRequest{ExpectedGeneration: generation(1)}); err == nil {
+		t.Error("Overwrite with a stale generation succeeded")
+	} else if _, ok := err.(*common.PreconditionFailedError); !ok {
+		t.Errorf("Expected PreconditionFailedError, got %v", err)
+	}
+	if _, err := store(&pb.StorageRequest{ExpectedGeneration: generation(2)}); err != nil {
+		t.Errorf("Overwrite with the current generation failed: %v", err)
+	}
+}
+
+func TestVersioning(t *testing.T) {
+	controller := NewController(0)
+	controller.maxVersions = 2
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node-%d", i)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	store := func() {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: "report.txt", FileSize: 100, ChunkSize: 100, ClientId: "writer-1", Overwrite: true})
+		if _, err := controller.handleStorageRequest(data, nil); err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		data, _ = proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: "report.txt", ClientId: "writer-1"})
+		if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+			t.Fatalf("Failed to release lease: %v", err)
+		}
+	}
+	versions := func() []uint64 {
+		var generations []uint64
+		for _, version := range controller.versions["report.txt"] {
+			generations = append(generations, version.Generation)
+		}
+		return generations
+	}
+
+	// Only the two most recent previous versions are kept
+	for i := 0; i < 4; i++ {
+		store()
+	}
+	if got := versions(); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Fatalf("Wrong previous versions: got %v, want [2 3]", got)
+	}
+	second := controller.versions["report.txt"][0]
+
+	// A previous version can be retrieved by generation
+	data, _ := proto.Marshal(&pb.RetrievalRequest{Filename: "report.txt", Generation: 2})
+	respData, err := controller.handleRetrievalRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Failed to retrieve previous version: %v", err)
+	}
+	retrieval := &pb.RetrievalResponse{}
+	if err := proto.Unmarshal(respData, retrieval); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if retrieval.Generation != 2 || retrieval.BlockName != second.BlockName {
+		t.Errorf("Wrong version retrieved: generation %d, block name %q", retrieval.Generation, retrieval.BlockName)
+	}
+
+	// Reverting makes the old version current under a new generation
+	data, _ = proto.Marshal(&pb.VersionsRequest{Action: "revert", Filename: "report.txt", Generation: 2})
+	if _, err := controller.handleVersionsRequest(data, nil); err != nil {
+		t.Fatalf("Failed to revert: %v", err)
+	}
+	current := controller.files["report.txt"]
+	if current != second || current.Generation != 5 {
+		t.Errorf("Wrong current version after revert: generation %d", current.Generation)
+	}
+	if got := versions(); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("Wrong previous versions after revert: got %v, want [3 4]", got)
+	}
+
+	// A deleted file stays recoverable, and recreating it does not reuse its chunks
+	data, _ = proto.Marshal(&pb.DeleteRequest{Filename: "report.txt"})
+	if _, err := controller.handleDeleteRequest(data, nil); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	if got := versions(); len(got) != 2 || got[1] != 5 {
+		t.Errorf("Deleted file not kept as a previous version: got %v", got)
+	}
+	store()
+	recreated := controller.files["report.txt"]
+	if recreated.Generation != 6 || recreated.BlockName == "" {
+		t.Errorf("Recreated file reuses old chunks: generation %d, block name %q", recreated.Generation, recreated.BlockName)
+	}
+
+	// Versions expire by age as well as count
+	controller.versionMaxAge = time.Hour
+	controller.versions["report.txt"][0].ArchivedAt = time.Now().Add(-2 * time.Hour)
+	if !controller.pruneVersions("report.txt", time.Now()) {
+		t.Error("Expired version not pruned")
+	}
+	if got := versions(); len(got) != 1 || got[0] != 5 {
+		t.Errorf("Wrong previous versions after expiry: got %v, want [5]", got)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	controller := NewController(0)
+	controller.trashInterval = time.Hour
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node-%d", i)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	store := func() *FileMetadata {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: "notes.txt", FileSize: 100, ChunkSize: 100, ClientId: "writer-1"})
+		if _, err := controller.handleStorageRequest(data, nil); err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		data, _ = proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: "notes.txt", ClientId: "writer-1"})
+		if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+			t.Fatalf("Failed to release lease: %v", err)
+		}
+		return controller.files["notes.txt"]
+	}
+	remove := func(filename string, skipTrash bool) string {
+		data, _ := proto.Marshal(&pb.DeleteRequest{Filename: filename, User: "alice", SkipTrash: skipTrash})
+		respData, err := controller.handleDeleteRequest(data, nil)
+		if err != nil {
+			t.Fatalf("Failed to delete %s: %v", filename, err)
+		}
+		response := &pb.DeleteResponse{}
+		if err := proto.Unmarshal(respData, response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return response.TrashPath
+	}
+	trash := func(action, filename string) (*pb.TrashResponse, error) {
+		data, _ := proto.Marshal(&pb.TrashRequest{Action: action, User: "alice", Filename: filename})
+		respData, err := controller.handleTrashRequest(data, nil)
+		response := &pb.TrashResponse{}
+		if respData != nil {
+			if err := proto.Unmarshal(respData, response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+		}
+		return response, err
+	}
+
+	// Deleting moves the file into the user's trash
+	first := store()
+	if got := remove("notes.txt", false); got != ".Trash/alice/notes.txt" {
+		t.Errorf("Wrong trash path: got %q", got)
+	}
+	if _, exists := controller.files["notes.txt"]; exists {
+		t.Error("Deleted file still visible under its name")
+	}
+
+	// A new file with the same name does not reuse the trashed file's chunks
+	second := store()
+	if second.BlockName == "" || second.BlockName == first.BlockName {
+		t.Errorf("Recreated file shares chunks with the trashed one: %q", second.BlockName)
+	}
+	if got := remove("notes.txt", false); got != ".Trash/alice/notes.txt.1" {
+		t.Errorf("Wrong trash path for second delete: got %q", got)
+	}
+
+	listing, err := trash("list", "")
+	if err != nil {
+		t.Fatalf("Failed to list trash: %v", err)
+	}
+	if len(listing.Entries) != 2 || listing.Entries[0].OriginalName != "notes.txt" || listing.Entries[0].ExpiresInSeconds <= 0 {
+		t.Errorf("Wrong trash listing: %v", listing.Entries)
+	}
+
+	// Restoring brings back the most recently deleted copy
+	if _, err := trash("restore", "notes.txt"); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if controller.files["notes.txt"] != second {
+		t.Error("Restore did not bring back the most recently deleted copy")
+	}
+	if _, err := trash("restore", "notes.txt"); err == nil {
+		t.Error("Restore over an existing file succeeded")
+	} else if _, ok := err.(*common.FileExistsError); !ok {
+		t.Errorf("Expected FileExistsError, got %v", err)
+	}
+
+	// Bypassing the trash deletes right away
+	if got := remove("notes.txt", true); got != "" {
+		t.Errorf("Delete bypassing the trash moved the file to %q", got)
+	}
+
+	// Emptying the trash removes the remaining copy for good
+	if _, err := trash("empty", ""); err != nil {
+		t.Fatalf("Failed to empty trash: %v", err)
+	}
+	if len(controller.files) != 0 {
+		t.Errorf("Files left after emptying the trash: %d", len(controller.files))
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	controller := NewController(0)
+
+	node := newMockCommandNode(t)
+	defer node.listener.Close()
+	nodeID := node.listener.Addr().String()
+	controller.nodes[nodeID] = &NodeInfo{
+		ID:               nodeID,
+		FreeSpace:        1024 * 1024 * 1024,
+		LastHeartbeat:    time.Now(),
+		ReplicatedChunks: make(map[string][]int),
+	}
+	for _, filename := range []string{"data/a.txt", "data/b.txt", "other.txt"} {
+		controller.files[filename] = &FileMetadata{
+			Size:              100,
+			ChunkSize:         100,
+			ReplicationFactor: 1,
+			CreatedAt:         time.Now(),
+			Generation:        1,
+			Chunks:            map[int][]string{0: {nodeID}},
+		}
+	}
+
+	snapshot := func(action, name, path string) (*pb.SnapshotResponse, error) {
+		data, _ := proto.Marshal(&pb.SnapshotRequest{Action: action, Name: name, Path: path})
+		respData, err := controller.handleSnapshotRequest(data, nil)
+		response := &pb.SnapshotResponse{}
+		if respData != nil {
+			if err := proto.Unmarshal(respData, response); err != nil {
+				t.Fatalf("Failed to unmarshal response: %v", err)
+			}
+		}
+		return response, err
+	}
+
+	// Only the snapshotted directory is captured
+	if _, err := snapshot("create", "backup", "data"); err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	if _, err := snapshot("create", "backup", ""); err == nil {
+		t.Error("Creating a snapshot with a duplicate name succeeded")
+	}
+	listing, err := snapshot("list", "backup", "")
+	if err != nil {
+		t.Fatalf("Failed to list snapshot: %v", err)
+	}
+	if len(listing.Files) != 2 || listing.Files[0].Filename != "data/a.txt" {
+		t.Errorf("Wrong files in snapshot: %v", listing.Files)
+	}
+
+	// Overwrite one file, delete another and add a third
+	controller.files["data/a.txt"] = &FileMetadata{
+		Size:       200,
+		ChunkSize:  100,
+		CreatedAt:  time.Now(),
+		Generation: 2,
+		BlockName:  "data/a.txt#v1",
+		Chunks:     map[int][]string{0: {nodeID}, 1: {nodeID}},
+	}
+	delete(controller.files, "data/b.txt")
+	controller.files["data/c.txt"] = &FileMetadata{Size: 10, ChunkSize: 100, CreatedAt: time.Now(), Generation: 1}
+
+	diff, err := snapshot("diff", "backup", "")
+	if err != nil {
+		t.Fatalf("Failed to diff snapshot: %v", err)
+	}
+	want := []string{"modified data/a.txt", "deleted data/b.txt", "added data/c.txt"}
+	if len(diff.Changes) != len(want) {
+		t.Fatalf("Wrong number of changes: got %v, want %v", diff.Changes, want)
+	}
+	for i, change := range diff.Changes {
+		if got := change.Change + " " + change.Filename; got != want[i] {
+			t.Errorf("Wrong change %d: got %q, want %q", i, got, want[i])
+		}
+	}
+
+	// The deleted file can still be read from the snapshot, and its chunks are kept
+	data, _ := proto.Marshal(&pb.RetrievalRequest{Filename: "data/b.txt", Snapshot: "backup"})
+	if _, err := controller.handleRetrievalRequest(data, nil); err != nil {
+		t.Errorf("Failed to read deleted file from snapshot: %v", err)
+	}
+	controller.deleteChunks("data/b.txt", map[int][]string{0: {nodeID}})
+	if deletes := node.count(common.MsgTypeChunkDelete); deletes != 0 {
+		t.Errorf("Chunks captured by a snapshot were deleted: %d", deletes)
+	}
+
+	// Deleting the snapshot garbage collects the chunks only it referenced
+	if _, err := snapshot("delete", "backup", ""); err != nil {
+		t.Fatalf("Failed to delete snapshot: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for node.count(common.MsgTypeChunkDelete) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if deletes := node.count(common.MsgTypeChunkDelete); deletes != 2 {
+		t.Errorf("Wrong number of chunks garbage collected: got %d, want 2", deletes)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	controller := NewController(0)
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node-%d", i)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	setQuota := func(request *pb.QuotaRequest) {
+		request.Action = "set"
+		data, _ := proto.Marshal(request)
+		if _, err := controller.handleQuotaRequest(data, nil); err != nil {
+			t.Fatalf("Failed to set quota: %v", err)
+		}
+	}
+	store := func(filename string, size uint64, user string, overwrite bool) error {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: size, ChunkSize: 100, ClientId: user, User: user, Overwrite: overwrite})
+		_, err := controller.handleStorageRequest(data, nil)
+		return err
+	}
+	expectExceeded := func(err error, resource string) {
+		t.Helper()
+		quotaErr, ok := err.(*common.QuotaExceededError)
+		if !ok {
+			t.Errorf("Expected QuotaExceededError, got %v", err)
+			return
+		}
+		if quotaErr.Resource != resource {
+			t.Errorf("Wrong quota exceeded: got %s, want %s", quotaErr.Resource, resource)
+		}
+	}
+
+	// Space counts every replica
+	setQuota(&pb.QuotaRequest{Directory: "/projects", SpaceLimit: 900, FileLimit: 2})
+	if err := store("projects/a.bin", 100, "alice", false); err != nil {
+		t.Fatalf("Store within quota failed: %v", err)
+	}
+	expectExceeded(store("projects/b.bin", 300, "alice", false), "space")
+	if err := store("projects/b.bin", 100, "alice", false); err != nil {
+		t.Fatalf("Store within quota failed: %v", err)
+	}
+	expectExceeded(store("projects/c.bin", 1, "alice", false), "files")
+	if err := store("elsewhere.bin", 1000, "alice", false); err != nil {
+		t.Errorf("Store outside the quota directory failed: %v", err)
+	}
+
+	// An overwrite is charged for the difference from the version it replaces
+	if err := store("projects/a.bin", 200, "alice", true); err != nil {
+		t.Errorf("Overwrite within quota failed: %v", err)
+	}
+
+	// User quotas apply wherever the user's files are
+	setQuota(&pb.QuotaRequest{User: "bob", FileLimit: 1})
+	if err := store("bob/one.bin", 1, "bob", false); err != nil {
+		t.Fatalf("Store within user quota failed: %v", err)
+	}
+	expectExceeded(store("two.bin", 1, "bob", false), "files")
+
+	data, _ := proto.Marshal(&pb.QuotaRequest{Action: "report"})
+	respData, err := controller.handleQuotaRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Failed to report quotas: %v", err)
+	}
+	report := &pb.QuotaResponse{}
+	if err := proto.Unmarshal(respData, report); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(report.Quotas) != 2 {
+		t.Fatalf("Wrong number of quotas: got %d, want 2", len(report.Quotas))
+	}
+	projects := report.Quotas[0]
+	if projects.Directory != "/projects" || projects.SpaceUsed != 600 || projects.FilesUsed != 2 || projects.SpaceLimit != 900 {
+		t.Errorf("Wrong directory usage: %v", projects)
+	}
+	if bob := report.Quotas[1]; bob.User != "bob" || bob.FilesUsed != 1 || bob.FileLimit != 1 {
+		t.Errorf("Wrong user usage: %v", bob)
+	}
+
+	// Clearing a quota lifts the limit
+	data, _ = proto.Marshal(&pb.QuotaRequest{Action: "clear", User: "bob"})
+	if _, err := controller.handleQuotaRequest(data, nil); err != nil {
+		t.Fatalf("Failed to clear quota: %v", err)
+	}
+	if err := store("two.bin", 1, "bob", false); err != nil {
+		t.Errorf("Store after clearing the quota failed: %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	controller := NewController(0)
+	controller.permissions = true
+	controller.superusers["root"] = true
+	for i := 1; i <= 3; i++ {
+		nodeID := fmt.Sprintf("node-%d", i)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+
+	groups := map[string][]string{"alice": {"staff"}, "bob": {"staff"}, "root": {"root"}}
+	store := func(user, filename string, overwrite bool) error {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: 10, ChunkSize: 100, ClientId: user,
+			User: user, Groups: groups[user], Overwrite: overwrite})
+		if _, err := controller.handleStorageRequest(data, nil); err != nil {
+			return err
+		}
+		data, _ = proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: filename, ClientId: user})
+		_, err := controller.handleLeaseRequest(data, nil)
+		return err
+	}
+	retrieve := func(user, filename string) error {
+		data, _ := proto.Marshal(&pb.RetrievalRequest{Filename: filename, User: user, Groups: groups[user]})
+		_, err := controller.handleRetrievalRequest(data, nil)
+		return err
+	}
+	remove := func(user, filename string) error {
+		data, _ := proto.Marshal(&pb.DeleteRequest{Filename: filename, User: user, Groups: groups[user]})
+		_, err := controller.handleDeleteRequest(data, nil)
+		return err
+	}
+	change := func(user string, request *pb.PermissionRequest) error {
+		request.User, request.Groups = user, groups[user]
+		data, _ := proto.Marshal(request)
+		_, err := controller.handlePermissionRequest(data, nil)
+		return err
+	}
+	list := func(user string) map[string]*pb.FileInfo {
+		data, _ := proto.Marshal(&pb.ListFilesRequest{User: user, Groups: groups[user]})
+		respData, err := controller.handleListRequest(data, nil)
+		if err != nil {
+			t.Fatalf("Failed to list files: %v", err)
+		}
+		response := &pb.ListFilesResponse{}
+		if err := proto.Unmarshal(respData, response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		files := make(map[string]*pb.FileInfo)
+		for _, file := range response.Files {
+			files[file.Filename] = file
+		}
+		return files
+	}
+	expectDenied := func(err error, what string) {
+		t.Helper()
+		if _, ok := err.(*common.PermissionDeniedError); !ok {
+			t.Errorf("Expected PermissionDeniedError for %s, got %v", what, err)
+		}
+	}
+
+	// New files get their creator as owner, its primary group and the default mode
+	if err := store("alice", "shared/a.txt", false); err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	info := list("bob")["shared/a.txt"]
+	if info == nil || info.Owner != "alice" || info.Group != "staff" || info.Mode != common.DefaultFileMode {
+		t.Fatalf("Wrong ownership of new file: %v", info)
+	}
+
+	// Others may read but not replace or delete it
+	if err := retrieve("bob", "shared/a.txt"); err != nil {
+		t.Errorf("Read by another user failed: %v", err)
+	}
+	expectDenied(store("bob", "shared/a.txt", true), "overwrite")
+	expectDenied(remove("bob", "shared/a.txt"), "delete")
+	expectDenied(change("bob", &pb.PermissionRequest{Action: "chmod", Path: "shared/a.txt", Mode: 0666}), "chmod")
+	if err := change("alice", &pb.PermissionRequest{Action: "chmod", Path: "shared/a.txt", Mode: 0600}); err != nil {
+		t.Fatalf("Owner chmod failed: %v", err)
+	}
+	expectDenied(retrieve("bob", "shared/a.txt"), "read")
+
+	// Only a superuser may give a file away or restrict a directory nobody owns
+	expectDenied(change("alice", &pb.PermissionRequest{Action: "chown", Path: "shared/a.txt", Owner: "bob"}), "chown")
+	if err := change("root", &pb.PermissionRequest{Action: "chown", Path: "shared/a.txt", Owner: "bob"}); err != nil {
+		t.Fatalf("Superuser chown failed: %v", err)
+	}
+	if err := remove("bob", "shared/a.txt"); err != nil {
+		t.Errorf("Delete by the new owner failed: %v", err)
+	}
+	expectDenied(change("alice", &pb.PermissionRequest{Action: "chmod", Path: "private", Mode: 0700}), "chmod of an implicit directory")
+	if err := change("root", &pb.PermissionRequest{Action: "chown", Path: "/private", Owner: "alice"}); err != nil {
+		t.Fatalf("Superuser chown of a directory failed: %v", err)
+	}
+	if err := change("alice", &pb.PermissionRequest{Action: "chmod", Path: "private", Mode: 0700}); err != nil {
+		t.Fatalf("Owner chmod of a directory failed: %v", err)
+	}
+
+	// A private directory hides its files and refuses new ones from others
+	if err := store("alice", "private/notes.txt", false); err != nil {
+		t.Fatalf("Store in own directory failed: %v", err)
+	}
+	expectDenied(store("bob", "private/other.txt", false), "create")
+	expectDenied(retrieve("bob", "private/notes.txt"), "traverse")
+	if _, visible := list("bob")["private/notes.txt"]; visible {
+		t.Error("File in a private directory listed for another user")
+	}
+	if _, visible := list("alice")["private/notes.txt"]; !visible {
+		t.Error("File in own directory not listed")
+	}
+	if err := retrieve("root", "private/notes.txt"); err != nil {
+		t.Errorf("Superuser read failed: %v", err)
+	}
+
+	// A client that authenticated with a certificate cannot claim another user
+	data, _ := proto.Marshal(&pb.RetrievalRequest{Filename: "private/notes.txt", User: "root", Groups: groups["root"]})
+	_, err := controller.handleRetrievalRequest(data, &caller{user: "bob", groups: groups["bob"]})
+	expectDenied(err, "read as a claimed superuser")
+
+	// Admin actions need a superuser, and per-file ones write access to the file
+	setQuota := func(user string) error {
+		data, _ := proto.Marshal(&pb.QuotaRequest{Action: "set", User: "alice", SpaceLimit: 1, Caller: user, CallerGroups: groups[user]})
+		_, err := controller.handleQuotaRequest(data, nil)
+		return err
+	}
+	enterSafeMode := func(user string) error {
+		data, _ := proto.Marshal(&pb.SafeModeRequest{Action: "enter", User: user, Groups: groups[user]})
+		_, err := controller.handleSafeModeRequest(data, nil)
+		return err
+	}
+	listLeases := func(user string) error {
+		data, _ := proto.Marshal(&pb.LeaseRequest{Action: "list", User: user, Groups: groups[user]})
+		_, err := controller.handleLeaseRequest(data, nil)
+		return err
+	}
+	createSnapshot := func(user string) error {
+		data, _ := proto.Marshal(&pb.SnapshotRequest{Action: "create", Name: "snap-" + user, User: user, Groups: groups[user]})
+		_, err := controller.handleSnapshotRequest(data, nil)
+		return err
+	}
+	setReplication := func(user string) error {
+		data, _ := proto.Marshal(&pb.SetReplicationRequest{Filename: "private/notes.txt", ReplicationFactor: 2, User: user, Groups: groups[user]})
+		_, err := controller.handleSetReplicationRequest(data, nil)
+		return err
+	}
+	revert := func(user string) error {
+		data, _ := proto.Marshal(&pb.VersionsRequest{Action: "revert", Filename: "private/notes.txt", Generation: 1, User: user, Groups: groups[user]})
+		_, err := controller.handleVersionsRequest(data, nil)
+		return err
+	}
+	expectDenied(setQuota("alice"), "quota set")
+	expectDenied(enterSafeMode("alice"), "safe mode")
+	expectDenied(listLeases("alice"), "lease list")
+	expectDenied(createSnapshot("alice"), "snapshot create")
+	expectDenied(setReplication("bob"), "setrep")
+	expectDenied(revert("bob"), "revert")
+	for name, run := range map[string]func(string) error{"quota set": setQuota, "lease list": listLeases, "snapshot create": createSnapshot} {
+		if err := run("root"); err != nil {
+			t.Errorf("Superuser %s failed: %v", name, err)
+		}
+	}
+	if err := setReplication("alice"); err != nil {
+		t.Errorf("Owner setrep failed: %v", err)
+	}
+}
+
+// writeTestCerts generates a throwaway CA and a certificate signed by it for each
+// name, valid for localhost. Returns the CA file and the cert and key files by name.
+func writeTestCerts(t *testing.T, names ...string) (string, map[string][2]string) {
+	t.Helper()
+	dir := t.TempDir()
+	writePEM := func(path, blockType string, der []byte) {
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(caFile, "CERTIFICATE", caDER)
+
+	files := make(map[string][2]string)
+	for i, name := range names {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("Failed to create certificate for %s: %v", name, err)
+		}
+		keyDER, _ := x509.MarshalECPrivateKey(key)
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+"-key.pem")
+		writePEM(certFile, "CERTIFICATE", der)
+		writePEM(keyFile, "EC PRIVATE KEY", keyDER)
+		files[name] = [2]string{certFile, keyFile}
+	}
+	return caFile, files
+}
+
+func TestMutualTLS(t *testing.T) {
+	caFile, files := writeTestCerts(t, "controller", "node-1")
+	transport := func(name string) *common.Transport {
+		tr, err := common.NewTransport(files[name][0], files[name][1], caFile)
+		if err != nil {
+			t.Fatalf("Failed to load certificates for %s: %v", name, err)
+		}
+		return tr
+	}
+
+	controller := NewController(0)
+	controller.transport = transport("controller")
+	go controller.Start()
+	time.Sleep(100 * time.Millisecond)
+	defer controller.listener.Close()
+	addr := fmt.Sprintf("localhost:%d", controller.listener.Addr().(*net.TCPAddr).Port)
+
+	heartbeat := func(conn net.Conn, nodeID string) {
+		node := &mockStorageNode{id: nodeID, freeSpace: 1024}
+		if err := node.sendHeartbeat(conn); err != nil {
+			t.Fatalf("Failed to send heartbeat: %v", err)
+		}
+	}
+	registered := func(nodeID string) bool {
+		time.Sleep(100 * time.Millisecond)
+		controller.mu.RLock()
+		defer controller.mu.RUnlock()
+		_, exists := controller.nodes[nodeID]
+		return exists
+	}
+
+	// A node whose certificate names its ID is accepted
+	nodeTransport := transport("node-1")
+	conn, err := nodeTransport.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect over TLS: %v", err)
+	}
+	defer conn.Close()
+	heartbeat(conn, "node-1")
+	if !registered("node-1") {
+		t.Error("Node with a matching certificate not registered")
+	}
+
+	// It cannot report as another node
+	impostor, err := nodeTransport.Dial(addr)
+	if err != nil {
+		t.Fatalf("Failed to connect over TLS: %v", err)
+	}
+	defer impostor.Close()
+	heartbeat(impostor, "node-2")
+	if registered("node-2") {
+		t.Error("Heartbeat accepted for an ID the certificate does not name")
+	}
+
+	// Connections without a certificate from the CA are refused
+	plain, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer plain.Close()
+	heartbeat(plain, "node-3")
+	if registered("node-3") {
+		t.Error("Heartbeat accepted over plain TCP")
+	}
+}
+
+func TestBlockTokenIssue(t *testing.T) {
+	controller := NewController(0)
+	controller.blockTokenSecret = []byte("shared-secret")
+
+	// Nodes receive the secret in reply to their heartbeats
+	data, _ := proto.Marshal(&pb.Heartbeat{NodeId: "node-1", FreeSpace: 1024 * 1024 * 1024})
+	respData, err := controller.handleHeartbeat(data, nil)
+	if err != nil {
+		t.Fatalf("Failed to handle heartbeat: %v", err)
+	}
+	heartbeat := &pb.HeartbeatResponse{}
+	if err := proto.Unmarshal(respData, heartbeat); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if string(heartbeat.BlockTokenSecret) != "shared-secret" {
+		t.Errorf("Wrong block token secret: %q", heartbeat.BlockTokenSecret)
+	}
+
+	verify := func(token *pb.BlockToken, operation string) {
+		t.Helper()
+		if token == nil {
+			t.Fatalf("No %s token issued", operation)
+		}
+		signature := common.SignBlockToken(controller.blockTokenSecret, token.BlockName, token.Operation, token.ExpiresAt, token.Offset, token.Length)
+		if token.BlockName != "data.bin" || token.Operation != operation || string(token.Signature) != string(signature) {
+			t.Errorf("Wrong %s token: %v", operation, token)
+		}
+		if expiresIn := time.Until(time.Unix(token.ExpiresAt, 0)); expiresIn <= 0 || expiresIn > controller.blockTokenLifetime {
+			t.Errorf("Wrong token expiry: %v from now", expiresIn)
+		}
+	}
+
+	data, _ = proto.Marshal(&pb.StorageRequest{Filename: "data.bin", FileSize: 10, ChunkSize: 100, ReplicationFactor: 1, ClientId: "writer"})
+	respData, err = controller.handleStorageRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	storage := &pb.StorageResponse{}
+	if err := proto.Unmarshal(respData, storage); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	verify(storage.BlockToken, common.BlockTokenWrite)
+
+	data, _ = proto.Marshal(&pb.RetrievalRequest{Filename: "data.bin"})
+	respData, err = controller.handleRetrievalRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Retrieval request failed: %v", err)
+	}
+	retrieval := &pb.RetrievalResponse{}
+	if err := proto.Unmarshal(respData, retrieval); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	verify(retrieval.BlockToken, common.BlockTokenRead)
+}
+
+func TestCompressionAccounting(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 2
+	for _, nodeID := range []string{"node-1", "node-2"} {
+		data, _ := proto.Marshal(&pb.Heartbeat{NodeId: nodeID, FreeSpace: 1024 * 1024 * 1024})
+		if _, err := controller.handleHeartbeat(data, nil); err != nil {
+			t.Fatalf("Failed to register %s: %v", nodeID, err)
+		}
+	}
+
+	// Unknown codecs are rejected
+	data, _ := proto.Marshal(&pb.StorageRequest{Filename: "bad.log", FileSize: 100, ChunkSize: 100, ClientId: "writer", Compression: "lz77"})
+	respData, _ := controller.handleStorageRequest(data, nil)
+	rejected := &pb.StorageResponse{}
+	proto.Unmarshal(respData, rejected)
+	if rejected.Error == "" {
+		t.Error("Storage request with an unknown codec succeeded")
+	}
+
+	data, _ = proto.Marshal(&pb.StorageRequest{Filename: "app.log", FileSize: 1000, ChunkSize: 1000, ClientId: "writer", Compression: common.CodecGzip})
+	if _, err := controller.handleStorageRequest(data, nil); err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	if controller.files["app.log"].Compression != common.CodecGzip {
+		t.Fatalf("Codec not recorded: %q", controller.files["app.log"].Compression)
+	}
+
+	// Appends are compressed with the file's codec
+	data, _ = proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: "app.log", ClientId: "writer"})
+	if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+		t.Fatalf("Failed to release lease: %v", err)
+	}
+	data, _ = proto.Marshal(&pb.AppendRequest{Filename: "app.log", Length: 10, ClientId: "writer"})
+	respData, err := controller.handleAppendRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Append request failed: %v", err)
+	}
+	grant := &pb.AppendResponse{}
+	proto.Unmarshal(respData, grant)
+	if grant.Compression != common.CodecGzip {
+		t.Errorf("Append granted with codec %q", grant.Compression)
+	}
+
+	// Nodes report what each chunk takes on disk
+	for _, nodeID := range controller.files["app.log"].Chunks[0] {
+		data, _ := proto.Marshal(&pb.Heartbeat{
+			NodeId:       nodeID,
+			FreeSpace:    1024 * 1024 * 1024,
+			Chunks:       []*pb.StoredChunk{{Filename: "app.log", ChunkNumber: 0, StoredSize: 100}},
+			FullReport:   true,
+			LogicalBytes: 1000,
+			StoredBytes:  100,
+		})
+		if _, err := controller.handleHeartbeat(data, nil); err != nil {
+			t.Fatalf("Failed to handle heartbeat: %v", err)
+		}
+	}
+
+	data, _ = proto.Marshal(&pb.ListFilesRequest{})
+	respData, err = controller.handleListRequest(data, nil)
+	if err != nil {
+		t.Fatalf("List request failed: %v", err)
+	}
+	list := &pb.ListFilesResponse{}
+	proto.Unmarshal(respData, list)
+	if len(list.Files) != 1 || list.Files[0].Size != 1000 || list.Files[0].StoredSize != 200 || list.Files[0].Compression != common.CodecGzip {
+		t.Errorf("Unexpected file listing: %v", list.Files)
+	}
+
+	respData, err = controller.handleNodeStatusRequest(nil)
+	if err != nil {
+		t.Fatalf("Node status request failed: %v", err)
+	}
+	status := &pb.NodeStatusResponse{}
+	proto.Unmarshal(respData, status)
+	for _, node := range status.Nodes {
+		if node.LogicalBytes != 1000 || node.StoredBytes != 100 {
+			t.Errorf("Node %s reports %d logical and %d stored bytes", node.NodeId, node.LogicalBytes, node.StoredBytes)
+		}
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 1
+
+	node := newMockCommandNode(t)
+	defer node.listener.Close()
+	nodeID := node.listener.Addr().String()
+	controller.nodes[nodeID] = &NodeInfo{
+		ID:               nodeID,
+		FreeSpace:        1024 * 1024 * 1024,
+		LastHeartbeat:    time.Now(),
+		ReplicatedChunks: make(map[string][]int),
+	}
+
+	shared := common.ContentHash([]byte("shared"))
+	first := common.ContentHash([]byte("first"))
+	second := common.ContentHash([]byte("second"))
+
+	store := func(filename string, hashes ...string) *pb.StorageResponse {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: 200, ChunkSize: 100, ClientId: "writer", ChunkHashes: hashes})
+		respData, err := controller.handleStorageRequest(data, nil)
+		if err != nil {
+			t.Fatalf("Storage request for %s failed: %v", filename, err)
+		}
+		response := &pb.StorageResponse{}
+		proto.Unmarshal(respData, response)
+		data, _ = proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: filename, ClientId: "writer"})
+		if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+			t.Fatalf("Failed to release lease: %v", err)
+		}
+		return response
+	}
+	remove := func(filename string) {
+		data, _ := proto.Marshal(&pb.DeleteRequest{Filename: filename})
+		if _, err := controller.handleDeleteRequest(data, nil); err != nil {
+			t.Fatalf("Failed to delete %s: %v", filename, err)
+		}
+	}
+	waitForDeletes := func(want int) {
+		deadline := time.Now().Add(2 * time.Second)
+		for node.count(common.MsgTypeChunkDelete) < want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if deletes := node.count(common.MsgTypeChunkDelete); deletes != want {
+			t.Errorf("Wrong number of chunks garbage collected: got %d, want %d", deletes, want)
+		}
+	}
+
+	// Every hash must be given, and names of content chunks are reserved
+	data, _ := proto.Marshal(&pb.StorageRequest{Filename: "short.bin", FileSize: 200, ChunkSize: 100, ClientId: "writer", ChunkHashes: []string{shared}})
+	respData, _ := controller.handleStorageRequest(data, nil)
+	rejected := &pb.StorageResponse{}
+	proto.Unmarshal(respData, rejected)
+	if rejected.Error == "" {
+		t.Error("Storage request with a missing chunk hash succeeded")
+	}
+	data, _ = proto.Marshal(&pb.StorageRequest{Filename: common.ContentBlockName(shared), FileSize: 100, ChunkSize: 100, ClientId: "writer"})
+	respData, _ = controller.handleStorageRequest(data, nil)
+	rejected = &pb.StorageResponse{}
+	proto.Unmarshal(respData, rejected)
+	if rejected.Error == "" {
+		t.Error("Storage request for a reserved name succeeded")
+	}
+
+	// The first file uploads everything, the second skips the chunk it shares
+	placed := store("a.bin", shared, first)
+	if placed.ChunkPlacements[0].Exists || placed.ChunkPlacements[0].BlockName != common.ContentBlockName(shared) {
+		t.Errorf("Unexpected placement of a new chunk: %v", placed.ChunkPlacements[0])
+	}
+	placed = store("b.bin", shared, second)
+	if !placed.ChunkPlacements[0].Exists || placed.ChunkPlacements[1].Exists {
+		t.Errorf("Wrong chunks reported as stored: %v", placed.ChunkPlacements)
+	}
+	if refs := controller.contentChunks[shared].Refs; refs != 2 {
+		t.Errorf("Shared chunk has %d references, want 2", refs)
+	}
+
+	data, _ = proto.Marshal(&pb.RetrievalRequest{Filename: "b.bin"})
+	respData, err := controller.handleRetrievalRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Retrieval request failed: %v", err)
+	}
+	layout := &pb.RetrievalResponse{}
+	proto.Unmarshal(respData, layout)
+	if len(layout.Chunks) != 2 || layout.Chunks[1].BlockName != common.ContentBlockName(second) || len(layout.Chunks[1].StorageNodes) != 1 {
+		t.Errorf("Unexpected layout: %v", layout.Chunks)
+	}
+
+	// A snapshot holds its own references
+	data, _ = proto.Marshal(&pb.SnapshotRequest{Action: "create", Name: "backup"})
+	if _, err := controller.handleSnapshotRequest(data, nil); err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+
+	// Deleting a file only garbage collects chunks nothing else references
+	remove("a.bin")
+	data, _ = proto.Marshal(&pb.SnapshotRequest{Action: "delete", Name: "backup"})
+	if _, err := controller.handleSnapshotRequest(data, nil); err != nil {
+		t.Fatalf("Failed to delete snapshot: %v", err)
+	}
+	waitForDeletes(1)
+	if _, exists := controller.contentChunks[first]; exists {
+		t.Error("Unreferenced chunk is still indexed")
+	}
+
+	remove("b.bin")
+	waitForDeletes(3)
+	if len(controller.contentChunks) != 0 {
+		t.Errorf("Chunks left in the index: %v", controller.contentChunks)
+	}
+}
+
+func TestContentDefinedChunks(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 1
+	data, _ := proto.Marshal(&pb.Heartbeat{NodeId: "node-1", FreeSpace: 1024 * 1024 * 1024})
+	if _, err := controller.handleHeartbeat(data, nil); err != nil {
+		t.Fatalf("Failed to register node: %v", err)
+	}
+
+	store := func(filename string, offsets ...uint64) *pb.StorageResponse {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: 1000, ChunkSize: 500, ClientId: "writer", ChunkOffsets: offsets})
+		respData, _ := controller.handleStorageRequest(data, nil)
+		response := &pb.StorageResponse{}
+		proto.Unmarshal(respData, response)
+		return response
+	}
+
+	// Chunks must start at 0, increase and fit the chunk size
+	for _, offsets := range [][]uint64{{100, 400}, {0, 600}, {0, 300, 300, 700}, {0, 1000}} {
+		if response := store("bad.bin", offsets...); response.Error == "" {
+			t.Errorf("Storage request with offsets %v succeeded", offsets)
+		}
+	}
+
+	response := store("file.bin", 0, 300, 550, 700)
+	if response.Error != "" {
+		t.Fatalf("Storage request failed: %s", response.Error)
+	}
+	if len(response.ChunkPlacements) != 4 {
+		t.Errorf("Placed %d chunks, want 4", len(response.ChunkPlacements))
+	}
+
+	data, _ = proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: "file.bin", ClientId: "writer"})
+	if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+		t.Fatalf("Failed to release lease: %v", err)
+	}
+	data, _ = proto.Marshal(&pb.RetrievalRequest{Filename: "file.bin"})
+	respData, err := controller.handleRetrievalRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Retrieval request failed: %v", err)
+	}
+	layout := &pb.RetrievalResponse{}
+	proto.Unmarshal(respData, layout)
+	if len(layout.ChunkOffsets) != 4 || layout.ChunkOffsets[2] != 550 {
+		t.Errorf("Unexpected chunk offsets: %v", layout.ChunkOffsets)
+	}
+
+	// Appends would need fixed-size chunks
+	data, _ = proto.Marshal(&pb.AppendRequest{Filename: "file.bin", Length: 10, ClientId: "writer"})
+	respData, _ = controller.handleAppendRequest(data, nil)
+	grant := &pb.AppendResponse{}
+	proto.Unmarshal(respData, grant)
+	if grant.Error == "" {
+		t.Error("Append to a file with content-defined chunks succeeded")
+	}
+}
+
+func TestSmallFilePacking(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 1
+	controller.packThreshold = 4096
+	controller.blockTokenSecret = []byte("shared-secret")
+
+	node := newMockCommandNode(t)
+	defer node.listener.Close()
+	nodeID := node.listener.Addr().String()
+	controller.nodes[nodeID] = &NodeInfo{
+		ID:               nodeID,
+		FreeSpace:        1024 * 1024 * 1024,
+		LastHeartbeat:    time.Now(),
+		ReplicatedChunks: make(map[string][]int),
+	}
+
+	store := func(filename string, size uint64) *pb.StorageResponse {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: size, ChunkSize: 1024 * 1024, ClientId: "writer"})
+		respData, err := controller.handleStorageRequest(data, nil)
+		if err != nil {
+			t.Fatalf("Storage request for %s failed: %v", filename, err)
+		}
+		response := &pb.StorageResponse{}
+		proto.Unmarshal(respData, response)
+		return response
+	}
+	lease := func(action, filename string) {
+		data, _ := proto.Marshal(&pb.LeaseRequest{Action: action, Filename: filename, ClientId: "writer"})
+		if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+			t.Fatalf("Failed to %s lease on %s: %v", action, filename, err)
+		}
+	}
+	stats := func() *pb.NodeStatusResponse {
+		respData, err := controller.handleNodeStatusRequest(nil)
+		if err != nil {
+			t.Fatalf("Node status request failed: %v", err)
+		}
+		status := &pb.NodeStatusResponse{}
+		proto.Unmarshal(respData, status)
+		return status
+	}
+
+	if response := store("big.bin", 5000); response.Packed != nil {
+		t.Error("File above the threshold was packed")
+	}
+
+	// A container takes one writer at a time
+	first := store("a.txt", 100).Packed
+	if first == nil || first.Offset != 0 {
+		t.Fatalf("Unexpected packing of the first file: %v", first)
+	}
+	if other := store("b.txt", 200).Packed; other == nil || other.BlockName == first.BlockName {
+		t.Errorf("File packed into a container being written: %v", other)
+	}
+	lease("release", "a.txt")
+
+	// The next file is packed after the first
+	second := store("c.txt", 300).Packed
+	if second == nil || second.BlockName != first.BlockName || second.Offset != 100 {
+		t.Fatalf("Unexpected packing of the next file: %v", second)
+	}
+	// Its token only grants writing its own extent
+	if token := second.BlockToken; token == nil || token.Offset != 100 || token.Length != 300 {
+		t.Errorf("Write token not limited to the packed file: %v", token)
+	}
+	lease("release", "b.txt")
+	lease("release", "c.txt")
+
+	// An aborted write leaves garbage, as nodes only append past the end
+	if aborted := store("aborted.txt", 50).Packed; aborted == nil {
+		t.Fatal("Small file was not packed")
+	}
+	lease("abort", "aborted.txt")
+
+	data, _ := proto.Marshal(&pb.RetrievalRequest{Filename: "a.txt"})
+	respData, err := controller.handleRetrievalRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Retrieval request failed: %v", err)
+	}
+	layout := &pb.RetrievalResponse{}
+	proto.Unmarshal(respData, layout)
+	if layout.Packed == nil || layout.Packed.BlockName != first.BlockName || layout.FileSize != 100 || len(layout.Packed.StorageNodes) != 1 {
+		t.Errorf("Unexpected layout of a packed file: %v", layout)
+	}
+
+	// Deleted packed files are garbage until their container is empty
+	if status := stats(); status.Containers != 2 || status.PackedBytes != 650 || status.GarbageBytes != 50 {
+		t.Errorf("Unexpected packing stats: %d containers, %d bytes, %d garbage", status.Containers, status.PackedBytes, status.GarbageBytes)
+	}
+	for _, filename := range []string{"a.txt", "b.txt", "c.txt"} {
+		data, _ := proto.Marshal(&pb.DeleteRequest{Filename: filename})
+		if _, err := controller.handleDeleteRequest(data, nil); err != nil {
+			t.Fatalf("Failed to delete %s: %v", filename, err)
+		}
+		if filename == "a.txt" {
+			if status := stats(); status.GarbageBytes != 150 {
+				t.Errorf("Deleted packed file left %d bytes of garbage, want 150", status.GarbageBytes)
+			}
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for node.count(common.MsgTypeChunkDelete) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(controller.containers) != 0 || node.count(common.MsgTypeChunkDelete) != 2 {
+		t.Errorf("Empty containers were not garbage collected: %d left, %d deleted", len(controller.containers), node.count(common.MsgTypeChunkDelete))
+	}
+}
+
+func TestContainerCompaction(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 1
+	controller.packThreshold = 4096
+
+	node := newMockCommandNode(t)
+	defer node.listener.Close()
+	nodeID := node.listener.Addr().String()
+	controller.nodes[nodeID] = &NodeInfo{
+		ID:               nodeID,
+		FreeSpace:        1024 * 1024 * 1024,
+		LastHeartbeat:    time.Now(),
+		ReplicatedChunks: make(map[string][]int),
+	}
+
+	var blockName string
+	for _, filename := range []string{"a.txt", "b.txt", "c.txt"} {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: 100, ChunkSize: 1024 * 1024, ClientId: "writer"})
+		respData, err := controller.handleStorageRequest(data, nil)
+		if err != nil {
+			t.Fatalf("Storage request for %s failed: %v", filename, err)
+		}
+		response := &pb.StorageResponse{}
+		proto.Unmarshal(respData, response)
+		blockName = response.Packed.BlockName
+		data, _ = proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: filename, ClientId: "writer"})
+		if _, err := controller.handleLeaseRequest(data, nil); err != nil {
+			t.Fatalf("Failed to release lease on %s: %v", filename, err)
+		}
+	}
+	packed := controller.containers[blockName]
+
+	// Containers are compacted once deleted files take up half of them
+	for _, filename := range []string{"a.txt", "b.txt"} {
+		if packed.needsCompaction() {
+			t.Errorf("Container compacted before %s was deleted", filename)
+		}
+		data, _ := proto.Marshal(&pb.DeleteRequest{Filename: filename})
+		if _, err := controller.handleDeleteRequest(data, nil); err != nil {
+			t.Fatalf("Failed to delete %s: %v", filename, err)
+		}
+	}
+	if !packed.needsCompaction() || packed.Garbage != 200 || len(packed.Released) != 2 {
+		t.Fatalf("Unexpected garbage after deletes: %d bytes at %v", packed.Garbage, packed.Released)
+	}
+
+	controller.compactContainer(blockName)
+	if node.count(common.MsgTypeChunkCompact) != 1 || packed.Garbage != 0 || len(packed.Released) != 0 || packed.Size != 300 {
+		t.Errorf("Unexpected container after compaction: %d garbage at %v, %d bytes", packed.Garbage, packed.Released, packed.Size)
+	}
+
+	// Container block names are reserved
+	data, _ := proto.Marshal(&pb.StorageRequest{Filename: blockName, FileSize: 100, ChunkSize: 1024 * 1024})
+	respData, _ := controller.handleStorageRequest(data, nil)
+	response := &pb.StorageResponse{}
+	proto.Unmarshal(respData, response)
+	if response.Error == "" {
+		t.Error("File stored under a container's block name")
+	}
+}
+
+func TestInlineFiles(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 1
+	controller.inlineThreshold = 1024
+	controller.metadataPath = filepath.Join(t.TempDir(), "metadata.json")
+	controller.userQuotas["alice"] = &quota{SpaceLimit: 2500}
+	data, _ := proto.Marshal(&pb.Heartbeat{NodeId: "node-1", FreeSpace: 1024 * 1024 * 1024})
+	if _, err := controller.handleHeartbeat(data, nil); err != nil {
+		t.Fatalf("Failed to register node: %v", err)
+	}
+
+	store := func(filename string, contents []byte, size uint64) (*pb.StorageResponse, error) {
+		data, _ := proto.Marshal(&pb.StorageRequest{Filename: filename, FileSize: size, ChunkSize: 1024 * 1024, ClientId: "writer", User: "alice", InlineData: contents})
+		respData, err := controller.handleStorageRequest(data, nil)
+		response := &pb.StorageResponse{}
+		proto.Unmarshal(respData, response)
+		return response, err
+	}
+
+	// The file is complete with the storage request
+	contents := []byte("tiny file contents")
+	response, err := store("tiny.txt", contents, uint64(len(contents)))
+	if err != nil || !response.Inline || len(response.ChunkPlacements) != 0 {
+		t.Fatalf("Tiny file was not stored inline: %v, %v", response, err)
+	}
+	if _, exists := controller.leases["tiny.txt"]; exists {
+		t.Error("Lease left behind by an inline store")
+	}
+
+	data, _ = proto.Marshal(&pb.RetrievalRequest{Filename: "tiny.txt"})
+	respData, err := controller.handleRetrievalRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Retrieval request failed: %v", err)
+	}
+	layout := &pb.RetrievalResponse{}
+	proto.Unmarshal(respData, layout)
+	if !bytes.Equal(layout.InlineData, contents) || len(layout.Chunks) != 0 {
+		t.Errorf("Unexpected layout of an inline file: %v", layout)
+	}
+
+	// Files above the threshold, or without all their contents, go to storage nodes
+	if response, _ := store("large.txt", make([]byte, 2000), 2000); response.Inline {
+		t.Error("File above the inline threshold was stored inline")
+	}
+	if response, _ := store("partial.txt", contents[:4], uint64(len(contents))); response.Inline {
+		t.Error("File with partial contents was stored inline")
+	}
+
+	// Inline bytes count against quotas once
+	info := controller.quotaInfo("", "alice", false)
+	if want := uint64(len(contents) + 2000 + len(contents)); info.SpaceUsed != want {
+		t.Errorf("Quota usage is %d, want %d", info.SpaceUsed, want)
+	}
+	if _, err := store("over.txt", make([]byte, 1000), 1000); err == nil {
+		t.Error("Inline store over quota succeeded")
+	}
+
+	// Inline contents are kept out of the metadata file and survive a restart
+	if controller.inlineChanged {
+		t.Error("Inline store left unsaved")
+	}
+	saved, err := os.ReadFile(controller.metadataPath)
+	if err != nil || bytes.Contains(saved, []byte(base64.StdEncoding.EncodeToString(contents))) {
+		t.Errorf("Inline contents written to the metadata file: %v", err)
+	}
+	restarted := NewController(0)
+	restarted.metadataPath = controller.metadataPath
+	if err := restarted.loadMetadata(); err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	if metadata := restarted.files["tiny.txt"]; metadata == nil || !bytes.Equal(metadata.Inline, contents) {
+		t.Errorf("Inline file lost on restart: %v", metadata)
+	}
+}
+
+func TestStreamingUpload(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 1
+	controller.userQuotas["alice"] = &quota{SpaceLimit: 3000}
+	data, _ := proto.Marshal(&pb.Heartbeat{NodeId: "node-1", FreeSpace: 1024 * 1024 * 1024})
+	if _, err := controller.handleHeartbeat(data, nil); err != nil {
+		t.Fatalf("Failed to register node: %v", err)
+	}
+
+	allocate := func(filename string, chunkNum uint32) (*pb.ChunkAllocationResponse, error) {
+		data, _ := proto.Marshal(&pb.ChunkAllocationRequest{Filename: filename, ChunkNumber: chunkNum, ClientId: "writer"})
+		respData, err := controller.handleChunkAllocationRequest(data)
+		response := &pb.ChunkAllocationResponse{}
+		proto.Unmarshal(respData, response)
+		return response, err
+	}
+	release := func(filename string, size uint64) error {
+		data, _ := proto.Marshal(&pb.LeaseRequest{Action: "release", Filename: filename, ClientId: "writer", FileSize: size})
+		_, err := controller.handleLeaseRequest(data, nil)
+		return err
+	}
+
+	// A streamed file starts without chunks or a size
+	data, _ = proto.Marshal(&pb.StorageRequest{Filename: "dump.sql", ChunkSize: 1000, ClientId: "writer", User: "alice", Streaming: true})
+	respData, err := controller.handleStorageRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Streaming storage request failed: %v", err)
+	}
+	response := &pb.StorageResponse{}
+	proto.Unmarshal(respData, response)
+	if len(response.ChunkPlacements) != 0 {
+		t.Errorf("Chunks placed before any data arrived: %v", response.ChunkPlacements)
+	}
+
+	// Chunks are allocated in order, and a retried allocation gets the same nodes
+	first, err := allocate("dump.sql", 0)
+	if err != nil || len(first.Placement.StorageNodes) != 1 {
+		t.Fatalf("Failed to allocate chunk 0: %v, %v", first, err)
+	}
+	if _, err := allocate("dump.sql", 2); err == nil {
+		t.Error("Chunk allocated out of order")
+	}
+	if again, err := allocate("dump.sql", 0); err != nil || !reflect.DeepEqual(again.Placement.StorageNodes, first.Placement.StorageNodes) {
+		t.Errorf("Retried allocation moved the chunk: %v, %v", again, err)
+	}
+	if _, err := allocate("dump.sql", 1); err != nil {
+		t.Fatalf("Failed to allocate chunk 1: %v", err)
+	}
+
+	// Each allocation is charged as a full chunk
+	if _, err := allocate("dump.sql", 2); err != nil {
+		t.Fatalf("Failed to allocate chunk 2: %v", err)
+	}
+	if _, err := allocate("dump.sql", 3); err == nil {
+		t.Error("Allocation over quota succeeded")
+	}
+
+	// The final size must end in the last allocated chunk
+	if err := release("dump.sql", 2000); err == nil {
+		t.Error("Stream released with a size short of its chunks")
+	}
+	if err := release("dump.sql", 3001); err == nil {
+		t.Error("Stream released with a size past its chunks")
+	}
+	if err := release("dump.sql", 2500); err != nil {
+		t.Fatalf("Failed to release stream: %v", err)
+	}
+	metadata := controller.files["dump.sql"]
+	if metadata.Size != 2500 || len(metadata.Chunks) != 3 {
+		t.Errorf("Streamed file has size %d and %d chunks, want 2500 and 3", metadata.Size, len(metadata.Chunks))
+	}
+	if _, exists := controller.leases["dump.sql"]; exists {
+		t.Error("Lease left behind by a completed stream")
+	}
+	if _, err := allocate("dump.sql", 3); err == nil {
+		t.Error("Chunk allocated after the stream completed")
+	}
+}
+
+func TestRetrievalNodeLoad(t *testing.T) {
+	controller := NewController(0)
+	controller.replicationFactor = 2
+	heartbeat := func(nodeID string, requests uint64) {
+		data, _ := proto.Marshal(&pb.Heartbeat{NodeId: nodeID, FreeSpace: 1024 * 1024 * 1024, RequestsProcessed: requests})
+		if _, err := controller.handleHeartbeat(data, nil); err != nil {
+			t.Fatalf("Heartbeat from %s failed: %v", nodeID, err)
+		}
+	}
+	heartbeat("node-1", 0)
+	heartbeat("node-2", 0)
+	controller.nodes["node-1"].LastHeartbeat = time.Now().Add(-10 * time.Second)
+	controller.nodes["node-2"].LastHeartbeat = time.Now().Add(-10 * time.Second)
+	heartbeat("node-1", 500)
+	heartbeat("node-2", 10)
+
+	data, _ := proto.Marshal(&pb.StorageRequest{Filename: "data.bin", FileSize: 100, ChunkSize: 1024, ClientId: "writer"})
+	if _, err := controller.handleStorageRequest(data, nil); err != nil {
+		t.Fatalf("Storage request failed: %v", err)
+	}
+	data, _ = proto.Marshal(&pb.RetrievalRequest{Filename: "data.bin"})
+	respData, err := controller.handleRetrievalRequest(data, nil)
+	if err != nil {
+		t.Fatalf("Retrieval request failed: %v", err)
+	}
+	layout := &pb.RetrievalResponse{}
+	proto.Unmarshal(respData, layout)
+
+	// Request rates come from the counts reported between heartbeats
+	if load := layout.NodeLoad["node-1"]; load < 45 || load > 50 {
+		t.Errorf("node-1 load is %.1f, want about 50 requests per second", load)
+	}
+	if load := layout.NodeLoad["node-2"]; load < 0.9 || load > 1 {
+		t.Errorf("node-2 load is %.1f, want about 1 request per second", load)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	controller := NewController(0)
+
+	// Register storage nodes that accept commands
+	var nodes []*mockCommandNode
+	var nodeIDs []string
+	for i := 0; i < 3; i++ {
+		node := newMockCommandNode(t)
+		defer node.listener.Close()
+		nodes = append(nodes, node)
+		nodeID := node.listener.Addr().String()
+		nodeIDs = append(nodeIDs, nodeID)
+		controller.nodes[nodeID] = &NodeInfo{
+			ID:               nodeID,
+			FreeSpace:        1024 * 1024 * 1024,
+			LastHeartbeat:    time.Now(),
+			ReplicatedChunks: make(map[string][]int),
+		}
+	}
+	controller.files["data.bin"] = &FileMetadata{
+		Size:              100,
+		ChunkSize:         100,
+		ReplicationFactor: 2,
+		CreatedAt:         time.Now(),
+		Chunks:            map[int][]string{0: nodeIDs[:2]},
+	}
+
+	report := func(blockName string, bad []string, good string) (*pb.ReplicaReportResponse, error) {
+		data, _ := proto.Marshal(&pb.ReplicaReportRequest{BlockName: blockName, ChunkNumber: 0, BadNodes: bad, GoodNode: good})
+		respData, err := controller.handleReplicaReport(data)
+		response := &pb.ReplicaReportResponse{}
+		proto.Unmarshal(respData, response)
+		return response, err
+	}
+
+	// Reports must name a replica that holds the chunk as the good one
+	if _, err := report("missing.bin", nodeIDs[:1], nodeIDs[1]); err == nil {
+		t.Error("Report on an unknown chunk accepted")
+	}
+	if _, err := report("data.bin", nodeIDs[:1], nodeIDs[2]); err == nil {
+		t.Error("Report naming a node without the chunk as good accepted")
+	}
+
+	// Nodes that do not hold the chunk are not repaired
+	response, err := report("data.bin", []string{nodeIDs[0], nodeIDs[2]}, nodeIDs[1])
+	if err != nil || response.Scheduled != 1 {
+		t.Fatalf("Report scheduled %d repairs, %v, want 1", response.Scheduled, err)
+	}
+
+	// The good replica overwrites the bad one
+	deadline := time.Now().Add(2 * time.Second)
+	for nodes[1].count(common.MsgTypeChunkReplicate) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if nodes[1].count(common.MsgTypeChunkReplicate) != 1 || nodes[0].count(common.MsgTypeChunkReplicate) != 0 {
+		t.Error("Repair was not sent to the good replica")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"distributed_file_system/common"
+)
+
+// metadataState is the controller state saved to the metadata file. Files saved
+// before the state was versioned hold the files map on its own.
+type metadataState struct {
+	Version   int
+	Files     map[string]*FileMetadata
+	Versions  map[string][]*FileMetadata
+	Snapshots map[string]*snapshot
+
+	DirQuotas  map[string]*quota
+	UserQuotas map[string]*quota
+	Dirs       map[string]*dirInfo
+
+	ContentChunks map[string]*contentChunk
+	Containers    map[string]*container
+
+	// Writes in progress, so they are completed or recovered after a restart
+	Leases map[string]*writeLease
+}
+
+// metadataVersion is the current metadataState version. Version 2 added file modes.
+const metadataVersion = 2
+
+// saveMetadata writes the file metadata to disk so it survives a restart.
+// The caller must hold c.mu.
+func (c *Controller) saveMetadata() error {
+	if c.metadataPath == "" {
+		return nil
+	}
+
+	// Inline contents are saved first so the metadata never refers to missing ones
+	if err := c.saveInlineStore(); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated file
+	tmpPath := c.metadataPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create metadata file: %v", err)
+	}
+
+	encoder := json.NewEncoder(file)
+	state := &metadataState{
+		Version:    metadataVersion,
+		Files:      c.files,
+		Versions:   c.versions,
+		Snapshots:  c.snapshots,
+		DirQuotas:  c.dirQuotas,
+		UserQuotas: c.userQuotas,
+		Dirs:       c.dirs,
+
+		ContentChunks: c.contentChunks,
+		Containers:    c.containers,
+
+		Leases: c.leases,
+	}
+	if err := encoder.Encode(state); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close metadata file: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, c.metadataPath); err != nil {
+		return fmt.Errorf("failed to replace metadata file: %v", err)
+	}
+
+	return nil
+}
+
+// loadMetadata reads the file metadata saved by a previous run
+func (c *Controller) loadMetadata() error {
+	if c.metadataPath == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(c.metadataPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open metadata file: %v", err)
+	}
+
+	state := &metadataState{}
+	if err := json.Unmarshal(raw, state); err != nil || state.Version == 0 {
+		state = &metadataState{}
+		if err := json.Unmarshal(raw, &state.Files); err != nil {
+			return fmt.Errorf("failed to decode metadata: %v", err)
+		}
+	}
+	files := state.Files
+	if files == nil {
+		files = make(map[string]*FileMetadata)
+	}
+	versions := state.Versions
+	if versions == nil {
+		versions = make(map[string][]*FileMetadata)
+	}
+	snapshots := state.Snapshots
+	if snapshots == nil {
+		snapshots = make(map[string]*snapshot)
+	}
+	dirQuotas := state.DirQuotas
+	if dirQuotas == nil {
+		dirQuotas = make(map[string]*quota)
+	}
+	userQuotas := state.UserQuotas
+	if userQuotas == nil {
+		userQuotas = make(map[string]*quota)
+	}
+	dirs := state.Dirs
+	if dirs == nil {
+		dirs = make(map[string]*dirInfo)
+	}
+	contentChunks := state.ContentChunks
+	if contentChunks == nil {
+		contentChunks = make(map[string]*contentChunk)
+	}
+	containers := state.Containers
+	if containers == nil {
+		containers = make(map[string]*container)
+	}
+	leases := state.Leases
+	if leases == nil {
+		leases = make(map[string]*writeLease)
+	}
+
+	// Writers get a full lease timeout from the restart to renew their leases;
+	// leases nobody renews are recovered once safe mode is left
+	var nextAppendID uint64
+	for _, lease := range leases {
+		lease.Expires = time.Now().Add(common.LeaseTimeout * time.Second)
+		if lease.Append != nil && lease.Append.ID > nextAppendID {
+			nextAppendID = lease.Append.ID
+		}
+	}
+
+	// Files saved without a creation time are treated as new rather than cold
+	now := time.Now()
+	for _, metadata := range files {
+		if metadata.CreatedAt.IsZero() {
+			metadata.CreatedAt = now
+		}
+		if metadata.Generation == 0 {
+			metadata.Generation = 1
+		}
+		// Files saved before permissions existed get the default mode
+		if state.Version < 2 {
+			metadata.Mode = common.DefaultFileMode
+		}
+	}
+
+	c.mu.Lock()
+	c.files = files
+	c.versions = versions
+	c.snapshots = snapshots
+	c.dirQuotas = dirQuotas
+	c.userQuotas = userQuotas
+	c.dirs = dirs
+	c.contentChunks = contentChunks
+	c.containers = containers
+	c.leases = leases
+	c.nextAppendID = nextAppendID
+	c.recoverContainers()
+	err = c.loadInlineStore()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+)
+
+// beginWrite records the metadata of a file placed by a storage request and grants
+// the writer its lease, if it named itself. A new file is visible right away, while the new version of
+// an overwritten file is written under a fresh block name and kept pending until
+// the writer releases its lease. Returns the block name to write the chunks under.
+// The caller must hold c.mu.
+func (c *Controller) beginWrite(request *dfs.StorageRequest, metadata *FileMetadata) string {
+	metadata.Generation = c.latestGeneration(request.Filename) + 1
+	if request.Compression != common.CodecNone {
+		metadata.Compression = request.Compression
+	}
+	if request.Encryption != nil {
+		metadata.Cipher, metadata.WrappedKey = request.Encryption.Algorithm, request.Encryption.WrappedKey
+	}
+	for _, offset := range request.ChunkOffsets {
+		metadata.ChunkOffsets = append(metadata.ChunkOffsets, int64(offset))
+	}
+	existing, exists := c.files[request.Filename]
+	if !exists {
+		metadata.Owner = request.User
+		metadata.Mode = common.DefaultFileMode
+		if len(request.Groups) > 0 {
+			metadata.Group = request.Groups[0]
+		}
+		// A trashed, previous or snapshotted version of a deleted file may still own the chunks under its name
+		if c.blockNameInUse(request.Filename) {
+			metadata.BlockName = newBlockName(request.Filename, "v")
+		}
+		c.files[request.Filename] = metadata
+		if request.ClientId != "" {
+			c.grantLease(request.Filename, request.ClientId, "create").Streaming = request.Streaming
+		}
+		return metadata.BlockName
+	}
+
+	metadata.Owner, metadata.Group, metadata.Mode = existing.Owner, existing.Group, existing.Mode
+	metadata.BlockName = newBlockName(request.Filename, "v")
+	lease := c.grantLease(request.Filename, request.ClientId, "overwrite")
+	lease.Streaming = request.Streaming
+	if lease.Pending != nil {
+		c.releaseChunks(request.Filename, lease.Pending)
+	}
+	lease.Pending = metadata
+	return metadata.BlockName
+}
+
+// commitOverwrite atomically replaces a file with its pending new version and
+// archives the old version. The caller must hold c.mu.
+func (c *Controller) commitOverwrite(filename string, pending *FileMetadata) {
+	old, exists := c.files[filename]
+	c.files[filename] = pending
+	delete(c.transcodeTasks, filename)
+	if exists {
+		c.archiveVersion(filename, old)
+	}
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+	log.Printf("Replaced %s with generation %d", filename, pending.Generation)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// containerCapacity is the most bytes packed into one container chunk
+const containerCapacity = common.DefaultChunkSize
+
+// containerPrefix starts the block names of container chunks
+const containerPrefix = common.ContainerBlockPrefix + "pack"
+
+// compactionRatio is the share of a container's bytes that deleted files may
+// take up before it is compacted
+const compactionRatio = 0.5
+
+// packedExtent is the range of a container holding one packed file
+type packedExtent struct {
+	Length    int64
+	Refs      int  // Files, versions and snapshot copies referencing it
+	Committed bool // The write that packed it completed
+}
+
+// container is a chunk that small files are packed into back to back. Deleted
+// files leave garbage behind until the container is compacted or empty.
+type container struct {
+	Nodes       []string
+	Replication int
+	Size        int64                   // Bytes written or reserved; the next file is packed here
+	Generation  uint64                  // Bumped by every file packed into it
+	Writing     bool                    // A file is being packed into it, so no other may be until it is done
+	Extents     map[int64]*packedExtent // Packed files, by offset
+	Garbage     int64                   // Bytes of deleted files not compacted away yet
+	Released    []int64                 // Offsets of the deleted files not compacted away yet
+}
+
+// needsCompaction reports whether deleted files take up enough of the container
+// to compact it
+func (p *container) needsCompaction() bool {
+	if p.Garbage == 0 {
+		return false
+	}
+	live := int64(0)
+	for _, extent := range p.Extents {
+		live += extent.Length
+	}
+	return float64(p.Garbage) >= compactionRatio*float64(live+p.Garbage)
+}
+
+// isPacked reports whether the file is stored inside a container chunk
+func (m *FileMetadata) isPacked() bool {
+	return m.Container != ""
+}
+
+// packable reports whether a storage request is for a small file to pack into
+// a container: plain replicated data no larger than the packing threshold
+func (c *Controller) packable(request *dfs.StorageRequest) bool {
+	if c.packThreshold <= 0 || request.FileSize == 0 || request.FileSize > uint64(c.packThreshold) {
+		return false
+	}
+	// The container is only released for others when the writer releases its lease
+	return plainData(request) && request.ClientId != ""
+}
+
+// placePackedFile packs a small file into a container with room left and the
+// same replication factor, opening a new container if none has. The writer
+// appends the file to the container at the returned offset. The caller must
+// hold c.mu.
+func (c *Controller) placePackedFile(request *dfs.StorageRequest, replication int) ([]byte, error) {
+	size := int64(request.FileSize)
+
+	// Appends to a chunk must not overlap, so containers take one writer at a time
+	var blockName string
+	var packed *container
+	for name, candidate := range c.containers {
+		if !candidate.Writing && candidate.Replication == replication && candidate.Size+size <= containerCapacity &&
+			len(c.liveReplicas(candidate.Nodes)) == len(candidate.Nodes) {
+			blockName, packed = name, candidate
+			break
+		}
+	}
+	if packed == nil {
+		nodes := c.selectStorageNodes(containerCapacity, replication, nil)
+		if len(nodes) < replication {
+			return nil, fmt.Errorf("not enough storage nodes available")
+		}
+		blockName = newBlockName(containerPrefix, "")
+		packed = &container{Nodes: nodes, Replication: replication, Extents: make(map[int64]*packedExtent)}
+		c.containers[blockName] = packed
+	}
+
+	offset := packed.Size
+	packed.Size += size
+	packed.Generation++
+	packed.Writing = true
+	packed.Extents[offset] = &packedExtent{Length: size, Refs: 1}
+
+	metadata := &FileMetadata{
+		Size:              size,
+		ChunkSize:         int(request.ChunkSize),
+		ReplicationFactor: replication,
+		CreatedAt:         time.Now(),
+		Chunks:            make(map[int][]string),
+		Container:         blockName,
+		ContainerOffset:   offset,
+	}
+	c.beginWrite(request, metadata)
+
+	response := &dfs.StorageResponse{
+		Packed: &dfs.PackedExtent{
+			BlockName:    blockName,
+			Offset:       uint64(offset),
+			Generation:   packed.Generation,
+			StorageNodes: packed.Nodes,
+			BlockToken:   c.issueExtentToken(blockName, common.BlockTokenWrite, offset, size),
+		},
+	}
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// packedExtent returns where a packed file is stored, with a token to read its
+// container. The caller must hold c.mu.
+func (c *Controller) packedExtent(metadata *FileMetadata) *dfs.PackedExtent {
+	extent := &dfs.PackedExtent{
+		BlockName:  metadata.Container,
+		Offset:     uint64(metadata.ContainerOffset),
+		BlockToken: c.issueExtentToken(metadata.Container, common.BlockTokenRead, metadata.ContainerOffset, metadata.Size),
+	}
+	if packed, exists := c.containers[metadata.Container]; exists {
+		extent.StorageNodes = c.liveReplicas(packed.Nodes)
+	}
+	return extent
+}
+
+// retainPacked adds a reference to a packed file's extent, e.g. for a snapshot
+// copy. The caller must hold c.mu.
+func (c *Controller) retainPacked(metadata *FileMetadata) {
+	if packed, exists := c.containers[metadata.Container]; exists {
+		if extent, exists := packed.Extents[metadata.ContainerOffset]; exists {
+			extent.Refs++
+		}
+	}
+}
+
+// commitPacked marks a packed file's write as completed, opening its container
+// to the next writer. The caller must hold c.mu.
+func (c *Controller) commitPacked(metadata *FileMetadata) {
+	packed, exists := c.containers[metadata.Container]
+	if !exists {
+		return
+	}
+	if extent, exists := packed.Extents[metadata.ContainerOffset]; exists && !extent.Committed {
+		extent.Committed = true
+		packed.Writing = false
+	}
+}
+
+// recoverContainers settles the files that were being packed when the
+// controller stopped. Writes still under a lease are left to lease recovery;
+// any other unfinished write is dropped, along with the file it created, so
+// its container opens to the next writer. The caller must hold c.mu.
+func (c *Controller) recoverContainers() {
+	owned := make(map[*packedExtent]bool)
+	for filename, lease := range c.leases {
+		for _, metadata := range []*FileMetadata{c.files[filename], lease.Pending} {
+			if extent := c.extentOf(metadata); extent != nil {
+				owned[extent] = true
+			}
+		}
+	}
+	for filename, metadata := range c.files {
+		if extent := c.extentOf(metadata); extent != nil && !extent.Committed && !owned[extent] {
+			delete(c.files, filename)
+			log.Printf("Removed %s, its write did not complete", filename)
+		}
+	}
+
+	for blockName, packed := range c.containers {
+		packed.Writing = false
+		for offset, extent := range packed.Extents {
+			switch {
+			case extent.Committed:
+			case owned[extent]:
+				packed.Writing = true
+			default:
+				delete(packed.Extents, offset)
+				packed.Garbage += extent.Length
+				packed.Released = append(packed.Released, offset)
+			}
+		}
+		if len(packed.Extents) == 0 && !packed.Writing {
+			delete(c.containers, blockName)
+			go c.deleteChunks(blockName, map[int][]string{0: packed.Nodes})
+		}
+	}
+}
+
+// extentOf returns the extent of a packed file, or nil if the file is not
+// packed. The caller must hold c.mu.
+func (c *Controller) extentOf(metadata *FileMetadata) *packedExtent {
+	if metadata == nil || !metadata.isPacked() {
+		return nil
+	}
+	packed, exists := c.containers[metadata.Container]
+	if !exists {
+		return nil
+	}
+	return packed.Extents[metadata.ContainerOffset]
+}
+
+// releasePacked drops a reference to a packed file's extent. An unreferenced
+// extent becomes garbage until the container is compacted, even if its write
+// never completed, since storage nodes only pack files past the end of a
+// container; a container left without extents is garbage collected. The caller
+// must hold c.mu.
+func (c *Controller) releasePacked(metadata *FileMetadata) {
+	packed, exists := c.containers[metadata.Container]
+	if !exists {
+		return
+	}
+	extent, exists := packed.Extents[metadata.ContainerOffset]
+	if !exists {
+		return
+	}
+	extent.Refs--
+	if extent.Refs > 0 {
+		return
+	}
+	delete(packed.Extents, metadata.ContainerOffset)
+
+	if !extent.Committed {
+		packed.Writing = false
+	}
+	packed.Garbage += extent.Length
+	packed.Released = append(packed.Released, metadata.ContainerOffset)
+	if len(packed.Extents) == 0 && !packed.Writing {
+		delete(c.containers, metadata.Container)
+		go c.deleteChunks(metadata.Container, map[int][]string{0: packed.Nodes})
+	}
+}
+
+// packingStats returns the number of containers, the bytes written to them and
+// the bytes of deleted files awaiting compaction. The caller must hold c.mu.
+func (c *Controller) packingStats() (containers int, packedBytes, garbageBytes uint64) {
+	for _, packed := range c.containers {
+		packedBytes += uint64(packed.Size)
+		garbageBytes += uint64(packed.Garbage)
+	}
+	return len(c.containers), packedBytes, garbageBytes
+}
+
+// replicateContainer copies a container from a live replica to new nodes until
+// it reaches its replication factor. Containers being written to are left for
+// a later pass, since the copy would miss the file being packed.
+func (c *Controller) replicateContainer(blockName string) {
+	key := chunkKey(blockName, 0)
+
+	c.mu.Lock()
+	packed, exists := c.containers[blockName]
+	if !exists || packed.Writing || c.safeMode || c.replicating[key] {
+		c.mu.Unlock()
+		return
+	}
+
+	live := c.liveReplicas(packed.Nodes)
+	missing := packed.Replication - len(live)
+	if missing <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	if len(live) == 0 {
+		c.mu.Unlock()
+		log.Printf("Container %s has no live replicas left", blockName)
+		return
+	}
+
+	targets := c.selectStorageNodes(containerCapacity, missing, packed.Nodes)
+	if len(targets) == 0 {
+		c.mu.Unlock()
+		log.Printf("No storage nodes available to re-replicate container %s", blockName)
+		return
+	}
+	generation := packed.Generation
+	c.replicating[key] = true
+	c.mu.Unlock()
+
+	// Have an existing replica push the container to the new nodes
+	err := c.sendChunkReplicate(live[0], blockName, 0, targets)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.replicating, key)
+
+	if err != nil {
+		// A partial copy would refuse the files of the next attempt
+		log.Printf("Failed to replicate container %s from %s: %v", blockName, live[0], err)
+		go c.deleteChunks(blockName, map[int][]string{0: targets})
+		return
+	}
+
+	// A file packed while the copy was in flight is missing from it
+	if c.containers[blockName] != packed || packed.Generation != generation {
+		go c.deleteChunks(blockName, map[int][]string{0: targets})
+		return
+	}
+	packed.Nodes = append(c.liveReplicas(packed.Nodes), targets...)
+	log.Printf("Replicated container %s to %v", blockName, targets)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+}
+
+// validateContainerName rejects storage requests for files whose chunks would
+// be taken for container chunks
+func validateContainerName(request *dfs.StorageRequest) error {
+	if common.IsContainerBlockName(request.Filename) {
+		return &common.ValidationError{Field: "filename", Message: fmt.Sprintf("names starting with %s are reserved", common.ContainerBlockPrefix)}
+	}
+	return nil
+}
+
+// compactContainer has every replica of a container drop the deleted files
+// packed into it, reclaiming their space. Replicas that miss a pass are
+// compacted by the next one.
+func (c *Controller) compactContainer(blockName string) {
+	key := chunkKey(blockName, 0)
+
+	c.mu.Lock()
+	packed, exists := c.containers[blockName]
+	if !exists || c.safeMode || c.replicating[key] {
+		c.mu.Unlock()
+		return
+	}
+	released := slices.Clone(packed.Released)
+	garbage := packed.Garbage
+	nodes := c.liveReplicas(packed.Nodes)
+	c.replicating[key] = true
+	c.mu.Unlock()
+
+	failed := len(nodes) < len(packed.Nodes)
+	for _, nodeID := range nodes {
+		if err := c.sendChunkCompact(nodeID, blockName, released); err != nil {
+			log.Printf("Failed to compact container %s on %s: %v", blockName, nodeID, err)
+			failed = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.replicating, key)
+	if failed || c.containers[blockName] != packed {
+		return
+	}
+
+	// Files deleted while the replicas were compacted are left for the next pass
+	packed.Released = packed.Released[len(released):]
+	packed.Garbage -= garbage
+	log.Printf("Compacted %d bytes of deleted files out of container %s", garbage, blockName)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Permission bits checked against a file's or directory's mode
+const (
+	accessRead    uint32 = 4
+	accessWrite   uint32 = 2
+	accessExecute uint32 = 1
+
+	modeSticky uint32 = 01000 // Only owners may delete files in the directory
+)
+
+// implicitDirMode applies to directories that were never chmod'ed or chown'ed:
+// anyone may create files, and only their owners may delete them
+const implicitDirMode uint32 = 01777
+
+// caller is the identity a request is made on behalf of
+type caller struct {
+	user   string
+	groups []string
+}
+
+// dirInfo holds the ownership and mode of a directory that was chmod'ed or chown'ed
+type dirInfo struct {
+	Owner string
+	Group string
+	Mode  uint32
+}
+
+// accessName describes permission bits for error messages
+func accessName(access uint32) string {
+	var names []string
+	if access&accessRead != 0 {
+		names = append(names, "read")
+	}
+	if access&accessWrite != 0 {
+		names = append(names, "write")
+	}
+	if access&accessExecute != 0 {
+		names = append(names, "execute")
+	}
+	return strings.Join(names, "+")
+}
+
+// permits reports whether who has the access bits on an object with the given
+// owner, group and mode. An anonymous caller never matches an owner.
+func permits(who caller, owner, group string, mode, access uint32) bool {
+	bits := mode & 7
+	if who.user != "" && who.user == owner {
+		bits = mode >> 6 & 7
+	} else {
+		for _, g := range who.groups {
+			if g != "" && g == group {
+				bits = mode >> 3 & 7
+				break
+			}
+		}
+	}
+	return bits&access == access
+}
+
+// identify returns who a request is made by. A client that authenticated with a
+// certificate is the user it names; without TLS the identity in the request is
+// trusted, so permission checks are only advisory.
+func identify(peer *caller, user string, groups []string) caller {
+	if peer != nil {
+		return *peer
+	}
+	return caller{user, groups}
+}
+
+// checkSuperuser checks that who may perform an admin action. The caller must
+// hold c.mu.
+func (c *Controller) checkSuperuser(who caller, path string) error {
+	if !c.isSuperuser(who) {
+		return &common.PermissionDeniedError{User: who.user, Path: path, Access: "admin"}
+	}
+	return nil
+}
+
+// isSuperuser reports whether permission checks are off or who is an admin. The
+// caller must hold c.mu.
+func (c *Controller) isSuperuser(who caller) bool {
+	return !c.permissions || (who.user != "" && c.superusers[who.user])
+}
+
+// dir returns the ownership and mode of a directory, empty for the root. The
+// caller must hold c.mu.
+func (c *Controller) dir(path string) *dirInfo {
+	if info, exists := c.dirs[path]; exists {
+		return info
+	}
+	return &dirInfo{Mode: implicitDirMode}
+}
+
+// parentDirs returns the directories containing a file, from the root down
+func parentDirs(filename string) []string {
+	dirs := []string{""}
+	for i, r := range filename {
+		if r == '/' && i > 0 {
+			dirs = append(dirs, filename[:i])
+		}
+	}
+	return dirs
+}
+
+// checkParents checks that who may traverse every directory containing a file
+// and has the access bits on its parent directory. The caller must hold c.mu.
+func (c *Controller) checkParents(who caller, filename string, access uint32) error {
+	if c.isSuperuser(who) {
+		return nil
+	}
+	dirs := parentDirs(filename)
+	for i, path := range dirs {
+		need := accessExecute
+		if i == len(dirs)-1 {
+			need |= access
+		}
+		info := c.dir(path)
+		if !permits(who, info.Owner, info.Group, info.Mode, need) {
+			return &common.PermissionDeniedError{User: who.user, Path: "/" + path, Access: accessName(need)}
+		}
+	}
+	return nil
+}
+
+// checkFile checks that who may reach a file and has the access bits on it. The
+// caller must hold c.mu.
+func (c *Controller) checkFile(who caller, filename string, metadata *FileMetadata, access uint32) error {
+	if c.isSuperuser(who) {
+		return nil
+	}
+	if err := c.checkParents(who, filename, 0); err != nil {
+		return err
+	}
+	if !permits(who, metadata.Owner, metadata.Group, metadata.Mode, access) {
+		return &common.PermissionDeniedError{User: who.user, Path: filename, Access: accessName(access)}
+	}
+	return nil
+}
+
+// checkDelete checks that who may remove a file from its directory: write access
+// to the directory and, if it is sticky, ownership of the file or directory. The
+// caller must hold c.mu.
+func (c *Controller) checkDelete(who caller, filename string, metadata *FileMetadata) error {
+	if c.isSuperuser(who) {
+		return nil
+	}
+	if err := c.checkParents(who, filename, accessWrite); err != nil {
+		return err
+	}
+	dirs := parentDirs(filename)
+	parent := c.dir(dirs[len(dirs)-1])
+	if parent.Mode&modeSticky != 0 && (who.user == "" || (who.user != metadata.Owner && who.user != parent.Owner)) {
+		return &common.PermissionDeniedError{User: who.user, Path: filename, Access: "delete"}
+	}
+	return nil
+}
+
+// changePermissions applies a chmod or chown to a file, or to a directory which
+// then stops being implicit. The caller must hold c.mu.
+func (c *Controller) changePermissions(who caller, request *dfs.PermissionRequest) error {
+	path := strings.Trim(request.Path, "/")
+	owner, group, mode := "", "", uint32(common.DefaultDirMode)
+	metadata, isFile := c.files[path]
+	info, isDir := c.dirs[path]
+	switch {
+	case isFile:
+		owner, group, mode = metadata.Owner, metadata.Group, metadata.Mode
+	case isDir:
+		owner, group, mode = info.Owner, info.Group, info.Mode
+	}
+
+	// Only the owner may chmod; only a superuser may give a file away, while the
+	// owner may change its group to one of their own
+	superuser := c.isSuperuser(who)
+	isOwner := who.user != "" && who.user == owner
+	switch request.Action {
+	case "chmod":
+		if !superuser && !isOwner {
+			return &common.PermissionDeniedError{User: who.user, Path: "/" + path, Access: "chmod"}
+		}
+		mode = request.Mode & 07777
+	case "chown":
+		memberOf := false
+		for _, g := range who.groups {
+			memberOf = memberOf || (g != "" && g == request.Group)
+		}
+		if !superuser && (request.Owner != "" || !isOwner || !memberOf) {
+			return &common.PermissionDeniedError{User: who.user, Path: "/" + path, Access: "chown"}
+		}
+		if request.Owner != "" {
+			owner = request.Owner
+		}
+		if request.Group != "" {
+			group = request.Group
+		}
+	default:
+		return &common.ValidationError{Field: "action", Message: fmt.Sprintf("unknown permission action %q", request.Action)}
+	}
+
+	if isFile {
+		metadata.Owner, metadata.Group, metadata.Mode = owner, group, mode
+	} else {
+		c.dirs[path] = &dirInfo{Owner: owner, Group: group, Mode: mode}
+	}
+	log.Printf("%s /%s: owner %s, group %s, mode %04o", request.Action, path, owner, group, mode)
+	return nil
+}
+
+// handlePermissionRequest changes the mode or ownership of a file or directory
+func (c *Controller) handlePermissionRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.PermissionRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal permission request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkWritable("change permissions"); err != nil {
+		return marshalErrorResponse(&dfs.PermissionResponse{Error: err.Error()}, err)
+	}
+	if err := c.changePermissions(identify(peer, request.User, request.Groups), request); err != nil {
+		return marshalErrorResponse(&dfs.PermissionResponse{Error: err.Error()}, err)
+	}
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	response := &dfs.PermissionResponse{
+		Success: true,
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
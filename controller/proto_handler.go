@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"slices"
 	"sort"
 	"time"
 
@@ -11,11 +12,16 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-// handleHeartbeat processes a heartbeat message from a storage node
-func (c *Controller) handleHeartbeat(data []byte) error {
+// handleHeartbeat processes a heartbeat message from a storage node. Over TLS,
+// peer holds the identities in the node's certificate, one of which must be its ID.
+func (c *Controller) handleHeartbeat(data []byte, peer []string) ([]byte, error) {
 	heartbeat := &dfs.Heartbeat{}
 	if err := proto.Unmarshal(data, heartbeat); err != nil {
-		return fmt.Errorf("failed to unmarshal heartbeat: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal heartbeat: %v", err)
+	}
+	if c.transport != nil && !slices.Contains(peer, heartbeat.NodeId) {
+		err := &common.UnauthenticatedNodeError{NodeID: heartbeat.NodeId, Identities: peer}
+		return marshalErrorResponse(&dfs.HeartbeatResponse{Error: err.Error()}, err)
 	}
 
 	c.mu.Lock()
@@ -32,20 +38,73 @@ func (c *Controller) handleHeartbeat(data []byte) error {
 		log.Printf("New node joined: %s", heartbeat.NodeId)
 	}
 
+	// The request rate tells clients how busy the node is; a restarted node counts from zero again
+	now := time.Now()
+	if elapsed := now.Sub(node.LastHeartbeat).Seconds(); exists && elapsed > 0 && heartbeat.RequestsProcessed >= node.RequestsHandled {
+		node.RequestRate = float64(heartbeat.RequestsProcessed-node.RequestsHandled) / elapsed
+	}
+
 	node.FreeSpace = heartbeat.FreeSpace
 	node.RequestsHandled = heartbeat.RequestsProcessed
-	node.LastHeartbeat = time.Now()
+	node.LastHeartbeat = now
+	node.LogicalBytes = heartbeat.LogicalBytes
+	node.StoredBytes = heartbeat.StoredBytes
 
 	// Process any new files reported
 	for _, filename := range heartbeat.NewFiles {
 		log.Printf("Node %s reported new file: %s", heartbeat.NodeId, filename)
 	}
 
-	return nil
+	// Rebuild the node's chunk list from its full chunk report. An empty full
+	// report is authoritative too: the node holds no chunks, e.g. after a disk wipe.
+	if heartbeat.FullReport {
+		node.ReplicatedChunks = make(map[string][]int)
+		node.StoredSizes = make(map[string]int64, len(heartbeat.Chunks))
+		if c.safeMode {
+			c.blockReports[heartbeat.NodeId] = true
+		}
+	}
+	// Between full reports, chunks stored since the last heartbeat are added
+	for _, chunk := range append(heartbeat.Chunks, heartbeat.NewChunks...) {
+		c.recordChunk(node, chunk)
+	}
+	c.checkSafeMode()
+
+	// Registered nodes learn the secret to verify block tokens with. In safe mode,
+	// nodes that have not sent a full report since it was entered are asked for one
+	// rather than waiting for their next periodic report.
+	response := &dfs.HeartbeatResponse{
+		BlockTokenSecret:     c.blockTokenSecret,
+		BlockReportRequested: c.safeMode && !c.blockReports[heartbeat.NodeId],
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// recordChunk adds a chunk a node reported to its chunk list. The caller must
+// hold c.mu.
+func (c *Controller) recordChunk(node *NodeInfo, chunk *dfs.StoredChunk) {
+	chunkNum := int(chunk.ChunkNumber)
+	if !slices.Contains(node.ReplicatedChunks[chunk.Filename], chunkNum) {
+		node.ReplicatedChunks[chunk.Filename] = append(node.ReplicatedChunks[chunk.Filename], chunkNum)
+	}
+	if node.StoredSizes == nil {
+		node.StoredSizes = make(map[string]int64)
+	}
+	node.StoredSizes[chunkKey(chunk.Filename, chunkNum)] = int64(chunk.StoredSize)
+	if c.safeMode {
+		c.reportedChunks[chunkKey(chunk.Filename, chunkNum)] = true
+	}
 }
 
 // handleStorageRequest processes a storage request from a client
-func (c *Controller) handleStorageRequest(data []byte) ([]byte, error) {
+func (c *Controller) handleStorageRequest(data []byte, peer *caller) ([]byte, error) {
 	request := &dfs.StorageRequest{}
 	if err := proto.Unmarshal(data, request); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal storage request: %v", err)
@@ -54,23 +113,126 @@ func (c *Controller) handleStorageRequest(data []byte) ([]byte, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Check if file already exists
-	if _, exists := c.files[request.Filename]; exists {
-		return nil, fmt.Errorf("file already exists")
+	if err := c.checkWritable("store file"); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+
+	// Another writer may be creating the same file
+	if err := c.checkLease(request.Filename, request.ClientId); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+
+	// Check the caller's precondition, or that the file does not exist unless it is overwritten
+	existing, exists := c.files[request.Filename]
+	if request.ExpectedGeneration != nil {
+		var actual uint64
+		if exists {
+			actual = existing.Generation
+		}
+		if *request.ExpectedGeneration != actual {
+			err := &common.PreconditionFailedError{Filename: request.Filename, Expected: *request.ExpectedGeneration, Actual: actual}
+			return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+		}
+	} else if exists && !request.Overwrite {
+		err := &common.FileExistsError{Filename: request.Filename}
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+
+	// Creating a file needs write access to its directory, replacing one to the
+	// file. The verified identity owns the file and is charged for it.
+	who := identify(peer, request.User, request.Groups)
+	request.User, request.Groups = who.user, who.groups
+	var accessErr error
+	if exists {
+		accessErr = c.checkFile(who, request.Filename, existing, accessWrite)
+	} else {
+		accessErr = c.checkParents(who, request.Filename, accessWrite)
+	}
+	if accessErr != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: accessErr.Error()}, accessErr)
+	}
+
+	if err := validateEncryption(request); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+	if _, err := common.LookupCodec(request.Compression); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+	if err := validateChunkOffsets(request); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+	if err := validateDedup(request); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+	if err := validateContainerName(request); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+	if err := validateStreaming(request); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+	if err := validateWriter(request, exists); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+
+	// Charge the new file against the quotas of its directories and owner
+	if err := c.checkStorageQuota(request); err != nil {
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+
+	// Erasure-coded files are placed stripe by stripe
+	if request.ErasureCoding != nil {
+		return c.placeErasureCodedFile(request)
+	}
+
+	// Use the requested replication factor, falling back to the cluster default
+	replication := c.replicationFactor
+	if request.ReplicationFactor > 0 {
+		replication = int(request.ReplicationFactor)
+	}
+	if replication > common.MaxReplication {
+		err := &common.ValidationError{Field: "replication_factor", Message: fmt.Sprintf("must be at most %d", common.MaxReplication)}
+		return marshalErrorResponse(&dfs.StorageResponse{Error: err.Error()}, err)
+	}
+
+	// Deduplicated files share chunks already stored under the same content hash
+	if len(request.ChunkHashes) > 0 {
+		return c.placeDeduplicatedFile(request, replication)
+	}
+
+	// Streamed files are placed chunk by chunk as the writer asks
+	if request.Streaming {
+		return c.placeStreamingFile(request, replication)
+	}
+
+	// Tiny files sent along with the request never reach storage nodes
+	if c.inlinable(request) {
+		return c.storeInlineFile(request, replication)
+	}
+
+	// Small files share container chunks rather than each taking a chunk of its own
+	if c.packable(request) {
+		return c.placePackedFile(request, replication)
 	}
 
 	// Calculate number of chunks needed
-	numChunks := (request.FileSize + uint64(request.ChunkSize) - 1) / uint64(request.ChunkSize)
+	numChunks := requestChunks(request)
 
 	// Create chunk placements
 	response := &dfs.StorageResponse{
 		ChunkPlacements: make([]*dfs.ChunkPlacement, 0, numChunks),
 	}
+	metadata := &FileMetadata{
+		Size:              int64(request.FileSize),
+		ChunkSize:         int(request.ChunkSize),
+		ReplicationFactor: replication,
+		CreatedAt:         time.Now(),
+		Chunks:            make(map[int][]string),
+	}
 
 	// For each chunk, select storage nodes
 	for chunkNum := uint64(0); chunkNum < numChunks; chunkNum++ {
-		nodes := c.selectStorageNodes(int(request.ChunkSize))
-		if len(nodes) < c.replicationFactor {
+		nodes := c.selectStorageNodes(int(request.ChunkSize), replication, nil)
+		if len(nodes) < replication {
 			return nil, fmt.Errorf("not enough storage nodes available")
 		}
 
@@ -81,14 +243,14 @@ func (c *Controller) handleStorageRequest(data []byte) ([]byte, error) {
 		response.ChunkPlacements = append(response.ChunkPlacements, placement)
 
 		// Store chunk placements in metadata
-		if _, exists := c.files[request.Filename]; !exists {
-			c.files[request.Filename] = &FileMetadata{
-				Size:      int64(request.FileSize),
-				ChunkSize: int(request.ChunkSize),
-				Chunks:    make(map[int][]string),
-			}
-		}
-		c.files[request.Filename].Chunks[int(chunkNum)] = nodes
+		metadata.Chunks[int(chunkNum)] = nodes
+	}
+
+	response.BlockName = c.beginWrite(request, metadata)
+	response.BlockToken = c.issueBlockToken(metadata.blockName(request.Filename), common.BlockTokenWrite)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
 	}
 
 	// Serialize response
@@ -101,24 +263,43 @@ func (c *Controller) handleStorageRequest(data []byte) ([]byte, error) {
 }
 
 // handleRetrievalRequest processes a file retrieval request from a client
-func (c *Controller) handleRetrievalRequest(data []byte) ([]byte, error) {
+func (c *Controller) handleRetrievalRequest(data []byte, peer *caller) ([]byte, error) {
 	request := &dfs.RetrievalRequest{}
 	if err := proto.Unmarshal(data, request); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal retrieval request: %v", err)
 	}
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Check if file exists
-	metadata, exists := c.files[request.Filename]
+	// Check if the file, the requested version or its snapshot copy exists
+	metadata, exists := c.findVersion(request.Filename, request.Generation)
+	if request.Snapshot != "" {
+		metadata, exists = c.snapshotFile(request.Snapshot, request.Filename)
+	}
 	if !exists {
 		return nil, fmt.Errorf("file not found")
 	}
+	if err := c.checkFile(identify(peer, request.User, request.Groups), request.Filename, metadata, accessRead); err != nil {
+		return marshalErrorResponse(&dfs.RetrievalResponse{Error: err.Error()}, err)
+	}
+
+	// Access times are persisted with the next metadata change rather than on every read
+	metadata.LastAccessed = time.Now()
 
 	// Create chunk locations response
 	response := &dfs.RetrievalResponse{
-		Chunks: make([]*dfs.ChunkLocation, 0, len(metadata.Chunks)),
+		Chunks:        make([]*dfs.ChunkLocation, 0, len(metadata.Chunks)),
+		FileSize:      uint64(metadata.Size),
+		ChunkSize:     uint32(metadata.ChunkSize),
+		ErasureCoding: metadata.erasureCoding(),
+		BlockName:     metadata.BlockName,
+		Generation:    metadata.Generation,
+		BlockToken:    c.issueBlockToken(metadata.blockName(request.Filename), common.BlockTokenRead),
+		Encryption:    metadata.encryption(),
+	}
+	for _, offset := range metadata.ChunkOffsets {
+		response.ChunkOffsets = append(response.ChunkOffsets, uint64(offset))
 	}
 
 	// Add locations for each chunk
@@ -129,6 +310,14 @@ func (c *Controller) handleRetrievalRequest(data []byte) ([]byte, error) {
 		}
 		response.Chunks = append(response.Chunks, chunk)
 	}
+	if metadata.isDeduplicated() {
+		response.Chunks = c.contentLocations(metadata)
+	}
+	if metadata.isPacked() {
+		response.Packed = c.packedExtent(metadata)
+	}
+	response.InlineData = metadata.Inline
+	response.NodeLoad = c.nodeLoad(response)
 
 	// Serialize response
 	responseData, err := proto.Marshal(response)
@@ -139,11 +328,37 @@ func (c *Controller) handleRetrievalRequest(data []byte) ([]byte, error) {
 	return responseData, nil
 }
 
-// selectStorageNodes selects nodes for storing a new chunk
-func (c *Controller) selectStorageNodes(chunkSize int) []string {
+// nodeLoad returns the request rate of every node holding chunks of a retrieval
+// response, so the client can prefer idle replicas. The caller must hold c.mu.
+func (c *Controller) nodeLoad(response *dfs.RetrievalResponse) map[string]float64 {
+	load := make(map[string]float64)
+	add := func(nodes []string) {
+		for _, nodeID := range nodes {
+			if node, exists := c.nodes[nodeID]; exists {
+				load[nodeID] = node.RequestRate
+			}
+		}
+	}
+	for _, chunk := range response.Chunks {
+		add(chunk.StorageNodes)
+	}
+	if response.Packed != nil {
+		add(response.Packed.StorageNodes)
+	}
+	return load
+}
+
+// selectStorageNodes selects up to count nodes for storing a chunk, skipping
+// nodes in exclude (e.g. nodes that already hold a replica)
+func (c *Controller) selectStorageNodes(chunkSize int, count int, exclude []string) []string {
+	excluded := make(map[string]bool, len(exclude))
+	for _, nodeID := range exclude {
+		excluded[nodeID] = true
+	}
+
 	var availableNodes []string
 	for nodeID, info := range c.nodes {
-		if info.FreeSpace >= uint64(chunkSize) {
+		if info.FreeSpace >= uint64(chunkSize) && !excluded[nodeID] {
 			availableNodes = append(availableNodes, nodeID)
 		}
 	}
@@ -153,16 +368,16 @@ func (c *Controller) selectStorageNodes(chunkSize int) []string {
 		return c.nodes[availableNodes[i]].FreeSpace > c.nodes[availableNodes[j]].FreeSpace
 	})
 
-	// Select top N nodes where N is replication factor
-	if len(availableNodes) > c.replicationFactor {
-		availableNodes = availableNodes[:c.replicationFactor]
+	// Select top N nodes where N is the requested count
+	if len(availableNodes) > count {
+		availableNodes = availableNodes[:count]
 	}
 
 	return availableNodes
 }
 
 // handleDeleteRequest processes a file deletion request
-func (c *Controller) handleDeleteRequest(data []byte) ([]byte, error) {
+func (c *Controller) handleDeleteRequest(data []byte, peer *caller) ([]byte, error) {
 	request := &dfs.DeleteRequest{}
 	if err := proto.Unmarshal(data, request); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal delete request: %v", err)
@@ -171,29 +386,55 @@ func (c *Controller) handleDeleteRequest(data []byte) ([]byte, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if err := c.checkWritable("delete file"); err != nil {
+		return marshalErrorResponse(&dfs.DeleteResponse{Error: err.Error()}, err)
+	}
+
 	// Check if file exists
 	metadata, exists := c.files[request.Filename]
 	if !exists {
 		return nil, fmt.Errorf("file not found")
 	}
+	who := identify(peer, request.User, request.Groups)
+	if err := c.checkDelete(who, request.Filename, metadata); err != nil {
+		return marshalErrorResponse(&dfs.DeleteResponse{Error: err.Error()}, err)
+	}
 
 	// Create response
 	response := &dfs.DeleteResponse{
 		Success: true,
 	}
 
-	// Remove file metadata
-	delete(c.files, request.Filename)
+	// Discard any write in progress, then move the file to the trash. Files already
+	// in the trash, or deleted with the trash bypassed, are removed right away and
+	// kept only as a previous version if versioning is enabled.
+	c.recoverLease(request.Filename)
+	if _, exists := c.files[request.Filename]; exists {
+		switch {
+		case isTrashed(request.Filename):
+			c.removeTrashed(request.Filename, metadata)
+		case c.trashInterval > 0 && !request.SkipTrash:
+			response.TrashPath = c.moveToTrash(request.Filename, who.user, metadata)
+		default:
+			c.archiveVersion(request.Filename, metadata)
+			delete(c.files, request.Filename)
+			delete(c.transcodeTasks, request.Filename)
+		}
+	}
 
 	// Update node chunk information
 	for _, nodes := range metadata.Chunks {
 		for _, nodeID := range nodes {
 			if node, exists := c.nodes[nodeID]; exists {
-				delete(node.ReplicatedChunks, request.Filename)
+				delete(node.ReplicatedChunks, metadata.blockName(request.Filename))
 			}
 		}
 	}
 
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
 	// Serialize response
 	responseData, err := proto.Marshal(response)
 	if err != nil {
@@ -204,7 +445,12 @@ func (c *Controller) handleDeleteRequest(data []byte) ([]byte, error) {
 }
 
 // handleListRequest processes a file listing request
-func (c *Controller) handleListRequest(data []byte) ([]byte, error) {
+func (c *Controller) handleListRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.ListFilesRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal list request: %v", err)
+	}
+
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
@@ -212,11 +458,28 @@ func (c *Controller) handleListRequest(data []byte) ([]byte, error) {
 		Files: make([]*dfs.FileInfo, 0, len(c.files)),
 	}
 
+	// Only files in directories the caller may read are listed
+	who := identify(peer, request.User, request.Groups)
 	for filename, metadata := range c.files {
+		if c.checkParents(who, filename, accessRead) != nil {
+			continue
+		}
 		fileInfo := &dfs.FileInfo{
-			Filename:  filename,
-			Size:      uint64(metadata.Size),
-			NumChunks: uint32(len(metadata.Chunks)),
+			Filename:          filename,
+			Size:              uint64(metadata.Size),
+			NumChunks:         uint32(metadata.numChunks()),
+			ReplicationFactor: uint32(c.replicationFor(metadata)),
+			ErasureCoding:     metadata.erasureCoding(),
+			Generation:        metadata.Generation,
+			Owner:             metadata.Owner,
+			Group:             metadata.Group,
+			Mode:              metadata.Mode,
+			Encryption:        metadata.Cipher,
+			Compression:       metadata.Compression,
+			StoredSize:        c.storedSize(filename, metadata),
+			ContentDefined:    metadata.isContentDefined(),
+			Packed:            metadata.isPacked(),
+			Inline:            metadata.isInline(),
 		}
 		response.Files = append(response.Files, fileInfo)
 	}
@@ -245,6 +508,8 @@ func (c *Controller) handleNodeStatusRequest(data []byte) ([]byte, error) {
 			NodeId:           node.ID,
 			FreeSpace:       node.FreeSpace,
 			RequestsProcessed: node.RequestsHandled,
+			LogicalBytes:      node.LogicalBytes,
+			StoredBytes:       node.StoredBytes,
 		}
 		response.Nodes = append(response.Nodes, nodeInfo)
 		totalSpace += node.FreeSpace
@@ -252,6 +517,127 @@ func (c *Controller) handleNodeStatusRequest(data []byte) ([]byte, error) {
 
 	response.TotalSpace = totalSpace
 
+	// Report safe mode status
+	reported, total := c.safeModeProgress()
+	response.SafeMode = c.safeMode
+	response.ReportedChunks = uint64(reported)
+	response.TotalChunks = uint64(total)
+
+	// Report packing and the garbage left by deleted packed files
+	containers, packedBytes, garbageBytes := c.packingStats()
+	response.Containers = uint32(containers)
+	response.PackedBytes = packedBytes
+	response.GarbageBytes = garbageBytes
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// handleSafeModeRequest enters, leaves or reports safe mode
+func (c *Controller) handleSafeModeRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.SafeModeRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal safe mode request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if request.Action == "enter" || request.Action == "leave" {
+		if err := c.checkSuperuser(identify(peer, request.User, request.Groups), "/"); err != nil {
+			return marshalErrorResponse(&dfs.SafeModeResponse{Error: err.Error()}, err)
+		}
+	}
+
+	switch request.Action {
+	case "enter":
+		c.enterSafeMode()
+	case "leave":
+		c.leaveSafeMode()
+	case "get", "":
+	default:
+		err := &common.ValidationError{Field: "action", Message: fmt.Sprintf("unknown safe mode action %q", request.Action)}
+		return marshalErrorResponse(&dfs.SafeModeResponse{Error: err.Error()}, err)
+	}
+
+	reported, total := c.safeModeProgress()
+	response := &dfs.SafeModeResponse{
+		SafeMode:       c.safeMode,
+		ReportedChunks: uint64(reported),
+		TotalChunks:    uint64(total),
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// handleSetReplicationRequest changes a file's replication factor; replicas are
+// added or trimmed in the background
+func (c *Controller) handleSetReplicationRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.SetReplicationRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal set replication request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkWritable("change replication"); err != nil {
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+
+	if request.ReplicationFactor == 0 || request.ReplicationFactor > common.MaxReplication {
+		err := &common.ValidationError{Field: "replication_factor", Message: fmt.Sprintf("must be between 1 and %d", common.MaxReplication)}
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+
+	metadata, exists := c.files[request.Filename]
+	if !exists {
+		err := &common.FileNotFoundError{Filename: request.Filename}
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+	if err := c.checkFile(identify(peer, request.User, request.Groups), request.Filename, metadata, accessWrite); err != nil {
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+	if metadata.isErasureCoded() {
+		err := &common.ValidationError{Field: "filename", Message: "file is erasure coded"}
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+	if metadata.isDeduplicated() {
+		err := &common.ValidationError{Field: "filename", Message: "file shares deduplicated chunks"}
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+	if metadata.isPacked() {
+		err := &common.ValidationError{Field: "filename", Message: "file is packed into a container"}
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+	if metadata.isInline() {
+		err := &common.ValidationError{Field: "filename", Message: "file is stored inline in the controller's metadata"}
+		return marshalErrorResponse(&dfs.SetReplicationResponse{Error: err.Error()}, err)
+	}
+
+	metadata.ReplicationFactor = int(request.ReplicationFactor)
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	// Add or trim replicas in the background
+	go c.adjustReplication(request.Filename)
+
+	response := &dfs.SetReplicationResponse{
+		Success: true,
+	}
+
 	// Serialize response
 	responseData, err := proto.Marshal(response)
 	if err != nil {
@@ -259,4 +645,51 @@ func (c *Controller) handleNodeStatusRequest(data []byte) ([]byte, error) {
 	}
 
 	return responseData, nil
-}
\ No newline at end of file
+}
+
+// handleTranscodeStatusRequest reports the transcoding policy and per-file progress
+func (c *Controller) handleTranscodeStatusRequest(data []byte) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	response := &dfs.TranscodeStatusResponse{
+		Enabled: c.transcodeAfter > 0,
+		Policy:  c.transcodePolicy(),
+		Tasks:   make([]*dfs.TranscodeTask, 0, len(c.transcodeTasks)),
+	}
+
+	for filename, task := range c.transcodeTasks {
+		response.Tasks = append(response.Tasks, &dfs.TranscodeTask{
+			Filename:     filename,
+			State:        task.State,
+			StripesDone:  uint32(task.StripesDone),
+			TotalStripes: uint32(task.TotalStripes),
+			ErasureCoding: &dfs.ErasureCoding{
+				DataShards:   uint32(task.DataShards),
+				ParityShards: uint32(task.ParityShards),
+			},
+			Error: task.Err,
+		})
+	}
+	sort.Slice(response.Tasks, func(i, j int) bool {
+		return response.Tasks[i].Filename < response.Tasks[j].Filename
+	})
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// marshalErrorResponse serializes a response carrying an error so the client can see
+// why its request was rejected
+func marshalErrorResponse(response proto.Message, err error) ([]byte, error) {
+	responseData, marshalErr := proto.Marshal(response)
+	if marshalErr != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", marshalErr)
+	}
+	return responseData, err
+}
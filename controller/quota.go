@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// quota limits the space and number of files used under a directory or by a user
+type quota struct {
+	SpaceLimit uint64 // Bytes including replication or parity, 0 for no limit
+	FileLimit  uint64 // Number of files, 0 for no limit
+}
+
+// quotaDir returns the key a directory's quota is stored under, empty for the root
+func quotaDir(dir string) string {
+	return strings.Trim(dir, "/")
+}
+
+// storedBytes returns the raw space a file takes on storage nodes, counting every
+// replica or parity fragment. Inline files count their contents once. The
+// caller must hold c.mu.
+func (c *Controller) storedBytes(metadata *FileMetadata) uint64 {
+	if metadata.isErasureCoded() {
+		return uint64(len(metadata.Chunks)) * uint64(metadata.ChunkSize)
+	}
+	if metadata.isInline() {
+		return uint64(metadata.Size)
+	}
+	return uint64(metadata.Size) * uint64(c.replicationFor(metadata))
+}
+
+// usage totals the stored bytes and number of files matching a filter. Files in
+// the trash still count against their owner. The caller must hold c.mu.
+func (c *Controller) usage(match func(filename string, metadata *FileMetadata) bool) (space, files uint64) {
+	for filename, metadata := range c.files {
+		if match(filename, metadata) {
+			space += c.storedBytes(metadata)
+			files++
+		}
+	}
+	return space, files
+}
+
+// checkQuota returns a QuotaExceededError if writing space more bytes and files
+// more files to filename, owned by owner, would exceed a quota of one of its
+// directories or of its owner. The replaced version of an overwritten file no
+// longer counts. The caller must hold c.mu.
+func (c *Controller) checkQuota(filename, owner string, space, files uint64, replaced *FileMetadata) error {
+	check := func(target string, limits *quota, match func(string, *FileMetadata) bool) error {
+		used, count := c.usage(match)
+		if replaced != nil {
+			used -= c.storedBytes(replaced)
+		}
+		if limits.SpaceLimit > 0 && used+space > limits.SpaceLimit {
+			return &common.QuotaExceededError{Target: target, Resource: "space", Limit: limits.SpaceLimit, Used: used, Requested: space}
+		}
+		if limits.FileLimit > 0 && count+files > limits.FileLimit {
+			return &common.QuotaExceededError{Target: target, Resource: "files", Limit: limits.FileLimit, Used: count, Requested: files}
+		}
+		return nil
+	}
+
+	for dir, limits := range c.dirQuotas {
+		if !inTree(filename, dir) {
+			continue
+		}
+		inDir := func(name string, _ *FileMetadata) bool { return inTree(name, dir) }
+		if err := check("directory /"+dir, limits, inDir); err != nil {
+			return err
+		}
+	}
+	if limits, exists := c.userQuotas[owner]; exists {
+		ownedBy := func(_ string, metadata *FileMetadata) bool { return metadata.Owner == owner }
+		if err := check("user "+owner, limits, ownedBy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStorageQuota checks that a new file, or the new version of an overwritten
+// one, fits in the quotas of its directories and owner. The caller must hold c.mu.
+func (c *Controller) checkStorageQuota(request *dfs.StorageRequest) error {
+	var space uint64
+	if request.ErasureCoding != nil {
+		dataShards := uint64(request.ErasureCoding.DataShards)
+		width := dataShards + uint64(request.ErasureCoding.ParityShards)
+		stripeSize := dataShards * uint64(request.ChunkSize)
+		if stripeSize > 0 {
+			space = (request.FileSize + stripeSize - 1) / stripeSize * width * uint64(request.ChunkSize)
+		}
+	} else if c.inlinable(request) {
+		space = request.FileSize
+	} else {
+		replication := uint64(c.replicationFactor)
+		if request.ReplicationFactor > 0 {
+			replication = uint64(request.ReplicationFactor)
+		}
+		space = request.FileSize * replication
+	}
+
+	if existing, exists := c.files[request.Filename]; exists {
+		return c.checkQuota(request.Filename, existing.Owner, space, 0, existing)
+	}
+	return c.checkQuota(request.Filename, request.User, space, 1, nil)
+}
+
+// quotaInfo reports the limits and current usage of a directory or user. The
+// caller must hold c.mu.
+func (c *Controller) quotaInfo(dir, user string, isDir bool) *dfs.QuotaInfo {
+	info := &dfs.QuotaInfo{}
+	var limits *quota
+	if isDir {
+		info.Directory = "/" + dir
+		limits = c.dirQuotas[dir]
+		info.SpaceUsed, info.FilesUsed = c.usage(func(name string, _ *FileMetadata) bool { return inTree(name, dir) })
+	} else {
+		info.User = user
+		limits = c.userQuotas[user]
+		info.SpaceUsed, info.FilesUsed = c.usage(func(_ string, metadata *FileMetadata) bool { return metadata.Owner == user })
+	}
+	if limits != nil {
+		info.SpaceLimit = limits.SpaceLimit
+		info.FileLimit = limits.FileLimit
+	}
+	return info
+}
+
+// handleQuotaRequest sets, clears or reports the quotas of directories and users
+func (c *Controller) handleQuotaRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.QuotaRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal quota request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response := &dfs.QuotaResponse{
+		Success: true,
+	}
+
+	isDir := request.Directory != ""
+	if isDir && request.User != "" {
+		err := &common.ValidationError{Field: "user", Message: "a quota applies to a directory or a user, not both"}
+		return marshalErrorResponse(&dfs.QuotaResponse{Error: err.Error()}, err)
+	}
+	dir := quotaDir(request.Directory)
+	quotas := c.userQuotas
+	key := request.User
+	if isDir {
+		quotas, key = c.dirQuotas, dir
+	}
+
+	switch request.Action {
+	case "set", "clear":
+		if err := c.checkWritable(request.Action + " quota"); err != nil {
+			return marshalErrorResponse(&dfs.QuotaResponse{Error: err.Error()}, err)
+		}
+		if err := c.checkSuperuser(identify(peer, request.Caller, request.CallerGroups), "/"+dir); err != nil {
+			return marshalErrorResponse(&dfs.QuotaResponse{Error: err.Error()}, err)
+		}
+		if !isDir && request.User == "" {
+			err := &common.ValidationError{Field: "directory", Message: "a directory or user is required"}
+			return marshalErrorResponse(&dfs.QuotaResponse{Error: err.Error()}, err)
+		}
+		if request.Action == "set" && (request.SpaceLimit > 0 || request.FileLimit > 0) {
+			quotas[key] = &quota{SpaceLimit: request.SpaceLimit, FileLimit: request.FileLimit}
+		} else {
+			delete(quotas, key)
+		}
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+
+	case "report":
+		if isDir || request.User != "" {
+			response.Quotas = append(response.Quotas, c.quotaInfo(dir, request.User, isDir))
+			break
+		}
+		var dirs, users []string
+		for dir := range c.dirQuotas {
+			dirs = append(dirs, dir)
+		}
+		for user := range c.userQuotas {
+			users = append(users, user)
+		}
+		sort.Strings(dirs)
+		sort.Strings(users)
+		for _, dir := range dirs {
+			response.Quotas = append(response.Quotas, c.quotaInfo(dir, "", true))
+		}
+		for _, user := range users {
+			response.Quotas = append(response.Quotas, c.quotaInfo("", user, false))
+		}
+
+	default:
+		err := &common.ValidationError{Field: "action", Message: fmt.Sprintf("unknown quota action %q", request.Action)}
+		return marshalErrorResponse(&dfs.QuotaResponse{Error: err.Error()}, err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// chunkReplicas returns the nodes holding a chunk stored under a block name: a
+// chunk of a live file, a deduplicated content chunk or a container. Containers
+// being written to are not returned, since a copy would miss the file being
+// packed. The caller must hold c.mu.
+func (c *Controller) chunkReplicas(blockName string, chunkNum int) ([]string, bool) {
+	if hash, isContent := common.ParseContentBlockName(blockName); isContent {
+		entry, exists := c.contentChunks[hash]
+		if !exists || chunkNum != 0 {
+			return nil, false
+		}
+		return entry.Nodes, true
+	}
+	if packed, exists := c.containers[blockName]; exists {
+		if packed.Writing || chunkNum != 0 {
+			return nil, false
+		}
+		return packed.Nodes, true
+	}
+	for filename, metadata := range c.files {
+		if metadata.blockName(filename) == blockName && !metadata.isErasureCoded() {
+			nodes, exists := metadata.Chunks[chunkNum]
+			return nodes, exists
+		}
+	}
+	return nil, false
+}
+
+// handleReplicaReport schedules the repair of replicas a client failed to read
+// from a replica of the same chunk that served it
+func (c *Controller) handleReplicaReport(data []byte) ([]byte, error) {
+	request := &dfs.ReplicaReportRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal replica report: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkWritable("repair replica"); err != nil {
+		return marshalErrorResponse(&dfs.ReplicaReportResponse{Error: err.Error()}, err)
+	}
+
+	chunkNum := int(request.ChunkNumber)
+	replicas, exists := c.chunkReplicas(request.BlockName, chunkNum)
+	if !exists {
+		err := &common.ChunkNotFoundError{Filename: request.BlockName, ChunkNum: chunkNum}
+		return marshalErrorResponse(&dfs.ReplicaReportResponse{Error: err.Error()}, err)
+	}
+	if !slices.Contains(replicas, request.GoodNode) {
+		err := &common.ValidationError{Field: "good_node", Message: fmt.Sprintf("%s does not hold the chunk", request.GoodNode)}
+		return marshalErrorResponse(&dfs.ReplicaReportResponse{Error: err.Error()}, err)
+	}
+
+	// Only live replicas of the chunk are repaired; dead nodes are re-replicated
+	// by the failure detector instead
+	var bad []string
+	for _, nodeID := range request.BadNodes {
+		if _, live := c.nodes[nodeID]; live && nodeID != request.GoodNode && slices.Contains(replicas, nodeID) && !slices.Contains(bad, nodeID) {
+			bad = append(bad, nodeID)
+		}
+	}
+
+	key := chunkKey(request.BlockName, chunkNum)
+	response := &dfs.ReplicaReportResponse{}
+	if len(bad) > 0 && !c.replicating[key] {
+		log.Printf("Client reported bad replicas of chunk %s on %v", key, bad)
+		c.replicating[key] = true
+		go c.repairReplicas(request.BlockName, chunkNum, request.GoodNode, bad)
+		response.Scheduled = uint32(len(bad))
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// repairReplicas has a good replica of a chunk overwrite its bad copies
+func (c *Controller) repairReplicas(blockName string, chunkNum int, source string, targets []string) {
+	key := chunkKey(blockName, chunkNum)
+	err := c.sendChunkReplicate(source, blockName, chunkNum, targets)
+
+	c.mu.Lock()
+	delete(c.replicating, key)
+	c.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to repair chunk %s on %v from %s: %v", key, targets, source, err)
+		return
+	}
+	log.Printf("Repaired chunk %s on %v from %s", key, targets, source)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"distributed_file_system/common"
+)
+
+// chunkKey returns the key used to track a single chunk of a file
+func chunkKey(filename string, chunkNum int) string {
+	return fmt.Sprintf("%s_%d", filename, chunkNum)
+}
+
+// safeModeProgress returns how many known chunks have been reported by registered nodes.
+// The caller must hold c.mu.
+func (c *Controller) safeModeProgress() (reported, total int) {
+	for filename, metadata := range c.files {
+		for chunkNum := range metadata.Chunks {
+			total++
+			if c.reportedChunks[chunkKey(metadata.blockName(filename), chunkNum)] {
+				reported++
+			}
+		}
+	}
+	for hash := range c.contentChunks {
+		total++
+		if c.reportedChunks[chunkKey(common.ContentBlockName(hash), 0)] {
+			reported++
+		}
+	}
+	for blockName := range c.containers {
+		total++
+		if c.reportedChunks[chunkKey(blockName, 0)] {
+			reported++
+		}
+	}
+	return reported, total
+}
+
+// checkSafeMode leaves safe mode once enough known chunks have been reported.
+// Safe mode entered manually is only left manually. The caller must hold c.mu.
+func (c *Controller) checkSafeMode() {
+	if !c.safeMode || c.safeModeManual {
+		return
+	}
+
+	reported, total := c.safeModeProgress()
+	if total > 0 && float64(reported) < c.safeModeThreshold*float64(total) {
+		return
+	}
+
+	c.safeMode = false
+	c.reportedChunks = nil
+	c.blockReports = nil
+	log.Printf("Leaving safe mode: %d of %d chunks reported", reported, total)
+}
+
+// enterSafeMode makes the controller read-only until safe mode is left manually.
+// The caller must hold c.mu.
+func (c *Controller) enterSafeMode() {
+	if !c.safeMode {
+		c.reportedChunks = make(map[string]bool)
+		c.blockReports = make(map[string]bool)
+	}
+	c.safeMode = true
+	c.safeModeManual = true
+	log.Printf("Entering safe mode")
+}
+
+// leaveSafeMode makes the controller writable again.
+// The caller must hold c.mu.
+func (c *Controller) leaveSafeMode() {
+	c.safeMode = false
+	c.safeModeManual = false
+	c.reportedChunks = nil
+	c.blockReports = nil
+	log.Printf("Leaving safe mode")
+}
+
+// checkWritable returns an error if the controller cannot accept modifications.
+// The caller must hold c.mu.
+func (c *Controller) checkWritable(operation string) error {
+	if c.safeMode {
+		return &common.SafeModeError{Operation: operation}
+	}
+	return nil
+}
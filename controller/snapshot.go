@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// snapshot is a copy-on-write, point-in-time copy of a directory tree. It records
+// each file's metadata and chunk lists without copying data; chunks it references
+// are not garbage collected until it is deleted.
+type snapshot struct {
+	Name      string
+	Path      string // Directory the snapshot was taken of, empty for the whole namespace
+	CreatedAt time.Time
+	Files     map[string]*FileMetadata
+}
+
+// inTree reports whether a file is dir or under it. An empty dir holds every file.
+func inTree(filename, dir string) bool {
+	return dir == "" || filename == dir || strings.HasPrefix(filename, dir+"/")
+}
+
+// copyMetadata returns a copy of a file's metadata that later appends,
+// transcoding or re-replication of the live file do not change
+func copyMetadata(filename string, metadata *FileMetadata) *FileMetadata {
+	copied := *metadata
+	copied.BlockName = metadata.blockName(filename)
+	copied.Chunks = make(map[int][]string, len(metadata.Chunks))
+	for chunkNum, nodes := range metadata.Chunks {
+		copied.Chunks[chunkNum] = append([]string(nil), nodes...)
+	}
+	return &copied
+}
+
+// createSnapshot records the current metadata of every file under dir. The
+// caller must hold c.mu.
+func (c *Controller) createSnapshot(name, dir string) (*snapshot, error) {
+	if name == "" {
+		return nil, &common.ValidationError{Field: "name", Message: "snapshot name is required"}
+	}
+	if _, exists := c.snapshots[name]; exists {
+		return nil, &common.ValidationError{Field: "name", Message: fmt.Sprintf("snapshot %s already exists", name)}
+	}
+
+	snap := &snapshot{
+		Name:      name,
+		Path:      strings.Trim(dir, "/"),
+		CreatedAt: time.Now(),
+		Files:     make(map[string]*FileMetadata),
+	}
+	for filename, metadata := range c.files {
+		// A file still being created has no committed contents yet
+		if lease, exists := c.leases[filename]; exists && lease.Operation == "create" {
+			continue
+		}
+		if inTree(filename, snap.Path) {
+			snap.Files[filename] = copyMetadata(filename, metadata)
+			c.retainShared(metadata)
+		}
+	}
+	c.snapshots[name] = snap
+	return snap, nil
+}
+
+// snapshotFile returns a file's metadata as captured by a snapshot. The caller
+// must hold c.mu.
+func (c *Controller) snapshotFile(name, filename string) (*FileMetadata, bool) {
+	snap, exists := c.snapshots[name]
+	if !exists {
+		return nil, false
+	}
+	metadata, exists := snap.Files[filename]
+	return metadata, exists
+}
+
+// snapshotChunks returns the chunk numbers stored under a block name that are
+// captured by any snapshot. The caller must hold c.mu.
+func (c *Controller) snapshotChunks(blockName string) map[int]bool {
+	captured := make(map[int]bool)
+	for _, snap := range c.snapshots {
+		for _, metadata := range snap.Files {
+			if metadata.BlockName != blockName {
+				continue
+			}
+			for chunkNum := range metadata.Chunks {
+				captured[chunkNum] = true
+			}
+		}
+	}
+	return captured
+}
+
+// blockNameReferenced reports whether a live file, a previous version or a
+// pending overwrite still stores chunks under a block name. The caller must
+// hold c.mu.
+func (c *Controller) blockNameReferenced(blockName string) bool {
+	for filename, metadata := range c.files {
+		if metadata.blockName(filename) == blockName {
+			return true
+		}
+	}
+	for filename, versions := range c.versions {
+		for _, version := range versions {
+			if version.blockName(filename) == blockName {
+				return true
+			}
+		}
+	}
+	for filename, lease := range c.leases {
+		if lease.Pending != nil && lease.Pending.blockName(filename) == blockName {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteSnapshot removes a snapshot and garbage collects the chunks only it
+// still referenced. The caller must hold c.mu.
+func (c *Controller) deleteSnapshot(name string) error {
+	snap, exists := c.snapshots[name]
+	if !exists {
+		return &common.ValidationError{Field: "name", Message: fmt.Sprintf("snapshot %s does not exist", name)}
+	}
+	delete(c.snapshots, name)
+
+	// Chunks captured by other snapshots are skipped by deleteChunks
+	for _, metadata := range snap.Files {
+		if !c.releaseShared(metadata) && !c.blockNameReferenced(metadata.BlockName) {
+			go c.deleteChunks(metadata.BlockName, metadata.Chunks)
+		}
+	}
+	return nil
+}
+
+// diffSnapshot lists the files under the snapshot's directory that were added,
+// deleted or modified since it was taken. The caller must hold c.mu.
+func (c *Controller) diffSnapshot(snap *snapshot) []*dfs.SnapshotChange {
+	var changes []*dfs.SnapshotChange
+	for filename, then := range snap.Files {
+		now, exists := c.files[filename]
+		switch {
+		case !exists:
+			changes = append(changes, &dfs.SnapshotChange{Filename: filename, Change: "deleted"})
+		case now.Generation != then.Generation || now.Size != then.Size || !now.CreatedAt.Equal(then.CreatedAt):
+			changes = append(changes, &dfs.SnapshotChange{Filename: filename, Change: "modified"})
+		}
+	}
+	for filename := range c.files {
+		if _, exists := snap.Files[filename]; !exists && inTree(filename, snap.Path) {
+			changes = append(changes, &dfs.SnapshotChange{Filename: filename, Change: "added"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Filename < changes[j].Filename
+	})
+	return changes
+}
+
+// handleSnapshotRequest creates, lists, diffs or deletes namespace snapshots
+func (c *Controller) handleSnapshotRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.SnapshotRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response := &dfs.SnapshotResponse{
+		Success: true,
+	}
+
+	switch request.Action {
+	case "create":
+		if err := c.checkWritable("create snapshot"); err != nil {
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		if err := c.checkSuperuser(identify(peer, request.User, request.Groups), "/"+request.Path); err != nil {
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		snap, err := c.createSnapshot(request.Name, request.Path)
+		if err != nil {
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+		log.Printf("Created snapshot %s of %q with %d files", snap.Name, snap.Path, len(snap.Files))
+
+	case "list":
+		if request.Name == "" {
+			for _, snap := range c.snapshots {
+				info := &dfs.SnapshotInfo{
+					Name:      snap.Name,
+					Path:      snap.Path,
+					CreatedAt: snap.CreatedAt.Unix(),
+					NumFiles:  uint32(len(snap.Files)),
+				}
+				for _, metadata := range snap.Files {
+					info.TotalSize += uint64(metadata.Size)
+				}
+				response.Snapshots = append(response.Snapshots, info)
+			}
+			sort.Slice(response.Snapshots, func(i, j int) bool {
+				return response.Snapshots[i].Name < response.Snapshots[j].Name
+			})
+			break
+		}
+		snap, exists := c.snapshots[request.Name]
+		if !exists {
+			err := &common.ValidationError{Field: "name", Message: fmt.Sprintf("snapshot %s does not exist", request.Name)}
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		for filename, metadata := range snap.Files {
+			response.Files = append(response.Files, &dfs.FileInfo{
+				Filename:          filename,
+				Size:              uint64(metadata.Size),
+				NumChunks:         uint32(metadata.numChunks()),
+				ReplicationFactor: uint32(c.replicationFor(metadata)),
+				ErasureCoding:     metadata.erasureCoding(),
+				Generation:        metadata.Generation,
+			})
+		}
+		sort.Slice(response.Files, func(i, j int) bool {
+			return response.Files[i].Filename < response.Files[j].Filename
+		})
+
+	case "diff":
+		snap, exists := c.snapshots[request.Name]
+		if !exists {
+			err := &common.ValidationError{Field: "name", Message: fmt.Sprintf("snapshot %s does not exist", request.Name)}
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		response.Changes = c.diffSnapshot(snap)
+
+	case "delete":
+		if err := c.checkWritable("delete snapshot"); err != nil {
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		if err := c.checkSuperuser(identify(peer, request.User, request.Groups), "/"); err != nil {
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		if err := c.deleteSnapshot(request.Name); err != nil {
+			return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+		}
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+
+	default:
+		err := &common.ValidationError{Field: "action", Message: fmt.Sprintf("unknown snapshot action %q", request.Action)}
+		return marshalErrorResponse(&dfs.SnapshotResponse{Error: err.Error()}, err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
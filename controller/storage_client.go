@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// storageNodeTimeout bounds how long the controller waits on a storage node command
+const storageNodeTimeout = 30 * time.Second
+
+// callStorageNode sends a request to a storage node and reads its response
+func (c *Controller) callStorageNode(nodeID string, msgType byte, request proto.Message, response proto.Message) error {
+	// Connect to storage node
+	conn, err := c.transport.DialTimeout(nodeID, storageNodeTimeout)
+	if err != nil {
+		return &common.ConnectionError{Address: nodeID, Err: err}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(storageNodeTimeout))
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, msgType, requestData); err != nil {
+		return fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	respType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if respType != msgType {
+		return fmt.Errorf("unexpected response type: %d", respType)
+	}
+
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	return nil
+}
+
+// sendChunkReplicate asks a storage node to copy a chunk it holds to the target nodes
+func (c *Controller) sendChunkReplicate(sourceNode string, filename string, chunkNum int, targets []string) error {
+	request := &dfs.ChunkReplicateRequest{
+		Filename:    filename,
+		ChunkNumber: uint32(chunkNum),
+		TargetNodes: targets,
+		BlockToken:  c.issueBlockToken(filename, common.BlockTokenWrite),
+	}
+	response := &dfs.ChunkReplicateResponse{}
+	if err := c.callStorageNode(sourceNode, common.MsgTypeChunkReplicate, request, response); err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("storage node error: %s", response.Error)
+	}
+	return nil
+}
+
+// sendChunkDelete asks a storage node to delete a chunk
+func (c *Controller) sendChunkDelete(nodeID string, filename string, chunkNum int) error {
+	request := &dfs.ChunkDeleteRequest{
+		Filename:    filename,
+		ChunkNumber: uint32(chunkNum),
+		BlockToken:  c.issueBlockToken(filename, common.BlockTokenDelete),
+	}
+	response := &dfs.ChunkDeleteResponse{}
+	if err := c.callStorageNode(nodeID, common.MsgTypeChunkDelete, request, response); err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("storage node error: %s", response.Error)
+	}
+	return nil
+}
+
+// sendChunkCompact asks a storage node to drop the files packed into a container
+// at the given offsets
+func (c *Controller) sendChunkCompact(nodeID string, blockName string, offsets []int64) error {
+	request := &dfs.ChunkCompactRequest{
+		Filename:   blockName,
+		BlockToken: c.issueBlockToken(blockName, common.BlockTokenDelete),
+	}
+	for _, offset := range offsets {
+		request.DropOffsets = append(request.DropOffsets, uint64(offset))
+	}
+	response := &dfs.ChunkCompactResponse{}
+	if err := c.callStorageNode(nodeID, common.MsgTypeChunkCompact, request, response); err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("storage node error: %s", response.Error)
+	}
+	return nil
+}
+
+// sendChunkReconstruct asks a storage node to rebuild a lost fragment from the
+// surviving fragments of its stripe and store it locally, compressed with the
+// file's codec
+func (c *Controller) sendChunkReconstruct(nodeID string, filename string, fragment int, erasureCoding *dfs.ErasureCoding, sources []*dfs.ChunkLocation, compression string) error {
+	request := &dfs.ChunkReconstructRequest{
+		Filename:      filename,
+		ChunkNumber:   uint32(fragment),
+		ErasureCoding: erasureCoding,
+		Sources:       sources,
+		Compression:   compression,
+		BlockToken:    c.issueBlockToken(filename, common.BlockTokenWrite),
+		ReadToken:     c.issueBlockToken(filename, common.BlockTokenRead),
+	}
+	response := &dfs.ChunkReconstructResponse{}
+	if err := c.callStorageNode(nodeID, common.MsgTypeChunkReconstruct, request, response); err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("storage node error: %s", response.Error)
+	}
+	return nil
+}
+
+// sendChunkTranscode asks a storage node to encode one stripe of a replicated file
+// and store its fragments on the target nodes
+func (c *Controller) sendChunkTranscode(nodeID string, request *dfs.ChunkTranscodeRequest) error {
+	response := &dfs.ChunkTranscodeResponse{}
+	if err := c.callStorageNode(nodeID, common.MsgTypeChunkTranscode, request, response); err != nil {
+		return err
+	}
+	if !response.Success {
+		return fmt.Errorf("storage node error: %s", response.Error)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// validateStreaming checks that a streamed file only uses features that do not
+// need the whole file up front
+func validateStreaming(request *dfs.StorageRequest) error {
+	if !request.Streaming {
+		return nil
+	}
+	if request.ChunkSize == 0 {
+		return &common.ValidationError{Field: "chunk_size", Message: "must be positive"}
+	}
+	if request.ErasureCoding != nil {
+		return &common.ValidationError{Field: "streaming", Message: "cannot be combined with erasure coding"}
+	}
+	if len(request.ChunkHashes) > 0 {
+		return &common.ValidationError{Field: "streaming", Message: "cannot be combined with deduplication"}
+	}
+	if len(request.ChunkOffsets) > 0 {
+		return &common.ValidationError{Field: "streaming", Message: "cannot be combined with content-defined chunks"}
+	}
+	return nil
+}
+
+// placeStreamingFile starts a file whose size is not known yet. It has no chunks
+// until the writer allocates them and is empty until the writer releases its
+// lease with the final size. The caller must hold c.mu.
+func (c *Controller) placeStreamingFile(request *dfs.StorageRequest, replication int) ([]byte, error) {
+	metadata := &FileMetadata{
+		ChunkSize:         int(request.ChunkSize),
+		ReplicationFactor: replication,
+		CreatedAt:         time.Now(),
+		Chunks:            make(map[int][]string),
+	}
+	response := &dfs.StorageResponse{
+		BlockName: c.beginWrite(request, metadata),
+	}
+	response.BlockToken = c.issueBlockToken(metadata.blockName(request.Filename), common.BlockTokenWrite)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// streamTarget returns the file being written under a streaming lease: the new
+// version of an overwrite, or the file being created. The caller must hold c.mu.
+func (c *Controller) streamTarget(filename string, lease *writeLease) *FileMetadata {
+	if lease.Pending != nil {
+		return lease.Pending
+	}
+	return c.files[filename]
+}
+
+// handleChunkAllocationRequest places the next chunk of a file being streamed.
+// Each allocation is charged against quotas as a full chunk and renews the lease.
+func (c *Controller) handleChunkAllocationRequest(data []byte) ([]byte, error) {
+	request := &dfs.ChunkAllocationRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunk allocation request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.checkWritable("allocate chunk"); err != nil {
+		return marshalErrorResponse(&dfs.ChunkAllocationResponse{Error: err.Error()}, err)
+	}
+
+	// An expired lease is recovered here, removing what was streamed
+	if err := c.checkLease(request.Filename, request.ClientId); err != nil {
+		return marshalErrorResponse(&dfs.ChunkAllocationResponse{Error: err.Error()}, err)
+	}
+	lease, exists := c.leases[request.Filename]
+	if !exists || !lease.Streaming {
+		err := &common.ValidationError{Field: "filename", Message: fmt.Sprintf("%s is not being streamed", request.Filename)}
+		return marshalErrorResponse(&dfs.ChunkAllocationResponse{Error: err.Error()}, err)
+	}
+	metadata := c.streamTarget(request.Filename, lease)
+	if metadata == nil {
+		err := &common.FileNotFoundError{Filename: request.Filename}
+		return marshalErrorResponse(&dfs.ChunkAllocationResponse{Error: err.Error()}, err)
+	}
+	lease.Expires = time.Now().Add(common.LeaseTimeout * time.Second)
+
+	// A retried allocation gets the chunk's existing placement
+	chunkNum := int(request.ChunkNumber)
+	nodes, allocated := metadata.Chunks[chunkNum]
+	if !allocated {
+		if chunkNum != len(metadata.Chunks) {
+			err := &common.ValidationError{Field: "chunk_number", Message: fmt.Sprintf("chunks must be allocated in order, next is %d", len(metadata.Chunks))}
+			return marshalErrorResponse(&dfs.ChunkAllocationResponse{Error: err.Error()}, err)
+		}
+
+		// The chunks allocated so far are not yet part of the file's size
+		chunkBytes := uint64(metadata.ChunkSize) * uint64(metadata.ReplicationFactor)
+		space := uint64(len(metadata.Chunks)+1) * chunkBytes
+		var replaced *FileMetadata
+		if lease.Pending != nil {
+			replaced = c.files[request.Filename]
+		}
+		if err := c.checkQuota(request.Filename, metadata.Owner, space, 0, replaced); err != nil {
+			return marshalErrorResponse(&dfs.ChunkAllocationResponse{Error: err.Error()}, err)
+		}
+
+		nodes = c.selectStorageNodes(metadata.ChunkSize, metadata.ReplicationFactor, nil)
+		if len(nodes) < metadata.ReplicationFactor {
+			err := &common.NotEnoughNodesError{Required: metadata.ReplicationFactor, Available: len(nodes)}
+			return marshalErrorResponse(&dfs.ChunkAllocationResponse{Error: err.Error()}, err)
+		}
+		metadata.Chunks[chunkNum] = nodes
+
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+	}
+
+	response := &dfs.ChunkAllocationResponse{
+		Placement: &dfs.ChunkPlacement{
+			ChunkNumber:  request.ChunkNumber,
+			StorageNodes: nodes,
+		},
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// finishStream sets the final size of a streamed file before its lease is
+// released. The size must end in the last allocated chunk. The caller must hold
+// c.mu.
+func (c *Controller) finishStream(filename string, lease *writeLease, size uint64) error {
+	metadata := c.streamTarget(filename, lease)
+	if metadata == nil {
+		return &common.FileNotFoundError{Filename: filename}
+	}
+	chunkSize := uint64(metadata.ChunkSize)
+	numChunks := uint64(len(metadata.Chunks))
+	if size > numChunks*chunkSize || (numChunks > 0 && size <= (numChunks-1)*chunkSize) {
+		return &common.ValidationError{Field: "file_size", Message: fmt.Sprintf("%d bytes do not fill the %d allocated chunks", size, numChunks)}
+	}
+	metadata.Size = int64(size)
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+)
+
+// issueBlockToken grants the bearer an operation on the chunks stored under a
+// block name until the token lifetime passes. Returns nil if block tokens are
+// disabled.
+func (c *Controller) issueBlockToken(blockName, operation string) *dfs.BlockToken {
+	return c.issueExtentToken(blockName, operation, 0, 0)
+}
+
+// issueExtentToken grants the bearer an operation on just the packed file of
+// length bytes at offset in a container
+func (c *Controller) issueExtentToken(blockName, operation string, offset, length int64) *dfs.BlockToken {
+	if c.blockTokenSecret == nil {
+		return nil
+	}
+	expiresAt := time.Now().Add(c.blockTokenLifetime).Unix()
+	return &dfs.BlockToken{
+		BlockName: blockName,
+		Operation: operation,
+		ExpiresAt: expiresAt,
+		Offset:    uint64(offset),
+		Length:    uint64(length),
+		Signature: common.SignBlockToken(c.blockTokenSecret, blockName, operation, expiresAt, uint64(offset), uint64(length)),
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+)
+
+// transcodeTask tracks the progress of converting one file to erasure coding
+type transcodeTask struct {
+	State        string // "running", "done" or "failed"
+	StripesDone  int
+	TotalStripes int
+	DataShards   int
+	ParityShards int
+	Err          string
+}
+
+// blockName returns the name the file's chunks are stored under on storage nodes
+func (m *FileMetadata) blockName(filename string) string {
+	if m.BlockName != "" {
+		return m.BlockName
+	}
+	return filename
+}
+
+// newBlockName returns a fresh name to store a new layout or version of a file under,
+// so its chunks never collide with the chunks of the version still being read
+func newBlockName(filename string, kind string) string {
+	return fmt.Sprintf("%s#%s%d", filename, kind, time.Now().UnixNano())
+}
+
+// transcodePolicy describes the transcoding policy for status reports
+func (c *Controller) transcodePolicy() string {
+	if c.transcodeAfter <= 0 {
+		return "disabled"
+	}
+	since := "creation"
+	if c.transcodeByAccess {
+		since = "last access"
+	}
+	return fmt.Sprintf("RS(%d,%d) after %v since %s", c.transcodeDataShards, c.transcodeParityShards, c.transcodeAfter, since)
+}
+
+// canTranscode reports whether a file's chunks can be re-encoded into stripes.
+// Client-encrypted chunks would be split across fragments, deduplicated and
+// packed files share chunks with other files, stripes need fixed-size chunks,
+// and inline files have no chunks.
+func (m *FileMetadata) canTranscode() bool {
+	return !m.isErasureCoded() && !m.isEncrypted() && !m.isDeduplicated() && !m.isPacked() &&
+		!m.isContentDefined() && !m.isInline()
+}
+
+// isCold reports whether a replicated file is old enough to be transcoded.
+// The caller must hold c.mu.
+func (c *Controller) isCold(metadata *FileMetadata, now time.Time) bool {
+	if c.transcodeAfter <= 0 || !metadata.canTranscode() {
+		return false
+	}
+	since := metadata.CreatedAt
+	if c.transcodeByAccess && metadata.LastAccessed.After(since) {
+		since = metadata.LastAccessed
+	}
+	return now.Sub(since) >= c.transcodeAfter
+}
+
+// transcodeColdFiles periodically converts replicated files that have gone cold
+// to the configured erasure-coded layout, one file at a time
+func (c *Controller) transcodeColdFiles() {
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		c.mu.RLock()
+		if c.safeMode {
+			c.mu.RUnlock()
+			continue
+		}
+		now := time.Now()
+		var cold []string
+		for filename, metadata := range c.files {
+			if c.isCold(metadata, now) {
+				cold = append(cold, filename)
+			}
+		}
+		c.mu.RUnlock()
+
+		for _, filename := range cold {
+			if err := c.transcodeFile(filename); err != nil {
+				log.Printf("Failed to transcode %s: %v", filename, err)
+			}
+		}
+	}
+}
+
+// transcodeFile encodes a replicated file into fragments stored under a new block
+// name, then switches the file's metadata to the erasure-coded layout and deletes
+// the old replicas. Readers see either the old or the new layout, never a mix.
+func (c *Controller) transcodeFile(filename string) error {
+	c.mu.Lock()
+	metadata, exists := c.files[filename]
+	if !exists || !metadata.canTranscode() || c.safeMode {
+		c.mu.Unlock()
+		return nil
+	}
+
+	// Files being written are transcoded once their writer is done
+	if _, leased := c.leases[filename]; leased {
+		c.mu.Unlock()
+		return nil
+	}
+
+	dataShards, parityShards := c.transcodeDataShards, c.transcodeParityShards
+	width := dataShards + parityShards
+	stripeSize := int64(metadata.ChunkSize) * int64(dataShards)
+	numStripes := int((metadata.Size + stripeSize - 1) / stripeSize)
+
+	task := &transcodeTask{
+		State:        "running",
+		TotalStripes: numStripes,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+	}
+	c.transcodeTasks[filename] = task
+
+	nodes := c.selectStorageNodes(metadata.ChunkSize, width, nil)
+	if len(nodes) < width {
+		err := &common.NotEnoughNodesError{Required: width, Available: len(nodes)}
+		task.State, task.Err = "failed", err.Error()
+		c.mu.Unlock()
+		return err
+	}
+
+	// Place the fragments the same way as a file stored erasure coded
+	chunks := make(map[int][]string, numStripes*width)
+	for stripe := 0; stripe < numStripes; stripe++ {
+		for shard := 0; shard < width; shard++ {
+			chunks[stripe*width+shard] = []string{nodes[(stripe+shard)%width]}
+		}
+	}
+	sourceBlock := metadata.blockName(filename)
+	generation := metadata.Generation
+	targetBlock := newBlockName(filename, "rs")
+	erasureCoding := &dfs.ErasureCoding{DataShards: uint32(dataShards), ParityShards: uint32(parityShards)}
+	c.mu.Unlock()
+
+	log.Printf("Transcoding %s to RS(%d,%d)", filename, dataShards, parityShards)
+
+	for stripe := 0; stripe < numStripes; stripe++ {
+		err := c.transcodeStripe(filename, metadata, sourceBlock, targetBlock, stripe, erasureCoding, chunks)
+
+		c.mu.Lock()
+		if err != nil {
+			task.State, task.Err = "failed", err.Error()
+			c.mu.Unlock()
+			c.deleteChunks(targetBlock, chunks)
+			return err
+		}
+		task.StripesDone++
+		c.mu.Unlock()
+	}
+
+	// Switch to the new layout unless the file was deleted, replaced or appended to meanwhile
+	c.mu.Lock()
+	if c.files[filename] != metadata || metadata.Generation != generation {
+		c.mu.Unlock()
+		c.deleteChunks(targetBlock, chunks)
+		return fmt.Errorf("file changed during transcoding")
+	}
+	oldChunks := metadata.Chunks
+	metadata.BlockName = targetBlock
+	metadata.DataShards = dataShards
+	metadata.ParityShards = parityShards
+	metadata.ReplicationFactor = 0
+	metadata.Chunks = chunks
+	task.State = "done"
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+	c.mu.Unlock()
+
+	log.Printf("Transcoded %s to RS(%d,%d)", filename, dataShards, parityShards)
+
+	// The old replicas are no longer referenced
+	c.deleteChunks(sourceBlock, oldChunks)
+	return nil
+}
+
+// transcodeStripe has a node holding the stripe's first chunk encode the stripe
+// and store its fragments
+func (c *Controller) transcodeStripe(filename string, metadata *FileMetadata, sourceBlock, targetBlock string, stripe int, erasureCoding *dfs.ErasureCoding, chunks map[int][]string) error {
+	dataShards := int(erasureCoding.DataShards)
+	width := dataShards + int(erasureCoding.ParityShards)
+
+	request := &dfs.ChunkTranscodeRequest{
+		SourceFilename: sourceBlock,
+		TargetFilename: targetBlock,
+		Stripe:         uint32(stripe),
+		ErasureCoding:  erasureCoding,
+		Compression:    metadata.Compression,
+		BlockToken:     c.issueBlockToken(targetBlock, common.BlockTokenWrite),
+		ReadToken:      c.issueBlockToken(sourceBlock, common.BlockTokenRead),
+	}
+
+	// The last stripe may hold fewer than dataShards chunks
+	c.mu.RLock()
+	for chunkNum := stripe * dataShards; chunkNum < (stripe+1)*dataShards; chunkNum++ {
+		nodes, exists := metadata.Chunks[chunkNum]
+		if !exists {
+			break
+		}
+		live := c.liveReplicas(nodes)
+		if len(live) == 0 {
+			c.mu.RUnlock()
+			return fmt.Errorf("chunk %s has no live replicas", chunkKey(filename, chunkNum))
+		}
+		request.Sources = append(request.Sources, &dfs.ChunkLocation{
+			ChunkNumber:  uint32(chunkNum),
+			StorageNodes: live,
+		})
+	}
+	c.mu.RUnlock()
+	if len(request.Sources) == 0 {
+		return fmt.Errorf("stripe %d of %s has no chunks", stripe, filename)
+	}
+
+	for fragment := stripe * width; fragment < (stripe+1)*width; fragment++ {
+		request.Targets = append(request.Targets, &dfs.ChunkPlacement{
+			ChunkNumber:  uint32(fragment),
+			StorageNodes: chunks[fragment],
+		})
+	}
+
+	return c.sendChunkTranscode(request.Sources[0].StorageNodes[0], request)
+}
+
+// deleteChunks removes every chunk stored under a block name, logging failures.
+// Chunks captured by a snapshot are kept until the snapshot is deleted.
+func (c *Controller) deleteChunks(blockName string, chunks map[int][]string) {
+	c.mu.RLock()
+	captured := c.snapshotChunks(blockName)
+	c.mu.RUnlock()
+
+	for chunkNum, nodes := range chunks {
+		if captured[chunkNum] {
+			continue
+		}
+		for _, nodeID := range nodes {
+			if err := c.sendChunkDelete(nodeID, blockName, chunkNum); err != nil {
+				log.Printf("Failed to delete chunk %s on %s: %v", chunkKey(blockName, chunkNum), nodeID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// trashDir is the namespace prefix under which each user's trash is kept
+const trashDir = ".Trash"
+
+// userTrash returns the namespace prefix of a user's trash
+func userTrash(user string) string {
+	if user == "" {
+		user = "anonymous"
+	}
+	return path.Join(trashDir, user) + "/"
+}
+
+// isTrashed reports whether a filename is inside someone's trash
+func isTrashed(filename string) bool {
+	return strings.HasPrefix(filename, trashDir+"/")
+}
+
+// moveToTrash moves a file into its user's trash, where it stays until the trash
+// interval passes. Returns the file's name in the trash. The caller must hold c.mu.
+func (c *Controller) moveToTrash(filename, user string, metadata *FileMetadata) string {
+	base := userTrash(user) + filename
+	trashName := base
+	for i := 1; ; i++ {
+		if _, exists := c.files[trashName]; !exists {
+			break
+		}
+		trashName = fmt.Sprintf("%s.%d", base, i)
+	}
+
+	// The chunks keep the name they were stored under
+	metadata.BlockName = metadata.blockName(filename)
+	metadata.TrashedFrom = filename
+	metadata.TrashedAt = time.Now()
+	delete(c.files, filename)
+	delete(c.transcodeTasks, filename)
+	c.files[trashName] = metadata
+	return trashName
+}
+
+// blockNameInUse reports whether chunks stored under a file's plain name still
+// belong to a trashed file, a previous version or a snapshot. The caller must
+// hold c.mu.
+func (c *Controller) blockNameInUse(filename string) bool {
+	if len(c.versions[filename]) > 0 {
+		return true
+	}
+	for name, metadata := range c.files {
+		if isTrashed(name) && metadata.BlockName == filename {
+			return true
+		}
+	}
+	return len(c.snapshotChunks(filename)) > 0
+}
+
+// removeTrashed permanently deletes a file from the trash and garbage collects
+// its chunks. The caller must hold c.mu.
+func (c *Controller) removeTrashed(trashName string, metadata *FileMetadata) {
+	c.recoverLease(trashName)
+	delete(c.files, trashName)
+	delete(c.transcodeTasks, trashName)
+	c.releaseChunks(trashName, metadata)
+	log.Printf("Removed %s from the trash", trashName)
+}
+
+// restoreTrashed moves the most recently trashed file with the given original
+// name in a user's trash back to that name. The caller must hold c.mu.
+func (c *Controller) restoreTrashed(user, filename string) error {
+	prefix := userTrash(user)
+	var trashName string
+	var metadata *FileMetadata
+	for name, candidate := range c.files {
+		if !strings.HasPrefix(name, prefix) || candidate.TrashedFrom != filename {
+			continue
+		}
+		if metadata == nil || candidate.TrashedAt.After(metadata.TrashedAt) {
+			trashName, metadata = name, candidate
+		}
+	}
+	if metadata == nil {
+		return &common.FileNotFoundError{Filename: prefix + filename}
+	}
+	if _, exists := c.files[filename]; exists {
+		return &common.FileExistsError{Filename: filename}
+	}
+
+	c.recoverLease(trashName)
+	delete(c.files, trashName)
+	delete(c.transcodeTasks, trashName)
+	if latest := c.latestGeneration(filename); metadata.Generation <= latest {
+		metadata.Generation = latest + 1
+	}
+	metadata.TrashedFrom = ""
+	metadata.TrashedAt = time.Time{}
+	c.files[filename] = metadata
+
+	log.Printf("Restored %s from %s", filename, trashName)
+	return nil
+}
+
+// purgeTrash periodically removes files that have been in the trash longer than
+// the trash interval
+func (c *Controller) purgeTrash() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		c.mu.Lock()
+		// Removal garbage collects chunks, which waits until safe mode is left
+		if !c.safeMode && c.trashInterval > 0 {
+			now := time.Now()
+			removed := false
+			for name, metadata := range c.files {
+				if !metadata.TrashedAt.IsZero() && now.Sub(metadata.TrashedAt) > c.trashInterval {
+					c.removeTrashed(name, metadata)
+					removed = true
+				}
+			}
+			if removed {
+				if err := c.saveMetadata(); err != nil {
+					log.Printf("Warning: failed to save metadata: %v", err)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// handleTrashRequest lists, restores from or empties a user's trash
+func (c *Controller) handleTrashRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.TrashRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal trash request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response := &dfs.TrashResponse{
+		Success: true,
+	}
+
+	// Only the caller's own trash is acted on
+	who := identify(peer, request.User, request.Groups)
+	prefix := userTrash(who.user)
+	switch request.Action {
+	case "list":
+		now := time.Now()
+		for name, metadata := range c.files {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			response.Entries = append(response.Entries, &dfs.TrashEntry{
+				Path:             name,
+				OriginalName:     metadata.TrashedFrom,
+				Size:             uint64(metadata.Size),
+				DeletedAt:        metadata.TrashedAt.Unix(),
+				ExpiresInSeconds: int64((c.trashInterval - now.Sub(metadata.TrashedAt)) / time.Second),
+			})
+		}
+		sort.Slice(response.Entries, func(i, j int) bool {
+			return response.Entries[i].Path < response.Entries[j].Path
+		})
+
+	case "restore":
+		if err := c.checkWritable("restore file"); err != nil {
+			return marshalErrorResponse(&dfs.TrashResponse{Error: err.Error()}, err)
+		}
+		if err := c.restoreTrashed(who.user, request.Filename); err != nil {
+			return marshalErrorResponse(&dfs.TrashResponse{Error: err.Error()}, err)
+		}
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+
+	case "empty":
+		if err := c.checkWritable("empty trash"); err != nil {
+			return marshalErrorResponse(&dfs.TrashResponse{Error: err.Error()}, err)
+		}
+		for name, metadata := range c.files {
+			if strings.HasPrefix(name, prefix) {
+				c.removeTrashed(name, metadata)
+			}
+		}
+		if err := c.saveMetadata(); err != nil {
+			log.Printf("Warning: failed to save metadata: %v", err)
+		}
+
+	default:
+		err := &common.ValidationError{Field: "action", Message: fmt.Sprintf("unknown trash action %q", request.Action)}
+		return marshalErrorResponse(&dfs.TrashResponse{Error: err.Error()}, err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// archiveVersion keeps the replaced or deleted version of a file as a previous
+// version. With versioning disabled its chunks are garbage collected right away.
+// The caller must hold c.mu.
+func (c *Controller) archiveVersion(filename string, metadata *FileMetadata) {
+	metadata.ArchivedAt = time.Now()
+	c.versions[filename] = append(c.versions[filename], metadata)
+	c.pruneVersions(filename, metadata.ArchivedAt)
+}
+
+// pruneVersions drops the oldest previous versions of a file beyond the retained
+// count or age and garbage collects their chunks. Returns whether any were
+// dropped. The caller must hold c.mu.
+func (c *Controller) pruneVersions(filename string, now time.Time) bool {
+	versions := c.versions[filename]
+	expired := 0
+	for expired < len(versions) {
+		tooMany := len(versions)-expired > c.maxVersions
+		tooOld := c.versionMaxAge > 0 && now.Sub(versions[expired].ArchivedAt) > c.versionMaxAge
+		if !tooMany && !tooOld {
+			break
+		}
+		expired++
+	}
+	if expired == 0 {
+		return false
+	}
+
+	for _, version := range versions[:expired] {
+		c.releaseChunks(filename, version)
+	}
+	if expired == len(versions) {
+		delete(c.versions, filename)
+	} else {
+		c.versions[filename] = versions[expired:]
+	}
+	return true
+}
+
+// latestGeneration returns the highest generation of a file across its current
+// and previous versions, so a recreated file never reuses a version number.
+// The caller must hold c.mu.
+func (c *Controller) latestGeneration(filename string) uint64 {
+	var latest uint64
+	if metadata, exists := c.files[filename]; exists {
+		latest = metadata.Generation
+	}
+	for _, version := range c.versions[filename] {
+		if version.Generation > latest {
+			latest = version.Generation
+		}
+	}
+	return latest
+}
+
+// findVersion returns the current version of a file if generation is 0 or
+// matches it, or else the previous version with that generation. The caller
+// must hold c.mu.
+func (c *Controller) findVersion(filename string, generation uint64) (*FileMetadata, bool) {
+	if metadata, exists := c.files[filename]; exists && (generation == 0 || metadata.Generation == generation) {
+		return metadata, true
+	}
+	if generation == 0 {
+		return nil, false
+	}
+	for _, version := range c.versions[filename] {
+		if version.Generation == generation {
+			return version, true
+		}
+	}
+	return nil, false
+}
+
+// revertVersion makes a previous version of a file current again under a new
+// generation, archiving the current version in its place. The caller must hold
+// c.mu.
+func (c *Controller) revertVersion(filename string, generation uint64) error {
+	versions := c.versions[filename]
+	index := -1
+	for i, version := range versions {
+		if version.Generation == generation {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return &common.ValidationError{Field: "generation", Message: fmt.Sprintf("%s has no previous version %d", filename, generation)}
+	}
+
+	// The restored version moves out of the history so its chunks have one owner
+	restored := versions[index]
+	versions = append(versions[:index:index], versions[index+1:]...)
+	if len(versions) == 0 {
+		delete(c.versions, filename)
+	} else {
+		c.versions[filename] = versions
+	}
+
+	restored.Generation = c.latestGeneration(filename) + 1
+	restored.ArchivedAt = time.Time{}
+	if current, exists := c.files[filename]; exists {
+		c.archiveVersion(filename, current)
+	}
+	c.files[filename] = restored
+	delete(c.transcodeTasks, filename)
+
+	if err := c.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+	log.Printf("Reverted %s to version %d as generation %d", filename, generation, restored.Generation)
+	return nil
+}
+
+// expireVersions periodically drops previous versions older than the retention age
+func (c *Controller) expireVersions() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		c.mu.Lock()
+		// Expiry garbage collects chunks, which waits until safe mode is left
+		if !c.safeMode && c.versionMaxAge > 0 {
+			now := time.Now()
+			changed := false
+			for filename := range c.versions {
+				if c.pruneVersions(filename, now) {
+					changed = true
+				}
+			}
+			if changed {
+				if err := c.saveMetadata(); err != nil {
+					log.Printf("Warning: failed to save metadata: %v", err)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// handleVersionsRequest lists the current and previous versions of a file, or
+// reverts it to a previous version
+func (c *Controller) handleVersionsRequest(data []byte, peer *caller) ([]byte, error) {
+	request := &dfs.VersionsRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal versions request: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response := &dfs.VersionsResponse{
+		Success: true,
+	}
+
+	switch request.Action {
+	case "list":
+		for _, version := range c.versions[request.Filename] {
+			response.Versions = append(response.Versions, &dfs.VersionInfo{
+				Generation: version.Generation,
+				Size:       uint64(version.Size),
+				CreatedAt:  version.CreatedAt.Unix(),
+				ArchivedAt: version.ArchivedAt.Unix(),
+			})
+		}
+		if metadata, exists := c.files[request.Filename]; exists {
+			response.Versions = append(response.Versions, &dfs.VersionInfo{
+				Generation: metadata.Generation,
+				Size:       uint64(metadata.Size),
+				CreatedAt:  metadata.CreatedAt.Unix(),
+				Current:    true,
+			})
+		}
+		if len(response.Versions) == 0 {
+			err := &common.FileNotFoundError{Filename: request.Filename}
+			return marshalErrorResponse(&dfs.VersionsResponse{Error: err.Error()}, err)
+		}
+
+	case "revert":
+		if err := c.checkWritable("revert file"); err != nil {
+			return marshalErrorResponse(&dfs.VersionsResponse{Error: err.Error()}, err)
+		}
+		// Reverting replaces the file, or recreates it in its directory
+		who := identify(peer, request.User, request.Groups)
+		var accessErr error
+		if metadata, exists := c.files[request.Filename]; exists {
+			accessErr = c.checkFile(who, request.Filename, metadata, accessWrite)
+		} else {
+			accessErr = c.checkParents(who, request.Filename, accessWrite)
+		}
+		if accessErr != nil {
+			return marshalErrorResponse(&dfs.VersionsResponse{Error: accessErr.Error()}, accessErr)
+		}
+		// A writer in progress would commit on top of the reverted version
+		if err := c.checkLease(request.Filename, ""); err != nil {
+			return marshalErrorResponse(&dfs.VersionsResponse{Error: err.Error()}, err)
+		}
+		if err := c.revertVersion(request.Filename, request.Generation); err != nil {
+			return marshalErrorResponse(&dfs.VersionsResponse{Error: err.Error()}, err)
+		}
+
+	default:
+		err := &common.ValidationError{Field: "action", Message: fmt.Sprintf("unknown versions action %q", request.Action)}
+		return marshalErrorResponse(&dfs.VersionsResponse{Error: err.Error()}, err)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
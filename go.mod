@@ -1,8 +1,9 @@
 module distributed_file_system
 
-go 1.21
+go 1.22
 
 require (
+	github.com/klauspost/compress v1.18.0
 	google.golang.org/protobuf v1.31.0
 	google.golang.org/grpc v1.59.0
 )
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"distributed_file_system/common"
+)
+
+// compressedChunkMagic starts the data of chunks stored compressed
+var compressedChunkMagic = []byte("DFSCMP01")
+
+// compressChunk compresses chunk data with the codec of its file. Data the codec
+// cannot shrink is stored raw.
+// Layout of a compressed payload: magic, codec name length (1 byte), codec name,
+// uncompressed size (8 bytes), compressed data.
+func compressChunk(compression string, data []byte) ([]byte, error) {
+	codec, err := common.LookupCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	if codec.Name() != common.CodecNone {
+		compressed, err := codec.Compress(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress chunk: %v", err)
+		}
+		if payload := frameChunk(codec.Name(), len(data), compressed); len(payload) < len(data) {
+			return payload, nil
+		}
+	}
+
+	// Raw data that happens to start with the magic is framed so it is never
+	// mistaken for compressed data
+	if bytes.HasPrefix(data, compressedChunkMagic) {
+		return frameChunk(common.CodecNone, len(data), data), nil
+	}
+	return data, nil
+}
+
+// frameChunk prepends the compressed chunk header to data
+func frameChunk(codec string, size int, data []byte) []byte {
+	payload := make([]byte, 0, len(compressedChunkMagic)+1+len(codec)+8+len(data))
+	payload = append(payload, compressedChunkMagic...)
+	payload = append(payload, byte(len(codec)))
+	payload = append(payload, codec...)
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(size))
+	return append(payload, data...)
+}
+
+// decompressChunk returns the data of a chunk payload. Raw payloads are
+// returned as they are.
+func decompressChunk(payload []byte) ([]byte, error) {
+	if !bytes.HasPrefix(payload, compressedChunkMagic) {
+		return payload, nil
+	}
+
+	header := payload[len(compressedChunkMagic):]
+	if len(header) < 1 || len(header) < 1+int(header[0])+8 {
+		return nil, fmt.Errorf("truncated compressed chunk header")
+	}
+	name := string(header[1 : 1+header[0]])
+	size := int64(binary.LittleEndian.Uint64(header[1+header[0]:]))
+	codec, err := common.LookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := codec.Decompress(header[1+int(header[0])+8:], size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s chunk: %v", name, err)
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("%s chunk decompressed to %d bytes, expected %d", name, len(data), size)
+	}
+	return data, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// containerHeaderSize is the size of the header before each packed file in a
+// container file: the file's offset in the container, its size, the size of its
+// payload on disk and the payload's checksum
+const containerHeaderSize = 8 + 4 + 4 + 32
+
+// containerExtent is where the payload of a packed file is in a container file
+type containerExtent struct {
+	at       int64 // Position of the payload in the file
+	size     int64 // Bytes of the packed file
+	stored   int64 // Bytes of payload on disk, more than size if encrypted
+	checksum []byte
+}
+
+// containerIndex locates the packed files in a container file. The file is only
+// appended to, one record per packed file in offset order, and the records of
+// deleted files stay on disk until the container is compacted.
+type containerIndex struct {
+	extents map[int64]containerExtent // By offset in the container
+	end     int64                     // End of the last complete record in the file
+	size    int64                     // End of the last packed file in the container
+}
+
+func newContainerIndex() *containerIndex {
+	return &containerIndex{extents: make(map[int64]containerExtent)}
+}
+
+// add records a packed file whose record ends the file
+func (x *containerIndex) add(offset int64, extent containerExtent) {
+	x.extents[offset] = extent
+	x.end = extent.at + extent.stored
+	x.size = offset + extent.size
+}
+
+// encodeContainerRecord returns the record of a packed file of size bytes at
+// offset, stored as payload
+func encodeContainerRecord(offset, size int64, payload []byte) []byte {
+	record := make([]byte, containerHeaderSize, containerHeaderSize+len(payload))
+	binary.LittleEndian.PutUint64(record[0:], uint64(offset))
+	binary.LittleEndian.PutUint32(record[8:], uint32(size))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(payload)))
+	copy(record[16:], common.CalculateChecksum(payload))
+	return append(record, payload...)
+}
+
+// decodeContainerHeader returns the offset and extent a record header describes,
+// for a record starting at position at in the file
+func decodeContainerHeader(header []byte, at int64) (int64, containerExtent) {
+	return int64(binary.LittleEndian.Uint64(header[0:])), containerExtent{
+		at:       at + containerHeaderSize,
+		size:     int64(binary.LittleEndian.Uint32(header[8:])),
+		stored:   int64(binary.LittleEndian.Uint32(header[12:])),
+		checksum: slices.Clone(header[16:containerHeaderSize]),
+	}
+}
+
+// loadContainer returns the index of a container chunk, reading the record
+// headers of its file the first time. A record torn by a crash ends the index
+// and is overwritten by the next append. The caller must hold the chunk's write
+// lock.
+func (n *StorageNode) loadContainer(filename string, chunkNum int) (*containerIndex, error) {
+	key := fmt.Sprintf("%s_%d", filename, chunkNum)
+	n.mu.RLock()
+	index, exists := n.containers[key]
+	n.mu.RUnlock()
+	if exists {
+		return index, nil
+	}
+
+	index = newContainerIndex()
+	file, err := os.Open(filepath.Join(n.dataDir, key))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open container: %v", err)
+	}
+	if err == nil {
+		defer file.Close()
+		reader := bufio.NewReader(file)
+		header := make([]byte, containerHeaderSize)
+		for {
+			if _, err := io.ReadFull(reader, header); err != nil {
+				break
+			}
+			offset, extent := decodeContainerHeader(header, index.end)
+			if _, err := reader.Discard(int(extent.stored)); err != nil {
+				break
+			}
+			index.add(offset, extent)
+		}
+	}
+
+	n.mu.Lock()
+	n.containers[key] = index
+	n.mu.Unlock()
+	return index, nil
+}
+
+// recordContainer updates the chunk metadata of a container after its file
+// changed, keeping the generation stamp of its last append
+func (n *StorageNode) recordContainer(filename string, chunkNum int, index *containerIndex) {
+	key := fmt.Sprintf("%s_%d", filename, chunkNum)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.containers[key] = index
+	var generation uint64
+	if current, exists := n.chunks[key]; exists {
+		generation = current.Generation
+	}
+	n.chunks[key] = &ChunkMetadata{
+		Filename:    filename,
+		ChunkNumber: chunkNum,
+		Size:        index.size,
+		Generation:  generation,
+		StoredSize:  index.end,
+	}
+	n.newChunks = append(n.newChunks, &dfs.StoredChunk{
+		Filename:    filename,
+		ChunkNumber: uint32(chunkNum),
+		StoredSize:  uint64(index.end),
+	})
+	n.requestsHandled++
+}
+
+// appendExtent packs a file into a container by writing its record after the
+// last one, so the files already packed are never rewritten. Containers are not
+// compressed; the file is encrypted at rest on its own if enabled. The caller
+// must hold the chunk's write lock.
+func (n *StorageNode) appendExtent(filename string, chunkNum int, offset int64, data []byte) error {
+	index, err := n.loadContainer(filename, chunkNum)
+	if err != nil {
+		return err
+	}
+	// A file is never packed over the files before it. Compaction leaves holes
+	// where deleted files were, and so does a write that never reached this node,
+	// so offsets past the end are allowed.
+	if offset < index.size {
+		return fmt.Errorf("container %s_%d holds %d bytes, cannot pack a file at offset %d", filename, chunkNum, index.size, offset)
+	}
+	payload, err := sealChunk(n.masterKey, filename, chunkNum, data)
+	if err != nil {
+		return err
+	}
+	record := encodeContainerRecord(offset, int64(len(data)), payload)
+
+	chunkPath := filepath.Join(n.dataDir, fmt.Sprintf("%s_%d", filename, chunkNum))
+	if err := os.MkdirAll(filepath.Dir(chunkPath), 0755); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+	file, err := os.OpenFile(chunkPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open container: %v", err)
+	}
+	defer file.Close()
+
+	// A record torn by a crash is cut off before the new one is written
+	if err := file.Truncate(index.end); err != nil {
+		return fmt.Errorf("failed to truncate container: %v", err)
+	}
+	if _, err := file.WriteAt(record, index.end); err != nil {
+		return fmt.Errorf("failed to write to container: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync container: %v", err)
+	}
+
+	_, extent := decodeContainerHeader(record, index.end)
+	index.add(offset, extent)
+	n.recordContainer(filename, chunkNum, index)
+	return nil
+}
+
+// readContainerExtent reads and verifies the payload of a packed file and
+// decrypts it
+func (n *StorageNode) readContainerExtent(file *os.File, filename string, chunkNum int, extent containerExtent) ([]byte, error) {
+	payload := make([]byte, extent.stored)
+	if _, err := file.ReadAt(payload, extent.at); err != nil {
+		return nil, fmt.Errorf("failed to read container: %v", err)
+	}
+	if !common.VerifyChecksum(payload, extent.checksum) {
+		return nil, &common.ChunkCorruptionError{Filename: filename, ChunkNum: chunkNum}
+	}
+	return decryptChunk(n.masterKey, filename, chunkNum, payload)
+}
+
+// readExtent reads length bytes of the file packed into a container at offset,
+// or the whole file if length is 0
+func (n *StorageNode) readExtent(filename string, chunkNum int, offset, length int64) ([]byte, error) {
+	defer n.lockChunk(filename, chunkNum)()
+	index, err := n.loadContainer(filename, chunkNum)
+	if err != nil {
+		return nil, err
+	}
+	extent, exists := index.extents[offset]
+	if !exists || length > extent.size {
+		return nil, fmt.Errorf("container %s_%d has no file of %d bytes at %d", filename, chunkNum, length, offset)
+	}
+
+	file, err := os.Open(filepath.Join(n.dataDir, fmt.Sprintf("%s_%d", filename, chunkNum)))
+	if err != nil {
+		return nil, &common.ChunkNotFoundError{Filename: filename, ChunkNum: chunkNum}
+	}
+	defer file.Close()
+	data, err := n.readContainerExtent(file, filename, chunkNum, extent)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	n.requestsHandled++
+	n.mu.Unlock()
+
+	if length > 0 {
+		data = data[:length]
+	}
+	return data, nil
+}
+
+// compactContainer rewrites a container file without the files packed at the
+// dropped offsets, reclaiming their space. The other files keep their offsets.
+// Returns the bytes of the container left on disk.
+func (n *StorageNode) compactContainer(filename string, chunkNum int, drop []uint64) (int64, error) {
+	defer n.lockChunk(filename, chunkNum)()
+	index, err := n.loadContainer(filename, chunkNum)
+	if err != nil {
+		return 0, err
+	}
+	chunkPath := filepath.Join(n.dataDir, fmt.Sprintf("%s_%d", filename, chunkNum))
+	file, err := os.Open(chunkPath)
+	if err != nil {
+		return 0, &common.ChunkNotFoundError{Filename: filename, ChunkNum: chunkNum}
+	}
+	defer file.Close()
+
+	var offsets []int64
+	for offset := range index.extents {
+		if !slices.Contains(drop, uint64(offset)) {
+			offsets = append(offsets, offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	// Payloads are copied as they are, so encrypted files stay encrypted
+	compacted := newContainerIndex()
+	var records []byte
+	for _, offset := range offsets {
+		extent := index.extents[offset]
+		payload := make([]byte, extent.stored)
+		if _, err := file.ReadAt(payload, extent.at); err != nil {
+			return 0, fmt.Errorf("failed to read container: %v", err)
+		}
+		if !common.VerifyChecksum(payload, extent.checksum) {
+			return 0, &common.ChunkCorruptionError{Filename: filename, ChunkNum: chunkNum}
+		}
+		record := encodeContainerRecord(offset, extent.size, payload)
+		_, moved := decodeContainerHeader(record, int64(len(records)))
+		compacted.add(offset, moved)
+		records = append(records, record...)
+	}
+
+	if err := replaceFile(chunkPath, records); err != nil {
+		return 0, err
+	}
+	n.recordContainer(filename, chunkNum, compacted)
+	if err := n.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+	return compacted.end, nil
+}
+
+// copyContainer sends every file packed into a container to the target nodes
+// as appends, so each target writes the container in its own format and under
+// its own master key
+func (n *StorageNode) copyContainer(request *dfs.ChunkReplicateRequest) error {
+	filename, chunkNum := request.Filename, int(request.ChunkNumber)
+	type packedFile struct {
+		offset int64
+		data   []byte
+	}
+
+	// Read the container's files under its lock, then send them without it
+	var files []packedFile
+	var generation uint64
+	err := func() error {
+		defer n.lockChunk(filename, chunkNum)()
+		index, err := n.loadContainer(filename, chunkNum)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(filepath.Join(n.dataDir, fmt.Sprintf("%s_%d", filename, chunkNum)))
+		if err != nil {
+			return &common.ChunkNotFoundError{Filename: filename, ChunkNum: chunkNum}
+		}
+		defer file.Close()
+		for offset, extent := range index.extents {
+			data, err := n.readContainerExtent(file, filename, chunkNum, extent)
+			if err != nil {
+				return err
+			}
+			files = append(files, packedFile{offset: offset, data: data})
+		}
+		n.mu.RLock()
+		if current, exists := n.chunks[fmt.Sprintf("%s_%d", filename, chunkNum)]; exists {
+			generation = current.Generation
+		}
+		n.mu.RUnlock()
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].offset < files[j].offset })
+
+	for _, target := range request.TargetNodes {
+		for _, packed := range files {
+			append := &dfs.ChunkAppendRequest{
+				Filename:    filename,
+				ChunkNumber: request.ChunkNumber,
+				Offset:      uint64(packed.offset),
+				Data:        packed.data,
+				Generation:  generation,
+				BlockToken:  request.BlockToken,
+			}
+			if err := n.forwardAppend(target, append); err != nil {
+				return fmt.Errorf("failed to replicate to %s: %v", target, err)
+			}
+		}
+	}
+	return nil
+}
+
+// handleChunkCompact drops the files deleted from a container on behalf of the
+// controller
+func (n *StorageNode) handleChunkCompact(data []byte) ([]byte, error) {
+	request := &dfs.ChunkCompactRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunk compact request: %v", err)
+	}
+
+	if err := n.checkBlockToken(request.BlockToken, request.Filename, common.BlockTokenDelete); err != nil {
+		return proto.Marshal(&dfs.ChunkCompactResponse{Error: err.Error()})
+	}
+
+	response := &dfs.ChunkCompactResponse{
+		Success: true,
+	}
+	if !common.IsContainerBlockName(request.Filename) {
+		response.Success = false
+		response.Error = fmt.Sprintf("%s is not a container", request.Filename)
+	} else if storedSize, err := n.compactContainer(request.Filename, int(request.ChunkNumber), request.DropOffsets); err != nil {
+		response.Success = false
+		response.Error = err.Error()
+	} else {
+		response.StoredSize = uint64(storedSize)
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// rewrapContainer rewraps the data key of every encrypted file in a container
+// file's contents and replaces the file. Returns the number of files rewrapped.
+func rewrapContainer(path string, contents, oldKey, newKey []byte) (int, error) {
+	rotated := 0
+	at := 0
+	for at+containerHeaderSize <= len(contents) {
+		header := contents[at : at+containerHeaderSize]
+		stored := int(binary.LittleEndian.Uint32(header[12:]))
+		if at+containerHeaderSize+stored > len(contents) {
+			break
+		}
+		payload := contents[at+containerHeaderSize : at+containerHeaderSize+stored]
+		if isEncryptedChunk(payload) {
+			rewrapped, err := rewrapDataKey(payload, oldKey, newKey)
+			if err != nil {
+				return rotated, fmt.Errorf("%s at %d: %v", path, binary.LittleEndian.Uint64(header), err)
+			}
+			if rewrapped {
+				copy(header[16:], common.CalculateChecksum(payload))
+				rotated++
+			}
+		}
+		at += containerHeaderSize + stored
+	}
+	if rotated == 0 {
+		return 0, nil
+	}
+	// A record torn by a crash is dropped
+	return rotated, replaceFile(path, contents[:at])
+}
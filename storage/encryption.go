@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"distributed_file_system/common"
+)
+
+// encryptedChunkMagic starts the data of chunk files that are encrypted at rest
+var encryptedChunkMagic = []byte("DFSENC01")
+
+// plainChunkMagic frames plaintext chunk data that starts with either magic, so
+// it is never mistaken for encrypted data
+var plainChunkMagic = []byte("DFSPLN01")
+
+const (
+	dataKeySize    = 32 // AES-256
+	wrappedKeySize = dataKeySize + common.SealedOverhead
+)
+
+// loadMasterKey reads a node master key: 32 bytes, raw or hex encoded
+func loadMasterKey(path string) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key: %v", err)
+	}
+	if key, err := hex.DecodeString(string(bytes.TrimSpace(raw))); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	if len(raw) != dataKeySize {
+		return nil, fmt.Errorf("master key in %s must be %d bytes or %d hex digits", path, dataKeySize, 2*dataKeySize)
+	}
+	return raw, nil
+}
+
+// chunkAAD binds encrypted chunk data to its chunk so chunk files cannot be swapped
+func chunkAAD(filename string, chunkNum int) []byte {
+	return []byte(fmt.Sprintf("%s_%d", filename, chunkNum))
+}
+
+// encryptChunk encrypts chunk data with a fresh data key, which is stored next
+// to it wrapped by the master key. Layout: magic, wrapped data key, sealed data.
+func encryptChunk(masterKey []byte, filename string, chunkNum int, data []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	wrappedKey, err := common.Seal(masterKey, dataKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	sealed, err := common.Seal(dataKey, data, chunkAAD(filename, chunkNum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt chunk: %v", err)
+	}
+
+	payload := make([]byte, 0, len(encryptedChunkMagic)+len(wrappedKey)+len(sealed))
+	payload = append(payload, encryptedChunkMagic...)
+	payload = append(payload, wrappedKey...)
+	return append(payload, sealed...), nil
+}
+
+// sealChunk returns the payload to store for chunk data: encrypted if a master
+// key is set, and otherwise the data itself, framed if it starts with a magic
+func sealChunk(masterKey []byte, filename string, chunkNum int, data []byte) ([]byte, error) {
+	if masterKey != nil {
+		return encryptChunk(masterKey, filename, chunkNum, data)
+	}
+	if bytes.HasPrefix(data, encryptedChunkMagic) || bytes.HasPrefix(data, plainChunkMagic) {
+		return append(slices.Clip(plainChunkMagic), data...), nil
+	}
+	return data, nil
+}
+
+// isEncryptedChunk reports whether chunk file data was written by encryptChunk
+func isEncryptedChunk(payload []byte) bool {
+	return len(payload) >= len(encryptedChunkMagic)+wrappedKeySize && bytes.HasPrefix(payload, encryptedChunkMagic)
+}
+
+// decryptChunk returns the data of a chunk file. Chunks stored before
+// encryption was enabled are returned as they are, without their framing.
+func decryptChunk(masterKey []byte, filename string, chunkNum int, payload []byte) ([]byte, error) {
+	if bytes.HasPrefix(payload, plainChunkMagic) {
+		return payload[len(plainChunkMagic):], nil
+	}
+	if !isEncryptedChunk(payload) {
+		return payload, nil
+	}
+	if masterKey == nil {
+		return nil, fmt.Errorf("chunk %s_%d is encrypted but no master key is configured", filename, chunkNum)
+	}
+
+	wrappedKey := payload[len(encryptedChunkMagic) : len(encryptedChunkMagic)+wrappedKeySize]
+	dataKey, err := common.Open(masterKey, wrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key of chunk %s_%d, wrong master key? %v", filename, chunkNum, err)
+	}
+	data, err := common.Open(dataKey, payload[len(encryptedChunkMagic)+wrappedKeySize:], chunkAAD(filename, chunkNum))
+	if err != nil {
+		// The data no longer matches its authentication tag
+		return nil, &common.ChunkCorruptionError{Filename: filename, ChunkNum: chunkNum}
+	}
+	return data, nil
+}
+
+// rotateMasterKey rewraps the data key of every encrypted chunk under dataDir
+// with a new master key. The encrypted data stays as it is, but each chunk is
+// replaced atomically, so a crash leaves it wrapped under either key. Returns the
+// number of chunks rewrapped.
+func rotateMasterKey(dataDir string, oldKey, newKey []byte) (int, error) {
+	rotated := 0
+	err := filepath.WalkDir(dataDir, func(path string, entry fs.DirEntry, err error) error {
+		// Temporary files are left over from interrupted writes
+		if err != nil || entry.IsDir() || entry.Name() == "metadata.json" || strings.HasSuffix(entry.Name(), ".tmp") {
+			return err
+		}
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+
+		// Each file packed into a container has its own data key
+		if rel, err := filepath.Rel(dataDir, path); err == nil && common.IsContainerBlockName(filepath.ToSlash(rel)) {
+			count, err := rewrapContainer(path, contents, oldKey, newKey)
+			rotated += count
+			if err != nil {
+				return fmt.Errorf("failed to rewrap %v", err)
+			}
+			return nil
+		}
+
+		if len(contents) < 32 || !isEncryptedChunk(contents[32:]) {
+			return nil
+		}
+		payload := contents[32:]
+		rewrapped, err := rewrapDataKey(payload, oldKey, newKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if !rewrapped {
+			return nil
+		}
+
+		// The checksum covers the header, so it changes with the wrapped key
+		if err := writeChunkFile(path, common.CalculateChecksum(payload), payload); err != nil {
+			return fmt.Errorf("failed to rewrap %s: %v", path, err)
+		}
+		rotated++
+		return nil
+	})
+	return rotated, err
+}
+
+// rewrapDataKey rewraps the data key in the header of an encrypted payload in
+// place. Returns false if the key is already wrapped with newKey.
+func rewrapDataKey(payload, oldKey, newKey []byte) (bool, error) {
+	keyStart := len(encryptedChunkMagic)
+	dataKey, err := common.Open(oldKey, payload[keyStart:keyStart+wrappedKeySize], nil)
+	if err != nil {
+		// Chunks rewrapped by an interrupted earlier rotation are skipped
+		if _, newErr := common.Open(newKey, payload[keyStart:keyStart+wrappedKeySize], nil); newErr == nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	wrappedKey, err := common.Seal(newKey, dataKey, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	copy(payload[keyStart:], wrappedKey)
+	return true, nil
+}
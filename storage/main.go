@@ -22,6 +22,9 @@ type ChunkMetadata struct {
 	Size        int64
 	Checksum    []byte
 	Replicas    []string // List of nodes that have replicas
+	Generation  uint64   // Generation stamp of the last append
+	Compression string   // Codec of the file the chunk belongs to
+	StoredSize  int64    // Bytes of chunk data on disk, after compression
 }
 
 // StorageNode handles chunk storage and retrieval
@@ -39,15 +42,38 @@ type StorageNode struct {
 	// Chunk metadata
 	chunks map[string]*ChunkMetadata // Key: filename_chunknumber
 
+	// Serializes writers of each chunk file, by the same key as chunks
+	chunkLocks map[string]*sync.Mutex
+
+	// Indexes of the container files read so far, by the same key as chunks
+	containers map[string]*containerIndex
+
 	// Statistics
 	freeSpace       uint64
 	requestsHandled uint64
 
 	// Network
-	listener net.Listener
+	listener  net.Listener
+	transport *common.Transport // Mutual TLS for every connection, nil for plain TCP
+
+	// Secret the controller signs block tokens with, empty if it does not use
+	// them. Until the controller has answered a heartbeat, every request that
+	// needs a token is refused.
+	blockTokenSecret []byte
+	blockTokensKnown bool
+
+	// Wraps the per-chunk data keys of chunks encrypted at rest, nil stores chunks in plaintext
+	masterKey []byte
 
 	// Track reported files
 	reportedFiles map[string]bool
+
+	// Full chunk reports are sent every common.BlockReportInterval, or sooner when the controller asks
+	lastBlockReport      time.Time
+	blockReportRequested bool
+
+	// Chunks stored since the last heartbeat, reported with the next one
+	newChunks []*pb.StoredChunk
 }
 
 func NewStorageNode(nodeID, controllerAddr, dataDir string) *StorageNode {
@@ -56,6 +82,8 @@ func NewStorageNode(nodeID, controllerAddr, dataDir string) *StorageNode {
 		controllerAddr: controllerAddr,
 		dataDir:        dataDir,
 		chunks:         make(map[string]*ChunkMetadata),
+		chunkLocks:     make(map[string]*sync.Mutex),
+		containers:     make(map[string]*containerIndex),
 		reportedFiles:  make(map[string]bool),
 	}
 }
@@ -80,7 +108,7 @@ func (n *StorageNode) Start() error {
 	go n.sendHeartbeats()
 
 	// Start listener for chunk operations
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", n.nodeID))
+	listener, err := n.transport.Listen(fmt.Sprintf(":%s", n.nodeID))
 	if err != nil {
 		return fmt.Errorf("failed to start listener: %v", err)
 	}
@@ -119,6 +147,18 @@ func (n *StorageNode) handleConnection(conn net.Conn) {
 			response, respErr = n.handleChunkStore(data)
 		case common.MsgTypeChunkRetrieve:
 			response, respErr = n.handleChunkRetrieve(data)
+		case common.MsgTypeChunkReplicate:
+			response, respErr = n.handleChunkReplicate(data)
+		case common.MsgTypeChunkDelete:
+			response, respErr = n.handleChunkDelete(data)
+		case common.MsgTypeChunkReconstruct:
+			response, respErr = n.handleChunkReconstruct(data)
+		case common.MsgTypeChunkTranscode:
+			response, respErr = n.handleChunkTranscode(data)
+		case common.MsgTypeChunkAppend:
+			response, respErr = n.handleChunkAppend(data)
+		case common.MsgTypeChunkCompact:
+			response, respErr = n.handleChunkCompact(data)
 		default:
 			respErr = &common.ProtocolError{Message: fmt.Sprintf("unknown message type: %d", msgType)}
 		}
@@ -144,31 +184,112 @@ func (n *StorageNode) handleConnection(conn net.Conn) {
 	}
 }
 
-func (n *StorageNode) storeChunk(filename string, chunkNum int, data []byte, checksum []byte) error {
-	// Create chunk file
-	chunkPath := filepath.Join(n.dataDir, fmt.Sprintf("%s_%d", filename, chunkNum))
-	file, err := os.Create(chunkPath)
+// lockChunk takes the write lock of a chunk and returns the function that
+// releases it
+func (n *StorageNode) lockChunk(filename string, chunkNum int) func() {
+	key := fmt.Sprintf("%s_%d", filename, chunkNum)
+	n.mu.Lock()
+	lock, exists := n.chunkLocks[key]
+	if !exists {
+		lock = &sync.Mutex{}
+		n.chunkLocks[key] = lock
+	}
+	n.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// writeChunkFile atomically replaces a chunk file with checksum and payload: they
+// are written to a temporary file, synced and renamed over the chunk, so a crash
+// leaves either the old chunk or the new one
+func writeChunkFile(chunkPath string, checksum, payload []byte) error {
+	return replaceFile(chunkPath, checksum, payload)
+}
+
+// replaceFile atomically replaces a file with parts written one after another
+func replaceFile(chunkPath string, parts ...[]byte) error {
+	tmpPath := chunkPath + ".tmp"
+	file, err := os.Create(tmpPath)
 	if err != nil {
 		return fmt.Errorf("failed to create chunk file: %v", err)
 	}
-	defer file.Close()
+	defer os.Remove(tmpPath)
 
-	// Write checksum and data
-	if err := binary.Write(file, binary.LittleEndian, checksum); err != nil {
-		return fmt.Errorf("failed to write checksum: %v", err)
+	for _, part := range parts {
+		if _, err := file.Write(part); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write chunk data: %v", err)
+		}
 	}
-	if _, err := file.Write(data); err != nil {
-		return fmt.Errorf("failed to write chunk data: %v", err)
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync chunk file: %v", err)
 	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close chunk file: %v", err)
+	}
+	if err := os.Rename(tmpPath, chunkPath); err != nil {
+		return fmt.Errorf("failed to replace chunk file: %v", err)
+	}
+	return nil
+}
 
-	// Update metadata
+// storeChunk writes a chunk to disk, compressed with the given codec if that
+// shrinks it
+func (n *StorageNode) storeChunk(filename string, chunkNum int, data []byte, checksum []byte, compression string) error {
+	// Replacing a container would drop every file packed into it
+	if common.IsContainerBlockName(filename) {
+		return fmt.Errorf("container %s is only written by appends", filename)
+	}
+	defer n.lockChunk(filename, chunkNum)()
+	return n.writeChunk(filename, chunkNum, data, checksum, compression)
+}
+
+// writeChunk stores a chunk for storeChunk and appendChunk. The caller must hold
+// the chunk's write lock.
+func (n *StorageNode) writeChunk(filename string, chunkNum int, data []byte, checksum []byte, compression string) error {
+	chunkPath := filepath.Join(n.dataDir, fmt.Sprintf("%s_%d", filename, chunkNum))
+
+	// Compress, then encrypt at rest if enabled; the checksum on disk then covers the stored data
+	payload, err := compressChunk(compression, data)
+	if err != nil {
+		return err
+	}
+	if payload, err = sealChunk(n.masterKey, filename, chunkNum, payload); err != nil {
+		return err
+	}
+	diskChecksum := checksum
+	if n.masterKey != nil || len(payload) != len(data) {
+		diskChecksum = common.CalculateChecksum(payload)
+	}
+
+	// Write checksum and data
+	if err := writeChunkFile(chunkPath, diskChecksum, payload); err != nil {
+		return err
+	}
+
+	// Update metadata, keeping the generation stamp of the chunk's last append
+	key := fmt.Sprintf("%s_%d", filename, chunkNum)
 	n.mu.Lock()
-	n.chunks[fmt.Sprintf("%s_%d", filename, chunkNum)] = &ChunkMetadata{
+	var generation uint64
+	if current, exists := n.chunks[key]; exists {
+		generation = current.Generation
+	}
+	n.chunks[key] = &ChunkMetadata{
 		Filename:    filename,
 		ChunkNumber: chunkNum,
 		Size:        int64(len(data)),
 		Checksum:    checksum,
+		Generation:  generation,
+		Compression: compression,
+		StoredSize:  int64(len(payload)),
 	}
+	n.newChunks = append(n.newChunks, &pb.StoredChunk{
+		Filename:    filename,
+		ChunkNumber: uint32(chunkNum),
+		StoredSize:  uint64(len(payload)),
+	})
 	n.requestsHandled++
 	n.mu.Unlock()
 
@@ -214,6 +335,12 @@ func (n *StorageNode) retrieveChunk(filename string, chunkNum int) ([]byte, erro
 			ChunkNum: chunkNum,
 		}
 	}
+	if data, err = decryptChunk(n.masterKey, filename, chunkNum, data); err != nil {
+		return nil, err
+	}
+	if data, err = decompressChunk(data); err != nil {
+		return nil, fmt.Errorf("chunk %s_%d: %v", filename, chunkNum, err)
+	}
 
 	n.mu.Lock()
 	n.requestsHandled++
@@ -222,17 +349,132 @@ func (n *StorageNode) retrieveChunk(filename string, chunkNum int) ([]byte, erro
 	return data, nil
 }
 
+func (n *StorageNode) deleteChunk(filename string, chunkNum int) error {
+	defer n.lockChunk(filename, chunkNum)()
+	chunkPath := filepath.Join(n.dataDir, fmt.Sprintf("%s_%d", filename, chunkNum))
+	if err := os.Remove(chunkPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove chunk file: %v", err)
+	}
+
+	// Update metadata
+	n.mu.Lock()
+	delete(n.chunks, fmt.Sprintf("%s_%d", filename, chunkNum))
+	delete(n.containers, fmt.Sprintf("%s_%d", filename, chunkNum))
+	n.requestsHandled++
+	n.mu.Unlock()
+
+	// Save metadata to disk
+	if err := n.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	return nil
+}
+
+// appendChunk replaces the chunk's data after offset with data and records the
+// append's generation stamp. Appends from an older generation are rejected so a
+// writer that lost its lease cannot overwrite newer data. The chunk's write lock
+// is held from the generation check until the new data is in place.
+func (n *StorageNode) appendChunk(filename string, chunkNum int, offset int64, data []byte, generation uint64, compression string) error {
+	key := fmt.Sprintf("%s_%d", filename, chunkNum)
+	defer n.lockChunk(filename, chunkNum)()
+
+	n.mu.RLock()
+	current, exists := n.chunks[key]
+	n.mu.RUnlock()
+	if exists && current.Generation > generation {
+		return fmt.Errorf("stale generation %d, chunk %s is at generation %d", generation, key, current.Generation)
+	}
+
+	if common.IsContainerBlockName(filename) {
+		// Packed files are appended to the container's file in place
+		if err := n.appendExtent(filename, chunkNum, offset, data); err != nil {
+			return err
+		}
+	} else {
+		// Keep the existing data up to the offset
+		var existing []byte
+		if offset > 0 {
+			var err error
+			existing, err = n.retrieveChunk(filename, chunkNum)
+			if err != nil {
+				return err
+			}
+			if int64(len(existing)) < offset {
+				return fmt.Errorf("chunk %s has %d bytes, cannot append at offset %d", key, len(existing), offset)
+			}
+		}
+		chunkData := append(existing[:offset:offset], data...)
+
+		if err := n.writeChunk(filename, chunkNum, chunkData, common.CalculateChecksum(chunkData), compression); err != nil {
+			return err
+		}
+	}
+
+	// Update metadata
+	n.mu.Lock()
+	n.chunks[key].Generation = generation
+	n.mu.Unlock()
+
+	// Save metadata to disk
+	if err := n.saveMetadata(); err != nil {
+		log.Printf("Warning: failed to save metadata: %v", err)
+	}
+
+	return nil
+}
+
 func main() {
 	nodeID := flag.String("id", "", "Node ID (port number)")
 	controllerAddr := flag.String("controller", "localhost:8000", "Controller address")
 	dataDir := flag.String("data", "", "Data directory path")
+	certFile := flag.String("cert", "", "TLS certificate naming this node's ID; with -key and -ca enables mutual TLS")
+	keyFile := flag.String("key", "", "TLS private key")
+	caFile := flag.String("ca", "", "CA certificate that signs every component's certificate")
+	masterKeyFile := flag.String("master-key", "", "File holding the 32-byte key that encrypts chunks at rest (optional)")
+	rotateKeyFile := flag.String("rotate-master-key", "", "Rewrap every chunk's data key from -master-key to the key in this file, then exit")
 	flag.Parse()
 
-	if *nodeID == "" || *dataDir == "" {
+	if *dataDir == "" {
+		log.Fatal("Data directory is required")
+	}
+	var masterKey []byte
+	if *masterKeyFile != "" {
+		key, err := loadMasterKey(*masterKeyFile)
+		if err != nil {
+			log.Fatalf("Invalid master key: %v", err)
+		}
+		masterKey = key
+	}
+
+	// Key rotation runs offline against the data directory
+	if *rotateKeyFile != "" {
+		if masterKey == nil {
+			log.Fatal("Key rotation needs the current key in -master-key")
+		}
+		newKey, err := loadMasterKey(*rotateKeyFile)
+		if err != nil {
+			log.Fatalf("Invalid new master key: %v", err)
+		}
+		rotated, err := rotateMasterKey(*dataDir, masterKey, newKey)
+		if err != nil {
+			log.Fatalf("Key rotation failed after %d chunks: %v", rotated, err)
+		}
+		log.Printf("Rewrapped the data keys of %d chunks; start the node with -master-key %s", rotated, *rotateKeyFile)
+		return
+	}
+
+	if *nodeID == "" {
 		log.Fatal("Node ID and data directory are required")
 	}
 
 	node := NewStorageNode(*nodeID, *controllerAddr, *dataDir)
+	node.masterKey = masterKey
+	transport, err := common.NewTransport(*certFile, *keyFile, *caFile)
+	if err != nil {
+		log.Fatalf("Invalid TLS configuration: %v", err)
+	}
+	node.transport = transport
 	if err := node.Start(); err != nil {
 		log.Fatalf("Storage node failed to start: %v", err)
 	}
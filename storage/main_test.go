@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -62,6 +66,10 @@ func (mc *mockController) handleConnection(t *testing.T, conn net.Conn) {
 				return
 			}
 			mc.nodes[heartbeat.NodeId] = true
+			response, _ := proto.Marshal(&pb.HeartbeatResponse{})
+			if err := common.WriteMessage(conn, common.MsgTypeHeartbeatResponse, response); err != nil {
+				return
+			}
 		}
 	}
 }
@@ -239,7 +247,7 @@ func TestCorruptionDetection(t *testing.T) {
 	chunkNum := 0
 	testData := []byte("test chunk data")
 
-	if err := node.storeChunk(filename, chunkNum, testData, common.CalculateChecksum(testData)); err != nil {
+	if err := node.storeChunk(filename, chunkNum, testData, common.CalculateChecksum(testData), ""); err != nil {
 		t.Fatalf("Failed to store chunk: %v", err)
 	}
 
@@ -285,7 +293,7 @@ func TestMetadataPersistence(t *testing.T) {
 	checksum := common.CalculateChecksum(testData)
 
 	for i := 0; i < 3; i++ {
-		if err := node.storeChunk(fmt.Sprintf("test%d.txt", i), 0, testData, checksum); err != nil {
+		if err := node.storeChunk(fmt.Sprintf("test%d.txt", i), 0, testData, checksum, ""); err != nil {
 			t.Fatalf("Failed to store chunk: %v", err)
 		}
 	}
@@ -312,4 +320,389 @@ func TestMetadataPersistence(t *testing.T) {
 			t.Errorf("Chunk %s not loaded", key)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestBlockTokens(t *testing.T) {
+	tmpDir := t.TempDir()
+	node := NewStorageNode("test-node", "localhost:0", tmpDir)
+	secret := []byte("shared-secret")
+
+	token := func(blockName, operation string, expiresAt time.Time) *pb.BlockToken {
+		return &pb.BlockToken{
+			BlockName: blockName,
+			Operation: operation,
+			ExpiresAt: expiresAt.Unix(),
+			Signature: common.SignBlockToken(secret, blockName, operation, expiresAt.Unix(), 0, 0),
+		}
+	}
+	store := func(blockToken *pb.BlockToken) *pb.ChunkStoreResponse {
+		data, _ := proto.Marshal(&pb.ChunkStoreRequest{Filename: "test.txt", Data: []byte("data"), BlockToken: blockToken})
+		respData, err := node.handleChunkStore(data)
+		if err != nil {
+			t.Fatalf("Failed to handle store request: %v", err)
+		}
+		response := &pb.ChunkStoreResponse{}
+		if err := proto.Unmarshal(respData, response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return response
+	}
+	retrieve := func(blockToken *pb.BlockToken) *pb.ChunkRetrieveResponse {
+		data, _ := proto.Marshal(&pb.ChunkRetrieveRequest{Filename: "test.txt", BlockToken: blockToken})
+		respData, err := node.handleChunkRetrieve(data)
+		if err != nil {
+			t.Fatalf("Failed to handle retrieve request: %v", err)
+		}
+		response := &pb.ChunkRetrieveResponse{}
+		if err := proto.Unmarshal(respData, response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return response
+	}
+
+	// Nothing is accepted before the controller has said whether it issues tokens
+	later := time.Now().Add(time.Minute)
+	if response := store(nil); response.Success {
+		t.Error("Store before registration not rejected")
+	}
+	node.blockTokenSecret, node.blockTokensKnown = secret, true
+
+	forged := token("test.txt", common.BlockTokenWrite, later)
+	forged.Signature = common.SignBlockToken([]byte("guessed"), "test.txt", common.BlockTokenWrite, later.Unix(), 0, 0)
+	for name, blockToken := range map[string]*pb.BlockToken{
+		"missing":         nil,
+		"expired":         token("test.txt", common.BlockTokenWrite, time.Now().Add(-time.Minute)),
+		"other file":      token("other.txt", common.BlockTokenWrite, later),
+		"wrong operation": token("test.txt", common.BlockTokenRead, later),
+		"forged":          forged,
+	} {
+		if response := store(blockToken); response.Success || !strings.Contains(response.Error, "invalid block token") {
+			t.Errorf("Store with %s token not rejected: %v", name, response)
+		}
+	}
+
+	if response := store(token("test.txt", common.BlockTokenWrite, later)); !response.Success {
+		t.Fatalf("Store with a valid token failed: %s", response.Error)
+	}
+	if response := retrieve(token("test.txt", common.BlockTokenWrite, later)); response.Error == "" {
+		t.Error("Retrieve with a write token not rejected")
+	}
+	if response := retrieve(token("test.txt", common.BlockTokenRead, later)); !bytes.Equal(response.Data, []byte("data")) {
+		t.Errorf("Retrieve with a valid token failed: %s", response.Error)
+	}
+
+	// Commands that move or remove chunks need a token from the controller too
+	remove := func(blockToken *pb.BlockToken) *pb.ChunkDeleteResponse {
+		data, _ := proto.Marshal(&pb.ChunkDeleteRequest{Filename: "test.txt", BlockToken: blockToken})
+		respData, err := node.handleChunkDelete(data)
+		if err != nil {
+			t.Fatalf("Failed to handle delete request: %v", err)
+		}
+		response := &pb.ChunkDeleteResponse{}
+		if err := proto.Unmarshal(respData, response); err != nil {
+			t.Fatalf("Failed to unmarshal response: %v", err)
+		}
+		return response
+	}
+	data, _ := proto.Marshal(&pb.ChunkReplicateRequest{Filename: "test.txt", TargetNodes: []string{"localhost:1"}})
+	respData, err := node.handleChunkReplicate(data)
+	replicated := &pb.ChunkReplicateResponse{}
+	if err != nil || proto.Unmarshal(respData, replicated) != nil || !strings.Contains(replicated.Error, "invalid block token") {
+		t.Errorf("Replicate without a token not rejected: %v %v", replicated, err)
+	}
+	data, _ = proto.Marshal(&pb.ChunkAppendRequest{Filename: "test.txt", Data: []byte("more")})
+	respData, err = node.handleChunkAppend(data)
+	appended := &pb.ChunkAppendResponse{}
+	if err != nil || proto.Unmarshal(respData, appended) != nil || !strings.Contains(appended.Error, "invalid block token") {
+		t.Errorf("Append without a token not rejected: %v %v", appended, err)
+	}
+	if response := remove(token("test.txt", common.BlockTokenWrite, later)); response.Success {
+		t.Error("Delete with a write token not rejected")
+	}
+	if response := remove(token("test.txt", common.BlockTokenDelete, later)); !response.Success {
+		t.Errorf("Delete with a valid token failed: %s", response.Error)
+	}
+
+	// A packed file's token only covers its own extent of the container
+	container := common.ContainerBlockPrefix + "pack#1"
+	extentToken := func(operation string, offset, length uint64) *pb.BlockToken {
+		return &pb.BlockToken{
+			BlockName: container,
+			Operation: operation,
+			ExpiresAt: later.Unix(),
+			Offset:    offset,
+			Length:    length,
+			Signature: common.SignBlockToken(secret, container, operation, later.Unix(), offset, length),
+		}
+	}
+	appendFile := func(offset uint64, fileData string, blockToken *pb.BlockToken) *pb.ChunkAppendResponse {
+		data, _ := proto.Marshal(&pb.ChunkAppendRequest{Filename: container, Offset: offset, Data: []byte(fileData), Generation: offset + 1, BlockToken: blockToken})
+		respData, err := node.handleChunkAppend(data)
+		if err != nil {
+			t.Fatalf("Failed to handle append request: %v", err)
+		}
+		response := &pb.ChunkAppendResponse{}
+		proto.Unmarshal(respData, response)
+		return response
+	}
+	if response := appendFile(0, "first", extentToken(common.BlockTokenWrite, 0, 5)); !response.Success {
+		t.Fatalf("Append with an extent token failed: %s", response.Error)
+	}
+	if response := appendFile(5, "other", extentToken(common.BlockTokenWrite, 0, 5)); response.Success {
+		t.Error("Append outside the token's extent not rejected")
+	}
+	if response := appendFile(0, "again", extentToken(common.BlockTokenWrite, 0, 5)); response.Success {
+		t.Error("Append over a packed file not rejected")
+	}
+	if response := appendFile(5, "other", token(container, common.BlockTokenWrite, later)); !response.Success {
+		t.Errorf("Append with the controller's container token failed: %s", response.Error)
+	}
+	data, _ = proto.Marshal(&pb.ChunkStoreRequest{Filename: container, Data: []byte("replaced"), BlockToken: token(container, common.BlockTokenWrite, later)})
+	respData, err = node.handleChunkStore(data)
+	stored := &pb.ChunkStoreResponse{}
+	if err != nil || proto.Unmarshal(respData, stored) != nil || stored.Success {
+		t.Errorf("Store over a container not rejected: %v %v", stored, err)
+	}
+	read := func(offset, length uint64, blockToken *pb.BlockToken) *pb.ChunkRetrieveResponse {
+		data, _ := proto.Marshal(&pb.ChunkRetrieveRequest{Filename: container, Offset: offset, Length: length, BlockToken: blockToken})
+		respData, err := node.handleChunkRetrieve(data)
+		if err != nil {
+			t.Fatalf("Failed to handle retrieve request: %v", err)
+		}
+		response := &pb.ChunkRetrieveResponse{}
+		proto.Unmarshal(respData, response)
+		return response
+	}
+	if response := read(5, 5, extentToken(common.BlockTokenRead, 5, 5)); string(response.Data) != "other" {
+		t.Errorf("Read with an extent token failed: %s", response.Error)
+	}
+	if response := read(0, 5, extentToken(common.BlockTokenRead, 5, 5)); response.Error == "" {
+		t.Error("Read outside the token's extent not rejected")
+	}
+	data, _ = proto.Marshal(&pb.ChunkRetrieveRequest{Filename: "test.txt", BlockToken: extentToken(common.BlockTokenRead, 5, 5)})
+	respData, _ = node.handleChunkRetrieve(data)
+	if response := (&pb.ChunkRetrieveResponse{}); proto.Unmarshal(respData, response) != nil || response.Error == "" {
+		t.Error("Extent token accepted for a whole chunk")
+	}
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	node := NewStorageNode("test-node", "localhost:0", tmpDir)
+	node.masterKey = oldKey
+
+	testData := []byte("confidential chunk data")
+	if err := node.storeChunk("secret.txt", 0, testData, common.CalculateChecksum(testData), ""); err != nil {
+		t.Fatalf("Failed to store chunk: %v", err)
+	}
+	chunkPath := filepath.Join(tmpDir, "secret.txt_0")
+	onDisk, err := os.ReadFile(chunkPath)
+	if err != nil {
+		t.Fatalf("Failed to read chunk file: %v", err)
+	}
+	if bytes.Contains(onDisk, testData) {
+		t.Error("Chunk stored in plaintext")
+	}
+	if data, err := node.retrieveChunk("secret.txt", 0); err != nil || !bytes.Equal(data, testData) {
+		t.Fatalf("Failed to retrieve encrypted chunk: %v", err)
+	}
+
+	// Rotation rewraps the data key without touching the encrypted data
+	if rotated, err := rotateMasterKey(tmpDir, oldKey, newKey); err != nil || rotated != 1 {
+		t.Fatalf("Key rotation failed: rotated %d, %v", rotated, err)
+	}
+	rotatedDisk, _ := os.ReadFile(chunkPath)
+	dataStart := 32 + len(encryptedChunkMagic) + wrappedKeySize
+	if !bytes.Equal(rotatedDisk[dataStart:], onDisk[dataStart:]) {
+		t.Error("Key rotation rewrote the encrypted data")
+	}
+	if _, err := node.retrieveChunk("secret.txt", 0); err == nil {
+		t.Error("Chunk readable with the retired master key")
+	}
+	node.masterKey = newKey
+	if data, err := node.retrieveChunk("secret.txt", 0); err != nil || !bytes.Equal(data, testData) {
+		t.Fatalf("Failed to retrieve chunk after rotation: %v", err)
+	}
+
+	// Tampering is detected as corruption so the chunk is repaired from a replica
+	rotatedDisk[len(rotatedDisk)-1] ^= 0xff
+	os.WriteFile(chunkPath, rotatedDisk, 0644)
+	if _, err := node.retrieveChunk("secret.txt", 0); err == nil {
+		t.Fatal("Corrupted chunk not detected")
+	} else if _, ok := err.(*common.ChunkCorruptionError); !ok {
+		t.Errorf("Expected ChunkCorruptionError, got %v", err)
+	}
+}
+
+func TestPlaintextStartingWithMagic(t *testing.T) {
+	// Plaintext that looks like an encrypted chunk is read back as it was stored
+	data := append(append([]byte{}, encryptedChunkMagic...), bytes.Repeat([]byte{7}, 2*wrappedKeySize)...)
+	for _, masterKey := range [][]byte{nil, bytes.Repeat([]byte{1}, 32)} {
+		node := NewStorageNode("test-node", "localhost:0", t.TempDir())
+		node.masterKey = masterKey
+		if err := node.storeChunk("magic.bin", 0, data, common.CalculateChecksum(data), common.CodecNone); err != nil {
+			t.Fatalf("Failed to store chunk: %v", err)
+		}
+		if stored, err := node.retrieveChunk("magic.bin", 0); err != nil || !bytes.Equal(stored, data) {
+			t.Errorf("Chunk starting with the encryption magic read back wrong with master key %v: %v", masterKey != nil, err)
+		}
+
+		container := common.ContainerBlockPrefix + "pack#1"
+		if err := node.appendChunk(container, 0, 0, data, 1, common.CodecNone); err != nil {
+			t.Fatalf("Failed to pack file: %v", err)
+		}
+		if stored, err := node.readExtent(container, 0, 0, 0); err != nil || !bytes.Equal(stored, data) {
+			t.Errorf("Packed file starting with the encryption magic read back wrong with master key %v: %v", masterKey != nil, err)
+		}
+	}
+}
+
+func TestChunkCompression(t *testing.T) {
+	tmpDir := t.TempDir()
+	node := NewStorageNode("test-node", "localhost:0", tmpDir)
+
+	logData := bytes.Repeat([]byte("2024-01-01 12:00:00 INFO request handled\n"), 1000)
+	randomData := make([]byte, 4096)
+	rand.Read(randomData)
+	lookalike := append([]byte("DFSCMP01"), []byte("raw data that looks compressed")...)
+
+	tests := []struct {
+		name       string
+		filename   string
+		data       []byte
+		codec      string
+		compressed bool
+	}{
+		{name: "gzip", filename: "app.log", data: logData, codec: common.CodecGzip, compressed: true},
+		{name: "flate", filename: "fast.log", data: logData, codec: common.CodecFlate, compressed: true},
+		{name: "none", filename: "raw.log", data: logData, codec: common.CodecNone},
+		{name: "incompressible", filename: "random.bin", data: randomData, codec: common.CodecGzip},
+		{name: "magic prefix", filename: "lookalike.bin", data: lookalike, codec: common.CodecNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := node.storeChunk(tt.filename, 0, tt.data, common.CalculateChecksum(tt.data), tt.codec); err != nil {
+				t.Fatalf("Failed to store chunk: %v", err)
+			}
+			metadata := node.chunks[tt.filename+"_0"]
+			if compressed := metadata.StoredSize < metadata.Size; compressed != tt.compressed {
+				t.Errorf("Stored %d of %d bytes, expected compressed = %v", metadata.StoredSize, metadata.Size, tt.compressed)
+			}
+			data, err := node.retrieveChunk(tt.filename, 0)
+			if err != nil || !bytes.Equal(data, tt.data) {
+				t.Fatalf("Failed to retrieve chunk: %v", err)
+			}
+		})
+	}
+
+	// Compression happens before encryption at rest
+	node.masterKey = bytes.Repeat([]byte{1}, 32)
+	if err := node.storeChunk("secret.log", 0, logData, common.CalculateChecksum(logData), common.CodecGzip); err != nil {
+		t.Fatalf("Failed to store encrypted chunk: %v", err)
+	}
+	if stored := node.chunks["secret.log_0"].StoredSize; stored >= int64(len(logData)) {
+		t.Errorf("Encrypted chunk not compressed: %d bytes stored", stored)
+	}
+	if data, err := node.retrieveChunk("secret.log", 0); err != nil || !bytes.Equal(data, logData) {
+		t.Fatalf("Failed to retrieve compressed, encrypted chunk: %v", err)
+	}
+
+	// Nodes report logical and on-disk bytes separately
+	logical, stored := node.storedBytes()
+	if logical <= stored {
+		t.Errorf("Expected compression to save space: %d logical, %d stored bytes", logical, stored)
+	}
+	if node.chunkCompression("app.log", 0) != common.CodecGzip {
+		t.Errorf("Codec of app.log not recorded")
+	}
+
+	if err := node.storeChunk("bad.log", 0, logData, common.CalculateChecksum(logData), "lz77"); err == nil {
+		t.Error("Unknown codec not rejected")
+	}
+}
+
+func TestConcurrentAppendFencing(t *testing.T) {
+	tmpDir := t.TempDir()
+	node := NewStorageNode("test-node", "localhost:0", tmpDir)
+
+	for i := 0; i < 50; i++ {
+		filename := fmt.Sprintf("app-%d.log", i)
+		if err := node.storeChunk(filename, 0, []byte("hello"), common.CalculateChecksum([]byte("hello")), common.CodecNone); err != nil {
+			t.Fatalf("Failed to store chunk: %v", err)
+		}
+
+		// A writer fenced out by a newer append must not overwrite its data
+		var wg sync.WaitGroup
+		for generation, data := range map[uint64]string{1: "stale", 2: "fresh"} {
+			wg.Add(1)
+			go func(generation uint64, data string) {
+				defer wg.Done()
+				node.appendChunk(filename, 0, 5, []byte(data), generation, common.CodecNone)
+			}(generation, data)
+		}
+		wg.Wait()
+
+		data, err := node.retrieveChunk(filename, 0)
+		if err != nil {
+			t.Fatalf("Failed to retrieve chunk: %v", err)
+		}
+		if string(data) != "hellofresh" || node.chunks[filename+"_0"].Generation != 2 {
+			t.Fatalf("Chunk holds %q at generation %d after racing appends", data, node.chunks[filename+"_0"].Generation)
+		}
+	}
+}
+
+func TestContainerPacking(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	node := NewStorageNode("test-node", "localhost:0", tmpDir)
+	node.masterKey = oldKey
+	container := common.ContainerBlockPrefix + "pack#1"
+
+	files := map[int64]string{0: "first", 5: "second", 11: "third"}
+	for _, offset := range []int64{0, 5, 11} {
+		if err := node.appendChunk(container, 0, offset, []byte(files[offset]), uint64(offset+1), common.CodecNone); err != nil {
+			t.Fatalf("Failed to pack file at %d: %v", offset, err)
+		}
+	}
+	if data, err := node.readExtent(container, 0, 5, 6); err != nil || string(data) != "second" {
+		t.Fatalf("Read %q from the container: %v", data, err)
+	}
+	if node.chunks[container+"_0"].Size != 16 || node.chunks[container+"_0"].Generation != 12 {
+		t.Errorf("Unexpected container metadata: %+v", node.chunks[container+"_0"])
+	}
+
+	// Files are only packed past the end, and a container is never replaced
+	if err := node.appendChunk(container, 0, 5, []byte("other"), 13, common.CodecNone); err == nil {
+		t.Error("File packed over another not rejected")
+	}
+	if err := node.storeChunk(container, 0, []byte("replaced"), common.CalculateChecksum([]byte("replaced")), ""); err == nil {
+		t.Error("Container replaced by a store")
+	}
+
+	// Compaction drops the deleted file and leaves the others where they were
+	before := node.chunks[container+"_0"].StoredSize
+	storedSize, err := node.compactContainer(container, 0, []uint64{5})
+	if err != nil || storedSize >= before {
+		t.Fatalf("Compaction left %d of %d bytes: %v", storedSize, before, err)
+	}
+	if _, err := node.readExtent(container, 0, 5, 0); err == nil {
+		t.Error("Compacted file is still readable")
+	}
+
+	// The index is rebuilt from the file, and rotation rewraps every packed file
+	if rotated, err := rotateMasterKey(tmpDir, oldKey, newKey); err != nil || rotated != 2 {
+		t.Fatalf("Key rotation failed: rotated %d, %v", rotated, err)
+	}
+	reopened := NewStorageNode("test-node", "localhost:0", tmpDir)
+	reopened.masterKey = newKey
+	for _, offset := range []int64{0, 11} {
+		if data, err := reopened.readExtent(container, 0, offset, 0); err != nil || string(data) != files[offset] {
+			t.Errorf("Read %q at %d after compaction and rotation: %v", data, offset, err)
+		}
+	}
+}
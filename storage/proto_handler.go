@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"path/filepath"
 	"time"
@@ -27,6 +26,20 @@ func (n *StorageNode) sendHeartbeat() error {
 		RequestsProcessed: n.requestsHandled,
 		NewFiles:        n.getNewFiles(),
 	}
+	heartbeat.LogicalBytes, heartbeat.StoredBytes = n.storedBytes()
+
+	// The full chunk list only goes out on the longer block report interval, so
+	// regular heartbeats stay small however many chunks the node holds
+	n.mu.RLock()
+	fullReport := n.blockReportRequested || time.Since(n.lastBlockReport) >= common.BlockReportInterval*time.Second
+	newChunks := n.newChunks
+	n.mu.RUnlock()
+	if fullReport {
+		heartbeat.FullReport = true
+		heartbeat.Chunks = n.getChunkReport()
+	} else {
+		heartbeat.NewChunks = newChunks
+	}
 
 	// Serialize message
 	data, err := proto.Marshal(heartbeat)
@@ -39,6 +52,36 @@ func (n *StorageNode) sendHeartbeat() error {
 		return fmt.Errorf("failed to send heartbeat: %v", err)
 	}
 
+	// The controller replies with the block token secret, or why it rejected the node
+	msgType, responseData, err := common.ReadMessage(n.controllerConn)
+	if err != nil {
+		return fmt.Errorf("failed to read heartbeat response: %v", err)
+	}
+
+	if msgType != common.MsgTypeHeartbeatResponse {
+		return fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.HeartbeatResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return fmt.Errorf("failed to unmarshal heartbeat response: %v", err)
+	}
+
+	if response.Error != "" {
+		return fmt.Errorf("controller rejected heartbeat: %s", response.Error)
+	}
+
+	n.mu.Lock()
+	n.blockTokenSecret = response.BlockTokenSecret
+	n.blockTokensKnown = true
+	n.blockReportRequested = response.BlockReportRequested
+	if fullReport {
+		n.lastBlockReport = time.Now()
+	}
+	// Chunks stored while the heartbeat was in flight go with the next one
+	n.newChunks = n.newChunks[len(newChunks):]
+	n.mu.Unlock()
+
 	return nil
 }
 
@@ -49,18 +92,34 @@ func (n *StorageNode) handleChunkStore(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to unmarshal chunk store request: %v", err)
 	}
 
+	// Only writes the controller granted are accepted
+	if err := n.checkBlockToken(request.BlockToken, request.Filename, common.BlockTokenWrite); err != nil {
+		return proto.Marshal(&dfs.ChunkStoreResponse{Error: err.Error()})
+	}
+
 	// Calculate checksum
 	checksum := common.CalculateChecksum(request.Data)
 
+	// Containers are written a packed file at a time, never replaced
+	if common.IsContainerBlockName(request.Filename) {
+		return proto.Marshal(&dfs.ChunkStoreResponse{Error: fmt.Sprintf("container %s is only written by appends", request.Filename)})
+	}
+
+	// A deduplicated chunk must hold the content it is named after, or one writer
+	// could replace the data of every file sharing it
+	if hash, ok := common.ParseContentBlockName(request.Filename); ok && common.ContentHash(request.Data) != hash {
+		return proto.Marshal(&dfs.ChunkStoreResponse{Error: fmt.Sprintf("chunk data does not match content hash %s", hash)})
+	}
+
 	// Store chunk
-	if err := n.storeChunk(request.Filename, int(request.ChunkNumber), request.Data, checksum); err != nil {
+	if err := n.storeChunk(request.Filename, int(request.ChunkNumber), request.Data, checksum, request.Compression); err != nil {
 		return nil, fmt.Errorf("failed to store chunk: %v", err)
 	}
 
 	// Forward to replicas if needed
 	for _, replicaNode := range request.ReplicaNodes {
 		if replicaNode != n.nodeID {
-			go n.forwardChunk(replicaNode, request.Filename, request.ChunkNumber, request.Data)
+			go n.forwardChunk(replicaNode, request.Filename, request.ChunkNumber, request.Data, request.Compression, request.BlockToken)
 		}
 	}
 
@@ -85,13 +144,31 @@ func (n *StorageNode) handleChunkRetrieve(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to unmarshal chunk retrieve request: %v", err)
 	}
 
+	// Files packed into a container are read on their own, and only the one the
+	// token was issued for
+	if common.IsContainerBlockName(request.Filename) {
+		if err := n.checkExtentToken(request.BlockToken, request.Filename, common.BlockTokenRead, int64(request.Offset), int64(request.Length)); err != nil {
+			return proto.Marshal(&dfs.ChunkRetrieveResponse{Error: err.Error()})
+		}
+		chunkData, err := n.readExtent(request.Filename, int(request.ChunkNumber), int64(request.Offset), int64(request.Length))
+		if err != nil {
+			return proto.Marshal(&dfs.ChunkRetrieveResponse{Error: err.Error()})
+		}
+		return proto.Marshal(&dfs.ChunkRetrieveResponse{Data: chunkData})
+	}
+
+	// Only reads the controller granted are served
+	if err := n.checkBlockToken(request.BlockToken, request.Filename, common.BlockTokenRead); err != nil {
+		return proto.Marshal(&dfs.ChunkRetrieveResponse{Error: err.Error()})
+	}
+
 	// Get chunk data
 	chunkData, err := n.retrieveChunk(request.Filename, int(request.ChunkNumber))
 	if err != nil {
 		// Check if it's a corruption error
 		if _, ok := err.(ChunkCorruptionError); ok {
 			// Try to repair from replicas
-			if err := n.repairChunk(request.Filename, int(request.ChunkNumber)); err != nil {
+			if err := n.repairChunk(request.Filename, int(request.ChunkNumber), request.BlockToken); err != nil {
 				return nil, fmt.Errorf("failed to repair corrupted chunk: %v", err)
 			}
 			// Try retrieval again
@@ -104,6 +181,15 @@ func (n *StorageNode) handleChunkRetrieve(data []byte) ([]byte, error) {
 		}
 	}
 
+	// A range of the chunk is read, e.g. a small file packed into a container
+	if request.Length > 0 {
+		end := request.Offset + request.Length
+		if end < request.Offset || end > uint64(len(chunkData)) {
+			return proto.Marshal(&dfs.ChunkRetrieveResponse{Error: fmt.Sprintf("range of %d bytes at %d is beyond the chunk's %d bytes", request.Length, request.Offset, len(chunkData))})
+		}
+		chunkData = chunkData[request.Offset:end]
+	}
+
 	// Create response
 	response := &dfs.ChunkRetrieveResponse{
 		Data: chunkData,
@@ -118,10 +204,410 @@ func (n *StorageNode) handleChunkRetrieve(data []byte) ([]byte, error) {
 	return responseData, nil
 }
 
-// forwardChunk forwards a chunk to another storage node
-func (n *StorageNode) forwardChunk(nodeID string, filename string, chunkNum uint32, data []byte) error {
+// handleChunkReplicate copies a locally stored chunk to other storage nodes
+// on behalf of the controller
+func (n *StorageNode) handleChunkReplicate(data []byte) ([]byte, error) {
+	request := &dfs.ChunkReplicateRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunk replicate request: %v", err)
+	}
+
+	// The controller's write token is what the targets accept the copy with
+	if err := n.checkBlockToken(request.BlockToken, request.Filename, common.BlockTokenWrite); err != nil {
+		return proto.Marshal(&dfs.ChunkReplicateResponse{Error: err.Error()})
+	}
+
+	// Containers are copied one packed file at a time
+	if common.IsContainerBlockName(request.Filename) {
+		response := &dfs.ChunkReplicateResponse{
+			Success: true,
+		}
+		if err := n.copyContainer(request); err != nil {
+			response.Success = false
+			response.Error = err.Error()
+		}
+		return proto.Marshal(response)
+	}
+
+	// Read and verify the local copy
+	chunkData, err := n.retrieveChunk(request.Filename, int(request.ChunkNumber))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve chunk: %v", err)
+	}
+
+	// Push the chunk to every target
+	response := &dfs.ChunkReplicateResponse{
+		Success: true,
+	}
+	for _, targetNode := range request.TargetNodes {
+		if err := n.forwardChunk(targetNode, request.Filename, request.ChunkNumber, chunkData, n.chunkCompression(request.Filename, int(request.ChunkNumber)), request.BlockToken); err != nil {
+			response.Success = false
+			response.Error = fmt.Sprintf("failed to replicate to %s: %v", targetNode, err)
+			break
+		}
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// handleChunkDelete removes a chunk on behalf of the controller
+func (n *StorageNode) handleChunkDelete(data []byte) ([]byte, error) {
+	request := &dfs.ChunkDeleteRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunk delete request: %v", err)
+	}
+
+	if err := n.checkBlockToken(request.BlockToken, request.Filename, common.BlockTokenDelete); err != nil {
+		return proto.Marshal(&dfs.ChunkDeleteResponse{Error: err.Error()})
+	}
+
+	response := &dfs.ChunkDeleteResponse{
+		Success: true,
+	}
+	if err := n.deleteChunk(request.Filename, int(request.ChunkNumber)); err != nil {
+		response.Success = false
+		response.Error = err.Error()
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// handleChunkReconstruct rebuilds a lost fragment of an erasure-coded stripe from
+// the surviving fragments and stores it locally
+func (n *StorageNode) handleChunkReconstruct(data []byte) ([]byte, error) {
+	request := &dfs.ChunkReconstructRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunk reconstruct request: %v", err)
+	}
+
+	if err := n.checkBlockToken(request.BlockToken, request.Filename, common.BlockTokenWrite); err != nil {
+		return proto.Marshal(&dfs.ChunkReconstructResponse{Error: err.Error()})
+	}
+
+	response := &dfs.ChunkReconstructResponse{
+		Success: true,
+	}
+	if err := n.reconstructFragment(request); err != nil {
+		response.Success = false
+		response.Error = err.Error()
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// reconstructFragment fetches enough fragments of the stripe to decode it and
+// stores the requested fragment
+func (n *StorageNode) reconstructFragment(request *dfs.ChunkReconstructRequest) error {
+	if request.ErasureCoding == nil {
+		return fmt.Errorf("missing erasure coding layout")
+	}
+	rs, err := common.NewReedSolomon(int(request.ErasureCoding.DataShards), int(request.ErasureCoding.ParityShards))
+	if err != nil {
+		return err
+	}
+
+	width := uint32(rs.DataShards() + rs.ParityShards())
+	first := request.ChunkNumber - request.ChunkNumber%width
+	shards := make([][]byte, width)
+
+	// Fetch surviving fragments until the stripe can be decoded
+	fetched := 0
+	for _, source := range request.Sources {
+		if fetched == rs.DataShards() {
+			break
+		}
+		if source.ChunkNumber < first || source.ChunkNumber >= first+width || source.ChunkNumber == request.ChunkNumber {
+			continue
+		}
+		for _, nodeID := range source.StorageNodes {
+			fragment, err := n.fetchChunk(nodeID, request.Filename, source.ChunkNumber, request.ReadToken)
+			if err != nil {
+				log.Printf("Failed to fetch fragment %s_%d from %s: %v", request.Filename, source.ChunkNumber, nodeID, err)
+				continue
+			}
+			shards[source.ChunkNumber-first] = fragment
+			fetched++
+			break
+		}
+	}
+
+	shards[request.ChunkNumber-first] = nil
+	if err := rs.Reconstruct(shards); err != nil {
+		return fmt.Errorf("failed to decode stripe: %v", err)
+	}
+
+	fragment := shards[request.ChunkNumber-first]
+	if err := n.storeChunk(request.Filename, int(request.ChunkNumber), fragment, common.CalculateChecksum(fragment), request.Compression); err != nil {
+		return err
+	}
+
+	log.Printf("Reconstructed fragment %s_%d", request.Filename, request.ChunkNumber)
+	return nil
+}
+
+// handleChunkTranscode encodes one stripe of a replicated file into erasure-coded
+// fragments on behalf of the controller
+func (n *StorageNode) handleChunkTranscode(data []byte) ([]byte, error) {
+	request := &dfs.ChunkTranscodeRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunk transcode request: %v", err)
+	}
+
+	// The stripe is read with one token and its fragments written with the other
+	if err := n.checkBlockToken(request.ReadToken, request.SourceFilename, common.BlockTokenRead); err != nil {
+		return proto.Marshal(&dfs.ChunkTranscodeResponse{Error: err.Error()})
+	}
+	if err := n.checkBlockToken(request.BlockToken, request.TargetFilename, common.BlockTokenWrite); err != nil {
+		return proto.Marshal(&dfs.ChunkTranscodeResponse{Error: err.Error()})
+	}
+
+	response := &dfs.ChunkTranscodeResponse{
+		Success: true,
+	}
+	if err := n.transcodeStripe(request); err != nil {
+		response.Success = false
+		response.Error = err.Error()
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// transcodeStripe reads the replicated chunks of a stripe, encodes them and
+// stores every fragment on its target node
+func (n *StorageNode) transcodeStripe(request *dfs.ChunkTranscodeRequest) error {
+	if request.ErasureCoding == nil {
+		return fmt.Errorf("missing erasure coding layout")
+	}
+	rs, err := common.NewReedSolomon(int(request.ErasureCoding.DataShards), int(request.ErasureCoding.ParityShards))
+	if err != nil {
+		return err
+	}
+	width := rs.DataShards() + rs.ParityShards()
+	if len(request.Targets) != width {
+		return fmt.Errorf("expected %d fragment targets, got %d", width, len(request.Targets))
+	}
+
+	// Reassemble the stripe from the replicated chunks, preferring local copies
+	var stripe []byte
+	for _, source := range request.Sources {
+		chunkData, err := n.retrieveChunk(request.SourceFilename, int(source.ChunkNumber))
+		if err != nil {
+			chunkData = nil
+			for _, nodeID := range source.StorageNodes {
+				if nodeID == n.nodeID {
+					continue
+				}
+				if chunkData, err = n.fetchChunk(nodeID, request.SourceFilename, source.ChunkNumber, request.ReadToken); err == nil {
+					break
+				}
+			}
+		}
+		if chunkData == nil {
+			return fmt.Errorf("failed to read chunk %s_%d: %v", request.SourceFilename, source.ChunkNumber, err)
+		}
+		stripe = append(stripe, chunkData...)
+	}
+
+	shards := append(common.SplitStripe(stripe, rs.DataShards()), make([][]byte, rs.ParityShards())...)
+	if err := rs.Encode(shards); err != nil {
+		return fmt.Errorf("failed to encode stripe: %v", err)
+	}
+
+	// Store the fragments
+	for shard, target := range request.Targets {
+		if len(target.StorageNodes) == 0 {
+			return fmt.Errorf("no storage node assigned to fragment %d", target.ChunkNumber)
+		}
+		nodeID := target.StorageNodes[0]
+		if nodeID == n.nodeID {
+			err = n.storeChunk(request.TargetFilename, int(target.ChunkNumber), shards[shard], common.CalculateChecksum(shards[shard]), request.Compression)
+		} else {
+			err = n.forwardChunk(nodeID, request.TargetFilename, target.ChunkNumber, shards[shard], request.Compression, request.BlockToken)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to store fragment %d on %s: %v", target.ChunkNumber, nodeID, err)
+		}
+	}
+
+	log.Printf("Transcoded stripe %d of %s to %s", request.Stripe, request.SourceFilename, request.TargetFilename)
+	return nil
+}
+
+// handleChunkAppend extends a chunk and forwards the append to the replicas.
+// The append only succeeds once every replica has applied it.
+func (n *StorageNode) handleChunkAppend(data []byte) ([]byte, error) {
+	request := &dfs.ChunkAppendRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chunk append request: %v", err)
+	}
+
+	// Only appends the controller granted are accepted, and a file packed into a
+	// container only at the extent granted to it
+	checkToken := n.checkBlockToken(request.BlockToken, request.Filename, common.BlockTokenWrite)
+	if common.IsContainerBlockName(request.Filename) {
+		checkToken = n.checkExtentToken(request.BlockToken, request.Filename, common.BlockTokenWrite, int64(request.Offset), int64(len(request.Data)))
+	}
+	if err := checkToken; err != nil {
+		return proto.Marshal(&dfs.ChunkAppendResponse{Error: err.Error()})
+	}
+
+	response := &dfs.ChunkAppendResponse{
+		Success: true,
+	}
+	if err := n.appendChunk(request.Filename, int(request.ChunkNumber), int64(request.Offset), request.Data, request.Generation, request.Compression); err != nil {
+		response.Success = false
+		response.Error = err.Error()
+	} else {
+		for _, replicaNode := range request.ReplicaNodes {
+			if replicaNode == n.nodeID {
+				continue
+			}
+			if err := n.forwardAppend(replicaNode, request); err != nil {
+				response.Success = false
+				response.Error = fmt.Sprintf("failed to append to replica %s: %v", replicaNode, err)
+				break
+			}
+		}
+	}
+
+	// Serialize response
+	responseData, err := proto.Marshal(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %v", err)
+	}
+
+	return responseData, nil
+}
+
+// forwardAppend applies an append on a replica node
+func (n *StorageNode) forwardAppend(nodeID string, request *dfs.ChunkAppendRequest) error {
+	// Connect to replica node
+	conn, err := n.transport.Dial(nodeID)
+	if err != nil {
+		return fmt.Errorf("failed to connect to replica node: %v", err)
+	}
+	defer conn.Close()
+
+	// Serialize request, with no further replicas to forward to
+	requestData, err := proto.Marshal(&dfs.ChunkAppendRequest{
+		Filename:    request.Filename,
+		ChunkNumber: request.ChunkNumber,
+		Offset:      request.Offset,
+		Data:        request.Data,
+		Generation:  request.Generation,
+		Compression: request.Compression,
+		BlockToken:  request.BlockToken,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal forward request: %v", err)
+	}
+
+	// Send to replica
+	if err := common.WriteMessage(conn, common.MsgTypeChunkAppend, requestData); err != nil {
+		return fmt.Errorf("failed to send append to replica: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return fmt.Errorf("failed to read replica response: %v", err)
+	}
+
+	if msgType != common.MsgTypeChunkAppend {
+		return fmt.Errorf("unexpected response type from replica: %d", msgType)
+	}
+
+	response := &dfs.ChunkAppendResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return fmt.Errorf("failed to unmarshal replica response: %v", err)
+	}
+
+	if !response.Success {
+		return fmt.Errorf("replica failed to append: %s", response.Error)
+	}
+
+	return nil
+}
+
+// fetchChunk retrieves a chunk from another storage node with a read token from
+// the controller
+func (n *StorageNode) fetchChunk(nodeID string, filename string, chunkNum uint32, token *dfs.BlockToken) ([]byte, error) {
+	// Connect to storage node
+	conn, err := n.transport.Dial(nodeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to storage node: %v", err)
+	}
+	defer conn.Close()
+
+	// Create request
+	request := &dfs.ChunkRetrieveRequest{
+		Filename:    filename,
+		ChunkNumber: chunkNum,
+		BlockToken:  token,
+	}
+
+	// Serialize request
+	requestData, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	// Send request
+	if err := common.WriteMessage(conn, common.MsgTypeChunkRetrieve, requestData); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	// Read response
+	msgType, responseData, err := common.ReadMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if msgType != common.MsgTypeChunkRetrieve {
+		return nil, fmt.Errorf("unexpected response type: %d", msgType)
+	}
+
+	response := &dfs.ChunkRetrieveResponse{}
+	if err := proto.Unmarshal(responseData, response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("storage node error: %s", response.Error)
+	}
+
+	return response.Data, nil
+}
+
+// forwardChunk forwards a chunk to another storage node with a write token from
+// the controller
+func (n *StorageNode) forwardChunk(nodeID string, filename string, chunkNum uint32, data []byte, compression string, token *dfs.BlockToken) error {
 	// Connect to replica node
-	conn, err := net.Dial("tcp", nodeID)
+	conn, err := n.transport.Dial(nodeID)
 	if err != nil {
 		return fmt.Errorf("failed to connect to replica node: %v", err)
 	}
@@ -132,6 +618,8 @@ func (n *StorageNode) forwardChunk(nodeID string, filename string, chunkNum uint
 		Filename:    filename,
 		ChunkNumber: chunkNum,
 		Data:       data,
+		BlockToken:  token,
+		Compression: compression,
 		// No further replicas to forward to
 	}
 
@@ -168,8 +656,9 @@ func (n *StorageNode) forwardChunk(nodeID string, filename string, chunkNum uint
 	return nil
 }
 
-// repairChunk attempts to repair a corrupted chunk from replicas
-func (n *StorageNode) repairChunk(filename string, chunkNum int) error {
+// repairChunk attempts to repair a corrupted chunk from replicas, reading them
+// with the token the chunk was requested with
+func (n *StorageNode) repairChunk(filename string, chunkNum int, token *dfs.BlockToken) error {
 	// Get chunk metadata
 	n.mu.RLock()
 	metadata, exists := n.chunks[fmt.Sprintf("%s_%d", filename, chunkNum)]
@@ -186,7 +675,7 @@ func (n *StorageNode) repairChunk(filename string, chunkNum int) error {
 		}
 
 		// Connect to replica
-		conn, err := net.Dial("tcp", replicaNode)
+		conn, err := n.transport.Dial(replicaNode)
 		if err != nil {
 			continue
 		}
@@ -196,6 +685,7 @@ func (n *StorageNode) repairChunk(filename string, chunkNum int) error {
 		request := &dfs.ChunkRetrieveRequest{
 			Filename:    filename,
 			ChunkNumber: uint32(chunkNum),
+			BlockToken:  token,
 		}
 
 		// Serialize request
@@ -231,7 +721,7 @@ func (n *StorageNode) repairChunk(filename string, chunkNum int) error {
 		}
 
 		// Store repaired chunk
-		if err := n.storeChunk(filename, chunkNum, response.Data, checksum); err != nil {
+		if err := n.storeChunk(filename, chunkNum, response.Data, checksum, metadata.Compression); err != nil {
 			continue
 		}
 
@@ -270,6 +760,48 @@ func (n *StorageNode) getNewFiles() []string {
 	return newFiles
 }
 
+// getChunkReport returns every chunk held by this node so the controller
+// can confirm its metadata, e.g. while in safe mode after a restart
+func (n *StorageNode) getChunkReport() []*dfs.StoredChunk {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	report := make([]*dfs.StoredChunk, 0, len(n.chunks))
+	for _, chunk := range n.chunks {
+		report = append(report, &dfs.StoredChunk{
+			Filename:    chunk.Filename,
+			ChunkNumber: uint32(chunk.ChunkNumber),
+			StoredSize:  uint64(chunk.StoredSize),
+		})
+	}
+	return report
+}
+
+// storedBytes returns how many bytes of chunk data this node holds before and
+// after compression
+func (n *StorageNode) storedBytes() (logical, stored uint64) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, chunk := range n.chunks {
+		logical += uint64(chunk.Size)
+		stored += uint64(chunk.StoredSize)
+	}
+	return logical, stored
+}
+
+// chunkCompression returns the codec of the file a stored chunk belongs to, so
+// copies of the chunk are compressed the same way
+func (n *StorageNode) chunkCompression(filename string, chunkNum int) string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if chunk, exists := n.chunks[fmt.Sprintf("%s_%d", filename, chunkNum)]; exists {
+		return chunk.Compression
+	}
+	return ""
+}
+
 // saveMetadata saves the current chunk metadata to disk
 func (n *StorageNode) saveMetadata() error {
 	n.mu.RLock()
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"time"
+
+	"distributed_file_system/common"
+	dfs "distributed_file_system/proto"
+)
+
+// checkBlockToken verifies that a request's block token was issued by the
+// controller, has not expired and grants the operation on the whole block name.
+// Every request is refused until the controller has said whether it issues
+// tokens, and allowed afterwards if it does not.
+func (n *StorageNode) checkBlockToken(token *dfs.BlockToken, blockName, operation string) error {
+	if err := n.verifyBlockToken(token, blockName, operation); err != nil || token == nil {
+		return err
+	}
+	if token.Length > 0 {
+		return &common.InvalidBlockTokenError{BlockName: blockName, Operation: operation, Reason: "limited to one packed file"}
+	}
+	return nil
+}
+
+// checkExtentToken is checkBlockToken for the packed file of length bytes at
+// offset in a container, which the token must cover either on its own or with
+// the whole container
+func (n *StorageNode) checkExtentToken(token *dfs.BlockToken, blockName, operation string, offset, length int64) error {
+	if err := n.verifyBlockToken(token, blockName, operation); err != nil || token == nil {
+		return err
+	}
+	if token.Length > 0 && (token.Offset != uint64(offset) || token.Length != uint64(length)) {
+		reason := fmt.Sprintf("issued for %d bytes at %d", token.Length, token.Offset)
+		return &common.InvalidBlockTokenError{BlockName: blockName, Operation: operation, Reason: reason}
+	}
+	return nil
+}
+
+// verifyBlockToken checks a token's signature, expiry, block name and operation.
+// A nil token passes only if the controller does not issue tokens.
+func (n *StorageNode) verifyBlockToken(token *dfs.BlockToken, blockName, operation string) error {
+	n.mu.RLock()
+	secret, known := n.blockTokenSecret, n.blockTokensKnown
+	n.mu.RUnlock()
+
+	invalid := func(reason string) error {
+		return &common.InvalidBlockTokenError{BlockName: blockName, Operation: operation, Reason: reason}
+	}
+	switch {
+	case !known:
+		return invalid("not registered with the controller yet")
+	case len(secret) == 0:
+		return nil
+	case token == nil:
+		return invalid("missing")
+	case !hmac.Equal(token.Signature, common.SignBlockToken(secret, token.BlockName, token.Operation, token.ExpiresAt, token.Offset, token.Length)):
+		return invalid("signature mismatch")
+	case time.Now().Unix() > token.ExpiresAt:
+		return invalid("expired")
+	case token.BlockName != blockName || token.Operation != operation:
+		return invalid(fmt.Sprintf("issued to %s %s", token.Operation, token.BlockName))
+	}
+	return nil
+}